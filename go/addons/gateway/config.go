@@ -2,16 +2,34 @@ package gateway
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/dueckminor/home-assistant-addons/go/services/acme"
 	"github.com/dueckminor/home-assistant-addons/go/utils/pki"
 	"github.com/goccy/go-yaml"
 	"github.com/google/uuid"
+	"golang.org/x/net/http/httpguts"
 )
 
 type ConfigExternalIp struct {
 	Method string `yaml:"method" json:"method"`
 	Param  string `yaml:"param" json:"param"`
+	// Providers are used by the "consensus" method
+	Providers []ConfigExternalIp `yaml:"providers,omitempty" json:"providers,omitempty"`
+	// Interval is the refresh interval (like "5m")
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+}
+
+func (configExternalIp *ConfigExternalIp) GetInterval() time.Duration {
+	interval, err := time.ParseDuration(configExternalIp.Interval)
+	if err != nil || interval < 10*time.Second {
+		return 5 * time.Minute
+	}
+	return interval
 }
 
 type ConfigRouteOptions struct {
@@ -19,6 +37,36 @@ type ConfigRouteOptions struct {
 	UseTargetHostname bool   `yaml:"use_target_hostname,omitempty" json:"use_target_hostname,omitempty"`
 	Auth              bool   `yaml:"auth,omitempty" json:"auth,omitempty"`
 	AuthSecret        string `yaml:"auth_secret,omitempty" json:"auth_secret,omitempty"`
+	// AllowedUsers and AllowedGroups restrict the access to a route with
+	// auth. If both are empty, every user is allowed.
+	AllowedUsers  []string `yaml:"allowed_users,omitempty" json:"allowed_users,omitempty"`
+	AllowedGroups []string `yaml:"allowed_groups,omitempty" json:"allowed_groups,omitempty"`
+	// UserHeader and GroupsHeader override the names of the headers, which
+	// pass the user and the groups to the target (X-Forwarded-User and
+	// X-Forwarded-Groups)
+	UserHeader   string `yaml:"user_header,omitempty" json:"user_header,omitempty"`
+	GroupsHeader string `yaml:"groups_header,omitempty" json:"groups_header,omitempty"`
+	// AccessTokens accepts the personal access tokens of the users (for
+	// clients which can't follow the login redirect)
+	AccessTokens bool `yaml:"access_tokens,omitempty" json:"access_tokens,omitempty"`
+}
+
+func (configRouteOptions *ConfigRouteOptions) Check() error {
+	for _, header := range []string{configRouteOptions.UserHeader, configRouteOptions.GroupsHeader} {
+		if header == "" {
+			continue
+		}
+		if !httpguts.ValidHeaderFieldName(header) {
+			return fmt.Errorf("invalid header name: %s", header)
+		}
+		// the gateway replaces the header, so it must not be one which is
+		// needed by the target
+		switch http.CanonicalHeaderKey(header) {
+		case "Authorization", "Cookie", "Host", "Connection", "Content-Length", "Content-Type", "Transfer-Encoding", "Upgrade":
+			return fmt.Errorf("the header %s can't be used to pass the user", header)
+		}
+	}
+	return nil
 }
 
 type ConfigRoute struct {
@@ -38,6 +86,43 @@ type ConfigRedirect struct {
 	HttpPort  int    `yaml:"http_port" json:"http_port"`
 	HttpsPort int    `yaml:"https_port" json:"https_port"`
 	DnsPort   int    `yaml:"dns_port" json:"dns_port"`
+	// DnsFallbacks are additional DNS targets (like "udp://10.0.0.2:53"),
+	// which are used if the target doesn't respond
+	DnsFallbacks []string `yaml:"dns_fallbacks,omitempty" json:"dns_fallbacks,omitempty"`
+	DnsTimeout   string   `yaml:"dns_timeout,omitempty" json:"dns_timeout,omitempty"`
+	DnsRetries   int      `yaml:"dns_retries,omitempty" json:"dns_retries,omitempty"`
+	// DnsStaleTTL defines how long the last good responses are used if no
+	// DNS target responds (like "1h")
+	DnsStaleTTL string `yaml:"dns_stale_ttl,omitempty" json:"dns_stale_ttl,omitempty"`
+}
+
+// Check returns an error if a duration is invalid
+func (configRedirect *ConfigRedirect) Check() error {
+	if _, err := configRedirect.GetDnsTimeout(); err != nil {
+		return err
+	}
+	_, err := configRedirect.GetDnsStaleTTL()
+	return err
+}
+
+func (configRedirect *ConfigRedirect) GetDnsTimeout() (time.Duration, error) {
+	return parseOptionalDuration("dns_timeout", configRedirect.DnsTimeout)
+}
+
+func (configRedirect *ConfigRedirect) GetDnsStaleTTL() (time.Duration, error) {
+	return parseOptionalDuration("dns_stale_ttl", configRedirect.DnsStaleTTL)
+}
+
+// parseOptionalDuration returns 0 for an empty value
+func parseOptionalDuration(name string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return duration, nil
 }
 
 func (configRedirect *ConfigRedirect) GetHTTPSTarget() string {
@@ -48,15 +133,75 @@ func (configRedirect *ConfigRedirect) GetDNSTarget() string {
 	return fmt.Sprintf("udp://%s:%d", configRedirect.Target, configRedirect.DnsPort)
 }
 
+func (configRedirect *ConfigRedirect) GetDNSTargets() []string {
+	return append([]string{configRedirect.GetDNSTarget()}, configRedirect.DnsFallbacks...)
+}
+
 type ConfigDomain struct {
 	Guid     string          `yaml:"guid" json:"guid"`
 	Name     string          `yaml:"name" json:"name"`
 	Routes   []*ConfigRoute  `yaml:"routes,omitempty" json:"routes,omitempty"`
 	Redirect *ConfigRedirect `yaml:"redirect,omitempty" json:"redirect,omitempty"`
+	// Challenge is the ACME challenge type ("dns-01", "http-01" or
+	// "tls-alpn-01"). Only DNS-01 requires that the gateway is the
+	// authoritative nameserver of the domain.
+	Challenge string `yaml:"challenge,omitempty" json:"challenge,omitempty"`
+	// CA is the name of the ACME certificate authority (see ConfigAcme) or
+	// "local" for the local CA (see ConfigLocalCA)
+	CA string `yaml:"ca,omitempty" json:"ca,omitempty"`
+	// RenewalThreshold is the percentage of the lifetime after which the
+	// certificate is renewed (default: 60)
+	RenewalThreshold int `yaml:"renewal_threshold,omitempty" json:"renewal_threshold,omitempty"`
+	// KeyAlgorithm is the key algorithm of the certificate (like "rsa2048"
+	// or "ecdsa-p256", default: "rsa2048")
+	KeyAlgorithm string `yaml:"key_algorithm,omitempty" json:"key_algorithm,omitempty"`
+	// DualCertificates requests an additional RSA (or ECDSA) certificate,
+	// the certificate is chosen by the capabilities of the client
+	DualCertificates bool `yaml:"dual_certificates,omitempty" json:"dual_certificates,omitempty"`
+	// KeyPolicy is "rotate" (new key on each renewal, default) or "reuse"
+	// (keeps the key, required for TLSA or HPKP pinning)
+	KeyPolicy string `yaml:"key_policy,omitempty" json:"key_policy,omitempty"`
+	// Exports copy the certificate to other consumers (like /ssl)
+	Exports []ConfigExport `yaml:"exports,omitempty" json:"exports,omitempty"`
 
 	serverCertificate pki.ServerCertificate
 }
 
+func (configDomain *ConfigDomain) GetChallenge() string {
+	if configDomain.Challenge == "" {
+		return acme.ChallengeDNS01
+	}
+	return configDomain.Challenge
+}
+
+func (configDomain *ConfigDomain) GetKeyConfig() pki.KeyConfig {
+	return pki.KeyConfig{
+		Algorithm: configDomain.KeyAlgorithm,
+		Dual:      configDomain.DualCertificates,
+		Policy:    configDomain.KeyPolicy,
+	}
+}
+
+// GetCertificateNames returns the names of the server certificate. DNS-01
+// allows to use a wildcard certificate, the other challenge types require
+// that all hostnames are listed.
+func (configDomain *ConfigDomain) GetCertificateNames() []string {
+	if configDomain.GetChallenge() == acme.ChallengeDNS01 {
+		return []string{"*." + configDomain.Name}
+	}
+	var names []string
+	for _, route := range configDomain.Routes {
+		if strings.Contains(route.Hostname, "*") {
+			continue
+		}
+		name := route.Hostname + "." + configDomain.Name
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 func (configDomain *ConfigDomain) AddRoute(route *ConfigRoute) {
 	route.domain = configDomain
 	configDomain.Routes = append(configDomain.Routes, route)
@@ -90,9 +235,98 @@ func (configDomain *ConfigDomain) DeleteRoute(guid string) *ConfigRoute {
 	return nil
 }
 
+type ConfigResolver struct {
+	Enabled         bool     `yaml:"enabled" json:"enabled"`
+	Upstreams       []string `yaml:"upstreams,omitempty" json:"upstreams,omitempty"`
+	Blocklists      []string `yaml:"blocklists,omitempty" json:"blocklists,omitempty"`
+	CacheSize       int      `yaml:"cache_size,omitempty" json:"cache_size,omitempty"`
+	AllowedNetworks []string `yaml:"allowed_networks,omitempty" json:"allowed_networks,omitempty"`
+	AllowEncrypted  bool     `yaml:"allow_encrypted,omitempty" json:"allow_encrypted,omitempty"`
+}
+
+type ConfigRateLimit struct {
+	Disabled           bool     `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	ResponsesPerSecond int      `yaml:"responses_per_second,omitempty" json:"responses_per_second,omitempty"`
+	ErrorsPerSecond    int      `yaml:"errors_per_second,omitempty" json:"errors_per_second,omitempty"`
+	Window             int      `yaml:"window,omitempty" json:"window,omitempty"`
+	Slip               int      `yaml:"slip,omitempty" json:"slip,omitempty"`
+	IPv4PrefixLength   int      `yaml:"ipv4_prefix_length,omitempty" json:"ipv4_prefix_length,omitempty"`
+	IPv6PrefixLength   int      `yaml:"ipv6_prefix_length,omitempty" json:"ipv6_prefix_length,omitempty"`
+	ExemptNetworks     []string `yaml:"exempt_networks,omitempty" json:"exempt_networks,omitempty"`
+	AnyQueries         string   `yaml:"any_queries,omitempty" json:"any_queries,omitempty"`
+}
+
+type ConfigHealthCheck struct {
+	Disabled bool `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	// Interval is the interval of the checks (like "15m")
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// AlertEmail receives a mail if a domain becomes unhealthy
+	AlertEmail string `yaml:"alert_email,omitempty" json:"alert_email,omitempty"`
+}
+
+func (configHealthCheck *ConfigHealthCheck) GetInterval() time.Duration {
+	interval, err := time.ParseDuration(configHealthCheck.Interval)
+	if err != nil || interval < time.Minute {
+		return 15 * time.Minute
+	}
+	return interval
+}
+
+type ConfigDnsEncrypted struct {
+	// DoT enables DNS-over-TLS on DoTPort (default: 853)
+	DoT     bool `yaml:"dot" json:"dot"`
+	DoTPort int  `yaml:"dot_port,omitempty" json:"dot_port,omitempty"`
+	// DoHHostname enables DNS-over-HTTPS (like dns.home.example.com)
+	DoHHostname string `yaml:"doh_hostname,omitempty" json:"doh_hostname,omitempty"`
+	DoHPath     string `yaml:"doh_path,omitempty" json:"doh_path,omitempty"`
+}
+
+func (configDnsEncrypted *ConfigDnsEncrypted) GetDoTPort() int {
+	if configDnsEncrypted.DoTPort == 0 {
+		return 853
+	}
+	return configDnsEncrypted.DoTPort
+}
+
+func (configDnsEncrypted *ConfigDnsEncrypted) GetDoHPath() string {
+	if configDnsEncrypted.DoHPath == "" {
+		return "/dns-query"
+	}
+	return configDnsEncrypted.DoHPath
+}
+
+type ConfigDdnsProvider struct {
+	Name          string `yaml:"name" json:"name"`
+	Type          string `yaml:"type" json:"type"`
+	Hostname      string `yaml:"hostname" json:"hostname"`
+	Server        string `yaml:"server" json:"server"`
+	Username      string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password      string `yaml:"password,omitempty" json:"password,omitempty"`
+	Zone          string `yaml:"zone,omitempty" json:"zone,omitempty"`
+	TTL           uint32 `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	TsigName      string `yaml:"tsig_name,omitempty" json:"tsig_name,omitempty"`
+	TsigAlgorithm string `yaml:"tsig_algorithm,omitempty" json:"tsig_algorithm,omitempty"`
+	TsigSecret    string `yaml:"tsig_secret,omitempty" json:"tsig_secret,omitempty"`
+	// DisableIPv4 / DisableIPv6 prevent pushing the corresponding address
+	DisableIPv4 bool `yaml:"disable_ipv4,omitempty" json:"disable_ipv4,omitempty"`
+	DisableIPv6 bool `yaml:"disable_ipv6,omitempty" json:"disable_ipv6,omitempty"`
+}
+
+type ConfigDdns struct {
+	Providers []ConfigDdnsProvider `yaml:"providers,omitempty" json:"providers,omitempty"`
+	// RetryInterval is the interval for retrying failed updates (like "5m")
+	RetryInterval string `yaml:"retry_interval,omitempty" json:"retry_interval,omitempty"`
+}
+
 type ConfigDns struct {
-	ExternalIpv4 ConfigExternalIp `yaml:"external_ipv4" json:"external_ipv4"`
-	ExternalIpv6 ConfigExternalIp `yaml:"external_ipv6" json:"external_ipv6"`
+	ExternalIpv4 ConfigExternalIp   `yaml:"external_ipv4" json:"external_ipv4"`
+	ExternalIpv6 ConfigExternalIp   `yaml:"external_ipv6" json:"external_ipv6"`
+	Resolver     ConfigResolver     `yaml:"resolver" json:"resolver"`
+	QueryLogSize int                `yaml:"query_log_size,omitempty" json:"query_log_size,omitempty"`
+	Ddns         ConfigDdns         `yaml:"ddns,omitempty" json:"ddns,omitempty"`
+	Encrypted    ConfigDnsEncrypted `yaml:"encrypted,omitempty" json:"encrypted,omitempty"`
+	RateLimit    ConfigRateLimit    `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	HealthCheck  ConfigHealthCheck  `yaml:"health_check,omitempty" json:"health_check,omitempty"`
 }
 
 type ConfigMail struct {
@@ -111,12 +345,65 @@ type ConfigInfluxDB struct {
 	Password string `yaml:"password" json:"password"`
 }
 
+// ConfigCA configures an ACME certificate authority. The well known CAs
+// (letsencrypt, letsencrypt-staging, zerossl, buypass) don't need a
+// directory URL.
+type ConfigCA struct {
+	Name         string `yaml:"name" json:"name"`
+	DirectoryURL string `yaml:"directory_url,omitempty" json:"directory_url,omitempty"`
+	Email        string `yaml:"email,omitempty" json:"email,omitempty"`
+	EABKeyID     string `yaml:"eab_key_id,omitempty" json:"eab_key_id,omitempty"`
+	EABHMACKey   string `yaml:"eab_hmac_key,omitempty" json:"eab_hmac_key,omitempty"`
+	// RootCAFile is the root certificate of a private CA (relative to the
+	// data dir)
+	RootCAFile string `yaml:"root_ca_file,omitempty" json:"root_ca_file,omitempty"`
+}
+
+type ConfigAcme struct {
+	// Email is the default contact for all CAs
+	Email string     `yaml:"email,omitempty" json:"email,omitempty"`
+	CAs   []ConfigCA `yaml:"cas,omitempty" json:"cas,omitempty"`
+	// Default is the CA of all domains without CA (default: letsencrypt)
+	Default string `yaml:"default,omitempty" json:"default,omitempty"`
+	// Fallback is used if the CA of a domain failed MaxFailures times
+	Fallback    string `yaml:"fallback,omitempty" json:"fallback,omitempty"`
+	MaxFailures int    `yaml:"max_failures,omitempty" json:"max_failures,omitempty"`
+}
+
+func (configAcme *ConfigAcme) GetDefault() string {
+	if configAcme.Default == "" {
+		return acme.CALetsEncrypt
+	}
+	return configAcme.Default
+}
+
+// GetCA returns the configuration of a CA. Well known CAs don't need to
+// be configured explicitly.
+func (configAcme *ConfigAcme) GetCA(name string) acme.CAConfig {
+	caConfig := acme.CAConfig{Name: name, Email: configAcme.Email}
+	for _, ca := range configAcme.CAs {
+		if ca.Name != name {
+			continue
+		}
+		caConfig.DirectoryURL = ca.DirectoryURL
+		caConfig.EABKeyID = ca.EABKeyID
+		caConfig.EABHMACKey = ca.EABHMACKey
+		caConfig.RootCAFile = ca.RootCAFile
+		if ca.Email != "" {
+			caConfig.Email = ca.Email
+		}
+	}
+	return caConfig
+}
+
 type Config struct {
 	file     string
 	Domains  []*ConfigDomain `yaml:"domains" json:"domains"`
 	Dns      ConfigDns       `yaml:"dns" json:"dns"`
 	Mail     ConfigMail      `yaml:"mail" json:"mail"`
 	InfluxDB ConfigInfluxDB  `yaml:"influxdb" json:"influxdb"`
+	Acme     ConfigAcme      `yaml:"acme,omitempty" json:"acme"`
+	LocalCA  ConfigLocalCA   `yaml:"local_ca,omitempty" json:"local_ca"`
 }
 
 func (config *Config) GetDomain(guid string) *ConfigDomain {
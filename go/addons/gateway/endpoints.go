@@ -2,23 +2,56 @@ package gateway
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dueckminor/home-assistant-addons/go/auth"
+	"github.com/dueckminor/home-assistant-addons/go/services/acme"
+	"github.com/dueckminor/home-assistant-addons/go/services/ddns"
 	"github.com/dueckminor/home-assistant-addons/go/services/dns"
 	"github.com/dueckminor/home-assistant-addons/go/services/homeassistant"
 	"github.com/dueckminor/home-assistant-addons/go/services/smtp"
+	"github.com/dueckminor/home-assistant-addons/go/utils/pki"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
 type Endpoints struct {
 	Gateway *Gateway
 }
 
+var websocketUpgrader = websocket.Upgrader{
+	CheckOrigin: checkIngressOrigin,
+}
+
+// checkIngressOrigin accepts websocket connections from the page of the Home
+// Assistant ingress only. The Supervisor passes the host of Home Assistant as
+// X-Forwarded-Host.
+func checkIngressOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // not a browser
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+	if host = strings.TrimSpace(host); host == "" {
+		host = r.Host
+	}
+	return strings.EqualFold(originURL.Host, host)
+}
+
 // CheckHomeAssistantAuth validates Home Assistant authentication headers
 // Allows GET requests for any authenticated HA user
 // Requires admin privileges for all other HTTP methods (POST, PUT, DELETE, etc.)
@@ -72,11 +105,28 @@ func (ep *Endpoints) setupEndpoints(r *gin.RouterGroup) {
 	r.GET("/dns/ipv4", ep.GET_Ipv4)
 	r.GET("/dns/ipv6", ep.GET_Ipv6)
 	r.GET("/dns/lookup", ep.GET_DnsLookup)
+	r.GET("/dns/resolver", ep.GET_DnsResolver)
+	r.PUT("/dns/resolver", ep.PUT_DnsResolver)
+	r.GET("/dns/resolver/clients", ep.GET_DnsResolverClients)
+	r.POST("/dns/resolver/reload", ep.POST_DnsResolverReload)
+	r.GET("/dns/queries", ep.GET_DnsQueries)
+	r.GET("/dns/queries/stats", ep.GET_DnsQueriesStats)
+	r.GET("/dns/proxy", ep.GET_DnsProxy)
+	r.GET("/dns/health", ep.GET_DnsHealth)
+	r.POST("/dns/health/check", ep.POST_DnsHealthCheck)
+	r.GET("/dns/health/:domain/history", ep.GET_DnsHealthDomainHistory)
+	r.GET("/dns/ratelimit", ep.GET_DnsRateLimit)
+	r.PUT("/dns/ratelimit", ep.PUT_DnsRateLimit)
+	r.GET("/dns/ddns", ep.GET_DnsDdns)
+	r.PUT("/dns/ddns", ep.PUT_DnsDdns)
+	r.POST("/dns/ddns/refresh", ep.POST_DnsDdnsRefresh)
 
 	// Domain management endpoints
 	r.GET("/domains", ep.GET_Domains)
 	r.POST("/domains", ep.POST_Domains)
 	r.DELETE("/domains/:guid", ep.DELETE_Domains)
+	r.PUT("/domains/:guid/challenge", ep.PUT_DomainsGuidChallenge)
+	r.PUT("/domains/:guid/ca", ep.PUT_DomainsGuidCA)
 
 	// Route management endpoints
 	r.GET("/domains/:guid/routes", ep.GET_DomainsGuidRoutes)
@@ -89,11 +139,44 @@ func (ep *Endpoints) setupEndpoints(r *gin.RouterGroup) {
 	r.POST("/users", ep.RequireAuthServer, ep.POST_Users)
 	r.DELETE("/users/:guid", ep.RequireAuthServer, ep.DELETE_UsersGuid)
 	r.POST("/users/:guid/password_reset", ep.RequireAuthServer, ep.POST_UsersGuidPasswordReset)
+	r.POST("/users/:guid/reset_2fa", ep.RequireAuthServer, ep.POST_UsersGuidReset2FA)
+	r.POST("/users/:guid/unlock", ep.RequireAuthServer, ep.POST_UsersGuidUnlock)
+	r.GET("/users/:guid/sessions", ep.RequireAuthServer, ep.GET_UsersGuidSessions)
+	r.DELETE("/users/:guid/sessions", ep.RequireAuthServer, ep.DELETE_UsersGuidSessions)
+	r.DELETE("/users/:guid/sessions/:id", ep.RequireAuthServer, ep.DELETE_UsersGuidSessionsId)
+	r.DELETE("/users/:guid/tokens/:id", ep.RequireAuthServer, ep.DELETE_UsersGuidTokensId)
 
 	// Group management endpoints (require both HA auth and auth server availability)
 	r.GET("/groups", ep.RequireAuthServer, ep.GET_Groups)
 	r.POST("/groups", ep.RequireAuthServer, ep.POST_Groups)
 	r.DELETE("/groups/:guid", ep.RequireAuthServer, ep.DELETE_GroupsGuid)
+	r.PUT("/groups/:guid/require_2fa", ep.RequireAuthServer, ep.PUT_GroupsGuidRequire2FA)
+
+	// OpenID Connect clients (applications using the gateway for SSO)
+	r.GET("/oidc/clients", ep.RequireAuthServer, ep.GET_OidcClients)
+	r.POST("/oidc/clients", ep.RequireAuthServer, ep.POST_OidcClients)
+	r.PUT("/oidc/clients/:id", ep.RequireAuthServer, ep.PUT_OidcClientsId)
+	r.DELETE("/oidc/clients/:id", ep.RequireAuthServer, ep.DELETE_OidcClientsId)
+	r.POST("/oidc/clients/:id/secret", ep.RequireAuthServer, ep.POST_OidcClientsIdSecret)
+
+	// Certificate inventory
+	r.GET("/certificates", ep.GET_Certificates)
+	r.GET("/certificates/:guid/chain", ep.GET_CertificatesGuidChain)
+	r.POST("/certificates/:guid/renew", ep.POST_CertificatesGuidRenew)
+	r.POST("/certificates/:guid/revoke", ep.POST_CertificatesGuidRevoke)
+	r.PUT("/certificates/:guid/threshold", ep.PUT_CertificatesGuidThreshold)
+	r.PUT("/certificates/:guid/key", ep.PUT_CertificatesGuidKey)
+	r.GET("/certificates/:guid/exports", ep.GET_CertificatesGuidExports)
+	r.PUT("/certificates/:guid/exports", ep.PUT_CertificatesGuidExports)
+
+	// ACME certificate authorities
+	r.GET("/acme", ep.GET_Acme)
+	r.PUT("/acme", ep.PUT_Acme)
+
+	// Local CA for LAN-only domains
+	r.GET("/localca", ep.GET_LocalCA)
+	r.PUT("/localca", ep.PUT_LocalCA)
+	r.GET("/localca/root.pem", ep.GET_LocalCARoot)
 
 	// Mail configuration endpoints
 	r.GET("/mail/config", ep.GET_MailConfig)
@@ -114,12 +197,14 @@ func (ep *Endpoints) setupEndpoints(r *gin.RouterGroup) {
 }
 
 type CertificateInfo struct {
-	ValidNotBefore time.Time `json:"valid_not_before"`
-	ValidNotAfter  time.Time `json:"valid_not_after"`
+	ValidNotBefore time.Time         `json:"valid_not_before,omitzero"`
+	ValidNotAfter  time.Time         `json:"valid_not_after,omitzero"`
+	Renewal        *pki.RenewalState `json:"renewal,omitempty"`
 }
 type DomainWithStatus struct {
 	ConfigDomain      `json:",inline"`
-	ServerCertificate *CertificateInfo `json:"server_certificate"`
+	ServerCertificate *CertificateInfo       `json:"server_certificate"`
+	Health            *dns.HealthCheckResult `json:"health,omitempty"`
 }
 
 func (ep *Endpoints) GET_Domains(c *gin.Context) {
@@ -127,14 +212,19 @@ func (ep *Endpoints) GET_Domains(c *gin.Context) {
 	for _, domain := range ep.Gateway.config.Domains {
 		domainWithStatus := DomainWithStatus{
 			ConfigDomain: *domain,
+			Health:       ep.Gateway.DomainHealth(domain.Name),
 		}
 		if domain.serverCertificate != nil {
-			chain := domain.serverCertificate.GetChain()
-			if chain != nil {
-				domainWithStatus.ServerCertificate = &CertificateInfo{
-					ValidNotBefore: chain[0].OBJ().NotBefore,
-					ValidNotAfter:  chain[0].OBJ().NotAfter,
-				}
+			info := &CertificateInfo{}
+			if chain := domain.serverCertificate.GetChain(); chain != nil {
+				info.ValidNotBefore = chain[0].OBJ().NotBefore
+				info.ValidNotAfter = chain[0].OBJ().NotAfter
+			}
+			if state := domain.serverCertificate.GetRenewalState(); state.Attempts > 0 {
+				info.Renewal = &state
+			}
+			if info.Renewal != nil || !info.ValidNotAfter.IsZero() {
+				domainWithStatus.ServerCertificate = info
 			}
 		}
 		domainsWithStatus = append(domainsWithStatus, domainWithStatus)
@@ -157,6 +247,44 @@ func (ep *Endpoints) POST_Domains(c *gin.Context) {
 	c.JSON(200, domain)
 }
 
+// PUT_DomainsGuidChallenge selects the ACME challenge type of a domain
+func (ep *Endpoints) PUT_DomainsGuidChallenge(c *gin.Context) {
+	var body struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	domain, err := ep.Gateway.SetDomainChallenge(c.Param("guid"), body.Challenge)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, domain)
+}
+
+// PUT_DomainsGuidCA selects the certificate authority of a domain
+func (ep *Endpoints) PUT_DomainsGuidCA(c *gin.Context) {
+	var body struct {
+		CA string `json:"ca"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	domain, err := ep.Gateway.SetDomainCA(c.Param("guid"), body.CA)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, domain)
+}
+
 func (ep *Endpoints) DELETE_Domains(c *gin.Context) {
 	guid := c.Param("guid")
 
@@ -176,32 +304,30 @@ func (ep *Endpoints) GET_ExternalIpv4(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "external IPv4 not configured"})
 		return
 	}
-	ip, err := ext.Refresh()
+	ip, err := dns.RefreshExternalIP(ext, ep.Gateway.externalIPChanged)
 	if ip == nil {
 		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"method": ep.Gateway.config.Dns.ExternalIpv4.Method, "param": ep.Gateway.config.Dns.ExternalIpv4.Param, "address": ip.String(), "timestamp": time.Now()})
+	config := ep.Gateway.config.Dns.ExternalIpv4
+	c.JSON(200, gin.H{"method": config.Method, "param": config.Param, "providers": config.Providers, "address": ip.String(), "timestamp": time.Now()})
 
 }
 
 func (ep *Endpoints) POST_ExternalIpv4(c *gin.Context) {
 	body := struct {
-		Test   bool
-		Method string
-		Param  string
+		Test bool `json:"test"`
+		ConfigExternalIp
 	}{}
 	c.BindJSON(&body)
 
-	var externalIp dns.ExternalIP
-
-	testOnly := body.Test
-	method := body.Method
-	param := body.Param
-
-	switch method {
-	case "dns":
-		externalIp = dns.NewExternalIP("ip4", param)
+	externalIp, err := ep.Gateway.CreateExternalIPv4(body.ConfigExternalIp)
+	if err == nil && externalIp == nil {
+		err = fmt.Errorf("no external ipv4 method specified")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	ip, err := externalIp.Refresh()
@@ -210,15 +336,14 @@ func (ep *Endpoints) POST_ExternalIpv4(c *gin.Context) {
 		return
 	}
 
-	if !testOnly {
-		ep.Gateway.config.Dns.ExternalIpv4.Method = method
-		ep.Gateway.config.Dns.ExternalIpv4.Param = param
+	if !body.Test {
+		ep.Gateway.config.Dns.ExternalIpv4 = body.ConfigExternalIp
 		ep.Gateway.SetExternalIPv4(externalIp)
 		ep.Gateway.config.save()
 
 	}
 
-	c.JSON(200, gin.H{"method": method, "param": param, "address": ip.String(), "timestamp": time.Now()})
+	c.JSON(200, gin.H{"method": body.Method, "param": body.Param, "providers": body.Providers, "address": ip.String(), "timestamp": time.Now()})
 }
 func (ep *Endpoints) GET_ExternalIpv6(c *gin.Context) {
 	ext := ep.Gateway.ExternalIPv6()
@@ -226,24 +351,25 @@ func (ep *Endpoints) GET_ExternalIpv6(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "external IPv6 not configured"})
 		return
 	}
-	ip, err := ext.Refresh()
+	ip, err := dns.RefreshExternalIP(ext, ep.Gateway.externalIPChanged)
 	if ip == nil {
 		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"method": ep.Gateway.config.Dns.ExternalIpv6.Method, "param": ep.Gateway.config.Dns.ExternalIpv6.Param, "address": ip.String(), "timestamp": time.Now()})
+	config := ep.Gateway.config.Dns.ExternalIpv6
+	c.JSON(200, gin.H{"method": config.Method, "param": config.Param, "providers": config.Providers, "address": ip.String(), "timestamp": time.Now()})
 }
 func (ep *Endpoints) POST_ExternalIpv6(c *gin.Context) {
 	body := struct {
-		Test   bool
-		Method string
-		Param  string
+		Test bool `json:"test"`
+		ConfigExternalIp
 	}{}
 	c.BindJSON(&body)
 
-	var externalIp dns.ExternalIP
-
-	externalIp, err := ep.Gateway.CreateExternalIPv6(body.Method, body.Param)
+	externalIp, err := ep.Gateway.CreateExternalIPv6(body.ConfigExternalIp)
+	if err == nil && externalIp == nil {
+		err = fmt.Errorf("no external ipv6 method specified")
+	}
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -256,13 +382,12 @@ func (ep *Endpoints) POST_ExternalIpv6(c *gin.Context) {
 	}
 
 	if !body.Test {
-		ep.Gateway.config.Dns.ExternalIpv6.Method = body.Method
-		ep.Gateway.config.Dns.ExternalIpv6.Param = body.Param
+		ep.Gateway.config.Dns.ExternalIpv6 = body.ConfigExternalIp
 		ep.Gateway.SetExternalIPv6(externalIp)
 		ep.Gateway.config.save()
 	}
 
-	c.JSON(200, gin.H{"method": body.Method, "param": body.Param, "address": ip.String(), "timestamp": time.Now()})
+	c.JSON(200, gin.H{"method": body.Method, "param": body.Param, "providers": body.Providers, "address": ip.String(), "timestamp": time.Now()})
 }
 
 func (ep *Endpoints) GET_Ipv4(c *gin.Context) {
@@ -352,6 +477,305 @@ func (ep *Endpoints) GET_DnsLookup(c *gin.Context) {
 	c.JSON(200, result)
 }
 
+// GET_DnsResolver returns the configuration and statistics of the LAN resolver
+func (ep *Endpoints) GET_DnsResolver(c *gin.Context) {
+	response := gin.H{"config": ep.Gateway.config.Dns.Resolver}
+	if resolver := ep.Gateway.Resolver(); resolver != nil {
+		response["stats"] = resolver.Stats()
+	}
+	c.JSON(200, response)
+}
+
+// PUT_DnsResolver replaces the configuration of the LAN resolver
+func (ep *Endpoints) PUT_DnsResolver(c *gin.Context) {
+	var config ConfigResolver
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	resolver, err := ep.Gateway.CreateResolver(config)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	ep.Gateway.SetResolver(resolver)
+	ep.Gateway.config.Dns.Resolver = config
+	if err := ep.Gateway.config.save(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, config)
+}
+
+// GET_DnsResolverClients returns the query statistics per LAN client
+func (ep *Endpoints) GET_DnsResolverClients(c *gin.Context) {
+	resolver := ep.Gateway.Resolver()
+	if resolver == nil {
+		c.JSON(404, gin.H{"error": "resolver not enabled"})
+		return
+	}
+	c.JSON(200, gin.H{"clients": resolver.ClientStats()})
+}
+
+// POST_DnsResolverReload reloads the blocklists and flushes the cache
+func (ep *Endpoints) POST_DnsResolverReload(c *gin.Context) {
+	resolver := ep.Gateway.Resolver()
+	if resolver == nil {
+		c.JSON(404, gin.H{"error": "resolver not enabled"})
+		return
+	}
+	if err := resolver.ReloadBlocklists(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, resolver.Stats())
+}
+
+// GET_DnsQueries returns the most recent DNS queries (newest first).
+// If stream=true is set, the connection is upgraded to a websocket and
+// all new queries are sent as they arrive.
+func (ep *Endpoints) GET_DnsQueries(c *gin.Context) {
+	queryLog := ep.Gateway.queryLog
+	if queryLog == nil {
+		c.JSON(404, gin.H{"error": "query log not available"})
+		return
+	}
+	if c.Query("stream") == "true" {
+		ep.streamDnsQueries(c, queryLog)
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	c.JSON(200, gin.H{"queries": queryLog.Records(limit)})
+}
+
+func (ep *Endpoints) streamDnsQueries(c *gin.Context, queryLog dns.QueryLog) {
+	ws, err := websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		fmt.Println("Failed to upgrade connection to WebSocket:", err)
+		return
+	}
+	defer ws.Close()
+
+	records, cancel := queryLog.Subscribe()
+	defer cancel()
+
+	// the reader detects closed connections
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case record, ok := <-records:
+			if !ok {
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := ws.WriteJSON(record); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// GET_DnsQueriesStats returns top names, top clients and rcode rates
+func (ep *Endpoints) GET_DnsQueriesStats(c *gin.Context) {
+	queryLog := ep.Gateway.queryLog
+	if queryLog == nil {
+		c.JSON(404, gin.H{"error": "query log not available"})
+		return
+	}
+	top, _ := strconv.Atoi(c.DefaultQuery("top", "10"))
+	c.JSON(200, queryLog.Stats(top))
+}
+
+// GET_DnsProxy returns the health of the targets of all proxy domains
+func (ep *Endpoints) GET_DnsProxy(c *gin.Context) {
+	c.JSON(200, gin.H{"domains": ep.Gateway.dnsServer.ProxyStatus()})
+}
+
+// GET_DnsHealth returns the latest health check result of all domains
+func (ep *Endpoints) GET_DnsHealth(c *gin.Context) {
+	results := []dns.HealthCheckResult{}
+	for _, domain := range ep.Gateway.config.Domains {
+		if result := ep.Gateway.DomainHealth(domain.Name); result != nil {
+			results = append(results, *result)
+		}
+	}
+	c.JSON(200, gin.H{"domains": results})
+}
+
+// POST_DnsHealthCheck runs the health checks immediately. If a domain is
+// given, only this domain is checked.
+func (ep *Endpoints) POST_DnsHealthCheck(c *gin.Context) {
+	var request struct {
+		Domain string `json:"domain"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil && err != io.EOF {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	results := []dns.HealthCheckResult{}
+	for _, domain := range ep.Gateway.config.Domains {
+		if domain.Redirect != nil && domain.Redirect.Target != "" {
+			continue
+		}
+		if request.Domain != "" && domain.Name != request.Domain {
+			continue
+		}
+		results = append(results, ep.Gateway.CheckDomainHealth(domain))
+	}
+	if request.Domain != "" && len(results) == 0 {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("domain %q not found", request.Domain)})
+		return
+	}
+	c.JSON(200, gin.H{"domains": results})
+}
+
+// GET_DnsHealthDomainHistory returns the health check history of a domain
+func (ep *Endpoints) GET_DnsHealthDomainHistory(c *gin.Context) {
+	history := ep.Gateway.DomainHealthHistory(c.Param("domain"))
+	if history == nil {
+		history = []dns.HealthCheckResult{}
+	}
+	c.JSON(200, gin.H{"history": history})
+}
+
+// GET_DnsRateLimit returns the configuration and the counters of the
+// response rate limiting
+func (ep *Endpoints) GET_DnsRateLimit(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"config": ep.Gateway.config.Dns.RateLimit,
+		"stats":  ep.Gateway.dnsServer.RateLimitStats(),
+	})
+}
+
+// PUT_DnsRateLimit replaces the configuration of the response rate limiting
+func (ep *Endpoints) PUT_DnsRateLimit(c *gin.Context) {
+	var config ConfigRateLimit
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ep.Gateway.SetRateLimit(config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	ep.Gateway.config.Dns.RateLimit = config
+	if err := ep.Gateway.config.save(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, config)
+}
+
+// maskDdnsConfig hides the secrets of the DDNS providers
+func maskDdnsConfig(config ConfigDdns) ConfigDdns {
+	config.Providers = slices.Clone(config.Providers)
+	for i := range config.Providers {
+		if config.Providers[i].Password != "" {
+			config.Providers[i].Password = "-"
+		}
+		if config.Providers[i].TsigSecret != "" {
+			config.Providers[i].TsigSecret = "-"
+		}
+	}
+	return config
+}
+
+// GET_DnsDdns returns the DDNS providers and the status of their last update
+func (ep *Endpoints) GET_DnsDdns(c *gin.Context) {
+	response := gin.H{"config": maskDdnsConfig(ep.Gateway.config.Dns.Ddns)}
+	if updater := ep.Gateway.DdnsUpdater(); updater != nil {
+		response["status"] = updater.Status()
+	} else {
+		response["status"] = []ddns.ProviderStatus{}
+	}
+	c.JSON(200, response)
+}
+
+// PUT_DnsDdns replaces the DDNS providers. Masked secrets ("-") are taken
+// from the existing provider with the same name.
+func (ep *Endpoints) PUT_DnsDdns(c *gin.Context) {
+	var config ConfigDdns
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing := ep.Gateway.config.Dns.Ddns.Providers
+	for i := range config.Providers {
+		provider := &config.Providers[i]
+		if provider.Password != "-" && provider.TsigSecret != "-" {
+			continue
+		}
+		j := slices.IndexFunc(existing, func(p ConfigDdnsProvider) bool {
+			return p.Name == provider.Name && p.Hostname == provider.Hostname
+		})
+		if provider.Password == "-" {
+			provider.Password = ""
+			if j >= 0 {
+				provider.Password = existing[j].Password
+			}
+		}
+		if provider.TsigSecret == "-" {
+			provider.TsigSecret = ""
+			if j >= 0 {
+				provider.TsigSecret = existing[j].TsigSecret
+			}
+		}
+	}
+
+	updater, err := ep.Gateway.CreateDdnsUpdater(config)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	ep.Gateway.SetDdnsUpdater(updater)
+	ep.Gateway.config.Dns.Ddns = config
+	if err := ep.Gateway.config.save(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, maskDdnsConfig(config))
+}
+
+// POST_DnsDdnsRefresh pushes the current addresses to all DDNS providers
+func (ep *Endpoints) POST_DnsDdnsRefresh(c *gin.Context) {
+	updater := ep.Gateway.DdnsUpdater()
+	if updater == nil {
+		c.JSON(404, gin.H{"error": "no ddns providers configured"})
+		return
+	}
+	updater.Refresh()
+	c.JSON(200, gin.H{"status": "refresh scheduled"})
+}
+
 func (ep *Endpoints) GET_DomainsGuidRoutes(c *gin.Context) {
 	guid := c.Param("guid")
 	for _, domain := range ep.Gateway.config.Domains {
@@ -404,8 +828,11 @@ func (ep *Endpoints) PUT_DomainsGuidRoutesGuid(c *gin.Context) {
 }
 
 func (ep *Endpoints) GET_Users(c *gin.Context) {
-	users := ep.Gateway.authServer.Users()
-	c.JSON(200, gin.H{"users": users.Users()})
+	users := ep.Gateway.authServer.Users().Users()
+	for i := range users {
+		users[i].LoginFailures = ep.Gateway.authServer.LoginFailures(users[i].Guid)
+	}
+	c.JSON(200, gin.H{"users": users})
 }
 
 func (ep *Endpoints) POST_Users(c *gin.Context) {
@@ -430,9 +857,65 @@ func (ep *Endpoints) DELETE_UsersGuid(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	err = ep.Gateway.authServer.RevokeSessions(guid)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(200, gin.H{"status": "deleted"})
 }
 
+// POST_UsersGuidUnlock unlocks a user, who has been locked after too many
+// failed logins
+func (ep *Endpoints) POST_UsersGuidUnlock(c *gin.Context) {
+	guid := c.Param("guid")
+	if _, err := ep.Gateway.authServer.Users().GetUser(guid); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	ep.Gateway.authServer.Unlock(guid)
+	c.JSON(200, gin.H{"status": "unlocked"})
+}
+
+func (ep *Endpoints) GET_UsersGuidSessions(c *gin.Context) {
+	c.JSON(200, gin.H{"sessions": ep.Gateway.authServer.UserSessions(c.Param("guid"))})
+}
+
+// DELETE_UsersGuidSessions logs the user out everywhere
+func (ep *Endpoints) DELETE_UsersGuidSessions(c *gin.Context) {
+	err := ep.Gateway.authServer.RevokeSessions(c.Param("guid"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "revoked"})
+}
+
+func (ep *Endpoints) DELETE_UsersGuidSessionsId(c *gin.Context) {
+	err := ep.Gateway.authServer.RevokeSession(c.Param("guid"), c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "revoked"})
+}
+
+// DELETE_UsersGuidTokensId revokes a personal access token of a user
+func (ep *Endpoints) DELETE_UsersGuidTokensId(c *gin.Context) {
+	users := ep.Gateway.authServer.Users()
+	user, err := users.GetUser(c.Param("guid"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = users.DeleteAccessToken(user.Name, c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "revoked"})
+}
+
 func (ep *Endpoints) POST_UsersGuidPasswordReset(c *gin.Context) {
 	guid := c.Param("guid")
 
@@ -450,6 +933,17 @@ func (ep *Endpoints) POST_UsersGuidPasswordReset(c *gin.Context) {
 	client.SendWelcomeEmail(user.Mail, user.Name)
 }
 
+// POST_UsersGuidReset2FA removes the second factor of a user (like after
+// the loss of the phone), so that the user can enroll again
+func (ep *Endpoints) POST_UsersGuidReset2FA(c *gin.Context) {
+	err := ep.Gateway.authServer.Users().ResetSecondFactor(c.Param("guid"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "reset"})
+}
+
 func (ep *Endpoints) GET_Groups(c *gin.Context) {
 	users := ep.Gateway.authServer.Users()
 	c.JSON(200, gin.H{"groups": users.Groups()})
@@ -480,6 +974,366 @@ func (ep *Endpoints) DELETE_GroupsGuid(c *gin.Context) {
 	c.JSON(200, gin.H{"status": "deleted"})
 }
 
+// PUT_GroupsGuidRequire2FA sets the "2FA required" policy of a group
+func (ep *Endpoints) PUT_GroupsGuidRequire2FA(c *gin.Context) {
+	var body struct {
+		Require2FA bool `json:"require_2fa"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	group, err := ep.Gateway.authServer.Users().SetGroupRequire2FA(c.Param("guid"), body.Require2FA)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, group)
+}
+
+// maskClientSecret hides the secret, it is only returned after it has been
+// created
+func maskClientSecret(client auth.AuthClientConfig) auth.AuthClientConfig {
+	if client.ClientSecret != "" {
+		client.ClientSecret = "-"
+	}
+	if client.Public {
+		client.ClientSecret = ""
+	}
+	return client
+}
+
+func (ep *Endpoints) GET_OidcClients(c *gin.Context) {
+	clients := ep.Gateway.authServer.Clients().AuthClientConfigs()
+	for i := range clients {
+		clients[i] = maskClientSecret(clients[i])
+	}
+	issuer := ""
+	if authRoute := ep.Gateway.config.GetAuthRoute(); authRoute != nil {
+		issuer = "https://" + authRoute.GetHostname()
+	}
+	c.JSON(200, gin.H{"clients": clients, "issuer": issuer})
+}
+
+// POST_OidcClients registers a client. The response contains the secret,
+// which can't be read later.
+func (ep *Endpoints) POST_OidcClients(c *gin.Context) {
+	var client auth.AuthClientConfig
+	if err := c.ShouldBindJSON(&client); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := client.Check(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	clients := ep.Gateway.authServer.Clients()
+	if existing, _ := clients.GewAuthClientConfig(client.ClientId); existing != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("client %q already exists", client.ClientId)})
+		return
+	}
+	created, err := clients.NewAuthClientConfig(client.ClientId, true)
+	if err == nil {
+		client.ClientSecret = created.ClientSecret
+		created, err = clients.SaveAuthClientConfig(client)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	result := *created
+	if result.Public {
+		result.ClientSecret = ""
+	}
+	c.JSON(200, result)
+}
+
+func (ep *Endpoints) PUT_OidcClientsId(c *gin.Context) {
+	var client auth.AuthClientConfig
+	if err := c.ShouldBindJSON(&client); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	client.ClientId = c.Param("id")
+	updated, err := ep.Gateway.authServer.Clients().SaveAuthClientConfig(client)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, maskClientSecret(*updated))
+}
+
+func (ep *Endpoints) DELETE_OidcClientsId(c *gin.Context) {
+	err := ep.Gateway.authServer.Clients().DeleteAuthClientConfig(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// POST_OidcClientsIdSecret replaces the secret of a client and returns it
+func (ep *Endpoints) POST_OidcClientsIdSecret(c *gin.Context) {
+	client, err := ep.Gateway.authServer.Clients().NewAuthClientSecret(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, *client)
+}
+
+type CertificateWithDomain struct {
+	pki.CertificateStatus `json:",inline"`
+	DomainGuid            string `json:"domain_guid"`
+	Domain                string `json:"domain"`
+	CA                    string `json:"ca"`
+	Challenge             string `json:"challenge"`
+}
+
+// GET_Certificates lists all managed certificates
+func (ep *Endpoints) GET_Certificates(c *gin.Context) {
+	certificates := []CertificateWithDomain{}
+	for _, domain := range ep.Gateway.config.Domains {
+		if domain.serverCertificate == nil {
+			continue
+		}
+		ca := domain.CA
+		if ca == "" {
+			ca = ep.Gateway.config.Acme.GetDefault()
+		}
+		certificates = append(certificates, CertificateWithDomain{
+			CertificateStatus: domain.serverCertificate.GetStatus(),
+			DomainGuid:        domain.Guid,
+			Domain:            domain.Name,
+			CA:                ca,
+			Challenge:         domain.GetChallenge(),
+		})
+	}
+	c.JSON(200, gin.H{"certificates": certificates})
+}
+
+// GET_CertificatesGuidChain downloads the PEM chain of a domain
+func (ep *Endpoints) GET_CertificatesGuidChain(c *gin.Context) {
+	certificate, err := ep.Gateway.getDomainCertificate(c.Param("guid"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	chain := certificate.GetChain()
+	if len(chain) == 0 {
+		c.JSON(404, gin.H{"error": "the certificate has not been issued yet"})
+		return
+	}
+	filename := strings.TrimPrefix(chain[0].OBJ().Subject.CommonName, "*.") + ".pem"
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(200, "application/x-pem-file", []byte(chain.PEM()))
+}
+
+// POST_CertificatesGuidRenew requests a new certificate immediately
+func (ep *Endpoints) POST_CertificatesGuidRenew(c *gin.Context) {
+	certificate, err := ep.Gateway.getDomainCertificate(c.Param("guid"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	certificate.Renew()
+	c.JSON(200, certificate.GetStatus())
+}
+
+// POST_CertificatesGuidRevoke revokes the certificate (the reason is a CRL
+// reason code like 1 for keyCompromise or 4 for superseded) and requests
+// a new one
+func (ep *Endpoints) POST_CertificatesGuidRevoke(c *gin.Context) {
+	var body struct {
+		Reason int `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Reason < 0 || body.Reason > 10 || body.Reason == 7 {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("invalid reason code %d", body.Reason)})
+		return
+	}
+	certificate, err := ep.Gateway.getDomainCertificate(c.Param("guid"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	if err = certificate.Revoke(body.Reason); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, certificate.GetStatus())
+}
+
+// PUT_CertificatesGuidThreshold sets the renewal threshold of a domain
+func (ep *Endpoints) PUT_CertificatesGuidThreshold(c *gin.Context) {
+	var body struct {
+		RenewalThreshold int `json:"renewal_threshold"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	domain, err := ep.Gateway.SetDomainRenewalThreshold(c.Param("guid"), body.RenewalThreshold)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, domain)
+}
+
+// PUT_CertificatesGuidKey selects the key algorithm and key policy of a
+// domain
+func (ep *Endpoints) PUT_CertificatesGuidKey(c *gin.Context) {
+	var body struct {
+		KeyAlgorithm     string `json:"key_algorithm"`
+		DualCertificates bool   `json:"dual_certificates"`
+		KeyPolicy        string `json:"key_policy"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	domain, err := ep.Gateway.SetDomainKeyConfig(c.Param("guid"), pki.KeyConfig{
+		Algorithm: body.KeyAlgorithm,
+		Dual:      body.DualCertificates,
+		Policy:    body.KeyPolicy,
+	})
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, domain)
+}
+
+// GET_CertificatesGuidExports returns the export targets of a domain (with
+// masked PKCS#12 passwords)
+func (ep *Endpoints) GET_CertificatesGuidExports(c *gin.Context) {
+	domain := ep.Gateway.config.GetDomain(c.Param("guid"))
+	if domain == nil {
+		c.JSON(404, gin.H{"error": "domain not found"})
+		return
+	}
+	c.JSON(200, gin.H{"exports": maskExportPasswords(ep.Gateway.domainExports(domain))})
+}
+
+// PUT_CertificatesGuidExports replaces the export targets of a domain
+func (ep *Endpoints) PUT_CertificatesGuidExports(c *gin.Context) {
+	var body struct {
+		Exports []exportPassword `json:"exports"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	domain := ep.Gateway.config.GetDomain(c.Param("guid"))
+	if domain == nil {
+		c.JSON(404, gin.H{"error": "domain not found"})
+		return
+	}
+	updated, err := ep.Gateway.SetDomainExports(domain.Guid, withExportPasswords(ep.Gateway.domainExports(domain), body.Exports))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"exports": maskExportPasswords(updated.Exports)})
+}
+
+// GET_LocalCA returns the configuration and the root certificate of the
+// local CA
+func (ep *Endpoints) GET_LocalCA(c *gin.Context) {
+	result := gin.H{"config": ep.Gateway.config.LocalCA}
+	if len(ep.Gateway.config.LocalCA.Domains) > 0 {
+		if localCA, err := ep.Gateway.getLocalCA(); err == nil {
+			root := localCA.RootCertificate().OBJ()
+			fingerprint := sha256.Sum256(root.Raw)
+			result["root"] = gin.H{
+				"subject":            root.Subject.String(),
+				"not_after":          root.NotAfter,
+				"permitted_domains":  root.PermittedDNSDomains,
+				"sha256_fingerprint": hex.EncodeToString(fingerprint[:]),
+			}
+		}
+	}
+	c.JSON(200, result)
+}
+
+func (ep *Endpoints) PUT_LocalCA(c *gin.Context) {
+	var config ConfigLocalCA
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ep.Gateway.SetLocalCAConfig(config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"config": ep.Gateway.config.LocalCA})
+}
+
+// GET_LocalCARoot downloads the root certificate, which has to be
+// installed on the devices
+func (ep *Endpoints) GET_LocalCARoot(c *gin.Context) {
+	localCA, err := ep.Gateway.getLocalCA()
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="gateway-root-ca.pem"`)
+	c.Data(200, "application/x-pem-file", []byte(localCA.RootCertificate().PEM()))
+}
+
+// maskAcmeConfig hides the EAB HMAC keys
+func maskAcmeConfig(config ConfigAcme) ConfigAcme {
+	config.CAs = slices.Clone(config.CAs)
+	for i := range config.CAs {
+		if config.CAs[i].EABHMACKey != "" {
+			config.CAs[i].EABHMACKey = "-"
+		}
+	}
+	return config
+}
+
+func (ep *Endpoints) GET_Acme(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"config":    maskAcmeConfig(ep.Gateway.config.Acme),
+		"known_cas": acme.KnownCAs(),
+	})
+}
+
+func (ep *Endpoints) PUT_Acme(c *gin.Context) {
+	var config ConfigAcme
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// "-" keeps the existing HMAC key (unless the key id has been changed)
+	for i, ca := range config.CAs {
+		if ca.EABHMACKey != "-" {
+			continue
+		}
+		config.CAs[i].EABHMACKey = ""
+		for _, existing := range ep.Gateway.config.Acme.CAs {
+			if existing.Name == ca.Name && existing.EABKeyID == ca.EABKeyID {
+				config.CAs[i].EABHMACKey = existing.EABHMACKey
+			}
+		}
+	}
+
+	if err := ep.Gateway.SetAcmeConfig(config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"config":    maskAcmeConfig(ep.Gateway.config.Acme),
+		"known_cas": acme.KnownCAs(),
+	})
+}
+
 func (ep *Endpoints) GET_MailConfig(c *gin.Context) {
 	config := ep.Gateway.config.Mail
 	// For security reasons, mask the password if it's set
@@ -0,0 +1,329 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dueckminor/home-assistant-addons/go/services/homeassistant"
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ConfigExport copies the certificate of a domain to a directory, which is
+// used by other add-ons (like /ssl)
+type ConfigExport struct {
+	Directory string `yaml:"directory" json:"directory"`
+	// Fullchain and Privkey are the file names of the PEM files (default:
+	// fullchain.pem and privkey.pem)
+	Fullchain string `yaml:"fullchain,omitempty" json:"fullchain,omitempty"`
+	Privkey   string `yaml:"privkey,omitempty" json:"privkey,omitempty"`
+	// PKCS12 is the (optional) file name of a PKCS#12 file
+	PKCS12         string `yaml:"pkcs12,omitempty" json:"pkcs12,omitempty"`
+	PKCS12Password string `yaml:"pkcs12_password,omitempty" json:"-"`
+	// Mode is the octal file mode (default: 0600)
+	Mode string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	// Owner is the numeric owner of the files ("uid" or "uid:gid")
+	Owner string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	// RestartAddon is the slug of an add-on, which is restarted after the
+	// certificate has been renewed
+	RestartAddon string `yaml:"restart_addon,omitempty" json:"restart_addon,omitempty"`
+}
+
+func (configExport *ConfigExport) GetFullchain() string {
+	if configExport.Fullchain == "" {
+		return "fullchain.pem"
+	}
+	return configExport.Fullchain
+}
+
+func (configExport *ConfigExport) GetPrivkey() string {
+	if configExport.Privkey == "" {
+		return "privkey.pem"
+	}
+	return configExport.Privkey
+}
+
+func (configExport *ConfigExport) GetMode() (os.FileMode, error) {
+	if configExport.Mode == "" {
+		return 0600, nil
+	}
+	mode, err := strconv.ParseUint(configExport.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode: %s", configExport.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// GetOwner returns -1 for the uid and gid, if they shouldn't be changed
+func (configExport *ConfigExport) GetOwner() (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	if configExport.Owner == "" {
+		return uid, gid, nil
+	}
+	uidText, gidText, hasGid := strings.Cut(configExport.Owner, ":")
+	if uid, err = strconv.Atoi(uidText); err != nil {
+		return -1, -1, fmt.Errorf("invalid owner: %s", configExport.Owner)
+	}
+	if hasGid {
+		if gid, err = strconv.Atoi(gidText); err != nil {
+			return -1, -1, fmt.Errorf("invalid owner: %s", configExport.Owner)
+		}
+	}
+	return uid, gid, nil
+}
+
+// exportRoots are the directories shared with other add-ons
+var exportRoots = []string{"/ssl", "/share"}
+
+var addonSlugRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func (configExport *ConfigExport) Check() error {
+	if !path.IsAbs(configExport.Directory) {
+		return fmt.Errorf("the export directory must be an absolute path")
+	}
+	directory := path.Clean(configExport.Directory)
+	if !slices.ContainsFunc(exportRoots, func(root string) bool {
+		return directory == root || strings.HasPrefix(directory, root+"/")
+	}) {
+		return fmt.Errorf("the export directory must be within %s", strings.Join(exportRoots, " or "))
+	}
+	for _, name := range []string{configExport.Fullchain, configExport.Privkey, configExport.PKCS12} {
+		if strings.Contains(name, "/") || name == "." || name == ".." {
+			return fmt.Errorf("invalid file name: %s", name)
+		}
+	}
+	names := []string{configExport.GetFullchain(), configExport.GetPrivkey()}
+	if configExport.PKCS12 != "" {
+		names = append(names, configExport.PKCS12)
+	}
+	for i, name := range names {
+		if slices.Contains(names[i+1:], name) {
+			return fmt.Errorf("the file name %s is used more than once", name)
+		}
+	}
+	if configExport.RestartAddon != "" && !addonSlugRegexp.MatchString(configExport.RestartAddon) {
+		return fmt.Errorf("invalid add-on slug: %s", configExport.RestartAddon)
+	}
+	if _, err := configExport.GetMode(); err != nil {
+		return err
+	}
+	if _, _, err := configExport.GetOwner(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// exportCertificate writes the files of an export, if the certificate has
+// changed (or if force is set). It returns true if the certificate has
+// changed.
+func exportCertificate(configExport ConfigExport, key crypto.PrivateKey, chain crypto.CertificateChain, force bool) (changed bool, err error) {
+	// the config file may have been edited by hand
+	if err = configExport.Check(); err != nil {
+		return false, err
+	}
+	mode, err := configExport.GetMode()
+	if err != nil {
+		return false, err
+	}
+	uid, gid, err := configExport.GetOwner()
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(configExport.Directory, 0755)
+	if err != nil {
+		return false, err
+	}
+
+	fullchainFile := filepath.Join(configExport.Directory, configExport.GetFullchain())
+	fullchain := []byte(chain.PEM())
+	current, err := os.ReadFile(fullchainFile)
+	changed = err != nil || !bytes.Equal(current, fullchain)
+	if !changed && !force {
+		return false, nil
+	}
+
+	files := map[string][]byte{
+		configExport.GetPrivkey(): []byte(key.PEM()),
+	}
+	if configExport.PKCS12 != "" {
+		pfx, err := encodePKCS12(key, chain, configExport.PKCS12Password)
+		if err != nil {
+			return false, err
+		}
+		files[configExport.PKCS12] = pfx
+	}
+	// the full chain is written last, as it is used to detect changes
+	for name, data := range files {
+		if err = writeExportFile(filepath.Join(configExport.Directory, name), data, mode, uid, gid); err != nil {
+			return false, err
+		}
+	}
+	return changed, writeExportFile(fullchainFile, fullchain, mode, uid, gid)
+}
+
+// writeExportFile replaces the file atomically, so that consumers never
+// see a partially written file
+func writeExportFile(filename string, data []byte, mode os.FileMode, uid int, gid int) error {
+	// a unique temporary file, as several exports may use the same directory
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	tempFile := file.Name()
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// CreateTemp always uses 0600
+	if err == nil {
+		err = os.Chmod(tempFile, mode)
+	}
+	if err == nil && (uid >= 0 || gid >= 0) {
+		err = os.Chown(tempFile, uid, gid)
+	}
+	if err == nil {
+		err = os.Rename(tempFile, filename)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+	}
+	return err
+}
+
+func encodePKCS12(key crypto.PrivateKey, chain crypto.CertificateChain, password string) ([]byte, error) {
+	pemBlock, _ := pem.Decode([]byte(key.PEM()))
+	if pemBlock == nil {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	var caCerts []*x509.Certificate
+	for _, cert := range chain[1:] {
+		caCerts = append(caCerts, cert.OBJ())
+	}
+	return pkcs12.Modern.Encode(privateKey, chain[0].OBJ(), caCerts, password)
+}
+
+// domainExports returns a copy of the exports of a domain
+func (g *Gateway) domainExports(domain *ConfigDomain) []ConfigExport {
+	g.exportsMu.Lock()
+	defer g.exportsMu.Unlock()
+	return slices.Clone(domain.Exports)
+}
+
+// lockDomainExports serializes the exports of a domain
+func (g *Gateway) lockDomainExports(domain *ConfigDomain) (unlock func()) {
+	g.exportsMu.Lock()
+	if g.exportLocks == nil {
+		g.exportLocks = make(map[string]*sync.Mutex)
+	}
+	lock := g.exportLocks[domain.Guid]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		g.exportLocks[domain.Guid] = lock
+	}
+	g.exportsMu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// exportDomainCertificate is called whenever the domain got a new
+// certificate (and after startup)
+func (g *Gateway) exportDomainCertificate(domain *ConfigDomain, key crypto.PrivateKey, chain crypto.CertificateChain, force bool) {
+	defer g.lockDomainExports(domain)()
+	for _, configExport := range g.domainExports(domain) {
+		changed, err := exportCertificate(configExport, key, chain, force)
+		if err != nil {
+			fmt.Printf("Export of %s to %s failed: %v\n", domain.Name, configExport.Directory, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		fmt.Printf("Exported the certificate of %s to %s\n", domain.Name, configExport.Directory)
+		if configExport.RestartAddon != "" {
+			err = homeassistant.NewSupervisorClient().RestartAddon(configExport.RestartAddon)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// SetDomainExports replaces the export targets of a domain. The exports
+// are written immediately.
+func (g *Gateway) SetDomainExports(domainGuid string, exports []ConfigExport) (ConfigDomain, error) {
+	domain := g.config.GetDomain(domainGuid)
+	if domain == nil {
+		return ConfigDomain{}, fmt.Errorf("domain with guid %q not found", domainGuid)
+	}
+	for i := range exports {
+		if err := exports[i].Check(); err != nil {
+			return ConfigDomain{}, err
+		}
+	}
+	g.exportsMu.Lock()
+	domain.Exports = exports
+	updated := *domain
+	g.config.save()
+	g.exportsMu.Unlock()
+	if domain.serverCertificate != nil {
+		key, chain := domain.serverCertificate.GetCertAndKey()
+		if len(chain) > 0 {
+			go g.exportDomainCertificate(domain, key, chain, true)
+		}
+	}
+	return updated, nil
+}
+
+// exportPassword is used as input of the export endpoint, as the password
+// isn't part of the JSON representation of ConfigExport
+type exportPassword struct {
+	ConfigExport
+	PKCS12Password string `json:"pkcs12_password,omitempty"`
+}
+
+// withExportPasswords combines the exports with their passwords. A masked
+// password ("-") keeps the password of the export to the same directory.
+func withExportPasswords(existingExports []ConfigExport, exports []exportPassword) []ConfigExport {
+	result := make([]ConfigExport, 0, len(exports))
+	for _, export := range exports {
+		configExport := export.ConfigExport
+		configExport.PKCS12Password = export.PKCS12Password
+		if export.PKCS12Password == "-" {
+			configExport.PKCS12Password = ""
+			for _, existing := range existingExports {
+				if existing.Directory == configExport.Directory {
+					configExport.PKCS12Password = existing.PKCS12Password
+				}
+			}
+		}
+		result = append(result, configExport)
+	}
+	return result
+}
+
+// maskExportPasswords returns the exports with masked passwords
+func maskExportPasswords(exports []ConfigExport) []exportPassword {
+	result := make([]exportPassword, 0, len(exports))
+	for _, export := range exports {
+		masked := exportPassword{ConfigExport: export}
+		if export.PKCS12Password != "" {
+			masked.PKCS12Password = "-"
+		}
+		result = append(result, masked)
+	}
+	return result
+}
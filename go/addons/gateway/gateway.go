@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -14,9 +16,11 @@ import (
 	"github.com/dueckminor/home-assistant-addons/go/auth"
 	"github.com/dueckminor/home-assistant-addons/go/embed/gateway_dist"
 	"github.com/dueckminor/home-assistant-addons/go/services/acme"
+	"github.com/dueckminor/home-assistant-addons/go/services/ddns"
 	"github.com/dueckminor/home-assistant-addons/go/services/dns"
 	"github.com/dueckminor/home-assistant-addons/go/services/homeassistant"
 	"github.com/dueckminor/home-assistant-addons/go/services/smtp"
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
 	"github.com/dueckminor/home-assistant-addons/go/utils/ginutil"
 	"github.com/dueckminor/home-assistant-addons/go/utils/network"
 	"github.com/dueckminor/home-assistant-addons/go/utils/pki"
@@ -55,9 +59,16 @@ type Gateway struct {
 	authServer *auth.AuthServer
 	authClient *auth.AuthClient
 
-	dnsServer dns.Server
+	dnsServer  dns.Server
+	resolverMu sync.Mutex
+	resolver   dns.Resolver
+	queryLog   dns.QueryLog
 
-	acmeClient acme.Client
+	acmeClientsMu sync.Mutex
+	acmeClients   map[string]acme.Client
+
+	localCAMu sync.Mutex
+	localCA   pki.LocalCA
 
 	httpServer  network.HttpToHttps
 	httpsServer network.TLSProxy
@@ -65,6 +76,18 @@ type Gateway struct {
 	externalIPv4 dns.ExternalIP
 	externalIPv6 dns.ExternalIP
 
+	externalIPListenersMu sync.Mutex
+	externalIPListeners   []dns.ExternalIPChangeFunc
+
+	// exportsMu guards the exports of the domains, exportLocks serialize
+	// the exports of each domain (by guid)
+	exportsMu   sync.Mutex
+	exportLocks map[string]*sync.Mutex
+
+	ddnsUpdater ddns.Updater
+
+	healthHistory dns.HealthHistory
+
 	influxDBConfig   *homeassistant.InfluxDBConfig
 	metricsCollector *MetricsCollector
 
@@ -194,6 +217,9 @@ func (g *Gateway) Start(ctx context.Context, dnsPort int, httpPort int, httpsPor
 	}()
 
 	err = g.StartDNS(ctx, dnsPort)
+	if err == nil {
+		g.StartDDNS(ctx)
+	}
 	for _, domain := range g.config.Domains {
 		if domain.Redirect != nil && domain.Redirect.Target != "" {
 			continue
@@ -224,6 +250,13 @@ func (g *Gateway) Start(ctx context.Context, dnsPort int, httpPort int, httpsPor
 	authRoute := g.config.GetAuthRoute()
 	if authRoute != nil {
 		g.startAuthServer(authRoute)
+		g.authServer.SetIssuer("https://" + authRoute.GetHostname())
+
+		webAuthnErr := g.authServer.EnableWebAuthn(authRoute.GetHostname(), authRoute.domain.Name)
+		if webAuthnErr != nil {
+			fmt.Println("Passkeys are disabled:", webAuthnErr)
+		}
+		g.authServer.EnableForwardAuth(authRoute.domain.Name)
 
 		smtpClient := g.GetSMTPClient()
 		if smtpClient != nil {
@@ -244,21 +277,13 @@ func (g *Gateway) Start(ctx context.Context, dnsPort int, httpPort int, httpsPor
 		}
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(5 * time.Minute):
-				if g.externalIPv4 != nil {
-					go g.externalIPv4.Refresh()
-				}
-				if g.externalIPv6 != nil {
-					go g.externalIPv6.Refresh()
-				}
-			}
-		}
-	}()
+	if err == nil {
+		g.startEncryptedDNS()
+	}
+
+	go g.watchExternalIP(ctx, false)
+	go g.watchExternalIP(ctx, true)
+	go g.runHealthChecks(ctx)
 
 	return nil
 }
@@ -336,7 +361,13 @@ func (g *Gateway) startRoute(route *ConfigRoute) {
 			options.AuthClient = new(auth.AuthClient)
 			*options.AuthClient = *g.authClient
 			options.AuthClient.Secret = options.AuthSecret
+			options.AuthClient.AllowedUsers = route.Options.AllowedUsers
+			options.AuthClient.AllowedGroups = route.Options.AllowedGroups
+			options.AuthClient.UserHeader = route.Options.UserHeader
+			options.AuthClient.GroupsHeader = route.Options.GroupsHeader
+			options.AuthClient.AccessTokens = route.Options.AccessTokens
 			options.SessionStore = g.authServer.GetSessionStore()
+			g.authServer.AddCallbackHost(hostname)
 		}
 		g.httpsServer.AddHandler(hostname, network.NewHostImplReverseProxy(route.Target, options))
 	}
@@ -351,6 +382,9 @@ func (g *Gateway) startRoute(route *ConfigRoute) {
 func (g *Gateway) stopRoute(route *ConfigRoute) {
 	hostname := route.GetHostname()
 	g.httpsServer.DeleteHandler(hostname)
+	if g.authServer != nil {
+		g.authServer.RemoveCallbackHost(hostname)
+	}
 }
 
 func (g *Gateway) startAuthServer(route *ConfigRoute) {
@@ -382,6 +416,7 @@ func (g *Gateway) startAuthServer(route *ConfigRoute) {
 		ClientSecret: acc.ClientSecret,
 		ServerKey:    g.authServer.GetPublicKey(),
 		Secret:       "",
+		Tokens:       g.authServer,
 	}
 
 	g.httpsServer.AddHandler(hostname, r)
@@ -393,6 +428,27 @@ func (g *Gateway) AddDomain(domain ConfigDomain) (ConfigDomain, error) {
 		return ConfigDomain{}, fmt.Errorf("domain %q already exists", domain.Name)
 	}
 	domain.Guid = uuid.New().String()
+	if err := acme.CheckChallengeType(domain.Challenge); err != nil {
+		return ConfigDomain{}, err
+	}
+	if domain.CA != "" {
+		if err := g.checkCA(domain.CA, domain.Name); err != nil {
+			return ConfigDomain{}, err
+		}
+	}
+	if err := domain.GetKeyConfig().Check(); err != nil {
+		return ConfigDomain{}, err
+	}
+	for i := range domain.Exports {
+		if err := domain.Exports[i].Check(); err != nil {
+			return ConfigDomain{}, err
+		}
+	}
+	if domain.Redirect != nil {
+		if err := domain.Redirect.Check(); err != nil {
+			return ConfigDomain{}, err
+		}
+	}
 
 	g.startDomain(&domain)
 
@@ -426,6 +482,9 @@ func (g *Gateway) DelDomain(guid string) error {
 }
 
 func (g *Gateway) AddRoute(domainGuid string, route ConfigRoute) (ConfigRoute, error) {
+	if err := route.Options.Check(); err != nil {
+		return ConfigRoute{}, err
+	}
 	route.Guid = uuid.New().String()
 	domain := g.config.GetDomain(domainGuid)
 	if domain == nil {
@@ -433,6 +492,7 @@ func (g *Gateway) AddRoute(domainGuid string, route ConfigRoute) (ConfigRoute, e
 	}
 	domain.AddRoute(&route)
 	g.startRoute(&route)
+	g.updateDomainCertificate(domain)
 	g.config.save()
 	return route, nil
 }
@@ -447,11 +507,56 @@ func (g *Gateway) DelRoute(domainGuid string, routeGuid string) error {
 		return fmt.Errorf("route with guid %q not found", routeGuid)
 	}
 	g.stopRoute(route)
+	g.updateDomainCertificate(domain)
 	g.config.save()
 	return nil
 }
 
+// SetDomainChallenge changes the ACME challenge type of a domain. The
+// certificate is requested again if the names change.
+func (g *Gateway) SetDomainChallenge(domainGuid string, challenge string) (ConfigDomain, error) {
+	domain := g.config.GetDomain(domainGuid)
+	if domain == nil {
+		return ConfigDomain{}, fmt.Errorf("domain with guid %q not found", domainGuid)
+	}
+	if err := acme.CheckChallengeType(challenge); err != nil {
+		return ConfigDomain{}, err
+	}
+	if challenge == "" {
+		challenge = acme.ChallengeDNS01
+	}
+	if domain.GetChallenge() != challenge {
+		domain.Challenge = challenge
+		g.restartDomainCertificate(domain)
+	}
+	g.config.save()
+	return *domain, nil
+}
+
+// SetDomainCA selects the certificate authority of a domain (an empty name
+// selects the default CA). It is used for the next renewal.
+func (g *Gateway) SetDomainCA(domainGuid string, ca string) (ConfigDomain, error) {
+	domain := g.config.GetDomain(domainGuid)
+	if domain == nil {
+		return ConfigDomain{}, fmt.Errorf("domain with guid %q not found", domainGuid)
+	}
+	if ca != "" {
+		if err := g.checkCA(ca, domain.Name); err != nil {
+			return ConfigDomain{}, err
+		}
+	}
+	if domain.CA != ca {
+		domain.CA = ca
+		g.restartDomainCertificate(domain)
+	}
+	g.config.save()
+	return *domain, nil
+}
+
 func (g *Gateway) UpdateRoute(domainGuid string, routeGuid string, route ConfigRoute) (ConfigRoute, error) {
+	if err := route.Options.Check(); err != nil {
+		return ConfigRoute{}, err
+	}
 	domain := g.config.GetDomain(domainGuid)
 	if domain == nil {
 		return ConfigRoute{}, fmt.Errorf("domain with guid %q not found", domainGuid)
@@ -468,6 +573,7 @@ func (g *Gateway) UpdateRoute(domainGuid string, routeGuid string, route ConfigR
 	}
 	existingRoute.Target = route.Target
 	g.startRoute(existingRoute)
+	g.updateDomainCertificate(domain)
 	g.config.save()
 
 	return *existingRoute, nil
@@ -482,43 +588,231 @@ func (g *Gateway) ExternalIPv6() (extIp dns.ExternalIP) {
 }
 
 func (g *Gateway) SetExternalIPv4(extIp dns.ExternalIP) {
+	oldIP := externalIPAddress(g.externalIPv4)
 	g.externalIPv4 = extIp
 	g.dnsServer.SetExternalIPv4(extIp)
+	if newIP := externalIPAddress(extIp); !oldIP.Equal(newIP) {
+		g.externalIPChanged(oldIP, newIP)
+	}
 }
 
 func (g *Gateway) SetExternalIPv6(extIp dns.ExternalIP) {
+	oldIP := externalIPAddress(g.externalIPv6)
 	g.externalIPv6 = extIp
 	g.dnsServer.SetExternalIPv6(extIp)
+	if newIP := externalIPAddress(extIp); !oldIP.Equal(newIP) {
+		g.externalIPChanged(oldIP, newIP)
+	}
 }
 
-func (g *Gateway) CreateExternalIPv4(method, params string) (extIp dns.ExternalIP, err error) {
-	switch method {
-	case "":
-		return nil, nil
-	case "dns":
-		return dns.NewExternalIP("ip4", params), nil
+func externalIPAddress(extIp dns.ExternalIP) net.IP {
+	if extIp == nil {
+		return nil
 	}
-	return nil, fmt.Errorf("unknown external ipv4 method %q", method)
+	return extIp.ExternalIP()
 }
 
-func (g *Gateway) CreateExternalIPv6(method, params string) (extIp dns.ExternalIP, err error) {
-	switch method {
+func (g *Gateway) CreateExternalIPv4(config ConfigExternalIp) (extIp dns.ExternalIP, err error) {
+	return g.createExternalIP("ip4", config)
+}
+
+func (g *Gateway) CreateExternalIPv6(config ConfigExternalIp) (extIp dns.ExternalIP, err error) {
+	return g.createExternalIP("ip6", config)
+}
+
+func (g *Gateway) createExternalIP(network string, config ConfigExternalIp) (extIp dns.ExternalIP, err error) {
+	switch config.Method {
 	case "":
 		return nil, nil
 	case "dns":
-		return dns.NewExternalIP("ip6", params), nil
+		return dns.NewExternalIP(network, config.Param), nil
+	case "stun":
+		return dns.NewExternalIPSTUN(network, config.Param), nil
+	case "http":
+		return dns.NewExternalIPHTTP(network, config.Param), nil
+	case "interface":
+		return dns.NewExternalIPInterface(network, config.Param), nil
+	case "consensus":
+		providers := make([]dns.ExternalIP, 0, len(config.Providers))
+		for _, providerConfig := range config.Providers {
+			if providerConfig.Method == "consensus" {
+				return nil, fmt.Errorf("consensus providers must not be nested")
+			}
+			provider, err := g.createExternalIP(network, providerConfig)
+			if err != nil {
+				return nil, err
+			}
+			if provider != nil {
+				providers = append(providers, provider)
+			}
+		}
+		if len(providers) == 0 {
+			return nil, fmt.Errorf("the consensus method requires at least one provider")
+		}
+		return dns.NewExternalIPConsensus(providers...), nil
+	}
+	if network == "ip4" {
+		switch config.Method {
+		case "natpmp":
+			return dns.NewExternalIPNATPMP(config.Param), nil
+		case "upnp":
+			return dns.NewExternalIPUPnP(config.Param), nil
+		}
+		return nil, fmt.Errorf("unknown external ipv4 method %q", config.Method)
+	}
+	switch config.Method {
 	case "homeassistant":
 		return homeassistant.NewExternalIP(), nil
 	}
-	return nil, fmt.Errorf("unknown external ipv6 method %q", method)
+	return nil, fmt.Errorf("unknown external ipv6 method %q", config.Method)
+}
+
+// OnExternalIPChange registers a callback which is called whenever the
+// external IPv4 or IPv6 address changes
+func (g *Gateway) OnExternalIPChange(callback dns.ExternalIPChangeFunc) {
+	g.externalIPListenersMu.Lock()
+	defer g.externalIPListenersMu.Unlock()
+	g.externalIPListeners = append(g.externalIPListeners, callback)
+}
+
+func (g *Gateway) externalIPChanged(oldIP net.IP, newIP net.IP) {
+	fmt.Printf("External IP changed: %v -> %v\n", oldIP, newIP)
+	if g.dnsServer != nil {
+		g.dnsServer.BumpSerial()
+	}
+
+	g.externalIPListenersMu.Lock()
+	listeners := slices.Clone(g.externalIPListeners)
+	g.externalIPListenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(oldIP, newIP)
+	}
+}
+
+// watchExternalIP periodically refreshes the external IPv4 or IPv6
+func (g *Gateway) watchExternalIP(ctx context.Context, ipv6 bool) {
+	for {
+		config := g.config.Dns.ExternalIpv4
+		if ipv6 {
+			config = g.config.Dns.ExternalIpv6
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.GetInterval()):
+			externalIP := g.externalIPv4
+			if ipv6 {
+				externalIP = g.externalIPv6
+			}
+			if externalIP == nil {
+				continue
+			}
+			_, err := dns.RefreshExternalIP(externalIP, g.externalIPChanged)
+			if err != nil {
+				fmt.Println("failed to refresh external IP:", err)
+			}
+		}
+	}
+}
+
+// runHealthChecks periodically checks the delegation and the resolution
+// of all domains
+func (g *Gateway) runHealthChecks(ctx context.Context) {
+	// give the external IP detection some time after the start
+	delay := time.Minute
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = g.config.Dns.HealthCheck.GetInterval()
+		if g.config.Dns.HealthCheck.Disabled {
+			continue
+		}
+		for _, domain := range g.config.Domains {
+			if domain.Redirect != nil && domain.Redirect.Target != "" {
+				continue
+			}
+			g.CheckDomainHealth(domain)
+		}
+	}
+}
+
+// CheckDomainHealth checks the delegation of the domain and the resolution
+// of all its routes. The result is added to the history.
+func (g *Gateway) CheckDomainHealth(domain *ConfigDomain) dns.HealthCheckResult {
+	target := dns.HealthCheckTarget{
+		Domain:       domain.Name,
+		ExternalIPv4: externalIPAddress(g.externalIPv4),
+		ExternalIPv6: externalIPAddress(g.externalIPv6),
+		Serial:       g.dnsServer.Serial(),
+	}
+	for _, route := range domain.Routes {
+		if route.Hostname != "*" {
+			target.Hostnames = append(target.Hostnames, route.GetHostname())
+		}
+	}
+
+	result := dns.NewDNSClient(5 * time.Second).CheckDomainHealth(target)
+	if g.healthHistory == nil {
+		return result
+	}
+
+	previous := g.healthHistory.Add(result)
+	if result.Status == dns.HealthError && (previous == nil || previous.Status != dns.HealthError) {
+		g.alertDomainHealth(result)
+	}
+	return result
+}
+
+func (g *Gateway) DomainHealth(domain string) *dns.HealthCheckResult {
+	if g.healthHistory == nil {
+		return nil
+	}
+	return g.healthHistory.Latest(domain)
+}
+
+func (g *Gateway) DomainHealthHistory(domain string) []dns.HealthCheckResult {
+	if g.healthHistory == nil {
+		return nil
+	}
+	return g.healthHistory.History(domain)
+}
+
+func (g *Gateway) alertDomainHealth(result dns.HealthCheckResult) {
+	var problems []string
+	for _, check := range result.Checks {
+		if check.Status != dns.HealthOK {
+			problems = append(problems, fmt.Sprintf("[%s] %s", check.Status, check.Message))
+		}
+	}
+	fmt.Printf("⚠️  DNS health check for %s failed:\n   %s\n", result.Domain, strings.Join(problems, "\n   "))
+
+	alertEmail := g.config.Dns.HealthCheck.AlertEmail
+	smtpClient := g.GetSMTPClient()
+	if alertEmail == "" || smtpClient == nil {
+		return
+	}
+	err := smtpClient.SendMail(&smtp.Message{
+		From:    g.config.Mail.FromEmail,
+		To:      []string{alertEmail},
+		Subject: fmt.Sprintf("DNS health check for %s failed", result.Domain),
+		Body: fmt.Sprintf("The DNS health check for %s failed at %s:\n\n%s\n",
+			result.Domain, result.Timestamp.Format(time.RFC1123), strings.Join(problems, "\n")),
+	})
+	if err != nil {
+		fmt.Println("DNS: failed to send health alert:", err)
+	}
 }
 
 func (g *Gateway) StartDNS(ctx context.Context, port int) (err error) {
-	g.externalIPv4, err = g.CreateExternalIPv4(g.config.Dns.ExternalIpv4.Method, g.config.Dns.ExternalIpv4.Param)
+	g.externalIPv4, err = g.CreateExternalIPv4(g.config.Dns.ExternalIpv4)
 	if err != nil {
 		return err
 	}
-	g.externalIPv6, err = g.CreateExternalIPv6(g.config.Dns.ExternalIpv6.Method, g.config.Dns.ExternalIpv6.Param)
+	g.externalIPv6, err = g.CreateExternalIPv6(g.config.Dns.ExternalIpv6)
 	if err != nil {
 		return err
 	}
@@ -537,15 +831,283 @@ func (g *Gateway) StartDNS(ctx context.Context, port int) (err error) {
 	g.dnsServer.SetExternalIPv4(g.externalIPv4)
 	g.dnsServer.SetExternalIPv6(g.externalIPv6)
 
+	err = g.SetRateLimit(g.config.Dns.RateLimit)
+	if err != nil {
+		fmt.Println("DNS: invalid rate limit configuration:", err)
+	}
+
+	g.queryLog, err = dns.NewQueryLog(path.Join(g.dataDir, "dns_queries.log"), g.config.Dns.QueryLogSize)
+	if err != nil {
+		fmt.Println("DNS: failed to open query log:", err)
+	} else {
+		g.dnsServer.SetQueryLog(g.queryLog)
+		go func() {
+			<-ctx.Done()
+			g.queryLog.Close()
+		}()
+	}
+
+	g.healthHistory, err = dns.NewHealthHistory(path.Join(g.dataDir, "dns_health.json"), 100)
+	if err != nil {
+		fmt.Println("DNS: failed to load health history:", err)
+	}
+
+	resolver, err := g.CreateResolver(g.config.Dns.Resolver)
+	if err != nil {
+		fmt.Println("DNS: failed to start resolver:", err)
+	} else {
+		g.SetResolver(resolver)
+	}
+
 	return nil
 }
 
+func (g *Gateway) SetRateLimit(config ConfigRateLimit) error {
+	return g.dnsServer.SetRateLimit(dns.RateLimitConfig{
+		Disabled:           config.Disabled,
+		ResponsesPerSecond: config.ResponsesPerSecond,
+		ErrorsPerSecond:    config.ErrorsPerSecond,
+		Window:             config.Window,
+		Slip:               config.Slip,
+		IPv4PrefixLength:   config.IPv4PrefixLength,
+		IPv6PrefixLength:   config.IPv6PrefixLength,
+		ExemptNetworks:     config.ExemptNetworks,
+		AnyQueries:         config.AnyQueries,
+	})
+}
+
+func (g *Gateway) CreateResolver(config ConfigResolver) (resolver dns.Resolver, err error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	blocklists := make([]string, 0, len(config.Blocklists))
+	for _, blocklist := range config.Blocklists {
+		if !path.IsAbs(blocklist) {
+			blocklist = path.Join(g.dataDir, blocklist)
+		}
+		blocklists = append(blocklists, blocklist)
+	}
+	return dns.NewResolver(dns.ResolverConfig{
+		Upstreams:       config.Upstreams,
+		Blocklists:      blocklists,
+		CacheSize:       config.CacheSize,
+		AllowedNetworks: config.AllowedNetworks,
+		AllowEncrypted:  config.AllowEncrypted,
+	})
+}
+
+func (g *Gateway) Resolver() dns.Resolver {
+	g.resolverMu.Lock()
+	defer g.resolverMu.Unlock()
+	return g.resolver
+}
+
+func (g *Gateway) SetResolver(resolver dns.Resolver) {
+	g.resolverMu.Lock()
+	defer g.resolverMu.Unlock()
+	g.resolver = resolver
+	g.dnsServer.SetResolver(resolver)
+}
+
+// StartDDNS pushes the external IP addresses to the configured DDNS
+// providers whenever they change
+func (g *Gateway) StartDDNS(ctx context.Context) {
+	updater, err := g.CreateDdnsUpdater(g.config.Dns.Ddns)
+	if err != nil {
+		fmt.Println("DDNS: failed to start updater:", err)
+	} else {
+		g.SetDdnsUpdater(updater)
+	}
+
+	g.OnExternalIPChange(func(oldIP, newIP net.IP) {
+		if updater := g.ddnsUpdater; updater != nil {
+			updater.Update(externalIPAddress(g.externalIPv4), externalIPAddress(g.externalIPv6))
+		}
+	})
+
+	go func() {
+		<-ctx.Done()
+		if g.ddnsUpdater != nil {
+			g.ddnsUpdater.Close()
+		}
+	}()
+}
+
+func (g *Gateway) CreateDdnsUpdater(config ConfigDdns) (updater ddns.Updater, err error) {
+	if len(config.Providers) == 0 {
+		return nil, nil
+	}
+	providers := make([]ddns.Provider, 0, len(config.Providers))
+	for _, providerConfig := range config.Providers {
+		provider, err := ddns.NewProvider(ddns.ProviderConfig{
+			Type:          providerConfig.Type,
+			Hostname:      providerConfig.Hostname,
+			Server:        providerConfig.Server,
+			Username:      providerConfig.Username,
+			Password:      providerConfig.Password,
+			Zone:          providerConfig.Zone,
+			TTL:           providerConfig.TTL,
+			TsigName:      providerConfig.TsigName,
+			TsigAlgorithm: providerConfig.TsigAlgorithm,
+			TsigSecret:    providerConfig.TsigSecret,
+			DisableIPv4:   providerConfig.DisableIPv4,
+			DisableIPv6:   providerConfig.DisableIPv6,
+		})
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	retryInterval, _ := time.ParseDuration(config.RetryInterval)
+	updater = ddns.NewUpdater(retryInterval)
+	for i, provider := range providers {
+		name := config.Providers[i].Name
+		if name == "" {
+			name = provider.Hostname()
+		}
+		updater.AddProvider(name, provider)
+	}
+	return updater, nil
+}
+
+func (g *Gateway) DdnsUpdater() ddns.Updater {
+	return g.ddnsUpdater
+}
+
+// SetDdnsUpdater replaces the DDNS updater and pushes the current
+// addresses to all providers
+func (g *Gateway) SetDdnsUpdater(updater ddns.Updater) {
+	if g.ddnsUpdater != nil {
+		g.ddnsUpdater.Close()
+	}
+	g.ddnsUpdater = updater
+	if updater != nil {
+		updater.Update(externalIPAddress(g.externalIPv4), externalIPAddress(g.externalIPv6))
+	}
+}
+
+// startEncryptedDNS serves DNS-over-TLS and DNS-over-HTTPS using the
+// certificates of the gateway
+func (g *Gateway) startEncryptedDNS() {
+	config := g.config.Dns.Encrypted
+
+	if config.DoT {
+		err := g.httpsServer.ListenTLS("tcp", fmt.Sprintf(":%d", config.GetDoTPort()), []string{"dot"},
+			network.ServeCtxFunc(g.dnsServer.ServeDoT))
+		if err != nil {
+			fmt.Println("DNS: failed to start DNS-over-TLS:", err)
+		} else {
+			fmt.Printf("DNS-over-TLS started on port %d\n", config.GetDoTPort())
+		}
+	}
+
+	if config.DoHHostname != "" {
+		for _, domain := range g.config.Domains {
+			for _, route := range domain.Routes {
+				if route.GetHostname() == config.DoHHostname {
+					fmt.Printf("DNS: DNS-over-HTTPS disabled, %s is already used by a route\n", config.DoHHostname)
+					return
+				}
+			}
+		}
+		dohPath := config.GetDoHPath()
+		g.httpsServer.AddHandler(config.DoHHostname, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != dohPath {
+				http.NotFound(w, r)
+				return
+			}
+			g.dnsServer.ServeDoH(w, r)
+		}))
+		fmt.Printf("DNS-over-HTTPS started on https://%s%s\n", config.DoHHostname, dohPath)
+	}
+}
+
 func (g *Gateway) StartAcmeClient(ctx context.Context) (err error) {
-	g.acmeClient, err = acme.NewClient(path.Join(g.dataDir, "acme"), g.dnsServer)
+	_, err = g.getAcmeClient(g.config.Acme.GetDefault())
+	return err
+}
+
+// getAcmeClient returns the client of a CA. Each CA uses its own account.
+// The account of Let's Encrypt is stored directly in the acme dir (as it
+// has been the only CA in the past).
+func (g *Gateway) getAcmeClient(name string) (acme.Client, error) {
+	g.acmeClientsMu.Lock()
+	defer g.acmeClientsMu.Unlock()
+
+	if client, ok := g.acmeClients[name]; ok {
+		return client, nil
+	}
+
+	caConfig := g.config.Acme.GetCA(name)
+	if caConfig.RootCAFile != "" && !path.IsAbs(caConfig.RootCAFile) {
+		caConfig.RootCAFile = path.Join(g.dataDir, caConfig.RootCAFile)
+	}
+	dataDir := path.Join(g.dataDir, "acme")
+	if name != acme.CALetsEncrypt {
+		dataDir = path.Join(dataDir, "accounts", name)
+	}
+
+	client, err := acme.NewClient(dataDir, caConfig, g.dnsServer)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	client.SetHTTPChallengeHandler(g.httpServer)
+	client.SetTLSALPNChallengeHandler(g.httpsServer)
+
+	if g.acmeClients == nil {
+		g.acmeClients = make(map[string]acme.Client)
+	}
+	g.acmeClients[name] = client
+	return client, nil
+}
+
+// getAcmeIssuer returns the client which issues the certificate of the
+// domain (using the fallback CA if the CA of the domain keeps failing)
+func (g *Gateway) getAcmeIssuer(domain *ConfigDomain) (acme.Client, error) {
+	name := domain.CA
+	if name == "" {
+		name = g.config.Acme.GetDefault()
+	}
+	issuer, err := g.getAcmeClient(name)
+	if err != nil {
+		return nil, err
+	}
+	if fallbackName := g.config.Acme.Fallback; fallbackName != "" && fallbackName != name {
+		fallback, err := g.getAcmeClient(fallbackName)
+		if err != nil {
+			return nil, err
+		}
+		issuer = acme.NewFallbackClient(issuer, fallback, g.config.Acme.MaxFailures)
+	}
+	return issuer.WithChallengeType(domain.GetChallenge())
+}
+
+// SetAcmeConfig replaces the CA configuration. The certificates of all
+// domains are restarted, so that the next renewal uses the new settings.
+func (g *Gateway) SetAcmeConfig(config ConfigAcme) error {
+	previous := g.config.Acme
+	g.config.Acme = config
+	g.acmeClientsMu.Lock()
+	g.acmeClients = nil
+	g.acmeClientsMu.Unlock()
+
+	for _, name := range []string{config.GetDefault(), config.Fallback} {
+		if name == "" {
+			continue
+		}
+		if _, err := g.getAcmeClient(name); err != nil {
+			g.config.Acme = previous
+			g.acmeClientsMu.Lock()
+			g.acmeClients = nil
+			g.acmeClientsMu.Unlock()
+			return err
+		}
+	}
+	for _, domain := range g.config.Domains {
+		g.restartDomainCertificate(domain)
+	}
+	return g.config.save()
 }
 
 func (g *Gateway) StartHttpServer(ctx context.Context, port int) (err error) {
@@ -587,8 +1149,102 @@ func (g *Gateway) startDomain(domain *ConfigDomain) {
 	}
 
 	g.dnsServer.AddDomains(domain.Name)
-	domain.serverCertificate = pki.NewServerCertificate(path.Join(g.acmeClient.DataDir(), domain.Name), g.acmeClient, "*."+domain.Name)
+	g.updateDomainCertificate(domain)
+}
+
+// updateDomainCertificate creates the server certificate of the domain or
+// updates its names (if the routes of a domain without wildcard
+// certificate have changed)
+func (g *Gateway) updateDomainCertificate(domain *ConfigDomain) {
+	if domain.Redirect != nil && domain.Redirect.Target != "" {
+		return
+	}
+	dnsNames := domain.GetCertificateNames()
+	if len(dnsNames) == 0 {
+		return
+	}
+	if domain.serverCertificate != nil {
+		domain.serverCertificate.SetDNSNames(dnsNames...)
+		domain.serverCertificate.SetRenewalThreshold(domain.RenewalThreshold)
+		if err := domain.serverCertificate.SetKeyConfig(domain.GetKeyConfig()); err != nil {
+			fmt.Printf("ACME: invalid key config of %s: %v\n", domain.Name, err)
+		}
+		return
+	}
+	issuer, err := g.getCertificateIssuer(domain)
+	if err != nil {
+		fmt.Printf("ACME: no certificate for %s: %v\n", domain.Name, err)
+		return
+	}
+	domain.serverCertificate = pki.NewServerCertificateWithKeyConfig(path.Join(g.dataDir, "acme", domain.Name), issuer, domain.GetKeyConfig(), dnsNames...)
+	domain.serverCertificate.SetRenewalThreshold(domain.RenewalThreshold)
 	domain.serverCertificate.SetTLSServer(g.httpsServer)
+	domain.serverCertificate.SetIssuedHandler(func(key crypto.PrivateKey, chain crypto.CertificateChain) {
+		g.exportDomainCertificate(domain, key, chain, false)
+	})
+}
+
+// getDomainCertificate returns the certificate of a domain
+func (g *Gateway) getDomainCertificate(domainGuid string) (pki.ServerCertificate, error) {
+	domain := g.config.GetDomain(domainGuid)
+	if domain == nil {
+		return nil, fmt.Errorf("domain with guid %q not found", domainGuid)
+	}
+	if domain.serverCertificate == nil {
+		return nil, fmt.Errorf("domain %s has no certificate", domain.Name)
+	}
+	return domain.serverCertificate, nil
+}
+
+// SetDomainRenewalThreshold sets the percentage of the lifetime after
+// which the certificate of the domain is renewed (0 selects the default)
+func (g *Gateway) SetDomainRenewalThreshold(domainGuid string, percent int) (ConfigDomain, error) {
+	domain := g.config.GetDomain(domainGuid)
+	if domain == nil {
+		return ConfigDomain{}, fmt.Errorf("domain with guid %q not found", domainGuid)
+	}
+	if percent < 0 || percent >= 100 {
+		return ConfigDomain{}, fmt.Errorf("the renewal threshold must be between 1 and 99 percent")
+	}
+	domain.RenewalThreshold = percent
+	if domain.serverCertificate != nil {
+		domain.serverCertificate.SetRenewalThreshold(percent)
+	}
+	g.config.save()
+	return *domain, nil
+}
+
+// SetDomainKeyConfig selects the key algorithm, dual certificates and the
+// key policy of a domain. A new certificate is requested if the algorithm
+// has been changed.
+func (g *Gateway) SetDomainKeyConfig(domainGuid string, keyConfig pki.KeyConfig) (ConfigDomain, error) {
+	domain := g.config.GetDomain(domainGuid)
+	if domain == nil {
+		return ConfigDomain{}, fmt.Errorf("domain with guid %q not found", domainGuid)
+	}
+	if err := keyConfig.Check(); err != nil {
+		return ConfigDomain{}, err
+	}
+	domain.KeyAlgorithm = keyConfig.Algorithm
+	domain.DualCertificates = keyConfig.Dual
+	domain.KeyPolicy = keyConfig.Policy
+	if domain.serverCertificate != nil {
+		if err := domain.serverCertificate.SetKeyConfig(keyConfig); err != nil {
+			return ConfigDomain{}, err
+		}
+	}
+	g.config.save()
+	return *domain, nil
+}
+
+// restartDomainCertificate is required if the issuer of the domain has
+// been changed
+func (g *Gateway) restartDomainCertificate(domain *ConfigDomain) {
+	if domain.serverCertificate != nil {
+		domain.serverCertificate.Close()
+		domain.serverCertificate = nil
+	}
+	g.updateDomainCertificate(domain)
 }
 
 func (g *Gateway) startRedirectDomain(domain *ConfigDomain) {
@@ -598,7 +1254,24 @@ func (g *Gateway) startRedirectDomain(domain *ConfigDomain) {
 		Target:   domain.Redirect.GetHTTPSTarget(),
 		domain:   domain,
 	})
-	g.dnsServer.AddProxyDomain(domain.Name, domain.Redirect.GetDNSTarget())
+	// invalid durations (of the config file) fall back to the defaults
+	timeout, err := domain.Redirect.GetDnsTimeout()
+	if err != nil {
+		fmt.Printf("DNS: %s: %v\n", domain.Name, err)
+	}
+	staleTTL, err := domain.Redirect.GetDnsStaleTTL()
+	if err != nil {
+		fmt.Printf("DNS: %s: %v\n", domain.Name, err)
+	}
+	err = g.dnsServer.AddProxyDomain(domain.Name, dns.ProxyConfig{
+		Targets:  domain.Redirect.GetDNSTargets(),
+		Timeout:  timeout,
+		Retries:  domain.Redirect.DnsRetries,
+		StaleTTL: staleTTL,
+	})
+	if err != nil {
+		fmt.Printf("DNS: failed to add proxy domain %s: %v\n", domain.Name, err)
+	}
 }
 
 func (g *Gateway) stopDomain(domain *ConfigDomain) {
@@ -608,7 +1281,10 @@ func (g *Gateway) stopDomain(domain *ConfigDomain) {
 	}
 
 	g.dnsServer.DelDomains(domain.Name)
-	domain.serverCertificate.Close()
+	if domain.serverCertificate != nil {
+		domain.serverCertificate.Close()
+		domain.serverCertificate = nil
+	}
 }
 
 func (g *Gateway) stopRedirectDomain(domain *ConfigDomain) {
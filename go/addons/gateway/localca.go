@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/pki"
+)
+
+// LocalCAName selects the local CA as CA of a domain
+const LocalCAName = "local"
+
+// ConfigLocalCA configures the private CA for LAN-only domains. The root
+// certificate is restricted to the listed domains.
+type ConfigLocalCA struct {
+	// Name is used in the subject of the CA certificates
+	Name    string   `yaml:"name,omitempty" json:"name,omitempty"`
+	Domains []string `yaml:"domains,omitempty" json:"domains,omitempty"`
+}
+
+func (configLocalCA *ConfigLocalCA) GetName() string {
+	if configLocalCA.Name == "" {
+		return "Home Assistant Gateway"
+	}
+	return configLocalCA.Name
+}
+
+// getLocalCA creates the local CA on first use
+func (g *Gateway) getLocalCA() (pki.LocalCA, error) {
+	g.localCAMu.Lock()
+	defer g.localCAMu.Unlock()
+	if g.localCA != nil {
+		return g.localCA, nil
+	}
+	config := g.config.LocalCA
+	localCA, err := pki.NewLocalCA(path.Join(g.dataDir, "localca"), config.GetName(), config.Domains)
+	if err != nil {
+		return nil, err
+	}
+	g.localCA = localCA
+	return localCA, nil
+}
+
+// checkCA returns an error if the CA can't issue certificates for the
+// domain
+func (g *Gateway) checkCA(name string, domainName string) error {
+	if name != LocalCAName {
+		_, err := g.getAcmeClient(name)
+		return err
+	}
+	localCA, err := g.getLocalCA()
+	if err != nil {
+		return err
+	}
+	if !localCA.Permits(domainName) {
+		return fmt.Errorf("the local CA is not permitted to issue certificates for %s", domainName)
+	}
+	return nil
+}
+
+// getCertificateIssuer returns the CA of the domain
+func (g *Gateway) getCertificateIssuer(domain *ConfigDomain) (pki.CA, error) {
+	if domain.CA == LocalCAName {
+		return g.getLocalCA()
+	}
+	return g.getAcmeIssuer(domain)
+}
+
+// SetLocalCAConfig changes the local CA. If the domains have been changed,
+// a new root is created and all certificates of the local CA are renewed.
+func (g *Gateway) SetLocalCAConfig(config ConfigLocalCA) error {
+	if len(config.Domains) == 0 {
+		for _, domain := range g.config.Domains {
+			if domain.CA == LocalCAName {
+				return fmt.Errorf("the local CA is used by %s", domain.Name)
+			}
+		}
+		g.localCAMu.Lock()
+		g.localCA = nil
+		g.config.LocalCA = config
+		g.localCAMu.Unlock()
+		return g.config.save()
+	}
+	localCA, err := pki.NewLocalCA(path.Join(g.dataDir, "localca"), config.GetName(), config.Domains)
+	if err != nil {
+		return err
+	}
+	g.localCAMu.Lock()
+	g.localCA = localCA
+	g.config.LocalCA = config
+	g.localCAMu.Unlock()
+
+	for _, domain := range g.config.Domains {
+		if domain.CA != LocalCAName {
+			continue
+		}
+		g.restartDomainCertificate(domain)
+		if domain.serverCertificate != nil {
+			domain.serverCertificate.Renew()
+		}
+	}
+	return g.config.save()
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExternalUser is a user of an external user backend
+type ExternalUser struct {
+	// ID identifies the user in the backend, it must not change if the
+	// user is renamed
+	ID   string
+	Name string
+	// Groups are the gateway groups of the user
+	Groups []string
+}
+
+// UserBackend checks the passwords of users, which are managed outside of
+// users.yml (like the users of Home Assistant)
+type UserBackend interface {
+	// Name is stored as source of the users of the backend
+	Name() string
+	// Authenticate checks the credentials and returns the user
+	Authenticate(username string, password string) (*ExternalUser, error)
+	// Users returns the active users of the backend
+	Users() ([]*ExternalUser, error)
+	// Groups returns the gateway groups, which are managed by the backend.
+	// Other groups of the users are kept.
+	Groups() []string
+}
+
+// userSyncer is implemented by the users of a backend
+type userSyncer interface {
+	// SyncUsers updates the users of the backend. The users, which have
+	// been removed or deactivated in the backend, are deleted and their
+	// guids are returned.
+	SyncUsers() (removed []string, err error)
+}
+
+// backendSyncInterval is the interval in which the users are synchronized
+// with the backend
+const backendSyncInterval = 5 * time.Minute
+
+// backendUsers checks the passwords with a user backend. The users of the
+// backend are added to users.yml at their first login, so that the second
+// factors, sessions and access tokens work like for the local users. Local
+// users with a password (like service accounts) are still checked locally.
+// The users are synchronized with the backend periodically (see SyncUsers).
+type backendUsers struct {
+	*users
+	backend UserBackend
+}
+
+// NewBackendUsers creates the users, whose passwords are checked by the
+// backend
+func NewBackendUsers(dataDir string, backend UserBackend) (Users, error) {
+	u, err := newUsers(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &backendUsers{users: u, backend: backend}, nil
+}
+
+func (u *backendUsers) CheckPassword(username, password string) bool {
+	u.mutex.Lock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	local := user != nil && user.Source == "" && user.Password != ""
+	u.mutex.Unlock()
+	if local {
+		return u.users.CheckPassword(username, password)
+	}
+	// the mutex isn't held while waiting for the backend
+	external, err := u.backend.Authenticate(username, password)
+	if err != nil {
+		return false
+	}
+	u.mutex.Lock()
+	err = u.syncUser(external)
+	u.mutex.Unlock()
+	if err != nil {
+		fmt.Printf("failed to add the user %s of %s: %v\n", external.Name, u.backend.Name(), err)
+		return false
+	}
+	return true
+}
+
+// SyncUsers updates the names and groups of the users of the backend and
+// deletes the users, which are unknown or deactivated in the backend
+func (u *backendUsers) SyncUsers() (removed []string, err error) {
+	// the mutex isn't held while waiting for the backend
+	externalUsers, err := u.backend.Users()
+	if err != nil {
+		return nil, err
+	}
+	externalUsersByID := make(map[string]*ExternalUser, len(externalUsers))
+	for _, external := range externalUsers {
+		externalUsersByID[external.ID] = external
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	source := u.backend.Name()
+	for _, user := range slices.Clone(u.config.Users) {
+		if user.Source != source {
+			continue
+		}
+		if external := externalUsersByID[user.ExternalID]; external != nil {
+			if err = u.syncUser(external); err != nil {
+				fmt.Printf("failed to update the user %s of %s: %v\n", external.Name, source, err)
+			}
+			continue
+		}
+		u.deleteUser(user)
+		removed = append(removed, user.Guid)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, u.Write()
+}
+
+// syncUser adds or updates the user of the backend. Existing local users
+// are never taken over by the backend. The caller holds the mutex.
+func (u *backendUsers) syncUser(external *ExternalUser) error {
+	source := u.backend.Name()
+	var user *User
+	for _, candidate := range u.config.Users {
+		if candidate.Source == source && candidate.ExternalID == external.ID {
+			user = candidate
+			break
+		}
+	}
+	if user == nil {
+		if u.usersByNameOrMail[strings.ToLower(external.Name)] != nil {
+			return fmt.Errorf("the name %s is used by another user", external.Name)
+		}
+		user = &User{Guid: uuid.NewString()}
+		u.config.Users = append(u.config.Users, user)
+		u.usersByGuid[user.Guid] = user
+	}
+
+	// only the groups which exist in the gateway
+	groups := slices.DeleteFunc(slices.Clone(external.Groups), func(group string) bool {
+		return u.groupsByName[group] == nil
+	})
+	if len(groups) == 0 && u.groupsByName["user"] != nil {
+		groups = []string{"user"}
+	}
+	// the groups, which aren't managed by the backend, are kept
+	managed := u.backend.Groups()
+	groups = append(slices.DeleteFunc(slices.Clone(user.Groups), func(group string) bool {
+		return slices.Contains(managed, group) || slices.Contains(groups, group)
+	}), groups...)
+
+	if user.Name != external.Name {
+		// the user has been renamed in the backend
+		if other := u.usersByNameOrMail[strings.ToLower(external.Name)]; other != nil && other != user {
+			return fmt.Errorf("the name %s is used by another user", external.Name)
+		}
+		delete(u.usersByNameOrMail, strings.ToLower(user.Name))
+		user.Name = external.Name
+		u.usersByNameOrMail[strings.ToLower(user.Name)] = user
+	} else if user.Source == source && slices.Equal(user.Groups, groups) {
+		return nil
+	}
+	user.Source = source
+	user.ExternalID = external.ID
+	user.Groups = groups
+	return u.Write()
+}
+
+// syncBackendUsers synchronizes the users with the backend and ends the
+// sessions (including their refresh tokens) of the removed users. Their
+// access tokens have been deleted with the users.
+func (a *AuthServer) syncBackendUsers(syncer userSyncer) {
+	for {
+		removed, err := syncer.SyncUsers()
+		if err != nil {
+			fmt.Println("failed to synchronize the users:", err)
+		}
+		for _, guid := range removed {
+			if err = a.sessions.RevokeUser(guid); err != nil {
+				fmt.Println("failed to revoke the sessions:", err)
+			}
+		}
+		time.Sleep(backendSyncInterval)
+	}
+}
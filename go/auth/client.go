@@ -4,10 +4,13 @@ import (
 	"crypto"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/dueckminor/home-assistant-addons/go/utils/ginutil"
 	"github.com/gin-contrib/sessions"
@@ -15,19 +18,61 @@ import (
 	"github.com/golang-jwt/jwt"
 )
 
+const (
+	DefaultUserHeader   = "X-Forwarded-User"
+	DefaultGroupsHeader = "X-Forwarded-Groups"
+)
+
 type AuthClient struct {
 	AuthURI      string
 	ClientID     string
 	ClientSecret string
 	ServerKey    crypto.PublicKey
 	Secret       string
+
+	// AllowedUsers and AllowedGroups restrict the access to the listed users
+	// and the members of the listed groups. If both are empty, every user
+	// is allowed.
+	AllowedUsers  []string
+	AllowedGroups []string
+	// UserHeader and GroupsHeader are the names of the request headers,
+	// which pass the user and the comma separated groups to the backend
+	UserHeader   string
+	GroupsHeader string
+
+	// AccessTokens enables the personal access tokens (as bearer token or
+	// as password of the basic authentication), which are checked by Tokens
+	AccessTokens bool
+	Tokens       AccessTokenVerifier
+}
+
+// AccessTokenVerifier checks the personal access tokens of the users
+type AccessTokenVerifier interface {
+	// VerifyAccessToken returns the user of a token, if the token may be
+	// used for the route and the method
+	VerifyAccessToken(token string, hostname string, method string) (*User, error)
 }
 
 func (ac *AuthClient) RegisterHandler(e *gin.Engine) {
 	e.GET("/login/callback", ac.handleLoginCallback)
+	e.GET("/login/switch", ac.handleLoginSwitch)
 	e.Use(ac.handleAuth)
 }
 
+func (ac *AuthClient) userHeader() string {
+	if ac.UserHeader != "" {
+		return ac.UserHeader
+	}
+	return DefaultUserHeader
+}
+
+func (ac *AuthClient) groupsHeader() string {
+	if ac.GroupsHeader != "" {
+		return ac.GroupsHeader
+	}
+	return DefaultGroupsHeader
+}
+
 func (ac *AuthClient) verifySession(c *gin.Context) bool {
 	hostname := ginutil.GetHostname(c)
 
@@ -39,15 +84,185 @@ func (ac *AuthClient) verifySession(c *gin.Context) bool {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return false
 		}
+		if accessToken == "anonymous" {
+			return true
+		}
+		// sessions created before the refresh tokens have to log in again
+		refreshToken, _ := session.Get("refresh_token").(string)
+		if refreshToken == "" {
+			return false
+		}
+		if expires, _ := session.Get("expires").(int64); time.Now().Unix() < expires {
+			return true
+		}
+		// the refresh fails, if the session at the auth server has been
+		// revoked or the user has been deleted
+		if err := ac.refreshTokens(c, refreshToken); err != nil {
+			session.Clear()
+			_ = session.Save()
+			return false
+		}
 		return true
 	}
 	return false
 }
 
+// isAllowed checks if the user may access the route
+func (ac *AuthClient) isAllowed(username string, groups []string) bool {
+	return accessAllowed(ac.AllowedUsers, ac.AllowedGroups, username, groups)
+}
+
+// accessAllowed checks if the user is one of the allowed users or a member of
+// one of the allowed groups. If both are empty, every user is allowed.
+func accessAllowed(allowedUsers []string, allowedGroups []string, username string, groups []string) bool {
+	if len(allowedUsers) == 0 && len(allowedGroups) == 0 {
+		return true
+	}
+	for _, allowedUser := range allowedUsers {
+		if strings.EqualFold(allowedUser, username) {
+			return true
+		}
+	}
+	for _, group := range groups {
+		if slices.Contains(allowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks if the user of the session may access the route and
+// passes the user and the groups to the backend
+func (ac *AuthClient) authorize(c *gin.Context) {
+	session := sessions.Default(c)
+	if session.Get("access_token") == "anonymous" {
+		// the secret of the route grants access without a user
+		return
+	}
+
+	username, _ := session.Get("username").(string)
+	groups, _ := session.Get("groups").([]string)
+
+	if !ac.isAllowed(username, groups) {
+		// the session is kept, otherwise every request would start a new
+		// login (see handleLoginSwitch)
+		renderForbidden(c, username, ginutil.GetHostname(c), "/login/switch")
+		return
+	}
+	ac.setUserHeaders(c, username, groups)
+}
+
+func (ac *AuthClient) setUserHeaders(c *gin.Context, username string, groups []string) {
+	c.Request.Header.Set(ac.userHeader(), username)
+	if len(groups) > 0 {
+		c.Request.Header.Set(ac.groupsHeader(), strings.Join(groups, ","))
+	}
+}
+
+// accessToken returns the personal access token sent as bearer token or as
+// password of the basic authentication. Other credentials are left for the
+// backend.
+func accessToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok && IsAccessToken(password) {
+		return password
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && IsAccessToken(token) {
+		return token
+	}
+	return ""
+}
+
+// handleAccessToken authenticates the request with a personal access
+// token. It returns false if the request doesn't contain a token.
+func (ac *AuthClient) handleAccessToken(c *gin.Context) bool {
+	token := accessToken(c.Request)
+	if token == "" {
+		return false
+	}
+	hostname := ginutil.GetHostname(c)
+	user, err := ac.Tokens.VerifyAccessToken(token, hostname, c.Request.Method)
+	if err != nil {
+		ac.requestBasicAuth(c)
+		return true
+	}
+	if !ac.isAllowed(user.Name, user.Groups) {
+		renderForbidden(c, user.Name, hostname, "/login/switch")
+		return true
+	}
+	// the token is only valid for the gateway
+	c.Request.Header.Del("Authorization")
+	ac.setUserHeaders(c, user.Name, user.Groups)
+	return true
+}
+
+// requestBasicAuth asks clients, which can't follow the login redirect,
+// for a personal access token
+func (ac *AuthClient) requestBasicAuth(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="`+ginutil.GetHostname(c)+`", charset="UTF-8"`)
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+var forbiddenPage = template.Must(template.New("forbidden").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Access denied</title>
+<style>
+body { font-family: sans-serif; background: #f5f5f5; color: #333; display: flex; align-items: center; justify-content: center; min-height: 100vh; margin: 0; }
+main { background: #fff; border-radius: 8px; box-shadow: 0 2px 8px rgba(0,0,0,.15); padding: 2em; max-width: 30em; text-align: center; }
+h1 { color: #c62828; font-size: 1.5em; }
+a { color: #1976d2; }
+</style>
+</head>
+<body>
+<main>
+<h1>Access denied</h1>
+<p>The user <b>{{.Username}}</b> is not allowed to access <b>{{.Hostname}}</b>.</p>
+<p>Ask your administrator for access or <a href="{{.SwitchURI}}">sign in as a different user</a>.</p>
+</main>
+</body>
+</html>
+`))
+
+// renderForbidden shows the access denied page, switchURI is the link to
+// sign in as a different user
+func renderForbidden(c *gin.Context, username string, hostname string, switchURI string) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusForbidden)
+	_ = forbiddenPage.Execute(c.Writer, map[string]string{
+		"Username":  username,
+		"Hostname":  hostname,
+		"SwitchURI": switchURI,
+	})
+	c.Abort()
+}
+
+// handleLoginSwitch forgets the user of the route and continues at the auth
+// server, where the user can sign in as a different user. The next request
+// to the route starts a new login.
+func (ac *AuthClient) handleLoginSwitch(c *gin.Context) {
+	session := sessions.Default(c)
+	session.Clear()
+	_ = session.Save()
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, ac.AuthURI)
+}
+
 func (ac *AuthClient) handleAuth(c *gin.Context) {
 	if c.IsAborted() {
 		return
 	}
+
+	// the backend must only trust the headers set by the gateway
+	c.Request.Header.Del(ac.userHeader())
+	c.Request.Header.Del(ac.groupsHeader())
+
+	if ac.AccessTokens && ac.Tokens != nil && ac.handleAccessToken(c) {
+		return
+	}
+
 	sessionVerified := ac.verifySession(c)
 
 	if c.Request.URL.Path == "/flv" && c.Request.Method == "GET" {
@@ -59,6 +274,15 @@ func (ac *AuthClient) handleAuth(c *gin.Context) {
 	}
 
 	if sessionVerified {
+		if !c.IsAborted() {
+			ac.authorize(c)
+		}
+		return
+	}
+
+	if ac.AccessTokens && !strings.Contains(c.GetHeader("Accept"), "text/html") {
+		// not a browser, e.g. a CalDAV client or a script
+		ac.requestBasicAuth(c)
 		return
 	}
 
@@ -146,7 +370,6 @@ func (ac *AuthClient) handleSecret(c *gin.Context, sessionVerified bool) bool {
 
 func (ac *AuthClient) handleLoginCallback(c *gin.Context) {
 	fmt.Println("login callback 2")
-	session := sessions.Default(c)
 	err := c.Request.ParseForm()
 	if err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
@@ -166,19 +389,46 @@ func (ac *AuthClient) handleLoginCallback(c *gin.Context) {
 	v := url.Values{}
 	v.Set("grant_type", "authorization_code")
 	v.Set("code", code)
-	v.Set("response_type", "token")
 	v.Set("redirect_uri", authRequest.RedirectURI)
 	v.Set("client_id", ac.ClientID)
 
-	//pass the values to the request's body
+	response, claims, err := ac.requestTokens(v)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err = ac.storeTokens(c, response, claims); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", path)
+	c.AbortWithStatus(http.StatusFound)
+}
+
+// refreshTokens replaces the expired access token of the session
+func (ac *AuthClient) refreshTokens(c *gin.Context, refreshToken string) error {
+	v := url.Values{}
+	v.Set("grant_type", "refresh_token")
+	v.Set("refresh_token", refreshToken)
+	v.Set("client_id", ac.ClientID)
+
+	response, claims, err := ac.requestTokens(v)
+	if err != nil {
+		return err
+	}
+	return ac.storeTokens(c, response, claims)
+}
 
+// requestTokens calls the token endpoint of the auth server and verifies
+// the returned access token
+func (ac *AuthClient) requestTokens(v url.Values) (*OauthTokenResponse, *ClaimsWithScope, error) {
 	authURIOauthToken, _ := url.Parse(ac.AuthURI)
 	authURIOauthToken.Path = "oauth/token"
 
 	req, err := http.NewRequest("POST", authURIOauthToken.String(), strings.NewReader(v.Encode()))
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
 	req.SetBasicAuth(ac.ClientID, ac.ClientSecret)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -186,49 +436,46 @@ func (ac *AuthClient) handleLoginCallback(c *gin.Context) {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 
 	bodyText, err := io.ReadAll(resp.Body)
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+		return nil, nil, err
 	}
-
-	var data map[string]any
-	err = json.Unmarshal(bodyText, &data)
-	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("token request failed: %s: %s", resp.Status, bodyText)
 	}
 
-	jwtToken, ok := data["access_token"].(string)
-	if !ok {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+	response := &OauthTokenResponse{}
+	err = json.Unmarshal(bodyText, response)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (any, error) {
+	claims := &ClaimsWithScope{}
+	_, err = jwt.ParseWithClaims(response.AccessToken, claims, func(token *jwt.Token) (any, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
 			return ac.ServerKey, nil
 		}
 		return nil, fmt.Errorf("Unexpected Signing Method")
 	})
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
-	fmt.Println(token)
+	return response, claims, nil
+}
 
-	session.Set("access_token", data["access_token"])
+// storeTokens stores the tokens and the user in the session of the route.
+// The groups are updated with every refresh.
+func (ac *AuthClient) storeTokens(c *gin.Context, response *OauthTokenResponse, claims *ClaimsWithScope) error {
+	session := sessions.Default(c)
+	session.Set("access_token", response.AccessToken)
+	session.Set("refresh_token", response.RefreshToken)
+	session.Set("expires", claims.ExpiresAt)
 	session.Set("hostname", ginutil.GetHostname(c))
-	err = session.Save()
-	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-
-	c.Header("Location", path)
-	c.AbortWithStatus(http.StatusFound)
+	session.Set("username", claims.Username)
+	session.Set("groups", claims.Groups)
+	return session.Save()
 }
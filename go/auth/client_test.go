@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func TestIsAllowed(t *testing.T) {
+	ac := &AuthClient{}
+	if !ac.isAllowed("alice", nil) {
+		t.Error("a route without restrictions must allow every user")
+	}
+
+	ac.AllowedUsers = []string{"Bob"}
+	ac.AllowedGroups = []string{"admins"}
+
+	tests := []struct {
+		username string
+		groups   []string
+		want     bool
+	}{
+		{"bob", nil, true},
+		{"alice", []string{"user", "admins"}, true},
+		{"alice", []string{"user"}, false},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		if got := ac.isAllowed(test.username, test.groups); got != test.want {
+			t.Errorf("isAllowed(%q, %v) = %v, want %v", test.username, test.groups, got, test.want)
+		}
+	}
+}
+
+func TestForbiddenKeepsSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ac := &AuthClient{AuthURI: "https://auth.example.com", AllowedGroups: []string{"admins"}}
+	r := gin.New()
+	r.Use(sessions.Sessions("session", cookie.NewStore(make([]byte, 32))))
+	r.GET("/test/login", func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Set("access_token", "token")
+		session.Set("refresh_token", "refresh")
+		session.Set("hostname", "app.example.com")
+		session.Set("expires", time.Now().Add(time.Hour).Unix())
+		session.Set("username", "alice")
+		session.Set("groups", []string{"user"})
+		_ = session.Save()
+	})
+	ac.RegisterHandler(r)
+	r.GET("/", func(c *gin.Context) {})
+
+	request := func(path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "https://app.example.com"+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	cookies := request("/test/login", nil).Result().Cookies()
+
+	w := request("/", cookies)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("the session has been changed by the access denied page")
+	}
+	if w = request("/", cookies); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d for the next request, want 403 instead of a new login", w.Code)
+	}
+
+	w = request("/login/switch", cookies)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != ac.AuthURI {
+		t.Errorf("switch = %d %s, want a redirect to the auth server", w.Code, w.Header().Get("Location"))
+	}
+	if w = request("/", w.Result().Cookies()); w.Code != http.StatusFound {
+		t.Errorf("status = %d after the switch, want a new login", w.Code)
+	}
+}
@@ -2,8 +2,15 @@ package auth
 
 import (
 	"encoding/base64"
+	"fmt"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
 	"github.com/dueckminor/home-assistant-addons/go/utils/crypto/rand"
@@ -18,6 +25,75 @@ type AuthServerConfig struct {
 	EncKey        []byte            `json:"-" yaml:"-"`
 	JWTKeyPEM     string            `json:"jwt_key" yaml:"jwt_key"`
 	JWTKey        crypto.PrivateKey `json:"-" yaml:"-"`
+
+	// AccessTokenLifetime, SessionIdleTimeout and SessionMaxAge are
+	// durations like "5m" or "720h"
+	AccessTokenLifetime string `json:"access_token_lifetime,omitempty" yaml:"access_token_lifetime,omitempty"`
+	SessionIdleTimeout  string `json:"session_idle_timeout,omitempty" yaml:"session_idle_timeout,omitempty"`
+	SessionMaxAge       string `json:"session_max_age,omitempty" yaml:"session_max_age,omitempty"`
+
+	// LoginLockoutThreshold is the number of failed logins, after which an
+	// account is locked for LoginLockoutDuration
+	LoginLockoutThreshold int    `json:"login_lockout_threshold,omitempty" yaml:"login_lockout_threshold,omitempty"`
+	LoginLockoutDuration  string `json:"login_lockout_duration,omitempty" yaml:"login_lockout_duration,omitempty"`
+	// LoginProofOfWork is the difficulty (in bits) of the proof of work,
+	// which is required after some failed logins. -1 disables it.
+	LoginProofOfWork int `json:"login_proof_of_work,omitempty" yaml:"login_proof_of_work,omitempty"`
+
+	// UserBackend checks the passwords of the users, which are not managed
+	// locally ("homeassistant")
+	UserBackend string `json:"user_backend,omitempty" yaml:"user_backend,omitempty"`
+	// HomeAssistantGroups maps the groups of Home Assistant to the groups
+	// of the gateway (default: DefaultHomeAssistantGroups)
+	HomeAssistantGroups map[string][]string `json:"homeassistant_groups,omitempty" yaml:"homeassistant_groups,omitempty"`
+}
+
+func parseDuration(value string, defaultValue time.Duration) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return defaultValue
+	}
+	return duration
+}
+
+// GetAccessTokenLifetime returns the lifetime of the access and ID tokens.
+// The routes of the gateway refresh their tokens when they expire, so this
+// is the time until a revoked session is rejected.
+func (a *AuthServerConfig) GetAccessTokenLifetime() time.Duration {
+	return parseDuration(a.AccessTokenLifetime, 5*time.Minute)
+}
+
+// GetSessionIdleTimeout returns the time after which unused sessions expire
+func (a *AuthServerConfig) GetSessionIdleTimeout() time.Duration {
+	return parseDuration(a.SessionIdleTimeout, 7*24*time.Hour)
+}
+
+// GetSessionMaxAge returns the time after which every session expires
+func (a *AuthServerConfig) GetSessionMaxAge() time.Duration {
+	return parseDuration(a.SessionMaxAge, 30*24*time.Hour)
+}
+
+func (a *AuthServerConfig) GetLoginLockoutThreshold() int {
+	if a.LoginLockoutThreshold <= 0 {
+		return 10
+	}
+	return a.LoginLockoutThreshold
+}
+
+func (a *AuthServerConfig) GetLoginLockoutDuration() time.Duration {
+	return parseDuration(a.LoginLockoutDuration, 15*time.Minute)
+}
+
+// GetLoginProofOfWork returns the difficulty of the proof of work (0 if
+// it is disabled)
+func (a *AuthServerConfig) GetLoginProofOfWork() int {
+	switch {
+	case a.LoginProofOfWork < 0:
+		return 0
+	case a.LoginProofOfWork == 0:
+		return 16
+	}
+	return min(a.LoginProofOfWork, 24)
 }
 
 func NewAuthServerConfigFile(filename string) (a *AuthServerConfig, err error) {
@@ -132,44 +208,231 @@ func (a *AuthServerConfig) GenerateKeys() (err error) {
 type AuthClientConfig struct {
 	ClientId     string `json:"client_id" yaml:"client_id"`
 	ClientSecret string `json:"client_secret" yaml:"client_secret"`
+	// Name is shown in the admin UI and on the login page
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// RedirectURIs are the allowed redirect URIs of a registered client.
+	// Internal clients (like the gateway itself) have none, they may only
+	// use the login callback of the routes (see AuthServer.AddCallbackHost).
+	RedirectURIs []string `json:"redirect_uris,omitempty" yaml:"redirect_uris,omitempty"`
+	// Public clients (like single page or mobile apps) can't keep a secret,
+	// so they must use PKCE instead
+	Public bool `json:"public,omitempty" yaml:"public,omitempty"`
+
+	persistent bool
+}
+
+// Persistent returns true for registered clients (which are stored in the
+// clients directory)
+func (c *AuthClientConfig) Persistent() bool {
+	return c.persistent
+}
+
+// CheckRedirectURI returns true if the redirect URI has been registered
+func (c *AuthClientConfig) CheckRedirectURI(redirectURI string) bool {
+	return slices.Contains(c.RedirectURIs, redirectURI)
+}
+
+func (c *AuthClientConfig) Check() error {
+	if err := checkClientID(c.ClientId); err != nil {
+		return err
+	}
+	if len(c.RedirectURIs) == 0 {
+		return fmt.Errorf("at least one redirect URI is required")
+	}
+	for _, redirectURI := range c.RedirectURIs {
+		uri, err := url.Parse(redirectURI)
+		if err != nil || !uri.IsAbs() || uri.Fragment != "" {
+			return fmt.Errorf("invalid redirect URI: %s", redirectURI)
+		}
+	}
+	return nil
+}
+
+// checkClientID ensures that the client id can be used as file name
+func checkClientID(clientId string) error {
+	if clientId == "" || strings.Contains(clientId, "..") || strings.ContainsAny(clientId, "/\\:") {
+		return fmt.Errorf("invalid client id: %q", clientId)
+	}
+	return nil
 }
 
 type AuthClientConfigManager interface {
 	NewAuthClientConfig(clientId string, persistent bool) (c *AuthClientConfig, err error)
 	GewAuthClientConfig(clientId string) (c *AuthClientConfig, err error)
+
+	// AuthClientConfigs returns the registered (persistent) clients
+	AuthClientConfigs() []AuthClientConfig
+	// SaveAuthClientConfig updates a registered client
+	SaveAuthClientConfig(c AuthClientConfig) (*AuthClientConfig, error)
+	// NewAuthClientSecret replaces the secret of a registered client
+	NewAuthClientSecret(clientId string) (c *AuthClientConfig, err error)
+	DeleteAuthClientConfig(clientId string) error
 }
 
 type authClientConfigManager struct {
+	mutex             sync.Mutex
 	dirname           string
 	authClientConfigs map[string]*AuthClientConfig
 }
 
 func NewAuthClientConfigManager(dirname string) AuthClientConfigManager {
-	return &authClientConfigManager{
+	m := &authClientConfigManager{
 		dirname:           dirname,
 		authClientConfigs: make(map[string]*AuthClientConfig),
 	}
+	m.read()
+	return m
+}
+
+// read loads the registered clients (one file per client)
+func (m *authClientConfigManager) read() {
+	files, _ := filepath.Glob(path.Join(m.dirname, "*.yml"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		c := &AuthClientConfig{}
+		if err = yaml.Unmarshal(data, c); err != nil || checkClientID(c.ClientId) != nil {
+			fmt.Println("invalid client configuration:", file, err)
+			continue
+		}
+		c.persistent = true
+		m.authClientConfigs[c.ClientId] = c
+	}
+}
+
+func (m *authClientConfigManager) write(c *AuthClientConfig) error {
+	err := os.MkdirAll(m.dirname, 0o700)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// contains the client secret
+	return os.WriteFile(path.Join(m.dirname, c.ClientId+".yml"), data, 0o600)
 }
 
 func (m *authClientConfigManager) NewAuthClientConfig(clientId string, persistent bool) (c *AuthClientConfig, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if c, ok := m.authClientConfigs[clientId]; ok {
 		return c, nil
 	}
+	if persistent {
+		if err = checkClientID(clientId); err != nil {
+			return nil, err
+		}
+	}
 
-	c = &AuthClientConfig{ClientId: clientId}
+	c = &AuthClientConfig{ClientId: clientId, persistent: persistent}
 	c.ClientSecret, err = rand.GetString(24)
 	if err != nil {
 		return nil, err
 	}
 
+	if persistent {
+		if err = m.write(c); err != nil {
+			return nil, err
+		}
+	}
+
 	m.authClientConfigs[clientId] = c
 
 	return c, nil
 }
 
 func (m *authClientConfigManager) GewAuthClientConfig(clientId string) (c *AuthClientConfig, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if c, ok := m.authClientConfigs[clientId]; ok {
 		return c, nil
 	}
 	return nil, nil
 }
+
+func (m *authClientConfigManager) AuthClientConfigs() []AuthClientConfig {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	clients := make([]AuthClientConfig, 0, len(m.authClientConfigs))
+	for _, c := range m.authClientConfigs {
+		if c.persistent {
+			clients = append(clients, *c)
+		}
+	}
+	slices.SortFunc(clients, func(a, b AuthClientConfig) int {
+		return strings.Compare(a.ClientId, b.ClientId)
+	})
+	return clients
+}
+
+func (m *authClientConfigManager) getPersistent(clientId string) (*AuthClientConfig, error) {
+	c, ok := m.authClientConfigs[clientId]
+	if !ok || !c.persistent {
+		return nil, fmt.Errorf("client %q not found", clientId)
+	}
+	return c, nil
+}
+
+func (m *authClientConfigManager) SaveAuthClientConfig(update AuthClientConfig) (*AuthClientConfig, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, err := m.getPersistent(update.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	if err = update.Check(); err != nil {
+		return nil, err
+	}
+	updated := *c
+	updated.Name = update.Name
+	updated.RedirectURIs = update.RedirectURIs
+	updated.Public = update.Public
+	if err = m.write(&updated); err != nil {
+		return nil, err
+	}
+	*c = updated
+	return c, nil
+}
+
+func (m *authClientConfigManager) NewAuthClientSecret(clientId string) (c *AuthClientConfig, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, err = m.getPersistent(clientId)
+	if err != nil {
+		return nil, err
+	}
+	updated := *c
+	updated.ClientSecret, err = rand.GetString(24)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.write(&updated); err != nil {
+		return nil, err
+	}
+	*c = updated
+	return c, nil
+}
+
+func (m *authClientConfigManager) DeleteAuthClientConfig(clientId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, err := m.getPersistent(clientId); err != nil {
+		return err
+	}
+	err := os.Remove(path.Join(m.dirname, clientId+".yml"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(m.authClientConfigs, clientId)
+	return nil
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ForwardAuthCookie is sent to all hosts of the domain of the auth route,
+// so that other reverse proxies can verify it with the forward-auth
+// endpoint. It contains its own token, not the session of the auth server.
+const ForwardAuthCookie = "MYPI_FORWARD_AUTH"
+
+// EnableForwardAuth sets the domain of the forward-auth cookie. Only hosts
+// of this domain (and its subdomains) can use the forward authentication.
+func (a *AuthServer) EnableForwardAuth(domain string) {
+	a.forwardAuthDomain = domain
+}
+
+// forwardedURL returns the URL which has been requested at the reverse
+// proxy. nginx has to pass it in X-Original-URL, Traefik and Caddy set
+// the X-Forwarded headers.
+func forwardedURL(c *gin.Context) string {
+	if original := c.GetHeader("X-Original-URL"); original != "" {
+		return original
+	}
+	host := c.GetHeader("X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+	scheme := c.GetHeader("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme + "://" + host + c.GetHeader("X-Forwarded-Uri")
+}
+
+// isForwardAuthTarget checks if the login may redirect to the URL, which
+// must be on a host of the forward-auth domain
+func (a *AuthServer) isForwardAuthTarget(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || a.forwardAuthDomain == "" {
+		return false
+	}
+	hostname := strings.ToLower(u.Hostname())
+	return hostname == a.forwardAuthDomain || strings.HasSuffix(hostname, "."+a.forwardAuthDomain)
+}
+
+// queryList returns the values of a query parameter, which may be repeated
+// or contain comma separated values
+func queryList(c *gin.Context, name string) (values []string) {
+	for _, value := range c.QueryArray(name) {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// handleForwardAuthVerify implements the forward authentication of nginx
+// (auth_request), Traefik (ForwardAuth) and Caddy (forward_auth). The
+// caller can restrict the access with the query parameters allowed_users
+// and allowed_groups.
+func (a *AuthServer) handleForwardAuthVerify(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	var user *User
+	if token, err := c.Cookie(ForwardAuthCookie); err == nil {
+		if session, ok := a.sessions.ForwardAuthSession(token); ok {
+			user, _ = a.users.GetUser(session.UserGuid)
+		}
+	}
+
+	target := forwardedURL(c)
+	if user == nil {
+		loginURL, _ := url.Parse(a.issuer(c) + "/auth/login")
+		if a.isForwardAuthTarget(target) {
+			loginURL.RawQuery = url.Values{"rd": {target}}.Encode()
+		}
+		c.Header("Location", loginURL.String())
+		if c.GetHeader("X-Original-URL") != "" {
+			// nginx only accepts 2xx, 401 and 403, it has to redirect with
+			// error_page
+			c.AbortWithStatus(http.StatusUnauthorized)
+		} else {
+			c.AbortWithStatus(http.StatusFound)
+		}
+		return
+	}
+
+	if !accessAllowed(queryList(c, "allowed_users"), queryList(c, "allowed_groups"), user.Name, user.Groups) {
+		hostname := target
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			hostname = u.Host
+		}
+		renderForbidden(c, user.Name, hostname, a.issuer(c))
+		return
+	}
+
+	c.Header(DefaultUserHeader, user.Name)
+	if len(user.Groups) > 0 {
+		c.Header(DefaultGroupsHeader, strings.Join(user.Groups, ","))
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// handleForwardAuthLogin sets the forward-auth cookie for the logged in
+// user and returns to the URL requested at the reverse proxy
+func (a *AuthServer) handleForwardAuthLogin(c *gin.Context) {
+	target := c.Query("rd")
+	if target != "" && !a.isForwardAuthTarget(target) {
+		// never redirect to hosts outside of the domain
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	session, user := a.currentSession(c)
+	if user == nil {
+		// show the login page, it returns to this URL after the login
+		c.Request.URL.Path = "/"
+		c.Header("Location", c.Request.URL.String())
+		c.AbortWithStatus(http.StatusFound)
+		return
+	}
+
+	token, err := a.sessions.NewForwardAuthToken(session.ID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	a.setForwardAuthCookie(c, token, int(a.config.GetSessionMaxAge().Seconds()))
+
+	if target == "" {
+		target = "/"
+	}
+	c.Header("Location", target)
+	c.AbortWithStatus(http.StatusFound)
+}
+
+// setForwardAuthCookie sets (or with maxAge < 0 deletes) the forward-auth
+// cookie for all hosts of the domain
+func (a *AuthServer) setForwardAuthCookie(c *gin.Context, token string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     ForwardAuthCookie,
+		Value:    token,
+		Path:     "/",
+		Domain:   a.forwardAuthDomain,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
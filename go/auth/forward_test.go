@@ -0,0 +1,23 @@
+package auth
+
+import "testing"
+
+func TestIsForwardAuthTarget(t *testing.T) {
+	a := &AuthServer{}
+	a.EnableForwardAuth("example.com")
+
+	tests := map[string]bool{
+		"https://app.example.com/path?x=1": true,
+		"https://example.com/":             true,
+		"http://App.Example.com":           true,
+		"https://example.com.evil.org/":    false,
+		"https://evilexample.com/":         false,
+		"javascript:alert(1)":              false,
+		"/relative":                        false,
+	}
+	for target, want := range tests {
+		if got := a.isForwardAuthTarget(target); got != want {
+			t.Errorf("isForwardAuthTarget(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
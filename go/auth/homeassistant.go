@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/dueckminor/home-assistant-addons/go/services/homeassistant"
+)
+
+// DefaultHomeAssistantGroups maps the groups of Home Assistant to the
+// groups of the gateway
+var DefaultHomeAssistantGroups = map[string][]string{
+	"system-admin":     {"admins", "user"},
+	"system-users":     {"user"},
+	"system-read-only": {"user"},
+}
+
+// homeAssistantBackend checks the passwords with the auth API of the
+// Supervisor. The groups are taken from the user list of Home Assistant.
+type homeAssistantBackend struct {
+	client *homeassistant.SupervisorClient
+	groups map[string][]string
+}
+
+// NewHomeAssistantBackend creates the user backend for the users of Home
+// Assistant. groups maps the groups of Home Assistant (like system-admin)
+// to gateway groups, it defaults to DefaultHomeAssistantGroups.
+func NewHomeAssistantBackend(client *homeassistant.SupervisorClient, groups map[string][]string) UserBackend {
+	if len(groups) == 0 {
+		groups = DefaultHomeAssistantGroups
+	}
+	return &homeAssistantBackend{client: client, groups: groups}
+}
+
+func (b *homeAssistantBackend) Name() string {
+	return "homeassistant"
+}
+
+func (b *homeAssistantBackend) Authenticate(username string, password string) (*ExternalUser, error) {
+	if err := b.client.Authenticate(username, password); err != nil {
+		return nil, err
+	}
+	users, err := b.client.Users()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.SystemGenerated || !strings.EqualFold(user.Username, username) {
+			continue
+		}
+		if !user.IsActive {
+			return nil, fmt.Errorf("the user %s is deactivated", username)
+		}
+		return b.externalUser(user), nil
+	}
+	return nil, fmt.Errorf("the user %s is unknown to Home Assistant", username)
+}
+
+func (b *homeAssistantBackend) Users() ([]*ExternalUser, error) {
+	users, err := b.client.Users()
+	if err != nil {
+		return nil, err
+	}
+	result := []*ExternalUser{}
+	for _, user := range users {
+		if user.SystemGenerated || !user.IsActive {
+			continue
+		}
+		result = append(result, b.externalUser(user))
+	}
+	return result, nil
+}
+
+func (b *homeAssistantBackend) Groups() []string {
+	groups := []string{}
+	for _, mapped := range b.groups {
+		for _, group := range mapped {
+			if !slices.Contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// externalUser maps the groups of Home Assistant to the gateway groups
+func (b *homeAssistantBackend) externalUser(user homeassistant.User) *ExternalUser {
+	external := &ExternalUser{ID: user.ID, Name: user.Username}
+	for _, groupID := range user.GroupIDs {
+		for _, group := range b.groups[groupID] {
+			if !slices.Contains(external.Groups, group) {
+				external.Groups = append(external.Groups, group)
+			}
+		}
+	}
+	return external
+}
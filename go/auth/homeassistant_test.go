@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dueckminor/home-assistant-addons/go/services/homeassistant"
+	"github.com/gorilla/websocket"
+)
+
+// fakeSupervisor implements the auth API of the Supervisor and the user
+// list of the websocket API of Home Assistant
+type fakeSupervisor struct {
+	passwords map[string]string
+	users     []homeassistant.User
+}
+
+func (f *fakeSupervisor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" && r.URL.Path != "/core/websocket" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/auth":
+		var params struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&params)
+		// Home Assistant normalizes the usernames
+		if password, ok := f.passwords[strings.ToLower(params.Username)]; !ok || password != params.Password {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	case "/core/websocket":
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var message map[string]any
+		_ = conn.WriteJSON(map[string]any{"type": "auth_required"})
+		if conn.ReadJSON(&message) != nil || message["access_token"] != "token" {
+			_ = conn.WriteJSON(map[string]any{"type": "auth_invalid"})
+			return
+		}
+		_ = conn.WriteJSON(map[string]any{"type": "auth_ok"})
+		if conn.ReadJSON(&message) != nil || message["type"] != "config/auth/list" {
+			return
+		}
+		_ = conn.WriteJSON(map[string]any{"id": 1, "type": "result", "success": true, "result": f.users})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestHomeAssistantBackend(t *testing.T) {
+	supervisor := &fakeSupervisor{
+		passwords: map[string]string{"alice": "secret", "bob": "secret"},
+		users: []homeassistant.User{
+			{ID: "1", Username: "alice", IsActive: true, GroupIDs: []string{"system-admin"}},
+			{ID: "2", Username: "bob", IsActive: false, GroupIDs: []string{"system-users"}},
+			{ID: "3", Username: "", IsActive: true, SystemGenerated: true},
+		},
+	}
+	server := httptest.NewServer(supervisor)
+	defer server.Close()
+
+	dataDir := t.TempDir()
+	backend := NewHomeAssistantBackend(homeassistant.NewSupervisorClientFor(server.URL, "token"), nil)
+	u, err := NewBackendUsers(dataDir, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range []string{"user", "admins"} {
+		if _, err = u.AddGroup(group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// local service accounts keep their passwords
+	if _, err = u.AddUser(User{Name: "backup", Mail: "backup@example.com", Password: "local"}); err != nil {
+		t.Fatal(err)
+	}
+	if !u.CheckPassword("backup", "local") {
+		t.Error("the password of the local user has been rejected")
+	}
+
+	if u.CheckPassword("alice", "wrong") {
+		t.Error("a wrong password has been accepted")
+	}
+	if !u.CheckPassword("Alice", "secret") {
+		t.Fatal("the password of the Home Assistant user has been rejected")
+	}
+	alice, err := u.FindUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Source != "homeassistant" || !slices.Equal(alice.Groups, []string{"admins", "user"}) {
+		t.Errorf("alice = %s %v, want homeassistant [admins user]", alice.Source, alice.Groups)
+	}
+
+	if u.CheckPassword("bob", "secret") {
+		t.Error("a deactivated user has been accepted")
+	}
+
+	// the user keeps its guid if it is renamed in Home Assistant
+	supervisor.passwords["alice2"] = "secret"
+	supervisor.users[0].Username = "alice2"
+	supervisor.users[0].GroupIDs = []string{"system-users"}
+	if !u.CheckPassword("alice2", "secret") {
+		t.Fatal("the password of the renamed user has been rejected")
+	}
+	renamed, err := u.FindUser("alice2")
+	if err != nil || renamed.Guid != alice.Guid || !slices.Equal(renamed.Groups, []string{"user"}) {
+		t.Errorf("FindUser(alice2) = %+v, %v, want the guid %s and the groups [user]", renamed, err, alice.Guid)
+	}
+	if _, err = u.FindUser("alice"); err == nil {
+		t.Error("the old name is still known")
+	}
+
+	// groups which aren't managed by Home Assistant are kept
+	if _, err = u.AddGroup("family"); err != nil {
+		t.Fatal(err)
+	}
+	backendUsers := u.(*backendUsers)
+	backendUsers.usersByGuid[alice.Guid].Groups = []string{"family", "user"}
+	supervisor.users[0].GroupIDs = []string{"system-admin"}
+	if removed, err := backendUsers.SyncUsers(); err != nil || len(removed) != 0 {
+		t.Fatalf("SyncUsers() = %v, %v, want nothing removed", removed, err)
+	}
+	if renamed, _ = u.FindUser("alice2"); !slices.Equal(renamed.Groups, []string{"family", "admins", "user"}) {
+		t.Errorf("groups = %v, want [family admins user]", renamed.Groups)
+	}
+
+	// a local user without password isn't taken over
+	if _, err = u.AddUser(User{Name: "carol", Mail: "carol@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	supervisor.passwords["carol"] = "secret"
+	supervisor.users = append(supervisor.users, homeassistant.User{ID: "4", Username: "carol", IsActive: true})
+	if u.CheckPassword("carol", "secret") {
+		t.Error("the local user has been taken over by Home Assistant")
+	}
+
+	// deactivated users are removed (with their access tokens)
+	supervisor.users[0].IsActive = false
+	if removed, err := backendUsers.SyncUsers(); err != nil || !slices.Equal(removed, []string{alice.Guid}) {
+		t.Fatalf("SyncUsers() = %v, %v, want [%s]", removed, err, alice.Guid)
+	}
+	if _, err = u.GetUser(alice.Guid); err == nil {
+		t.Error("the deactivated user still exists")
+	}
+}
@@ -0,0 +1,473 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto/rand"
+	"github.com/dueckminor/home-assistant-addons/go/utils/ginutil"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// oidcScopes are the supported scopes. The claims of the user are returned
+// depending on the requested scopes.
+var oidcScopes = []string{"openid", "profile", "email", "groups"}
+
+type ClaimsWithScope struct {
+	Scopes []string `json:"scopes,omitempty"`
+	// Username and Groups are used by the routes of the gateway to authorize
+	// the user and to pass them to the backends
+	Username string   `json:"preferred_username,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	// SessionID is the session at the auth server, the token is rejected
+	// by the userinfo endpoint after the session has been revoked
+	SessionID string `json:"sid,omitempty"`
+	jwt.StandardClaims
+}
+
+type OauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	IDToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// SetIssuer sets the issuer of the tokens (the URL of the auth route). If
+// it isn't set, the URL of the request is used.
+func (a *AuthServer) SetIssuer(issuer string) {
+	a.issuerURL = strings.TrimSuffix(issuer, "/")
+}
+
+func (a *AuthServer) issuer(c *gin.Context) string {
+	if a.issuerURL != "" {
+		return a.issuerURL
+	}
+	return ginutil.GetScheme(c) + "://" + ginutil.GetHostname(c)
+}
+
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// keyID returns the JWK thumbprint (RFC 7638) of the signing key, so that
+// clients can detect a new key
+func (a *AuthServer) keyID() string {
+	key := a.config.JWTKey.RSA().PublicKey
+	thumbprint := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64URL(big.NewInt(int64(key.E)).Bytes()), base64URL(key.N.Bytes()))
+	sum := sha256.Sum256([]byte(thumbprint))
+	return base64URL(sum[:])
+}
+
+func (a *AuthServer) signToken(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = a.keyID()
+	return token.SignedString(a.config.JWTKey.RSA())
+}
+
+func (a *AuthServer) handleDiscovery(c *gin.Context) {
+	issuer := a.issuer(c)
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"jwks_uri":                              issuer + "/oauth/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      oidcScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"name", "preferred_username", "email", "email_verified", "groups"},
+	})
+}
+
+func (a *AuthServer) handleJWKS(c *gin.Context) {
+	key := a.config.JWTKey.RSA().PublicKey
+	c.JSON(http.StatusOK, gin.H{
+		"keys": []gin.H{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": a.keyID(),
+			"n":   base64URL(key.N.Bytes()),
+			"e":   base64URL(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+// oauthError returns an error to the client (RFC 6749, section 5.2)
+func oauthError(c *gin.Context, status int, code string, description string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": code, "error_description": description})
+}
+
+func (a *AuthServer) handleOauthAuthorize(c *gin.Context) {
+	query := c.Request.URL.Query()
+	client, _ := a.clients.GewAuthClientConfig(query.Get("client_id"))
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if client == nil || err != nil || !a.checkRedirectURI(client, query.Get("redirect_uri")) {
+		// never redirect to an URI which hasn't been registered
+		oauthError(c, http.StatusBadRequest, "invalid_request", "unknown client or redirect URI")
+		return
+	}
+	redirect := func(params url.Values) {
+		values := redirectURI.Query()
+		for name := range params {
+			values.Set(name, params.Get(name))
+		}
+		if state := query.Get("state"); state != "" {
+			values.Set("state", state)
+		}
+		redirectURI.RawQuery = values.Encode()
+		c.Header("Location", redirectURI.String())
+		c.AbortWithStatus(http.StatusFound)
+	}
+	redirectError := func(code string, description string) {
+		redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+
+	if query.Get("response_type") != "code" {
+		redirectError("unsupported_response_type", "only the authorization code flow is supported")
+		return
+	}
+	codeChallenge := query.Get("code_challenge")
+	codeChallengeMethod := query.Get("code_challenge_method")
+	// the plain method (which is the default) doesn't protect the code
+	if (codeChallenge != "" || codeChallengeMethod != "") && codeChallengeMethod != "S256" {
+		redirectError("invalid_request", "only the code challenge method S256 is supported")
+		return
+	}
+	if client.Public && codeChallenge == "" {
+		redirectError("invalid_request", "public clients must use PKCE")
+		return
+	}
+
+	session, user := a.currentSession(c)
+	if user == nil {
+		if query.Get("prompt") == "none" {
+			redirectError("login_required", "the user is not logged in")
+			return
+		}
+		// show the login page, it returns to this URL after the login
+		c.Request.URL.Path = "/"
+		c.Header("Location", c.Request.URL.String())
+		c.AbortWithStatus(http.StatusFound)
+		return
+	}
+
+	authRequest, err := NewRequest()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	authRequest.RedirectURI = query.Get("redirect_uri")
+	authRequest.ClientID = client.ClientId
+	authRequest.Username = user.Name
+	authRequest.SessionID = session.ID
+	authRequest.AuthTime = session.Created
+	authRequest.Scopes = strings.Fields(query.Get("scope"))
+	authRequest.Nonce = query.Get("nonce")
+	authRequest.CodeChallenge = codeChallenge
+	authRequest.CodeChallengeMethod = codeChallengeMethod
+	redirect(url.Values{"code": {authRequest.Id}})
+}
+
+// authenticateClient supports client_secret_basic, client_secret_post and
+// (for public clients) none
+func (a *AuthServer) authenticateClient(c *gin.Context) *AuthClientConfig {
+	clientID, clientSecret, ok := c.Request.BasicAuth()
+	if ok {
+		// the credentials are form encoded (RFC 6749, section 2.3.1)
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = c.Request.Form.Get("client_id")
+		clientSecret = c.Request.Form.Get("client_secret")
+	}
+	if checkClientID(clientID) != nil {
+		return nil
+	}
+	client, err := a.clients.GewAuthClientConfig(clientID)
+	if err != nil || client == nil {
+		return nil
+	}
+	if client.Public {
+		return client
+	}
+	if subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(clientSecret)) != 1 {
+		return nil
+	}
+	return client
+}
+
+// checkRedirectURI returns true if the client may use the redirect URI.
+// Internal clients (like the gateway itself) may only use the login
+// callback of the routes protected by them.
+func (a *AuthServer) checkRedirectURI(client *AuthClientConfig, redirectURI string) bool {
+	if client.Persistent() {
+		return client.CheckRedirectURI(redirectURI)
+	}
+	uri, err := url.Parse(redirectURI)
+	if err != nil || uri.Scheme != "https" || uri.User != nil || uri.Fragment != "" || uri.Path != "/login/callback" {
+		return false
+	}
+	a.callbackHostsMutex.Lock()
+	defer a.callbackHostsMutex.Unlock()
+	return a.callbackHosts[strings.ToLower(uri.Hostname())]
+}
+
+// AddCallbackHost allows the internal clients to use the login callback
+// of a route
+func (a *AuthServer) AddCallbackHost(hostname string) {
+	a.callbackHostsMutex.Lock()
+	defer a.callbackHostsMutex.Unlock()
+	if a.callbackHosts == nil {
+		a.callbackHosts = make(map[string]bool)
+	}
+	a.callbackHosts[strings.ToLower(hostname)] = true
+}
+
+// RemoveCallbackHost is called when a route has been removed
+func (a *AuthServer) RemoveCallbackHost(hostname string) {
+	a.callbackHostsMutex.Lock()
+	defer a.callbackHostsMutex.Unlock()
+	delete(a.callbackHosts, strings.ToLower(hostname))
+}
+
+// verifyPKCE checks the code verifier (RFC 7636)
+func verifyPKCE(method string, challenge string, verifier string) bool {
+	switch method {
+	case "":
+		return verifier == ""
+	case "S256":
+		sum := sha256.Sum256([]byte(verifier))
+		return subtle.ConstantTimeCompare([]byte(base64URL(sum[:])), []byte(challenge)) == 1
+	}
+	return false
+}
+
+func (a *AuthServer) handleOauthToken(c *gin.Context) {
+	err := c.Request.ParseForm()
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+
+	grantType := c.Request.Form.Get("grant_type")
+	if grantType != "authorization_code" && grantType != "refresh_token" {
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "unsupported grant type: "+grantType)
+		return
+	}
+	client := a.authenticateClient(c)
+	if client == nil {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	var authRequest *AuthRequest
+	var user *User
+	if grantType == "refresh_token" {
+		authRequest, user = a.refreshGrant(c, client)
+	} else {
+		authRequest, user = a.authorizationCodeGrant(c, client)
+	}
+	if authRequest == nil {
+		return
+	}
+
+	response, err := a.issueTokens(a.issuer(c), client, user, authRequest)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+// authorizationCodeGrant exchanges the authorization code (RFC 6749,
+// section 4.1.3)
+func (a *AuthServer) authorizationCodeGrant(c *gin.Context, client *AuthClientConfig) (*AuthRequest, *User) {
+	authRequest := TakeRequest(c.Request.Form.Get("code"))
+	if authRequest == nil || authRequest.ClientID != client.ClientId ||
+		authRequest.RedirectURI != c.Request.Form.Get("redirect_uri") {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+		return nil, nil
+	}
+	if !verifyPKCE(authRequest.CodeChallengeMethod, authRequest.CodeChallenge, c.Request.Form.Get("code_verifier")) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "invalid code verifier")
+		return nil, nil
+	}
+	if _, ok := a.sessions.Get(authRequest.SessionID); !ok {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the session has ended")
+		return nil, nil
+	}
+	user, err := a.users.FindUser(authRequest.Username)
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the user doesn't exist anymore")
+		return nil, nil
+	}
+	return authRequest, user
+}
+
+// refreshGrant checks the refresh token (RFC 6749, section 6). The new
+// tokens have the scopes of the original grant.
+func (a *AuthServer) refreshGrant(c *gin.Context, client *AuthClientConfig) (*AuthRequest, *User) {
+	session, scopes, err := a.sessions.UseRefreshToken(c.Request.Form.Get("refresh_token"), client.ClientId)
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return nil, nil
+	}
+	user, err := a.users.GetUser(session.UserGuid)
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the user doesn't exist anymore")
+		return nil, nil
+	}
+	return &AuthRequest{
+		ClientID:  client.ClientId,
+		Username:  user.Name,
+		Scopes:    scopes,
+		SessionID: session.ID,
+		AuthTime:  session.Created,
+	}, user
+}
+
+// issueTokens returns the access token, a refresh token bound to the
+// session and (for the openid scope) the ID token
+func (a *AuthServer) issueTokens(issuer string, client *AuthClientConfig, user *User, authRequest *AuthRequest) (response *OauthTokenResponse, err error) {
+	now := time.Now()
+	lifetime := a.config.GetAccessTokenLifetime()
+	tokenID, err := rand.GetString(24)
+	if err != nil {
+		return nil, err
+	}
+	response = &OauthTokenResponse{
+		TokenType: "Bearer",
+		ExpiresIn: int(lifetime.Seconds()),
+		Scope:     strings.Join(authRequest.Scopes, " "),
+	}
+	claims := ClaimsWithScope{
+		Scopes:    authRequest.Scopes,
+		SessionID: authRequest.SessionID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			Issuer:    issuer,
+			Subject:   user.Guid,
+			Audience:  client.ClientId,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+		},
+	}
+	// internal clients (the routes of the gateway) always get the user and
+	// the groups, registered clients only if they asked for them
+	internal := !client.Persistent()
+	if internal || slices.Contains(authRequest.Scopes, "profile") {
+		claims.Username = user.Name
+	}
+	if internal || slices.Contains(authRequest.Scopes, "groups") {
+		claims.Groups = user.Groups
+	}
+	response.AccessToken, err = a.signToken(claims)
+	if err != nil {
+		return nil, err
+	}
+	if authRequest.SessionID != "" {
+		response.RefreshToken, err = a.sessions.NewRefreshToken(authRequest.SessionID, client.ClientId, authRequest.Scopes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !slices.Contains(authRequest.Scopes, "openid") {
+		return response, nil
+	}
+	idClaims := userClaims(user, authRequest.Scopes)
+	idClaims["iss"] = issuer
+	idClaims["aud"] = client.ClientId
+	idClaims["iat"] = now.Unix()
+	idClaims["exp"] = now.Add(lifetime).Unix()
+	if authRequest.Nonce != "" {
+		idClaims["nonce"] = authRequest.Nonce
+	}
+	if !authRequest.AuthTime.IsZero() {
+		idClaims["auth_time"] = authRequest.AuthTime.Unix()
+	}
+	response.IDToken, err = a.signToken(idClaims)
+	return response, err
+}
+
+// userClaims returns the claims of the user, which are allowed by the
+// scopes. The subject is the guid, as names and mail addresses may change.
+func userClaims(user *User, scopes []string) jwt.MapClaims {
+	claims := jwt.MapClaims{"sub": user.Guid}
+	if slices.Contains(scopes, "profile") {
+		claims["name"] = user.Name
+		claims["preferred_username"] = user.Name
+	}
+	if slices.Contains(scopes, "email") && user.Mail != "" {
+		claims["email"] = user.Mail
+		// the mail addresses are maintained by the administrator
+		claims["email_verified"] = true
+	}
+	if slices.Contains(scopes, "groups") {
+		claims["groups"] = user.Groups
+	}
+	return claims
+}
+
+// parseAccessToken verifies an access token issued by this server
+func (a *AuthServer) parseAccessToken(c *gin.Context, accessToken string) (*ClaimsWithScope, error) {
+	claims := &ClaimsWithScope{}
+	_, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return a.GetPublicKey(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(a.issuer(c), true) {
+		return nil, fmt.Errorf("invalid issuer")
+	}
+	return claims, nil
+}
+
+func (a *AuthServer) handleUserinfo(c *gin.Context) {
+	accessToken, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		accessToken = c.PostForm("access_token")
+	}
+	claims, err := a.parseAccessToken(c, accessToken)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	user, err := a.users.GetUser(claims.Subject)
+	if err == nil && claims.SessionID != "" {
+		if _, ok := a.sessions.Get(claims.SessionID); !ok {
+			err = fmt.Errorf("the session has ended")
+		}
+	}
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.JSON(http.StatusOK, userClaims(user, claims.Scopes))
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// example of RFC 7636, appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !verifyPKCE("S256", challenge, verifier) {
+		t.Error("the S256 verifier has been rejected")
+	}
+	if verifyPKCE("S256", challenge, verifier+"x") {
+		t.Error("an invalid verifier has been accepted")
+	}
+	if verifyPKCE("plain", verifier, verifier) {
+		t.Error("the plain method has been accepted")
+	}
+	if verifyPKCE("", "", verifier) {
+		t.Error("a verifier without challenge has been accepted")
+	}
+}
+
+func TestIssueTokens(t *testing.T) {
+	a := &AuthServer{config: &AuthServerConfig{}}
+	if err := a.config.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	client := &AuthClientConfig{ClientId: "grafana"}
+	user := &User{Guid: "1234", Name: "alice", Mail: "alice@example.com", Groups: []string{"admin"}}
+	authRequest := &AuthRequest{Scopes: []string{"openid", "email", "groups"}, Nonce: "n-0S6_WzA2Mj"}
+
+	response, err := a.issueTokens("https://auth.example.com", client, user, authRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(response.IDToken, claims, func(token *jwt.Token) (any, error) {
+		return a.GetPublicKey(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != a.keyID() {
+		t.Errorf("kid = %v, want %s", token.Header["kid"], a.keyID())
+	}
+	if claims["sub"] != "1234" || claims["aud"] != "grafana" || claims["iss"] != "https://auth.example.com" ||
+		claims["email"] != "alice@example.com" || claims["nonce"] != "n-0S6_WzA2Mj" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+	if groups, _ := claims["groups"].([]any); len(groups) != 1 || groups[0] != "admin" {
+		t.Errorf("groups = %v, want [admin]", claims["groups"])
+	}
+	if _, ok := claims["name"]; ok {
+		t.Error("the profile claims must only be returned for the profile scope")
+	}
+}
+
+func TestCheckRedirectURI(t *testing.T) {
+	a := &AuthServer{}
+	a.AddCallbackHost("app.example.com")
+	internal := &AuthClientConfig{ClientId: "gateway"}
+	registered := &AuthClientConfig{ClientId: "grafana", RedirectURIs: []string{"https://grafana.example.com/login"}, persistent: true}
+
+	tests := []struct {
+		client      *AuthClientConfig
+		redirectURI string
+		want        bool
+	}{
+		{internal, "https://app.example.com/login/callback?id=1", true},
+		{internal, "https://APP.example.com:8443/login/callback?id=1", true},
+		{internal, "http://app.example.com/login/callback?id=1", false},
+		{internal, "https://app.example.com/other", false},
+		{internal, "https://evil.example.com/login/callback?id=1", false},
+		{registered, "https://grafana.example.com/login", true},
+		{registered, "https://app.example.com/login/callback?id=1", false},
+	}
+	for _, test := range tests {
+		if got := a.checkRedirectURI(test.client, test.redirectURI); got != test.want {
+			t.Errorf("checkRedirectURI(%s, %s) = %v, want %v", test.client.ClientId, test.redirectURI, got, test.want)
+		}
+	}
+
+	a.RemoveCallbackHost("app.example.com")
+	if a.checkRedirectURI(internal, "https://app.example.com/login/callback?id=1") {
+		t.Error("the callback of a removed route has been accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"sync"
 	"time"
 
 	"github.com/dueckminor/home-assistant-addons/go/utils/crypto/rand"
@@ -11,9 +12,25 @@ type AuthRequest struct {
 	TTL         time.Time
 	RedirectURI string
 	Path        string
+
+	// the following fields are set if the request is an authorization code
+	// issued by the auth server
+	ClientID            string
+	Username            string
+	Scopes              []string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	AuthTime            time.Time
+	// SessionID is the session at the auth server, the refresh tokens are
+	// bound to it
+	SessionID string
 }
 
-var authRequests []*AuthRequest
+var (
+	authRequestsMu sync.Mutex
+	authRequests   []*AuthRequest
+)
 
 func init() {
 	authRequests = make([]*AuthRequest, 0)
@@ -29,13 +46,27 @@ func NewRequest() (request *AuthRequest, err error) {
 
 	request.TTL = time.Now().Add(time.Minute * 5)
 
-	authRequests = append(authRequests, request)
+	authRequestsMu.Lock()
+	defer authRequestsMu.Unlock()
+
+	// forget the expired requests
+	now := time.Now()
+	valid := authRequests[:0]
+	for _, r := range authRequests {
+		if r.TTL.After(now) {
+			valid = append(valid, r)
+		}
+	}
+	authRequests = append(valid, request)
 
 	return request, nil
 }
 
 // GetRequest gets an existing AuthRequest by id
 func GetRequest(id string) (request *AuthRequest) {
+	authRequestsMu.Lock()
+	defer authRequestsMu.Unlock()
+
 	for _, request = range authRequests {
 		if request.Id == id {
 			if request.TTL.After(time.Now()) {
@@ -46,3 +77,21 @@ func GetRequest(id string) (request *AuthRequest) {
 	}
 	return nil
 }
+
+// TakeRequest gets an existing AuthRequest by id and removes it, so that
+// an authorization code can be used only once
+func TakeRequest(id string) (request *AuthRequest) {
+	authRequestsMu.Lock()
+	defer authRequestsMu.Unlock()
+
+	for i, request := range authRequests {
+		if request.Id == id {
+			authRequests = append(authRequests[:i], authRequests[i+1:]...)
+			if request.TTL.After(time.Now()) {
+				return request
+			}
+			return nil
+		}
+	}
+	return nil
+}
@@ -2,15 +2,16 @@ package auth
 
 import (
 	"crypto"
-	"encoding/base64"
-	"net"
+	"fmt"
+	"math"
 	"net/http"
-	"net/url"
 	"path"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/dueckminor/home-assistant-addons/go/services/homeassistant"
 	"github.com/dueckminor/home-assistant-addons/go/services/smtp"
-	"github.com/dueckminor/home-assistant-addons/go/utils/crypto/rand"
 	"github.com/dueckminor/home-assistant-addons/go/utils/ginutil"
 
 	"github.com/dueckminor/home-assistant-addons/go/embed/auth_dist"
@@ -19,7 +20,7 @@ import (
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 func NewAuthServer(r *gin.Engine, distDir string, dataDir string) (a *AuthServer, err error) {
@@ -32,11 +33,32 @@ func NewAuthServer(r *gin.Engine, distDir string, dataDir string) (a *AuthServer
 		return nil, err
 	}
 
-	a.users, err = NewUsers(dataDir)
+	switch a.config.UserBackend {
+	case "":
+		a.users, err = NewUsers(dataDir)
+	case "homeassistant":
+		backend := NewHomeAssistantBackend(homeassistant.NewSupervisorClient(), a.config.HomeAssistantGroups)
+		a.users, err = NewBackendUsers(dataDir, backend)
+	default:
+		err = fmt.Errorf("unknown user backend: %s", a.config.UserBackend)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	a.sessions, err = newSessionRegistry(path.Join(dataDir, "sessions.yml"),
+		a.config.GetSessionIdleTimeout(), a.config.GetSessionMaxAge())
+	if err != nil {
+		return nil, err
+	}
+
+	if syncer, ok := a.users.(userSyncer); ok {
+		go a.syncBackendUsers(syncer)
+	}
+
+	a.throttle = newLoginThrottle(a.config.GetLoginLockoutThreshold(),
+		a.config.GetLoginLockoutDuration(), a.config.GetLoginProofOfWork())
+
 	if distDir != "" {
 		ginutil.ServeFromUri(r, distDir)
 	} else {
@@ -53,13 +75,32 @@ type AuthServer struct {
 	clients      AuthClientConfigManager
 	sessionStore sessions.Store
 	users        Users
+	// sessions are the logins of the users, the session cookie only
+	// contains the id
+	sessions *sessionRegistry
+	// throttle protects the passwords against brute-force attacks
+	throttle *loginThrottle
 	// for the password reset
 	hostname   string
 	domain     string
 	smtpClient *smtp.Client
+	// webAuthn is nil until EnableWebAuthn has been called
+	webAuthn *webauthn.WebAuthn
+	// issuerURL is the issuer of the OpenID Connect tokens
+	issuerURL string
+	// forwardAuthDomain is the domain of the forward-auth cookie
+	forwardAuthDomain string
+	// callbackHosts are the hostnames of the routes, whose login callback
+	// may be used by the internal clients
+	callbackHostsMutex sync.Mutex
+	callbackHosts      map[string]bool
 }
 
 func (a *AuthServer) Register(r *gin.Engine) {
+	// the clients connect directly (the gateway terminates TLS itself), so
+	// X-Forwarded-For must not be used to determine the client address. The
+	// login throttle could be bypassed otherwise.
+	r.SetTrustedProxies(nil)
 
 	store := a.GetSessionStore()
 
@@ -77,14 +118,40 @@ func (a *AuthServer) Register(r *gin.Engine) {
 	rg.GET("/status", a.handleStatus)
 	rg.GET("/oauth/authorize", a.handleOauthAuthorize)
 	rg.POST("/oauth/token", a.handleOauthToken)
+	rg.GET("/oauth/userinfo", a.handleUserinfo)
+	rg.POST("/oauth/userinfo", a.handleUserinfo)
+	rg.GET("/oauth/jwks", a.handleJWKS)
+	rg.GET("/.well-known/openid-configuration", a.handleDiscovery)
 	rg.POST("/send_reset_password_mail", a.sendResetPasswordMail)
 	rg.POST("/reset_password", a.resetPassword)
+	rg.POST("/2fa/enroll", a.handle2FAEnroll)
+	rg.POST("/2fa/confirm", a.handle2FAConfirm)
+	rg.POST("/webauthn/register/begin", a.handleWebAuthnRegisterBegin)
+	rg.POST("/webauthn/register/finish", a.handleWebAuthnRegisterFinish)
+	rg.POST("/webauthn/login/begin", a.handleWebAuthnLoginBegin)
+	rg.POST("/webauthn/login/finish", a.handleWebAuthnLoginFinish)
+	rg.GET("/webauthn/passkeys", a.handleGetPasskeys)
+	rg.PUT("/webauthn/passkeys/:id", a.handlePutPasskey)
+	rg.DELETE("/webauthn/passkeys/:id", a.handleDeletePasskey)
+	rg.GET("/sessions", a.handleGetSessions)
+	rg.DELETE("/sessions/:id", a.handleDeleteSession)
+	rg.GET("/tokens", a.handleGetTokens)
+	rg.POST("/tokens", a.handlePostToken)
+	rg.DELETE("/tokens/:id", a.handleDeleteToken)
+	rg.Any("/auth/verify", a.handleForwardAuthVerify)
+	rg.GET("/auth/login", a.handleForwardAuthLogin)
 }
 
 func (a *AuthServer) Users() Users {
 	return a.users
 }
 
+// Clients returns the OAuth clients (to register applications which use
+// the gateway as OpenID Connect provider)
+func (a *AuthServer) Clients() AuthClientConfigManager {
+	return a.clients
+}
+
 func (a *AuthServer) GetPublicKey() (p crypto.PublicKey) {
 	return a.config.JWTKey.Public()
 }
@@ -108,8 +175,10 @@ func (a *AuthServer) EnableSMTP(hostname string, domain string, smtpClient *smtp
 
 func (a *AuthServer) login(c *gin.Context) {
 	var params struct {
-		Username string
-		Password string
+		Username    string
+		Password    string
+		Code        string
+		ProofOfWork *ProofOfWorkSolution `json:"proof_of_work"`
 	}
 	err := c.BindJSON(&params)
 	if err != nil {
@@ -117,163 +186,211 @@ func (a *AuthServer) login(c *gin.Context) {
 		return
 	}
 
-	if !a.users.CheckPassword(params.Username, params.Password) {
-		c.AbortWithStatus(http.StatusUnauthorized)
+	if !a.checkPassword(c, params.Username, params.Password, params.ProofOfWork) {
 		return
 	}
 
-	session := sessions.Default(c)
-
-	secret, _ := session.Get("secret").(string)
-
-	if len(secret) == 0 {
-		domain := ""
-		host, _, _ := net.SplitHostPort(c.Request.Host)
-		addr := net.ParseIP(host)
-		if addr != nil {
-			origin := c.Request.Header["Origin"]
-			if len(origin) == 1 {
-				uri, _ := url.Parse(origin[0])
-				host = uri.Hostname()
-				addr = net.ParseIP(host)
-			}
-		}
-
-		if addr == nil {
-			hostParts := strings.Split(host, ".")
-			if len(hostParts) > 1 {
-				domain = strings.Join(hostParts[1:], ".")
-			}
-		}
+	// the second factor is requested after the password has been checked,
+	// so that the client can ask for a code or a passkey
+	factors, required := a.users.SecondFactors(params.Username)
+	switch {
+	case len(factors) > 0 && params.Code == "":
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"second_factors": factors})
+		return
+	case len(factors) > 0 && !a.users.CheckSecondFactor(params.Username, params.Code):
+		a.loginFailed(c, params.Username)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"second_factors": factors, "error": "invalid code"})
+		return
+	case len(factors) == 0 && required:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"enrollment_required": a.enrollableFactors()})
+		return
+	}
 
-		secret, _ = rand.GetString(48)
-		session.Set("secret", secret)
-		session.Set("domain", domain)
-		session.Set("username", params.Username)
-		err = session.Save()
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-		}
+	if err := a.startSession(c, params.Username); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
 	}
 	c.Data(http.StatusOK, "text/plain", []byte("OK"))
 }
 
-type ClaimsWithScope struct {
-	Scopes []string `json:"scopes,omitempty"`
-	jwt.StandardClaims
+// accountKey returns the key of the failed logins of an account. Unknown
+// accounts are throttled too, so that they can't be distinguished.
+func (a *AuthServer) accountKey(username string) string {
+	if user, err := a.users.FindUser(username); err == nil {
+		return user.Guid
+	}
+	return username
 }
 
-func (a *AuthServer) handleOauthAuthorize(c *gin.Context) {
-	session := sessions.Default(c)
-	secret, _ := session.Get("secret").(string)
-
-	if len(secret) > 0 {
-		authRequest, err := NewRequest()
+// checkPassword checks the password of a login attempt and protects it
+// against brute-force attacks. The request is aborted if the attempt is
+// throttled, a proof of work is missing or the password is wrong.
+func (a *AuthServer) checkPassword(c *gin.Context, username string, password string, proofOfWork *ProofOfWorkSolution) bool {
+	account, address := a.accountKey(username), c.ClientIP()
+	if wait, locked := a.throttle.check(account, address); wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error": "too many failed logins", "locked": locked, "retry_after": seconds})
+		return false
+	}
+	if a.throttle.proofOfWorkRequired(account, address) && !a.throttle.verifyProofOfWork(proofOfWork) {
+		challenge, err := a.throttle.newChallenge()
 		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
-			return
+			return false
 		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"proof_of_work": challenge})
+		return false
+	}
+	if !a.users.CheckPassword(username, password) {
+		a.loginFailed(c, username)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
 
-		values := c.Request.URL.Query()
-		authRequest.RedirectURI = values.Get("redirect_uri")
-		redirectURI, err := url.Parse(authRequest.RedirectURI)
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		values = redirectURI.Query()
-		values.Add("code", authRequest.Id)
-		redirectURI.RawQuery = values.Encode()
-		c.Header("Location", redirectURI.String())
-		c.AbortWithStatus(http.StatusFound)
+// loginFailed records a failed login. The owner of the account gets a mail
+// if the account has been locked.
+func (a *AuthServer) loginFailed(c *gin.Context, username string) {
+	address := c.ClientIP()
+	if !a.throttle.failed(a.accountKey(username), address) {
+		return
 	}
+	user, err := a.users.FindUser(username)
+	if err != nil || user.Mail == "" || a.smtpClient == nil {
+		return
+	}
+	until := time.Now().Add(a.config.GetLoginLockoutDuration())
+	go a.smtpClient.SendAccountLockedEmail(user.Mail, user.Name, address, until)
+}
 
-	c.Request.URL.Path = "/"
-	c.Header("Location", c.Request.URL.String())
-	c.AbortWithStatus(http.StatusFound)
+// LoginFailures returns the failed logins of a user (by guid)
+func (a *AuthServer) LoginFailures(guid string) *LoginFailures {
+	return a.throttle.failures(guid)
 }
 
-type OauthTokenResponse struct {
-	AccessToken string `json:"access_token"`
+// Unlock forgets the failed logins of a user (by guid)
+func (a *AuthServer) Unlock(guid string) {
+	a.throttle.unlock(guid)
 }
 
-func (a *AuthServer) basicAuth(c *gin.Context) string {
-	s := strings.SplitN(c.Request.Header.Get("Authorization"), " ", 2)
-	if len(s) != 2 {
-		return ""
+// enrollableFactors returns the second factors a user can enroll
+func (a *AuthServer) enrollableFactors() []string {
+	if a.webAuthn == nil {
+		return []string{SecondFactorTOTP}
 	}
-	b, err := base64.StdEncoding.DecodeString(s[1])
+	return []string{SecondFactorTOTP, SecondFactorWebAuthn}
+}
+
+// startSession creates the session of an authenticated user. A former
+// session in the same browser is revoked.
+func (a *AuthServer) startSession(c *gin.Context, username string) (err error) {
+	user, err := a.users.FindUser(username)
 	if err != nil {
-		return ""
-	}
-	pair := strings.SplitN(string(b), ":", 2)
-	if len(pair) != 2 {
-		return ""
+		return err
 	}
+	a.throttle.succeeded(user.Guid)
 
-	clientID := pair[0]
-	if len(clientID) == 0 {
-		return ""
-	}
-	if strings.Contains(clientID, "..") || strings.ContainsAny(clientID, "/\\") {
-		return ""
+	session := sessions.Default(c)
+	if sid, ok := session.Get("sid").(string); ok {
+		_ = a.sessions.Revoke(sid)
 	}
 
-	clientConfig, err := a.clients.GewAuthClientConfig(clientID)
+	s, err := a.sessions.Create(user.Guid, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
-		return ""
+		return err
 	}
-	if clientConfig.ClientSecret != pair[1] {
-		return ""
-	}
-
-	return clientID
+	session.Clear()
+	session.Set("sid", s.ID)
+	return session.Save()
 }
 
-func (a *AuthServer) handleOauthToken(c *gin.Context) {
-	err := c.Request.ParseForm()
+// currentSession returns the session of the logged in user. Revoked and
+// expired sessions and sessions of deleted users are rejected.
+func (a *AuthServer) currentSession(c *gin.Context) (*Session, *User) {
+	sid, _ := sessions.Default(c).Get("sid").(string)
+	if sid == "" {
+		return nil, nil
+	}
+	s, ok := a.sessions.Get(sid)
+	if !ok {
+		return nil, nil
+	}
+	user, err := a.users.GetUser(s.UserGuid)
 	if err != nil {
+		return nil, nil
+	}
+	return &s, user
+}
+
+// handle2FAEnroll starts the TOTP enrollment. It requires the password
+// (also for logged in users), as the enrollment may be required to login.
+func (a *AuthServer) handle2FAEnroll(c *gin.Context) {
+	var params struct {
+		Username    string
+		Password    string
+		ProofOfWork *ProofOfWorkSolution `json:"proof_of_work"`
+	}
+	if err := c.BindJSON(&params); err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	code := c.Request.Form.Get("code")
-	grantType := c.Request.Form.Get("grant_type")
-	responseType := c.Request.Form.Get("response_type")
-	redirectURI := c.Request.Form.Get("redirect_uri")
-	clientID := c.Request.Form.Get("client_id")
-
-	if grantType != "authorization_code" {
-		c.AbortWithStatus(http.StatusInternalServerError)
+	if !a.checkPassword(c, params.Username, params.Password, params.ProofOfWork) {
 		return
 	}
-	if responseType != "token" {
-		c.AbortWithStatus(http.StatusInternalServerError)
+	if factors, _ := a.users.SecondFactors(params.Username); len(factors) > 0 {
+		// replacing the second factor requires an admin reset
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a second factor is already enrolled"})
 		return
 	}
-
-	username := a.basicAuth(c)
-	if username != clientID {
+	issuer := a.domain
+	if issuer == "" {
+		issuer = "Home Assistant Gateway"
+	}
+	enrollment, err := a.users.StartTOTPEnrollment(params.Username, issuer)
+	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	c.AbortWithStatusJSON(http.StatusOK, enrollment)
+}
 
-	authRequest := GetRequest(code)
-	if authRequest.RedirectURI != redirectURI {
-		c.AbortWithStatus(http.StatusInternalServerError)
+// handle2FAConfirm activates the second factor, returns the recovery codes
+// and logs the user in
+func (a *AuthServer) handle2FAConfirm(c *gin.Context) {
+	var params struct {
+		Username    string
+		Password    string
+		Code        string
+		ProofOfWork *ProofOfWorkSolution `json:"proof_of_work"`
+	}
+	if err := c.BindJSON(&params); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, ClaimsWithScope{})
-	jwt, _ := token.SignedString(a.config.JWTKey.RSA())
-
-	response := OauthTokenResponse{
-		AccessToken: jwt,
+	if !a.checkPassword(c, params.Username, params.Password, params.ProofOfWork) {
+		return
+	}
+	recoveryCodes, err := a.users.ConfirmTOTPEnrollment(params.Username, params.Code)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	c.AbortWithStatusJSON(http.StatusOK, response)
+	if err = a.startSession(c, params.Username); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
 }
 
 func (a *AuthServer) handleLogout(c *gin.Context) {
 	session := sessions.Default(c)
+	if sid, ok := session.Get("sid").(string); ok {
+		_ = a.sessions.Revoke(sid)
+	}
+	a.setForwardAuthCookie(c, "", -1)
 	session.Clear()
 	err := session.Save()
 	if err != nil {
@@ -327,11 +444,16 @@ func (a *AuthServer) resetPassword(c *gin.Context) {
 		return
 	}
 
-	err := a.Users().PasswordReset(payload.Token, payload.Password)
+	user, err := a.Users().PasswordReset(payload.Token, payload.Password)
 	if err != nil {
 		c.AbortWithStatus(http.StatusForbidden)
 		return
 	}
+	// the password may have been reset because it has been stolen
+	if err = a.RevokeSessions(user.Guid); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
 	c.AbortWithStatus(http.StatusAccepted)
 }
@@ -341,11 +463,64 @@ type status struct {
 }
 
 func (a *AuthServer) handleStatus(c *gin.Context) {
-	session := sessions.Default(c)
-
-	username, _ := session.Get("username").(string)
+	username := ""
+	if _, user := a.currentSession(c); user != nil {
+		username = user.Name
+	}
 
 	c.AbortWithStatusJSON(http.StatusOK, status{
 		Username: username,
 	})
 }
+
+// UserSessions returns the active sessions of a user (by guid)
+func (a *AuthServer) UserSessions(guid string) []Session {
+	return a.sessions.UserSessions(guid)
+}
+
+// RevokeSession ends a session of a user (by guid)
+func (a *AuthServer) RevokeSession(guid string, id string) error {
+	for _, s := range a.sessions.UserSessions(guid) {
+		if s.ID == id {
+			return a.sessions.Revoke(id)
+		}
+	}
+	return fmt.Errorf("session not found")
+}
+
+// RevokeSessions ends all sessions of a user (by guid). The routes of the
+// gateway notice it when they refresh their tokens.
+func (a *AuthServer) RevokeSessions(guid string) error {
+	return a.sessions.RevokeUser(guid)
+}
+
+type sessionInfo struct {
+	Session
+	Current bool `json:"current"`
+}
+
+func (a *AuthServer) handleGetSessions(c *gin.Context) {
+	current, user := a.currentSession(c)
+	if user == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	infos := []sessionInfo{}
+	for _, s := range a.sessions.UserSessions(user.Guid) {
+		infos = append(infos, sessionInfo{Session: s, Current: s.ID == current.ID})
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+func (a *AuthServer) handleDeleteSession(c *gin.Context) {
+	_, user := a.currentSession(c)
+	if user == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	if err := a.RevokeSession(user.Guid, c.Param("id")); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+}
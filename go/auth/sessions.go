@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto/rand"
+	"gopkg.in/yaml.v3"
+)
+
+// refreshTokenGracePeriod is the time a rotated refresh token can still be
+// used, as parallel requests of a route may refresh at the same time
+const refreshTokenGracePeriod = time.Minute
+
+// Session is the login of a user at the auth server. The session cookie
+// only contains the id, so that sessions can be revoked on the server.
+type Session struct {
+	ID         string    `yaml:"id" json:"id"`
+	UserGuid   string    `yaml:"user_guid" json:"-"`
+	Created    time.Time `yaml:"created" json:"created"`
+	LastUsed   time.Time `yaml:"last_used" json:"last_used"`
+	RemoteAddr string    `yaml:"remote_addr,omitempty" json:"remote_addr,omitempty"`
+	UserAgent  string    `yaml:"user_agent,omitempty" json:"user_agent,omitempty"`
+
+	RefreshTokens []*refreshToken `yaml:"refresh_tokens,omitempty" json:"-"`
+	// ForwardAuthHash is the SHA-256 hash of the secret of the forward-auth
+	// cookie, which is sent to all hosts of the domain
+	ForwardAuthHash string `yaml:"forward_auth_hash,omitempty" json:"-"`
+}
+
+// refreshToken is issued together with an access token. It is valid as
+// long as its session and is replaced by a new one when it is used.
+type refreshToken struct {
+	// Hash is the SHA-256 hash of the secret part of the token
+	Hash     string   `yaml:"hash"`
+	ClientID string   `yaml:"client_id"`
+	Scopes   []string `yaml:"scopes,omitempty"`
+	// Rotated is the time the token has been replaced by a new one
+	Rotated *time.Time `yaml:"rotated,omitempty"`
+}
+
+type sessionRegistry struct {
+	mu          sync.Mutex
+	filename    string
+	idleTimeout time.Duration
+	maxAge      time.Duration
+	sessions    map[string]*Session
+}
+
+func newSessionRegistry(filename string, idleTimeout time.Duration, maxAge time.Duration) (r *sessionRegistry, err error) {
+	r = &sessionRegistry{
+		filename:    filename,
+		idleTimeout: idleTimeout,
+		maxAge:      maxAge,
+		sessions:    make(map[string]*Session),
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	var sessions []*Session
+	if err = yaml.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		r.sessions[session.ID] = session
+	}
+	return r, nil
+}
+
+// maxRotatedRefreshTokens is the number of rotated refresh tokens, which
+// are kept per session to detect their reuse
+const maxRotatedRefreshTokens = 50
+
+// pruneRefreshTokens removes the oldest rotated refresh tokens
+func pruneRefreshTokens(tokens []*refreshToken) []*refreshToken {
+	rotated := 0
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if tokens[i].Rotated == nil {
+			continue
+		}
+		rotated++
+		if rotated > maxRotatedRefreshTokens {
+			tokens = slices.Delete(tokens, i, i+1)
+		}
+	}
+	return tokens
+}
+
+// save writes the sessions, which are not expired. The caller must hold
+// the lock.
+func (r *sessionRegistry) save() error {
+	now := time.Now()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for id, session := range r.sessions {
+		if r.expired(session, now) {
+			delete(r.sessions, id)
+			continue
+		}
+		session.RefreshTokens = pruneRefreshTokens(session.RefreshTokens)
+		sessions = append(sessions, session)
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return a.Created.Compare(b.Created)
+	})
+	data, err := yaml.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	// contains the hashes of the refresh tokens
+	return os.WriteFile(r.filename, data, 0o600)
+}
+
+func (r *sessionRegistry) expired(session *Session, now time.Time) bool {
+	return now.Sub(session.LastUsed) > r.idleTimeout || now.Sub(session.Created) > r.maxAge
+}
+
+// Create registers a new session
+func (r *sessionRegistry) Create(userGuid string, remoteAddr string, userAgent string) (Session, error) {
+	id, err := rand.GetString(32)
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	session := &Session{
+		ID:         id,
+		UserGuid:   userGuid,
+		Created:    now,
+		LastUsed:   now,
+		RemoteAddr: remoteAddr,
+		UserAgent:  userAgent,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[id] = session
+	return *session, r.save()
+}
+
+// Get returns a session, which is neither expired nor revoked, and marks it
+// as used
+func (r *sessionRegistry) Get(id string) (Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session := r.sessions[id]
+	now := time.Now()
+	if session == nil || r.expired(session, now) {
+		return Session{}, false
+	}
+	r.touch(session, now)
+	return *session, true
+}
+
+// touch marks a session as used. The last use is only saved once a minute.
+// The caller must hold the lock.
+func (r *sessionRegistry) touch(session *Session, now time.Time) {
+	if now.Sub(session.LastUsed) > time.Minute {
+		session.LastUsed = now
+		_ = r.save()
+	}
+}
+
+// UserSessions returns the active sessions of a user, the most recently
+// used first
+func (r *sessionRegistry) UserSessions(userGuid string) []Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, session := range r.sessions {
+		if session.UserGuid == userGuid && !r.expired(session, now) {
+			sessions = append(sessions, *session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return b.LastUsed.Compare(a.LastUsed)
+	})
+	return sessions
+}
+
+// Revoke ends a session, including the refresh tokens issued for it
+func (r *sessionRegistry) Revoke(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sessions[id]; !ok {
+		return fmt.Errorf("session not found")
+	}
+	delete(r.sessions, id)
+	return r.save()
+}
+
+// RevokeUser ends all sessions of a user
+func (r *sessionRegistry) RevokeUser(userGuid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, session := range r.sessions {
+		if session.UserGuid == userGuid {
+			delete(r.sessions, id)
+		}
+	}
+	return r.save()
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewRefreshToken issues a refresh token for a session. The token contains
+// the session id, so that it can be found without an index.
+func (r *sessionRegistry) NewRefreshToken(sessionID string, clientID string, scopes []string) (string, error) {
+	secret, err := rand.GetString(48)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session := r.sessions[sessionID]
+	if session == nil || r.expired(session, time.Now()) {
+		return "", fmt.Errorf("session not found")
+	}
+	session.RefreshTokens = append(session.RefreshTokens, &refreshToken{
+		Hash:     hashToken(secret),
+		ClientID: clientID,
+		Scopes:   scopes,
+	})
+	return sessionID + "." + secret, r.save()
+}
+
+// UseRefreshToken checks a refresh token and marks it as rotated, the
+// caller has to issue a new one. If a rotated token is used again after
+// the grace period, it has probably been stolen and the session is revoked.
+func (r *sessionRegistry) UseRefreshToken(token string, clientID string) (session Session, scopes []string, err error) {
+	sessionID, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return Session{}, nil, fmt.Errorf("invalid refresh token")
+	}
+	hash := hashToken(secret)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.sessions[sessionID]
+	now := time.Now()
+	if s == nil || r.expired(s, now) {
+		return Session{}, nil, fmt.Errorf("the session has ended")
+	}
+	for _, t := range s.RefreshTokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if t.ClientID != clientID {
+			return Session{}, nil, fmt.Errorf("invalid refresh token")
+		}
+		if t.Rotated != nil && now.Sub(*t.Rotated) > refreshTokenGracePeriod {
+			delete(r.sessions, sessionID)
+			if err = r.save(); err != nil {
+				return Session{}, nil, err
+			}
+			return Session{}, nil, fmt.Errorf("the refresh token has been used before, the session has been revoked")
+		}
+		if t.Rotated == nil {
+			t.Rotated = &now
+		}
+		// refreshing the tokens counts as use of the session
+		s.LastUsed = now
+		return *s, t.Scopes, r.save()
+	}
+	return Session{}, nil, fmt.Errorf("invalid refresh token")
+}
+
+// NewForwardAuthToken issues the token of the forward-auth cookie. A former
+// token of the session is replaced.
+func (r *sessionRegistry) NewForwardAuthToken(sessionID string) (string, error) {
+	secret, err := rand.GetString(48)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session := r.sessions[sessionID]
+	if session == nil || r.expired(session, time.Now()) {
+		return "", fmt.Errorf("session not found")
+	}
+	session.ForwardAuthHash = hashToken(secret)
+	return sessionID + "." + secret, r.save()
+}
+
+// ForwardAuthSession returns the session of a forward-auth token and marks
+// it as used
+func (r *sessionRegistry) ForwardAuthSession(token string) (Session, bool) {
+	sessionID, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return Session{}, false
+	}
+	hash := hashToken(secret)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session := r.sessions[sessionID]
+	now := time.Now()
+	if session == nil || r.expired(session, now) || session.ForwardAuthHash == "" ||
+		subtle.ConstantTimeCompare([]byte(session.ForwardAuthHash), []byte(hash)) != 1 {
+		return Session{}, false
+	}
+	r.touch(session, now)
+	return *session, true
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	filename := path.Join(t.TempDir(), "sessions.yml")
+	r, err := newSessionRegistry(filename, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := r.Create("alice", "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get(session.ID); !ok {
+		t.Fatal("the new session is not valid")
+	}
+
+	// the sessions survive a restart
+	r, err = newSessionRegistry(filename, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions := r.UserSessions("alice"); len(sessions) != 1 || sessions[0].ID != session.ID {
+		t.Fatalf("UserSessions() = %v, want the session %s", sessions, session.ID)
+	}
+
+	r.sessions[session.ID].LastUsed = time.Now().Add(-2 * time.Hour)
+	if _, ok := r.Get(session.ID); ok {
+		t.Error("an idle session has been accepted")
+	}
+
+	session, _ = r.Create("alice", "192.0.2.1", "test")
+	r.sessions[session.ID].Created = time.Now().Add(-25 * time.Hour)
+	if _, ok := r.Get(session.ID); ok {
+		t.Error("a session older than the maximum age has been accepted")
+	}
+
+	session, _ = r.Create("alice", "192.0.2.1", "test")
+	if err = r.RevokeUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get(session.ID); ok {
+		t.Error("a revoked session has been accepted")
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	r, err := newSessionRegistry(path.Join(t.TempDir(), "sessions.yml"), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := r.Create("alice", "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := r.NewRefreshToken(session.ID, "gateway", []string{"openid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = r.UseRefreshToken(token, "grafana"); err == nil {
+		t.Error("the refresh token has been accepted for another client")
+	}
+	_, scopes, err := r.UseRefreshToken(token, "gateway")
+	if err != nil || len(scopes) != 1 || scopes[0] != "openid" {
+		t.Fatalf("UseRefreshToken() = %v, %v, want [openid]", scopes, err)
+	}
+	// parallel requests may use the rotated token for a short time
+	if _, _, err = r.UseRefreshToken(token, "gateway"); err != nil {
+		t.Errorf("the rotated token has been rejected within the grace period: %v", err)
+	}
+	newToken, err := r.NewRefreshToken(session.ID, "gateway", []string{"openid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reuse of a rotated token after the grace period revokes the session
+	rotated := time.Now().Add(-2 * refreshTokenGracePeriod)
+	r.sessions[session.ID].RefreshTokens[0].Rotated = &rotated
+	if _, _, err = r.UseRefreshToken(token, "gateway"); err == nil {
+		t.Error("the rotated token has been accepted after the grace period")
+	}
+	if _, ok := r.Get(session.ID); ok {
+		t.Error("the session is still valid after the reuse of a rotated token")
+	}
+	if _, _, err = r.UseRefreshToken(newToken, "gateway"); err == nil {
+		t.Error("the latest refresh token has been accepted after the reuse of a rotated token")
+	}
+
+	session, _ = r.Create("alice", "192.0.2.1", "test")
+	token, _ = r.NewRefreshToken(session.ID, "gateway", nil)
+	if err = r.Revoke(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = r.UseRefreshToken(token, "gateway"); err == nil {
+		t.Error("the refresh token of a revoked session has been accepted")
+	}
+}
+
+func TestForwardAuthToken(t *testing.T) {
+	r, err := newSessionRegistry(path.Join(t.TempDir(), "sessions.yml"), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := r.Create("alice", "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := r.NewForwardAuthToken(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := r.ForwardAuthSession(token); !ok || s.UserGuid != "alice" {
+		t.Fatalf("ForwardAuthSession() = %v, %v, want the session of alice", s, ok)
+	}
+	// the session id alone must not be accepted
+	if _, ok := r.ForwardAuthSession(session.ID + "."); ok {
+		t.Error("a token without secret has been accepted")
+	}
+
+	newToken, _ := r.NewForwardAuthToken(session.ID)
+	if _, ok := r.ForwardAuthSession(token); ok {
+		t.Error("a replaced token has been accepted")
+	}
+	_ = r.Revoke(session.ID)
+	if _, ok := r.ForwardAuthSession(newToken); ok {
+		t.Error("the token of a revoked session has been accepted")
+	}
+}
@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto/rand"
+)
+
+const (
+	// maxLoginDelay is the maximum delay between two failed logins
+	maxLoginDelay = 30 * time.Second
+	// addressLockoutFactor multiplies the lockout threshold for the client
+	// addresses, as several users may share an address
+	addressLockoutFactor = 3
+	// proofOfWorkAfter is the number of failed logins, after which a proof
+	// of work is required
+	proofOfWorkAfter = 3
+	// maxProofOfWorkChallenges limits the memory used for the challenges
+	maxProofOfWorkChallenges = 10000
+	proofOfWorkChallengeTTL  = 5 * time.Minute
+)
+
+// LoginFailures are the failed logins of an account (or of a client
+// address), which are forgotten after the lockout duration
+type LoginFailures struct {
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LastAddress string     `json:"last_address,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// ProofOfWorkChallenge is sent to the client after some failed logins. The
+// client has to find a nonce, so that the SHA-256 hash of
+// "<challenge>:<nonce>" starts with the given number of zero bits.
+type ProofOfWorkChallenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+}
+
+type ProofOfWorkSolution struct {
+	Challenge string `json:"challenge"`
+	Nonce     string `json:"nonce"`
+}
+
+// loginThrottle protects the passwords against brute-force attacks. After
+// each failed login, the next attempt of the account or the client address
+// is delayed (1s, 2s, 4s, ... up to 30s). After the threshold, the account
+// (or the address) is locked for the lockout duration.
+type loginThrottle struct {
+	threshold  int
+	lockout    time.Duration
+	difficulty int
+	now        func() time.Time
+
+	mu         sync.Mutex
+	accounts   map[string]*LoginFailures
+	addresses  map[string]*LoginFailures
+	challenges map[string]time.Time
+}
+
+func newLoginThrottle(threshold int, lockout time.Duration, difficulty int) *loginThrottle {
+	return &loginThrottle{
+		threshold:  threshold,
+		lockout:    lockout,
+		difficulty: difficulty,
+		now:        time.Now,
+		accounts:   make(map[string]*LoginFailures),
+		addresses:  make(map[string]*LoginFailures),
+		challenges: make(map[string]time.Time),
+	}
+}
+
+func progressiveDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	if failures > 6 {
+		return maxLoginDelay
+	}
+	return min(time.Second<<(failures-1), maxLoginDelay)
+}
+
+// get returns the failures, which have not been forgotten yet. The caller
+// must hold the lock.
+func (t *loginThrottle) get(failures map[string]*LoginFailures, key string, now time.Time) *LoginFailures {
+	f := failures[key]
+	if f == nil {
+		return nil
+	}
+	if f.LockedUntil != nil && now.Before(*f.LockedUntil) {
+		return f
+	}
+	if now.Sub(f.LastFailure) > t.lockout {
+		delete(failures, key)
+		return nil
+	}
+	return f
+}
+
+// check returns how long the client has to wait before the next attempt.
+// locked is set if the account or the address is locked.
+func (t *loginThrottle) check(account string, address string) (wait time.Duration, locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	account = strings.ToLower(account)
+	if f := t.get(t.accounts, account, now); f != nil {
+		if f.LockedUntil != nil && now.Before(*f.LockedUntil) {
+			return f.LockedUntil.Sub(now), true
+		}
+		wait = max(wait, f.LastFailure.Add(progressiveDelay(f.Failures)).Sub(now))
+	}
+	if f := t.get(t.addresses, address, now); f != nil {
+		if f.LockedUntil != nil && now.Before(*f.LockedUntil) {
+			return f.LockedUntil.Sub(now), true
+		}
+		// several users may share the address, so the delay starts later
+		wait = max(wait, f.LastFailure.Add(progressiveDelay(f.Failures-t.threshold)).Sub(now))
+	}
+	return max(wait, 0), false
+}
+
+// failed records a failed login. It returns true if the account has been
+// locked by this attempt.
+func (t *loginThrottle) failed(account string, address string) (locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	account = strings.ToLower(account)
+	lockedUntil := now.Add(t.lockout)
+
+	f := t.get(t.accounts, account, now)
+	if f == nil {
+		f = &LoginFailures{}
+		t.accounts[account] = f
+	}
+	f.Failures++
+	f.LastFailure = now
+	f.LastAddress = address
+	if f.Failures >= t.threshold && f.LockedUntil == nil {
+		f.LockedUntil = &lockedUntil
+		locked = true
+	}
+
+	f = t.get(t.addresses, address, now)
+	if f == nil {
+		f = &LoginFailures{}
+		t.addresses[address] = f
+	}
+	f.Failures++
+	f.LastFailure = now
+	if f.Failures >= t.threshold*addressLockoutFactor && f.LockedUntil == nil {
+		f.LockedUntil = &lockedUntil
+	}
+	return locked
+}
+
+// succeeded forgets the failed logins of the account. The failures of the
+// address are kept, so that a valid account can't be used to reset them.
+func (t *loginThrottle) succeeded(account string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.accounts, strings.ToLower(account))
+}
+
+// unlock forgets the failed logins of the account (for the administrator)
+func (t *loginThrottle) unlock(account string) {
+	t.succeeded(account)
+}
+
+// failures returns the failed logins of the account
+func (t *loginThrottle) failures(account string) *LoginFailures {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f := t.get(t.accounts, strings.ToLower(account), t.now())
+	if f == nil {
+		return nil
+	}
+	result := *f
+	if f.LockedUntil != nil && !t.now().Before(*f.LockedUntil) {
+		result.LockedUntil = nil
+	}
+	return &result
+}
+
+// proofOfWorkRequired returns true after some failed logins of the account
+// or the address
+func (t *loginThrottle) proofOfWorkRequired(account string, address string) bool {
+	if t.difficulty <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if f := t.get(t.accounts, strings.ToLower(account), now); f != nil && f.Failures >= proofOfWorkAfter {
+		return true
+	}
+	if f := t.get(t.addresses, address, now); f != nil && f.Failures >= proofOfWorkAfter {
+		return true
+	}
+	return false
+}
+
+// newChallenge creates a proof of work challenge, which can be used once
+func (t *loginThrottle) newChallenge() (ProofOfWorkChallenge, error) {
+	challenge, err := rand.GetString(32)
+	if err != nil {
+		return ProofOfWorkChallenge{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if len(t.challenges) >= maxProofOfWorkChallenges {
+		for c, expires := range t.challenges {
+			if now.After(expires) {
+				delete(t.challenges, c)
+			}
+		}
+		if len(t.challenges) >= maxProofOfWorkChallenges {
+			// the oldest challenges are not known, so forget all of them
+			clear(t.challenges)
+		}
+	}
+	t.challenges[challenge] = now.Add(proofOfWorkChallengeTTL)
+	return ProofOfWorkChallenge{Challenge: challenge, Difficulty: t.difficulty}, nil
+}
+
+// verifyProofOfWork checks the solution and invalidates the challenge
+func (t *loginThrottle) verifyProofOfWork(solution *ProofOfWorkSolution) bool {
+	if solution == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	expires, ok := t.challenges[solution.Challenge]
+	delete(t.challenges, solution.Challenge)
+	t.mu.Unlock()
+
+	if !ok || t.now().After(expires) {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(solution.Challenge+":"+solution.Nonce))) >= t.difficulty
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	throttle := newLoginThrottle(4, 15*time.Minute, 8)
+	throttle.now = func() time.Time { return now }
+
+	if wait, locked := throttle.check("alice", "192.0.2.1"); wait != 0 || locked {
+		t.Fatalf("check() = %v, %v before any failure", wait, locked)
+	}
+
+	throttle.failed("Alice", "192.0.2.1")
+	throttle.failed("alice", "192.0.2.1")
+	if wait, _ := throttle.check("alice", "192.0.2.2"); wait != 2*time.Second {
+		t.Errorf("wait = %v after two failures, want 2s", wait)
+	}
+	now = now.Add(2 * time.Second)
+	if wait, _ := throttle.check("alice", "192.0.2.2"); wait != 0 {
+		t.Errorf("wait = %v after the delay, want 0", wait)
+	}
+
+	throttle.failed("alice", "192.0.2.1")
+	if !throttle.proofOfWorkRequired("alice", "192.0.2.2") {
+		t.Error("no proof of work is required after three failures")
+	}
+	if !throttle.failed("alice", "192.0.2.1") {
+		t.Error("the account has not been locked at the threshold")
+	}
+	if _, locked := throttle.check("alice", "192.0.2.2"); !locked {
+		t.Error("the locked account has been accepted")
+	}
+	if f := throttle.failures("alice"); f == nil || f.Failures != 4 || f.LockedUntil == nil {
+		t.Errorf("failures() = %+v, want 4 failures and a lock", f)
+	}
+
+	now = now.Add(16 * time.Minute)
+	if wait, locked := throttle.check("alice", "192.0.2.2"); wait != 0 || locked {
+		t.Errorf("check() = %v, %v after the lockout", wait, locked)
+	}
+
+	throttle.failed("bob", "192.0.2.3")
+	throttle.succeeded("bob")
+	if f := throttle.failures("bob"); f != nil {
+		t.Errorf("failures() = %+v after a successful login", f)
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	throttle := newLoginThrottle(10, 15*time.Minute, 8)
+	challenge, err := throttle.newChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	solution := &ProofOfWorkSolution{Challenge: challenge.Challenge}
+	for i := 0; ; i++ {
+		solution.Nonce = strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge.Challenge+":"+solution.Nonce))) >= challenge.Difficulty {
+			break
+		}
+	}
+	if !throttle.verifyProofOfWork(solution) {
+		t.Fatal("the solution has been rejected")
+	}
+	if throttle.verifyProofOfWork(solution) {
+		t.Error("a challenge has been accepted twice")
+	}
+	if throttle.verifyProofOfWork(nil) {
+		t.Error("a missing solution has been accepted")
+	}
+}
+
+func TestLoginThrottleIgnoresForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	u, err := NewUsers(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &AuthServer{
+		config:   &AuthServerConfig{AuthKey: make([]byte, 32), EncKey: make([]byte, 32)},
+		users:    u,
+		throttle: newLoginThrottle(1, 15*time.Minute, 0),
+	}
+	r := gin.New()
+	a.Register(r)
+
+	// lock the address of the client
+	for i := range addressLockoutFactor {
+		a.throttle.failed("user"+strconv.Itoa(i), "192.0.2.1")
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"carol","password":"secret"}`))
+	req.RemoteAddr = "192.0.2.1:40000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d with a spoofed X-Forwarded-For, want 429", w.Code)
+	}
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto/rand"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// accessTokenPrefix identifies the personal access tokens, so that other
+	// credentials are passed to the backend
+	accessTokenPrefix = "gwpat_"
+
+	// TokenScopeRead allows the safe methods (GET, HEAD, ...)
+	TokenScopeRead = "read"
+	// TokenScopeWrite allows all other methods
+	TokenScopeWrite = "write"
+)
+
+// AccessToken is a personal access token of a user. It is used by clients,
+// which can't follow the login redirect (CalDAV, WebDAV, scripts, ...).
+type AccessToken struct {
+	ID     string   `yaml:"id" json:"id"`
+	Name   string   `yaml:"name" json:"name"`
+	Scopes []string `yaml:"scopes" json:"scopes"`
+	// Routes are the hostnames of the routes the token may be used for. If
+	// it is empty, all routes accepting tokens are allowed.
+	Routes   []string   `yaml:"routes,omitempty" json:"routes,omitempty"`
+	Created  time.Time  `yaml:"created" json:"created"`
+	Expires  *time.Time `yaml:"expires,omitempty" json:"expires,omitempty"`
+	LastUsed *time.Time `yaml:"last_used,omitempty" json:"last_used,omitempty"`
+	// Hash is the SHA-256 hash of the secret part of the token
+	Hash string `yaml:"hash" json:"-"`
+}
+
+// newAccessToken creates the token and returns it with the secret, which
+// is only shown once
+func newAccessToken(params AccessToken) (*AccessToken, string, error) {
+	if params.Name == "" {
+		return nil, "", fmt.Errorf("access tokens must have a name")
+	}
+	if len(params.Scopes) == 0 {
+		return nil, "", fmt.Errorf("access tokens need at least one scope")
+	}
+	for _, scope := range params.Scopes {
+		if scope != TokenScopeRead && scope != TokenScopeWrite {
+			return nil, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if params.Expires != nil && params.Expires.Before(time.Now()) {
+		return nil, "", fmt.Errorf("the expiry date is in the past")
+	}
+
+	id, err := rand.GetString(12)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := rand.GetString(40)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &AccessToken{
+		ID:      id,
+		Name:    params.Name,
+		Scopes:  params.Scopes,
+		Created: time.Now(),
+		Expires: params.Expires,
+		Hash:    hashToken(secret),
+	}
+	for _, route := range params.Routes {
+		if route = strings.ToLower(strings.TrimSpace(route)); route != "" {
+			token.Routes = append(token.Routes, route)
+		}
+	}
+	return token, accessTokenPrefix + id + "_" + secret, nil
+}
+
+// IsAccessToken checks if the credential looks like a personal access
+// token
+func IsAccessToken(credential string) bool {
+	return strings.HasPrefix(credential, accessTokenPrefix)
+}
+
+// parseAccessToken splits a token into its id and secret
+func parseAccessToken(token string) (id string, secret string, ok bool) {
+	token, ok = strings.CutPrefix(token, accessTokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(token, "_")
+}
+
+// isSafeMethod returns true for the methods, which don't change anything
+// (including the read methods of WebDAV)
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "REPORT":
+		return true
+	}
+	return false
+}
+
+// allows checks if the token may be used for a request
+func (token *AccessToken) allows(hostname string, method string) error {
+	if token.Expires != nil && time.Now().After(*token.Expires) {
+		return fmt.Errorf("the access token has expired")
+	}
+	if len(token.Routes) > 0 && !slices.Contains(token.Routes, strings.ToLower(hostname)) {
+		return fmt.Errorf("the access token is not valid for %s", hostname)
+	}
+	if !slices.Contains(token.Scopes, TokenScopeWrite) && !isSafeMethod(method) {
+		return fmt.Errorf("the access token is read-only")
+	}
+	if !slices.Contains(token.Scopes, TokenScopeRead) && isSafeMethod(method) {
+		return fmt.Errorf("the access token is write-only")
+	}
+	return nil
+}
+
+// VerifyAccessToken returns the user of a personal access token, if the
+// token may be used for the route and the method
+func (a *AuthServer) VerifyAccessToken(token string, hostname string, method string) (*User, error) {
+	user, accessToken, err := a.users.CheckAccessToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err = accessToken.allows(hostname, method); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (a *AuthServer) handleGetTokens(c *gin.Context) {
+	username, ok := a.sessionUsername(c)
+	if !ok {
+		return
+	}
+	tokens, err := a.users.AccessTokens(username)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+func (a *AuthServer) handlePostToken(c *gin.Context) {
+	username, ok := a.sessionUsername(c)
+	if !ok {
+		return
+	}
+	var params AccessToken
+	if err := c.BindJSON(&params); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	token, secret, err := a.users.AddAccessToken(username, params)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": token, "secret": secret})
+}
+
+func (a *AuthServer) handleDeleteToken(c *gin.Context) {
+	username, ok := a.sessionUsername(c)
+	if !ok {
+		return
+	}
+	if err := a.users.DeleteAccessToken(username, c.Param("id")); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAccessToken(t *testing.T) {
+	token, secret, err := newAccessToken(AccessToken{
+		Name:   "calendar",
+		Scopes: []string{TokenScopeRead},
+		Routes: []string{" Cal.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, s, ok := parseAccessToken(secret)
+	if !ok || id != token.ID || hashToken(s) != token.Hash {
+		t.Fatalf("parseAccessToken(%q) doesn't match the token", secret)
+	}
+
+	if err = token.allows("cal.example.com", "PROPFIND"); err != nil {
+		t.Errorf("allows() = %v for a read request", err)
+	}
+	if err = token.allows("cal.example.com", http.MethodPut); err == nil {
+		t.Error("a read-only token has been accepted for PUT")
+	}
+	if err = token.allows("ha.example.com", http.MethodGet); err == nil {
+		t.Error("the token has been accepted for another route")
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	token.Expires = &expired
+	if err = token.allows("cal.example.com", http.MethodGet); err == nil {
+		t.Error("an expired token has been accepted")
+	}
+
+	if _, _, err = newAccessToken(AccessToken{Name: "admin", Scopes: []string{"admin"}}); err == nil {
+		t.Error("an unknown scope has been accepted")
+	}
+}
+
+func TestAccessTokenFromRequest(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "https://cal.example.com/", nil)
+	r.SetBasicAuth("alice", accessTokenPrefix+"id_secret")
+	if got := accessToken(r); got != accessTokenPrefix+"id_secret" {
+		t.Errorf("accessToken() = %q for basic authentication", got)
+	}
+
+	// other credentials are passed to the backend
+	r.Header.Set("Authorization", "Bearer eyJhbGciOi")
+	if got := accessToken(r); got != "" {
+		t.Errorf("accessToken() = %q for a foreign bearer token", got)
+	}
+	r.Header.Set("Authorization", "Bearer "+accessTokenPrefix+"id_secret")
+	if got := accessToken(r); got != accessTokenPrefix+"id_secret" {
+		t.Errorf("accessToken() = %q for a bearer token", got)
+	}
+}
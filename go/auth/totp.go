@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults of all authenticator
+// apps, so they are not included in the otpauth URI.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is the number of time steps a code may be off (to tolerate
+	// clocks which are not in sync)
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a base32 encoded secret of 160 bits
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks the code and returns its time step. Codes of steps up
+// to lastStep have already been used and are rejected (so a code can't be
+// replayed).
+func verifyTOTP(secret string, code string, now time.Time, lastStep int64) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step = current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI, which is shown as QR code
+func totpURI(issuer string, account string, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: values.Encode(),
+	}).String()
+}
+
+// qrCodeDataURL returns the QR code as PNG data URL
+func qrCodeDataURL(content string) (string, error) {
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+// newRecoveryCodes returns the codes (shown once to the user) and their
+// hashes (stored in users.yml)
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for range recoveryCodeCount {
+		random := make([]byte, 5)
+		if _, err = rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random))
+		code = code[:4] + "-" + code[4:]
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost-2)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode returns the remaining hashes, if the code matches one of
+// them
+func useRecoveryCode(hashes []string, code string) ([]string, bool) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return append(hashes[:i:i], hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
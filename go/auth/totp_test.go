@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// test vector of RFC 6238 (SHA1, truncated to 6 digits)
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0)
+
+	step, ok := verifyTOTP(secret, "287082", now, 0)
+	if !ok || step != 1 {
+		t.Fatalf("verifyTOTP() = %d, %v, want 1, true", step, ok)
+	}
+	if _, ok = verifyTOTP(secret, "287082", now, step); ok {
+		t.Error("a code must not be accepted twice")
+	}
+	if _, ok = verifyTOTP(secret, "287083", now, 0); ok {
+		t.Error("an invalid code has been accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining, ok := useRecoveryCode(hashes, codes[3])
+	if !ok || len(remaining) != recoveryCodeCount-1 {
+		t.Fatalf("expected the recovery code to be accepted")
+	}
+	if _, ok = useRecoveryCode(remaining, codes[3]); ok {
+		t.Error("a recovery code must not be accepted twice")
+	}
+}
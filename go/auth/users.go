@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base32"
 	"errors"
 	"fmt"
@@ -9,8 +10,10 @@ import (
 	"path"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
@@ -27,16 +30,78 @@ type Users interface {
 	CheckPassword(username, password string) bool
 
 	StartPasswordReset(mail string) (user User, err error)
-	PasswordReset(token string, password string) (err error)
+	// PasswordReset sets the new password and returns the user, whose
+	// sessions have to be revoked
+	PasswordReset(token string, password string) (user User, err error)
 
 	GetUser(guid string) (*User, error)
+	// FindUser returns the user by name or mail
+	FindUser(username string) (*User, error)
+
+	// SecondFactors returns the second factors the user has enrolled
+	// (SecondFactorTOTP, SecondFactorWebAuthn) and if one of its groups
+	// requires a second factor
+	SecondFactors(username string) (factors []string, required bool)
+	// StartTOTPEnrollment creates a new TOTP secret, which gets active
+	// after it has been confirmed
+	StartTOTPEnrollment(username string, issuer string) (enrollment TOTPEnrollment, err error)
+	// ConfirmTOTPEnrollment activates the secret and returns new recovery
+	// codes
+	ConfirmTOTPEnrollment(username string, code string) (recoveryCodes []string, err error)
+	// CheckSecondFactor accepts a TOTP code or a (one-time) recovery code
+	CheckSecondFactor(username string, code string) bool
+	// ResetSecondFactor removes the second factors (including the
+	// passkeys) of a user (by guid)
+	ResetSecondFactor(guid string) error
+
+	// WebAuthnUser returns the user (by name, mail or guid) with its
+	// passkeys
+	WebAuthnUser(username string) (webauthn.User, error)
+	Passkeys(username string) ([]Passkey, error)
+	AddPasskey(username string, name string, credential *webauthn.Credential) (Passkey, error)
+	// PasskeyUsed stores the new signature counter and the last-used time
+	PasskeyUsed(username string, credential *webauthn.Credential) error
+	RenamePasskey(username string, id string, name string) (Passkey, error)
+	DeletePasskey(username string, id string) error
+
+	AccessTokens(username string) ([]AccessToken, error)
+	// AddAccessToken creates a personal access token and returns it with
+	// the secret, which is only shown once
+	AddAccessToken(username string, params AccessToken) (token AccessToken, secret string, err error)
+	DeleteAccessToken(username string, id string) error
+	// CheckAccessToken returns the user and the token of a secret and
+	// stores the last-used time
+	CheckAccessToken(secret string) (*User, *AccessToken, error)
 
 	Groups() []Group
 	AddGroup(name string) (Group, error)
 	DeleteGroup(guid string) error
+	// SetGroupRequire2FA sets the policy, that all members of the group
+	// need a second factor
+	SetGroupRequire2FA(guid string, required bool) (Group, error)
+}
+
+const (
+	SecondFactorTOTP     = "totp"
+	SecondFactorWebAuthn = "webauthn"
+)
+
+// TOTPEnrollment is shown to the user to configure the authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode string `json:"qr_code"`
 }
 
 func NewUsers(dataDir string) (Users, error) {
+	u, err := newUsers(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func newUsers(dataDir string) (*users, error) {
 	u := &users{
 		filename:          path.Join(dataDir, "users.yml"),
 		usersByGuid:       make(map[string]*User),
@@ -52,13 +117,37 @@ func NewUsers(dataDir string) (Users, error) {
 }
 
 type User struct {
-	Guid          string     `yaml:"guid" json:"guid"`
-	Name          string     `yaml:"name" json:"name"`
-	Password      string     `yaml:"password,omitempty" json:"password,omitempty"`
+	Guid     string `yaml:"guid" json:"guid"`
+	Name     string `yaml:"name" json:"name"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+	// Source is the user backend (like "homeassistant"), which manages the
+	// password and the groups. It is empty for the local users.
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+	// ExternalID is the id of the user in the backend
+	ExternalID    string     `yaml:"external_id,omitempty" json:"-"`
 	Mail          string     `yaml:"mail" json:"mail"`
 	Groups        []string   `yaml:"groups" json:"groups"`
 	ResetToken    string     `yaml:"reset_token,omitempty" json:"reset_token,omitempty"`
 	ResetTokenTTL *time.Time `yaml:"reset_token_ttl,omitempty" json:"reset_token_ttl,omitempty"`
+	// TOTPSecret is the base32 encoded secret of the second factor,
+	// TOTPPending the secret of an enrollment which hasn't been confirmed
+	TOTPSecret  string `yaml:"totp_secret,omitempty" json:"-"`
+	TOTPPending string `yaml:"totp_pending,omitempty" json:"-"`
+	// TOTPLastStep is the time step of the last accepted code
+	TOTPLastStep int64 `yaml:"totp_last_step,omitempty" json:"-"`
+	// RecoveryCodes are the bcrypt hashes of the unused recovery codes
+	RecoveryCodes []string `yaml:"recovery_codes,omitempty" json:"-"`
+	// Passkeys are the registered WebAuthn credentials
+	Passkeys []*Passkey `yaml:"passkeys,omitempty" json:"passkeys,omitempty"`
+	// AccessTokens are the personal access tokens
+	AccessTokens []*AccessToken `yaml:"access_tokens,omitempty" json:"access_tokens,omitempty"`
+	// SecondFactor is only used in the JSON representation
+	SecondFactor bool `yaml:"-" json:"second_factor"`
+	// RecoveryCodesLeft is only used in the JSON representation
+	RecoveryCodesLeft int `yaml:"-" json:"recovery_codes_left,omitempty"`
+	// LoginFailures is only used in the JSON representation (set by the
+	// admin API, as they are only known to the auth server)
+	LoginFailures *LoginFailures `yaml:"-" json:"login_failures,omitempty"`
 }
 
 func (user *User) SetPassword(password string) error {
@@ -75,6 +164,8 @@ func (user *User) SetPassword(password string) error {
 type Group struct {
 	Guid string `yaml:"guid" json:"guid"`
 	Name string `yaml:"name" json:"name"`
+	// Require2FA requires a second factor for all members of the group
+	Require2FA bool `yaml:"require_2fa,omitempty" json:"require_2fa"`
 }
 
 type Config struct {
@@ -83,6 +174,9 @@ type Config struct {
 }
 
 type users struct {
+	// mutex guards the users and groups, the login handlers run
+	// concurrently
+	mutex    sync.Mutex
 	filename string
 	config   Config
 
@@ -93,12 +187,14 @@ type users struct {
 	groupsByName map[string]*Group
 }
 
+// Write saves the users, the caller holds the mutex
 func (u *users) Write() (err error) {
 	data, err := yaml.Marshal(u.config)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(u.filename, data, 0o644)
+	// contains the TOTP secrets
+	return os.WriteFile(u.filename, data, 0o600)
 }
 
 func (u *users) Read() (err error) {
@@ -153,16 +249,22 @@ func (u *users) Read() (err error) {
 }
 
 func (u *users) Users() []User {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	users := make([]User, 0, len(u.config.Users))
 	for _, user := range u.config.Users {
 		userWithoutPassword := *user
 		userWithoutPassword.Password = ""
+		userWithoutPassword.SecondFactor = user.TOTPSecret != "" || len(user.Passkeys) > 0
+		userWithoutPassword.RecoveryCodesLeft = len(user.RecoveryCodes)
 		users = append(users, userWithoutPassword)
 	}
 	return users
 }
 
 func (u *users) AddUser(user User) (User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	if user.Name == "" {
 		return User{}, fmt.Errorf("Users must have a name")
 	}
@@ -172,7 +274,7 @@ func (u *users) AddUser(user User) (User, error) {
 	if len(user.Groups) == 0 {
 		user.Groups = []string{"user"}
 	}
-	err := u.CheckGroups(user.Groups...)
+	err := u.checkGroups(user.Groups...)
 	if err != nil {
 		return User{}, err
 	}
@@ -194,6 +296,7 @@ func (u *users) AddUser(user User) (User, error) {
 
 	user.Guid = uuid.New().String()
 
+	u.usersByGuid[user.Guid] = &user
 	u.usersByNameOrMail[strings.ToLower(user.Name)] = &user
 	u.usersByNameOrMail[strings.ToLower(user.Mail)] = &user
 
@@ -211,23 +314,30 @@ func (u *users) AddUser(user User) (User, error) {
 }
 
 func (u *users) DeleteUser(guid string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	user := u.usersByGuid[guid]
 	if user == nil {
 		return ErrNotFound
 	}
+	u.deleteUser(user)
+	return u.Write()
+}
+
+// deleteUser removes the user without writing users.yml. The caller holds
+// the mutex.
+func (u *users) deleteUser(user *User) {
 	delete(u.usersByNameOrMail, strings.ToLower(user.Name))
 	delete(u.usersByNameOrMail, strings.ToLower(user.Mail))
 	delete(u.usersByGuid, user.Guid)
-	for i, user := range u.config.Users {
-		if user.Guid == guid {
-			u.config.Users = append(u.config.Users[:i], u.config.Users[i+1:]...)
-			break
-		}
-	}
-	return u.Write()
+	u.config.Users = slices.DeleteFunc(u.config.Users, func(other *User) bool {
+		return other.Guid == user.Guid
+	})
 }
 
 func (u *users) GetUser(guid string) (*User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	user := u.usersByGuid[guid]
 	if user == nil {
 		return nil, ErrNotFound
@@ -235,7 +345,19 @@ func (u *users) GetUser(guid string) (*User, error) {
 	return user, nil
 }
 
+func (u *users) FindUser(username string) (*User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	return user, nil
+}
+
 func (u *users) GetUserByMail(mail string) (*User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	user := u.usersByNameOrMail[strings.ToLower(mail)]
 	if user == nil {
 		return nil, ErrNotFound
@@ -247,6 +369,12 @@ func (u *users) GetUserByMail(mail string) (*User, error) {
 }
 
 func (u *users) GetUserByResetToken(token string) (*User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.getUserByResetToken(token)
+}
+
+func (u *users) getUserByResetToken(token string) (*User, error) {
 	for _, user := range u.config.Users {
 		if user.ResetToken == token && (user.ResetTokenTTL == nil || time.Now().Before(*user.ResetTokenTTL)) {
 			return user, nil
@@ -256,6 +384,8 @@ func (u *users) GetUserByResetToken(token string) (*User, error) {
 }
 
 func (u *users) StartPasswordReset(mail string) (User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	user := u.usersByNameOrMail[strings.ToLower(mail)]
 	if user == nil {
 		return User{}, ErrNotFound
@@ -281,27 +411,31 @@ func (u *users) StartPasswordReset(mail string) (User, error) {
 	return *user, nil
 }
 
-func (u *users) PasswordReset(token string, password string) (err error) {
+func (u *users) PasswordReset(token string, password string) (User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	if token == "" || password == "" {
-		return fmt.Errorf("must specify a token and password")
+		return User{}, fmt.Errorf("must specify a token and password")
 	}
 
-	user, err := u.GetUserByResetToken(token)
+	user, err := u.getUserByResetToken(token)
 	if err != nil {
-		return err
+		return User{}, err
 	}
 	err = user.SetPassword(password)
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
 	user.ResetToken = ""
 	user.ResetTokenTTL = nil
 
-	return u.Write()
+	return *user, u.Write()
 }
 
 func (u *users) CheckPassword(username, password string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	user := u.usersByNameOrMail[strings.ToLower(username)]
 	if nil == user {
 		return false
@@ -310,7 +444,281 @@ func (u *users) CheckPassword(username, password string) bool {
 	return err == nil
 }
 
+func (u *users) SecondFactors(username string) (factors []string, required bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return nil, false
+	}
+	for _, name := range user.Groups {
+		if group := u.groupsByName[name]; group != nil && group.Require2FA {
+			required = true
+		}
+	}
+	if user.TOTPSecret != "" {
+		factors = append(factors, SecondFactorTOTP)
+	}
+	if len(user.Passkeys) > 0 {
+		factors = append(factors, SecondFactorWebAuthn)
+	}
+	return factors, required
+}
+
+func (u *users) StartTOTPEnrollment(username string, issuer string) (enrollment TOTPEnrollment, err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return enrollment, ErrNotFound
+	}
+	enrollment.Secret, err = newTOTPSecret()
+	if err != nil {
+		return enrollment, err
+	}
+	enrollment.URI = totpURI(issuer, user.Name, enrollment.Secret)
+	enrollment.QRCode, err = qrCodeDataURL(enrollment.URI)
+	if err != nil {
+		return enrollment, err
+	}
+	user.TOTPPending = enrollment.Secret
+	return enrollment, u.Write()
+}
+
+func (u *users) ConfirmTOTPEnrollment(username string, code string) (recoveryCodes []string, err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	if user.TOTPPending == "" {
+		return nil, fmt.Errorf("there is no pending enrollment")
+	}
+	step, ok := verifyTOTP(user.TOTPPending, code, time.Now(), 0)
+	if !ok {
+		return nil, fmt.Errorf("invalid code")
+	}
+	recoveryCodes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = user.TOTPPending
+	user.TOTPPending = ""
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	return recoveryCodes, u.Write()
+}
+
+func (u *users) CheckSecondFactor(username string, code string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil || user.TOTPSecret == "" {
+		return false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	if step, ok := verifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		user.TOTPLastStep = step
+		u.Write()
+		return true
+	}
+	remaining, ok := useRecoveryCode(user.RecoveryCodes, code)
+	if !ok {
+		return false
+	}
+	user.RecoveryCodes = remaining
+	u.Write()
+	return true
+}
+
+func (u *users) ResetSecondFactor(guid string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByGuid[guid]
+	if user == nil {
+		return ErrNotFound
+	}
+	user.TOTPSecret = ""
+	user.TOTPPending = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	user.Passkeys = nil
+	return u.Write()
+}
+
+func (u *users) WebAuthnUser(username string) (webauthn.User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByGuid[username]
+	if user == nil {
+		user = u.usersByNameOrMail[strings.ToLower(username)]
+	}
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	return newWebAuthnUser(user)
+}
+
+func (u *users) Passkeys(username string) ([]Passkey, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	passkeys := make([]Passkey, 0, len(user.Passkeys))
+	for _, passkey := range user.Passkeys {
+		passkeys = append(passkeys, *passkey)
+	}
+	return passkeys, nil
+}
+
+func (u *users) AddPasskey(username string, name string, credential *webauthn.Credential) (Passkey, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return Passkey{}, ErrNotFound
+	}
+	passkey, err := newPasskey(name, credential)
+	if err != nil {
+		return Passkey{}, err
+	}
+	user.Passkeys = append(user.Passkeys, passkey)
+	return *passkey, u.Write()
+}
+
+func (u *users) getPasskey(username string, id string) (*User, *Passkey, error) {
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return nil, nil, ErrNotFound
+	}
+	for _, passkey := range user.Passkeys {
+		if passkey.ID == id {
+			return user, passkey, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("passkey %q not found", id)
+}
+
+func (u *users) PasskeyUsed(username string, credential *webauthn.Credential) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	_, passkey, err := u.getPasskey(username, passkeyID(credential.ID))
+	if err != nil {
+		return err
+	}
+	if err = passkey.setCredential(credential); err != nil {
+		return err
+	}
+	now := time.Now()
+	passkey.LastUsed = &now
+	return u.Write()
+}
+
+func (u *users) RenamePasskey(username string, id string, name string) (Passkey, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if name == "" {
+		return Passkey{}, fmt.Errorf("passkeys must have a name")
+	}
+	_, passkey, err := u.getPasskey(username, id)
+	if err != nil {
+		return Passkey{}, err
+	}
+	passkey.Name = name
+	return *passkey, u.Write()
+}
+
+func (u *users) DeletePasskey(username string, id string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user, passkey, err := u.getPasskey(username, id)
+	if err != nil {
+		return err
+	}
+	user.Passkeys = slices.DeleteFunc(user.Passkeys, func(p *Passkey) bool { return p == passkey })
+	return u.Write()
+}
+
+func (u *users) AccessTokens(username string) ([]AccessToken, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	tokens := make([]AccessToken, 0, len(user.AccessTokens))
+	for _, token := range user.AccessTokens {
+		tokens = append(tokens, *token)
+	}
+	return tokens, nil
+}
+
+func (u *users) AddAccessToken(username string, params AccessToken) (AccessToken, string, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return AccessToken{}, "", ErrNotFound
+	}
+	token, secret, err := newAccessToken(params)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	user.AccessTokens = append(user.AccessTokens, token)
+	return *token, secret, u.Write()
+}
+
+func (u *users) DeleteAccessToken(username string, id string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	user := u.usersByNameOrMail[strings.ToLower(username)]
+	if user == nil {
+		return ErrNotFound
+	}
+	n := len(user.AccessTokens)
+	user.AccessTokens = slices.DeleteFunc(user.AccessTokens, func(t *AccessToken) bool { return t.ID == id })
+	if len(user.AccessTokens) == n {
+		return fmt.Errorf("access token %q not found", id)
+	}
+	return u.Write()
+}
+
+func (u *users) CheckAccessToken(secret string) (*User, *AccessToken, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	id, secret, ok := parseAccessToken(secret)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid access token")
+	}
+	hash := hashToken(secret)
+	for _, user := range u.config.Users {
+		for _, token := range user.AccessTokens {
+			if token.ID != id {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+				return nil, nil, fmt.Errorf("invalid access token")
+			}
+			// the last use is only saved once a minute
+			now := time.Now()
+			if token.LastUsed == nil || now.Sub(*token.LastUsed) > time.Minute {
+				token.LastUsed = &now
+				if err := u.Write(); err != nil {
+					return nil, nil, err
+				}
+			}
+			return user, token, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("invalid access token")
+}
+
 func (u *users) Groups() []Group {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	groups := make([]Group, 0, len(u.config.Groups))
 	for _, group := range u.config.Groups {
 		groups = append(groups, *group)
@@ -319,6 +727,12 @@ func (u *users) Groups() []Group {
 }
 
 func (u *users) CheckGroups(names ...string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.checkGroups(names...)
+}
+
+func (u *users) checkGroups(names ...string) error {
 	for _, name := range names {
 		if _, ok := u.groupsByName[name]; !ok {
 			return fmt.Errorf("there is no group with name %s", name)
@@ -328,6 +742,8 @@ func (u *users) CheckGroups(names ...string) error {
 }
 
 func (u *users) AddGroup(name string) (Group, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	group := u.groupsByName[name]
 	if group != nil {
 		return *group, nil
@@ -335,6 +751,7 @@ func (u *users) AddGroup(name string) (Group, error) {
 
 	group = &Group{Name: name}
 	group.Guid = uuid.New().String()
+	u.groupsByGuid[group.Guid] = group
 	u.groupsByName[name] = group
 	u.config.Groups = append(u.config.Groups, group)
 
@@ -345,7 +762,20 @@ func (u *users) AddGroup(name string) (Group, error) {
 	return *group, nil
 }
 
+func (u *users) SetGroupRequire2FA(guid string, required bool) (Group, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	group := u.groupsByGuid[guid]
+	if group == nil {
+		return Group{}, ErrNotFound
+	}
+	group.Require2FA = required
+	return *group, u.Write()
+}
+
 func (u *users) DeleteGroup(guid string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	group := u.groupsByGuid[guid]
 	if group == nil {
 		return ErrNotFound
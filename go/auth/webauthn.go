@@ -0,0 +1,406 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Passkey is a WebAuthn credential of a user
+type Passkey struct {
+	// ID is the base64url encoded credential ID
+	ID       string     `yaml:"id" json:"id"`
+	Name     string     `yaml:"name" json:"name"`
+	Created  time.Time  `yaml:"created" json:"created"`
+	LastUsed *time.Time `yaml:"last_used,omitempty" json:"last_used,omitempty"`
+	// Credential is the JSON encoded webauthn.Credential (public key,
+	// signature counter, ...)
+	Credential string `yaml:"credential" json:"-"`
+}
+
+func passkeyID(credentialID []byte) string {
+	return base64.RawURLEncoding.EncodeToString(credentialID)
+}
+
+func newPasskey(name string, credential *webauthn.Credential) (*Passkey, error) {
+	passkey := &Passkey{
+		ID:      passkeyID(credential.ID),
+		Name:    name,
+		Created: time.Now(),
+	}
+	return passkey, passkey.setCredential(credential)
+}
+
+func (passkey *Passkey) setCredential(credential *webauthn.Credential) error {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	passkey.Credential = string(data)
+	return nil
+}
+
+func (passkey *Passkey) credential() (credential webauthn.Credential, err error) {
+	err = json.Unmarshal([]byte(passkey.Credential), &credential)
+	return credential, err
+}
+
+// webAuthnUser implements webauthn.User. The guid is used as user handle,
+// so that renaming a user doesn't break its passkeys.
+type webAuthnUser struct {
+	guid        string
+	name        string
+	credentials []webauthn.Credential
+}
+
+func newWebAuthnUser(user *User) (*webAuthnUser, error) {
+	w := &webAuthnUser{guid: user.Guid, name: user.Name}
+	for _, passkey := range user.Passkeys {
+		credential, err := passkey.credential()
+		if err != nil {
+			return nil, fmt.Errorf("invalid passkey %q of user %s: %w", passkey.Name, user.Name, err)
+		}
+		w.credentials = append(w.credentials, credential)
+	}
+	return w, nil
+}
+
+func (w *webAuthnUser) WebAuthnID() []byte {
+	return []byte(w.guid)
+}
+
+func (w *webAuthnUser) WebAuthnName() string {
+	return w.name
+}
+
+func (w *webAuthnUser) WebAuthnDisplayName() string {
+	return w.name
+}
+
+func (w *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return w.credentials
+}
+
+// EnableWebAuthn enables the passkey login. The relying party ID is the
+// domain of the auth route, so the passkeys stay valid if the hostname of
+// the auth route is changed within the domain.
+func (a *AuthServer) EnableWebAuthn(hostname string, domain string) (err error) {
+	a.webAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          domain,
+		RPDisplayName: "Home Assistant Gateway",
+		RPOrigins:     []string{"https://" + hostname},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+	return err
+}
+
+const (
+	webAuthnRegistration = "registration"
+	webAuthnLogin        = "login"
+)
+
+// webAuthnCeremony is stored in the session between the begin and finish
+// requests of a registration or login
+type webAuthnCeremony struct {
+	Type    string               `json:"type"`
+	Session webauthn.SessionData `json:"session"`
+	// Username is empty for a discoverable (passwordless) login
+	Username string `json:"username,omitempty"`
+	// Name is the name of the passkey to register
+	Name string `json:"name,omitempty"`
+	// Login is set if the registration happens before the first login
+	Login bool `json:"login,omitempty"`
+}
+
+func (a *AuthServer) saveWebAuthnCeremony(c *gin.Context, ceremony webAuthnCeremony) error {
+	data, err := json.Marshal(ceremony)
+	if err != nil {
+		return err
+	}
+	session := sessions.Default(c)
+	session.Set("webauthn", string(data))
+	return session.Save()
+}
+
+// takeWebAuthnCeremony removes the ceremony from the session, so that each
+// challenge can be used only once
+func (a *AuthServer) takeWebAuthnCeremony(c *gin.Context, ceremonyType string) (*webAuthnCeremony, error) {
+	session := sessions.Default(c)
+	data, _ := session.Get("webauthn").(string)
+	if data == "" {
+		return nil, fmt.Errorf("there is no pending %s", ceremonyType)
+	}
+	session.Delete("webauthn")
+	if err := session.Save(); err != nil {
+		return nil, err
+	}
+	var ceremony webAuthnCeremony
+	if err := json.Unmarshal([]byte(data), &ceremony); err != nil {
+		return nil, err
+	}
+	if ceremony.Type != ceremonyType {
+		return nil, fmt.Errorf("there is no pending %s", ceremonyType)
+	}
+	return &ceremony, nil
+}
+
+func (a *AuthServer) requireWebAuthn(c *gin.Context) bool {
+	if a.webAuthn == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{"error": "passkeys are not enabled"})
+		return false
+	}
+	return true
+}
+
+// sessionUsername returns the user of the session or aborts the request
+func (a *AuthServer) sessionUsername(c *gin.Context) (string, bool) {
+	_, user := a.currentSession(c)
+	if user == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return "", false
+	}
+	return user.Name, true
+}
+
+// handleWebAuthnRegisterBegin starts the registration of a passkey. Logged
+// in users can register additional passkeys, otherwise the password is
+// required and the registration is only possible if the user hasn't
+// enrolled a second factor yet (like the TOTP enrollment).
+func (a *AuthServer) handleWebAuthnRegisterBegin(c *gin.Context) {
+	if !a.requireWebAuthn(c) {
+		return
+	}
+	var params struct {
+		Username    string
+		Password    string
+		Name        string
+		ProofOfWork *ProofOfWorkSolution `json:"proof_of_work"`
+	}
+	if err := c.BindJSON(&params); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	ceremony := webAuthnCeremony{Type: webAuthnRegistration, Name: params.Name}
+	if _, sessionUser := a.currentSession(c); sessionUser != nil {
+		ceremony.Username = sessionUser.Name
+	}
+	if ceremony.Username == "" {
+		if !a.checkPassword(c, params.Username, params.Password, params.ProofOfWork) {
+			return
+		}
+		if factors, _ := a.users.SecondFactors(params.Username); len(factors) > 0 {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a second factor is already enrolled"})
+			return
+		}
+		ceremony.Username, ceremony.Login = params.Username, true
+	}
+	if ceremony.Name == "" {
+		ceremony.Name = "Passkey"
+	}
+
+	user, err := a.users.WebAuthnUser(ceremony.Username)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	creation, session, err := a.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ceremony.Session = *session
+	if err = a.saveWebAuthnCeremony(c, ceremony); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, creation)
+}
+
+// handleWebAuthnRegisterFinish expects the response of
+// navigator.credentials.create() and stores the new passkey
+func (a *AuthServer) handleWebAuthnRegisterFinish(c *gin.Context) {
+	if !a.requireWebAuthn(c) {
+		return
+	}
+	ceremony, err := a.takeWebAuthnCeremony(c, webAuthnRegistration)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := a.users.WebAuthnUser(ceremony.Username)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	credential, err := a.webAuthn.FinishRegistration(user, ceremony.Session, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	passkey, err := a.users.AddPasskey(ceremony.Username, ceremony.Name, credential)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if ceremony.Login {
+		if err = a.startSession(c, ceremony.Username); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, passkey)
+}
+
+// handleWebAuthnLoginBegin starts a passwordless login, or (if username and
+// password are given) the login with a passkey as second factor
+func (a *AuthServer) handleWebAuthnLoginBegin(c *gin.Context) {
+	if !a.requireWebAuthn(c) {
+		return
+	}
+	var params struct {
+		Username    string
+		Password    string
+		ProofOfWork *ProofOfWorkSolution `json:"proof_of_work"`
+	}
+	if err := c.BindJSON(&params); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	ceremony := webAuthnCeremony{Type: webAuthnLogin}
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	var err error
+	if params.Username != "" {
+		if !a.checkPassword(c, params.Username, params.Password, params.ProofOfWork) {
+			return
+		}
+		var user webauthn.User
+		user, err = a.users.WebAuthnUser(params.Username)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if len(user.WebAuthnCredentials()) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "no passkeys registered"})
+			return
+		}
+		ceremony.Username = params.Username
+		assertion, session, err = a.webAuthn.BeginLogin(user)
+	} else {
+		// without password, the authenticator has to verify the user
+		assertion, session, err = a.webAuthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ceremony.Session = *session
+	if err = a.saveWebAuthnCeremony(c, ceremony); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, assertion)
+}
+
+// handleWebAuthnLoginFinish expects the response of
+// navigator.credentials.get() and starts the session
+func (a *AuthServer) handleWebAuthnLoginFinish(c *gin.Context) {
+	if !a.requireWebAuthn(c) {
+		return
+	}
+	ceremony, err := a.takeWebAuthnCeremony(c, webAuthnLogin)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user webauthn.User
+	var credential *webauthn.Credential
+	if ceremony.Username != "" {
+		user, err = a.users.WebAuthnUser(ceremony.Username)
+		if err == nil {
+			credential, err = a.webAuthn.FinishLogin(user, ceremony.Session, c.Request)
+		}
+	} else {
+		// the user handle is the guid of the user
+		user, credential, err = a.webAuthn.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			return a.users.WebAuthnUser(string(userHandle))
+		}, ceremony.Session, c.Request)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if credential.Authenticator.CloneWarning {
+		fmt.Printf("WebAuthn: the signature counter of a passkey of %s is invalid (cloned authenticator?)\n", user.WebAuthnName())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "the passkey may have been cloned"})
+		return
+	}
+	if err = a.users.PasskeyUsed(user.WebAuthnName(), credential); err != nil {
+		fmt.Println("WebAuthn:", err)
+	}
+	if err = a.startSession(c, user.WebAuthnName()); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain", []byte("OK"))
+}
+
+func (a *AuthServer) handleGetPasskeys(c *gin.Context) {
+	username, ok := a.sessionUsername(c)
+	if !ok {
+		return
+	}
+	passkeys, err := a.users.Passkeys(username)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"passkeys": passkeys})
+}
+
+func (a *AuthServer) handlePutPasskey(c *gin.Context) {
+	username, ok := a.sessionUsername(c)
+	if !ok {
+		return
+	}
+	var params struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&params); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	passkey, err := a.users.RenamePasskey(username, c.Param("id"), params.Name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, passkey)
+}
+
+func (a *AuthServer) handleDeletePasskey(c *gin.Context) {
+	username, ok := a.sessionUsername(c)
+	if !ok {
+		return
+	}
+	if err := a.users.DeletePasskey(username, c.Param("id")); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestPasskeys(t *testing.T) {
+	dataDir := t.TempDir()
+	u, err := NewUsers(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.AddGroup("user"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := u.AddUser(User{Name: "alice", Mail: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential := &webauthn.Credential{ID: []byte{1, 2, 3}, PublicKey: []byte{4, 5, 6}}
+	passkey, err := u.AddPasskey("alice", "Laptop", credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential.Authenticator.SignCount = 7
+	if err = u.PasskeyUsed("alice", credential); err != nil {
+		t.Fatal(err)
+	}
+	if factors, _ := u.SecondFactors("alice"); len(factors) != 1 || factors[0] != SecondFactorWebAuthn {
+		t.Errorf("SecondFactors() = %v, want [%s]", factors, SecondFactorWebAuthn)
+	}
+
+	// the credential must survive a restart and be found by the user handle
+	u, err = NewUsers(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webAuthnUser, err := u.WebAuthnUser(user.Guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := webAuthnUser.WebAuthnCredentials()
+	if len(credentials) != 1 || string(credentials[0].PublicKey) != string(credential.PublicKey) ||
+		credentials[0].Authenticator.SignCount != 7 {
+		t.Fatalf("unexpected credentials: %+v", credentials)
+	}
+	passkeys, _ := u.Passkeys("alice")
+	if len(passkeys) != 1 || passkeys[0].ID != passkey.ID || passkeys[0].LastUsed == nil {
+		t.Fatalf("unexpected passkeys: %+v", passkeys)
+	}
+
+	if err = u.DeletePasskey("alice", passkey.ID); err != nil {
+		t.Fatal(err)
+	}
+	if factors, _ := u.SecondFactors("alice"); len(factors) != 0 {
+		t.Errorf("SecondFactors() = %v, want none", factors)
+	}
+}
+
+func TestWebAuthnLoginBeginThrottled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	u, err := NewUsers(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.AddGroup("user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.AddUser(User{Name: "alice", Mail: "alice@example.com", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	a := &AuthServer{config: &AuthServerConfig{}, users: u, throttle: newLoginThrottle(3, 15*time.Minute, 0)}
+	if err = a.EnableWebAuthn("auth.example.com", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	account := a.accountKey("alice")
+	for range 3 {
+		a.throttle.failed(account, "192.0.2.1")
+	}
+
+	// the correct password must not reveal anything about a locked account
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/webauthn/login/begin",
+		strings.NewReader(`{"username":"alice","password":"secret"}`))
+	a.handleWebAuthnLoginBegin(c)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d for a locked account, want 429", w.Code)
+	}
+}
@@ -2,64 +2,187 @@ package acme
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
 	"path"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
 	"golang.org/x/crypto/acme"
 )
 
+// Challenge types which can be used to prove the ownership of a domain
+const (
+	ChallengeDNS01     = "dns-01"
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
 type Client interface {
 	DataDir() string
+	// CAName returns the name of the certificate authority
+	CAName() string
+	// IssueCertificate uses the challenge type of the client (DNS-01 by default)
 	IssueCertificate(csr crypto.CSR) (chain crypto.CertificateChain, err error)
+	// IssueCertificateWithLog passes all messages of the issuance to logf
+	IssueCertificateWithLog(csr crypto.CSR, logf func(msg string)) (chain crypto.CertificateChain, err error)
+	// RevokeCertificate revokes a certificate issued by this CA. The reason
+	// is a CRL reason code (RFC 5280).
+	RevokeCertificate(cert crypto.Certificate, reason int) error
+	// SuggestedRenewalWindow queries the ACME Renewal Information of a
+	// certificate (the window is zero if the CA doesn't support it)
+	SuggestedRenewalWindow(cert crypto.Certificate) (start time.Time, end time.Time, err error)
+	// WithChallengeType returns a client using the same account, which
+	// proves the ownership using the given challenge type
+	WithChallengeType(challengeType string) (Client, error)
+	SetHTTPChallengeHandler(handler HTTPChallengeHandler)
+	SetTLSALPNChallengeHandler(handler TLSALPNChallengeHandler)
 }
 
+// ChallengeHandler publishes the TXT record of DNS-01 challenges
 type ChallengeHandler interface {
 	SetChallenge(domain string, challenge string) error
 }
 
+// HTTPChallengeHandler serves the key authorization of HTTP-01 challenges
+// at /.well-known/acme-challenge/<token>. An empty challenge removes it.
+type HTTPChallengeHandler interface {
+	SetChallenge(hostname string, token string, challenge string) error
+}
+
+// TLSALPNChallengeHandler presents the certificate of TLS-ALPN-01
+// challenges to clients requesting the "acme-tls/1" protocol. A nil
+// certificate removes the challenge.
+type TLSALPNChallengeHandler interface {
+	SetTLSALPNChallenge(hostname string, certificate *tls.Certificate)
+}
+
+type handlers struct {
+	dns     ChallengeHandler
+	http    HTTPChallengeHandler
+	tlsALPN TLSALPNChallengeHandler
+}
+
 type client struct {
-	dataDir          string
-	client           *acme.Client
-	account          *acme.Account
-	challengeHandler ChallengeHandler
+	dataDir       string
+	config        CAConfig
+	client        *acme.Client
+	account       *acme.Account
+	handlers      *handlers
+	challengeType string
+	issuanceLog   func(msg string)
+}
+
+// log prints the message and appends it to the log of the current issuance
+func (c *client) log(a ...any) {
+	msg := strings.TrimSuffix(fmt.Sprintln(a...), "\n")
+	fmt.Println("ACME|", msg)
+	if c.issuanceLog != nil {
+		c.issuanceLog(msg)
+	}
 }
 
 func (c *client) DataDir() string {
 	return c.dataDir
 }
 
+func (c *client) CAName() string {
+	return c.config.Name
+}
+
+// CheckChallengeType returns an error if the challenge type is not supported
+// (an empty challenge type selects DNS-01)
+func CheckChallengeType(challengeType string) error {
+	switch challengeType {
+	case "", ChallengeDNS01, ChallengeHTTP01, ChallengeTLSALPN01:
+		return nil
+	}
+	return fmt.Errorf("unsupported challenge type: %s", challengeType)
+}
+
+func (c *client) WithChallengeType(challengeType string) (Client, error) {
+	if err := CheckChallengeType(challengeType); err != nil {
+		return nil, err
+	}
+	if challengeType == "" {
+		challengeType = ChallengeDNS01
+	}
+	result := *c
+	result.challengeType = challengeType
+	return &result, nil
+}
+
+func (c *client) SetHTTPChallengeHandler(handler HTTPChallengeHandler) {
+	c.handlers.http = handler
+}
+
+func (c *client) SetTLSALPNChallengeHandler(handler TLSALPNChallengeHandler) {
+	c.handlers.tlsALPN = handler
+}
+
+// orderTimeout limits the time an order may stay pending or processing
+const orderTimeout = 10 * time.Minute
+
+func (c *client) IssueCertificateWithLog(csr crypto.CSR, logf func(msg string)) (chain crypto.CertificateChain, err error) {
+	issuance := *c
+	issuance.issuanceLog = logf
+	chain, err = issuance.IssueCertificate(csr)
+	c.account = issuance.account
+	return chain, err
+}
+
+func (c *client) RevokeCertificate(cert crypto.Certificate, reason int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := c.GetAccount(ctx)
+	if err != nil {
+		return err
+	}
+	c.log("Revoke certificate:", cert.OBJ().SerialNumber, "reason:", reason)
+	return c.client.RevokeCert(ctx, nil, cert.ASN1(), acme.CRLReasonCode(reason))
+}
+
 func (c *client) IssueCertificate(csr crypto.CSR) (chain crypto.CertificateChain, err error) {
-	fmt.Println("ACME| Try to create order...")
-	ctx := context.Background()
+	c.log("Try to create order...")
+	ctx, cancel := context.WithTimeout(context.Background(), orderTimeout)
+	defer cancel()
 
 	err = c.GetAccount(ctx)
 	if err != nil {
-		fmt.Println("ACME| ", err)
+		c.log(err)
 		return nil, err
 	}
 	order, err := c.client.AuthorizeOrder(ctx, acme.DomainIDs(csr.OBJ().DNSNames...))
 	if err != nil {
-		fmt.Println("ACME| ", err)
+		c.log(err)
 		return nil, err
 	}
 	orderURI := order.URI
-	fmt.Println("ACME| Order-URI:", orderURI)
+	c.log("Order-URI:", orderURI)
+
+	// the challenges prepared for the order (by identifier)
+	prepared := map[string]*acme.Challenge{}
+	defer c.clearChallenges(prepared)
 
 	for {
-		fmt.Println("ACME| Order-Status:", order.Status)
+		c.log("Order-Status:", order.Status)
 
 		var der [][]byte
 
 		switch order.Status {
 		case acme.StatusPending:
-			err = c.acceptChallenges(ctx, order)
+			err = c.acceptChallenges(ctx, order, prepared)
+			if err == nil {
+				err = sleep(ctx, time.Second*5)
+			}
 		case acme.StatusInvalid:
-			time.Sleep(time.Second * 5)
+			// a new order is required to try it again
+			return nil, c.orderError(ctx, order)
 		case acme.StatusProcessing:
-			time.Sleep(time.Second * 5)
+			err = sleep(ctx, time.Second*5)
 		case acme.StatusReady:
 			der, _, err = c.client.CreateOrderCert(ctx, order.FinalizeURL, csr.ASN1(), true)
 		case acme.StatusValid:
@@ -69,7 +192,7 @@ func (c *client) IssueCertificate(csr crypto.CSR) (chain crypto.CertificateChain
 		}
 
 		if err != nil {
-			fmt.Println("ACME| ", err)
+			c.log(err)
 			return nil, err
 		}
 
@@ -77,16 +200,45 @@ func (c *client) IssueCertificate(csr crypto.CSR) (chain crypto.CertificateChain
 			return c.derToChain(der)
 		}
 
-		fmt.Println("ACME| Refresh-Order:", orderURI)
+		c.log("Refresh-Order:", orderURI)
 
 		order, err = c.client.GetOrder(ctx, orderURI)
 		if err != nil {
-			fmt.Println("ACME| ", err)
+			c.log(err)
 			return nil, err
 		}
 	}
 }
 
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// orderError returns the reason why the order became invalid
+func (c *client) orderError(ctx context.Context, order *acme.Order) error {
+	if order.Error != nil {
+		return fmt.Errorf("acme order is invalid: %w", order.Error)
+	}
+	for _, authURL := range order.AuthzURLs {
+		auth, err := c.client.GetAuthorization(ctx, authURL)
+		if err != nil || auth.Status != acme.StatusInvalid {
+			continue
+		}
+		for _, challenge := range auth.Challenges {
+			if challenge.Error != nil {
+				return fmt.Errorf("acme %s challenge for %s failed: %w", challenge.Type, auth.Identifier.Value, challenge.Error)
+			}
+		}
+		return fmt.Errorf("acme authorization for %s is invalid", auth.Identifier.Value)
+	}
+	return fmt.Errorf("acme order is invalid")
+}
+
 func (c *client) derToChain(der [][]byte) (chain crypto.CertificateChain, err error) {
 	for _, asn1 := range der {
 		cert, err := crypto.NewCertificateFromASN1(asn1)
@@ -104,12 +256,19 @@ func (c *client) GetAccount(ctx context.Context) (err error) {
 	}
 	c.account, err = c.client.GetReg(ctx, "")
 	if err != nil {
-		fmt.Println("ACME| ", err)
+		c.log(err)
 	}
 	if c.account != nil {
-		return nil
+		return c.updateContact(ctx)
 	}
 	acct := &acme.Account{}
+	if c.config.Email != "" {
+		acct.Contact = []string{"mailto:" + c.config.Email}
+	}
+	acct.ExternalAccountBinding, err = c.config.externalAccountBinding()
+	if err != nil {
+		return err
+	}
 
 	c.account, err = c.client.Register(ctx, acct, acme.AcceptTOS)
 	if err != nil {
@@ -118,43 +277,134 @@ func (c *client) GetAccount(ctx context.Context) (err error) {
 	return nil
 }
 
-func (c *client) acceptChallenges(ctx context.Context, order *acme.Order) (err error) {
+// updateContact updates the contact of an existing account, if the email
+// address has been changed
+func (c *client) updateContact(ctx context.Context) (err error) {
+	if c.config.Email == "" || slices.Contains(c.account.Contact, "mailto:"+c.config.Email) {
+		return nil
+	}
+	acct := *c.account
+	acct.Contact = []string{"mailto:" + c.config.Email}
+	account, err := c.client.UpdateReg(ctx, &acct)
+	if err != nil {
+		c.log("failed to update the contact:", err)
+		return nil
+	}
+	c.account = account
+	return nil
+}
+
+func (c *client) acceptChallenges(ctx context.Context, order *acme.Order, prepared map[string]*acme.Challenge) (err error) {
 	for _, authURL := range order.AuthzURLs {
 		auth, err := c.client.GetAuthorization(ctx, authURL)
 		if err != nil {
-			fmt.Println("ACME| ", err)
+			c.log(err)
 			return err
 		}
-		fmt.Println("ACME| Identifier:", auth.Identifier.Value)
-		for _, challenge := range auth.Challenges {
-			fmt.Println("ACME| - Type:", challenge.Type)
-			fmt.Println("ACME|   URI:", challenge.URI)
-			fmt.Println("ACME|   Token:", challenge.Token)
-			fmt.Println("ACME|   Status:", challenge.Status)
+		c.log("Identifier:", auth.Identifier.Value)
+		if auth.Status != acme.StatusPending {
+			continue
+		}
 
-			if challenge.Status != acme.StatusPending {
-				continue
+		var challenge *acme.Challenge
+		for _, ch := range auth.Challenges {
+			c.log("- Type:", ch.Type)
+			c.log("  URI:", ch.URI)
+			c.log("  Token:", ch.Token)
+			c.log("  Status:", ch.Status)
+			if ch.Type == c.challengeType {
+				challenge = ch
 			}
-			record, err := c.client.DNS01ChallengeRecord(challenge.Token)
-			if err != nil {
-				fmt.Println("ACME| ", err)
-				return err
-			}
-			fmt.Println("ACME|   Record:", record)
-			c.challengeHandler.SetChallenge(auth.Identifier.Value, record)
-			challenge, err = c.client.Accept(ctx, challenge)
-			if err != nil {
-				fmt.Println("ACME| ", err)
-				return err
-			}
-			fmt.Println("ACME|   New-Status:", challenge.Status)
 		}
+		if challenge == nil {
+			return fmt.Errorf("the CA offers no %s challenge for %s", c.challengeType, auth.Identifier.Value)
+		}
+		if challenge.Status != acme.StatusPending {
+			continue
+		}
+
+		err = c.prepareChallenge(auth.Identifier.Value, challenge)
+		if err != nil {
+			c.log(err)
+			return err
+		}
+		prepared[auth.Identifier.Value] = challenge
+		challenge, err = c.client.Accept(ctx, challenge)
+		if err != nil {
+			c.log(err)
+			return err
+		}
+		c.log("  New-Status:", challenge.Status)
 	}
 
 	return nil
 }
 
-func NewClient(dataDir string, challengeHandler ChallengeHandler) (c Client, err error) {
+// prepareChallenge publishes the response to the challenge using the
+// handler of the challenge type
+func (c *client) prepareChallenge(identifier string, challenge *acme.Challenge) error {
+	switch challenge.Type {
+	case ChallengeDNS01:
+		record, err := c.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		c.log("  Record:", record)
+		return c.handlers.dns.SetChallenge(identifier, record)
+	case ChallengeHTTP01:
+		if c.handlers.http == nil {
+			return fmt.Errorf("no handler for %s challenges", challenge.Type)
+		}
+		response, err := c.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		c.log("  Path:", c.client.HTTP01ChallengePath(challenge.Token))
+		return c.handlers.http.SetChallenge(identifier, challenge.Token, response)
+	case ChallengeTLSALPN01:
+		if c.handlers.tlsALPN == nil {
+			return fmt.Errorf("no handler for %s challenges", challenge.Type)
+		}
+		cert, err := c.client.TLSALPN01ChallengeCert(challenge.Token, identifier)
+		if err != nil {
+			return err
+		}
+		c.handlers.tlsALPN.SetTLSALPNChallenge(identifier, &cert)
+		return nil
+	}
+	return fmt.Errorf("unsupported challenge type: %s", challenge.Type)
+}
+
+// clearChallenges removes the responses to HTTP-01 and TLS-ALPN-01
+// challenges after the authorization has finished. The TXT records of
+// DNS-01 challenges are replaced by the next challenge.
+func (c *client) clearChallenges(prepared map[string]*acme.Challenge) {
+	for identifier, challenge := range prepared {
+		switch challenge.Type {
+		case ChallengeHTTP01:
+			if err := c.handlers.http.SetChallenge(identifier, challenge.Token, ""); err != nil {
+				c.log(err)
+			}
+		case ChallengeTLSALPN01:
+			c.handlers.tlsALPN.SetTLSALPNChallenge(identifier, nil)
+		}
+	}
+}
+
+// NewClient creates a client for the CA. The account key is stored in the
+// dataDir, so each CA requires its own dataDir.
+func NewClient(dataDir string, config CAConfig, challengeHandler ChallengeHandler) (c Client, err error) {
+	if config.Name == "" {
+		config.Name = CALetsEncrypt
+	}
+	directoryURL, err := config.GetDirectoryURL()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := config.httpClient()
+	if err != nil {
+		return nil, err
+	}
 	err = os.MkdirAll(dataDir, 0700)
 	if err != nil {
 		return nil, err
@@ -164,8 +414,14 @@ func NewClient(dataDir string, challengeHandler ChallengeHandler) (c Client, err
 		return nil, err
 	}
 	return &client{
-		dataDir:          dataDir,
-		client:           &acme.Client{Key: key},
-		challengeHandler: challengeHandler,
+		dataDir: dataDir,
+		config:  config,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: directoryURL,
+			HTTPClient:   httpClient,
+		},
+		handlers:      &handlers{dns: challengeHandler},
+		challengeType: ChallengeDNS01,
 	}, nil
 }
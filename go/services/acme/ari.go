@@ -0,0 +1,93 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
+)
+
+// renewalInfo is the response of the ACME Renewal Information (ARI)
+// endpoint (RFC 9773)
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL,omitempty"`
+}
+
+// ariCertID returns the identifier of a certificate used by ARI: the
+// base64url encoded authority key identifier and serial number
+func ariCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("the certificate has no authority key identifier")
+	}
+	// the serial number is DER encoded, so a leading zero is required if
+	// the highest bit is set
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+func (c *client) httpGetJSON(ctx context.Context, url string, v any) error {
+	httpClient := c.client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// SuggestedRenewalWindow returns the window in which the CA suggests to
+// renew the certificate. The window is zero if the CA doesn't support ARI.
+func (c *client) SuggestedRenewalWindow(cert crypto.Certificate) (start time.Time, end time.Time, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var directory struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	err = c.httpGetJSON(ctx, c.client.DirectoryURL, &directory)
+	if err != nil || directory.RenewalInfo == "" {
+		return start, end, err
+	}
+	certID, err := ariCertID(cert.OBJ())
+	if err != nil {
+		return start, end, err
+	}
+	var info renewalInfo
+	err = c.httpGetJSON(ctx, strings.TrimSuffix(directory.RenewalInfo, "/")+"/"+certID, &info)
+	if err != nil {
+		return start, end, err
+	}
+	start, end = info.SuggestedWindow.Start, info.SuggestedWindow.End
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid renewal window: %s - %s", start, end)
+	}
+	if info.ExplanationURL != "" {
+		fmt.Println("ACME| renewal window of", cert.OBJ().SerialNumber, "explained at", info.ExplanationURL)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,22 @@
+package acme
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+)
+
+func TestARICertID(t *testing.T) {
+	// example of RFC 9773
+	cert := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3, 0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber:   big.NewInt(0x87654321),
+	}
+	certID, err := ariCertID(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"; certID != want {
+		t.Errorf("ariCertID() = %s, want %s", certID, want)
+	}
+}
@@ -0,0 +1,208 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
+	"golang.org/x/crypto/acme"
+)
+
+// Names of the well known certificate authorities
+const (
+	CALetsEncrypt        = "letsencrypt"
+	CALetsEncryptStaging = "letsencrypt-staging"
+	CAZeroSSL            = "zerossl"
+	CABuypass            = "buypass"
+)
+
+var knownDirectories = map[string]string{
+	CALetsEncrypt:        acme.LetsEncryptURL,
+	CALetsEncryptStaging: "https://acme-staging-v02.api.letsencrypt.org/directory",
+	CAZeroSSL:            "https://acme.zerossl.com/v2/DV90",
+	CABuypass:            "https://api.buypass.com/acme/directory",
+}
+
+// KnownCAs returns the names of the well known CAs
+func KnownCAs() []string {
+	return []string{CALetsEncrypt, CALetsEncryptStaging, CAZeroSSL, CABuypass}
+}
+
+// CAConfig describes an ACME certificate authority
+type CAConfig struct {
+	// Name is either one of the well known CAs or a custom name (in this
+	// case the DirectoryURL is required)
+	Name         string
+	DirectoryURL string
+	// Email is used as contact of the account
+	Email string
+	// EABKeyID and EABHMACKey are the External Account Binding credentials
+	// (required by ZeroSSL and some private CAs). The HMAC key is base64url
+	// encoded.
+	EABKeyID   string
+	EABHMACKey string
+	// RootCAFile is a PEM file with the root certificate of a private CA
+	// (like step-ca or Pebble)
+	RootCAFile string
+}
+
+// GetDirectoryURL returns the directory of the CA
+func (config CAConfig) GetDirectoryURL() (string, error) {
+	if config.DirectoryURL != "" {
+		return config.DirectoryURL, nil
+	}
+	name := config.Name
+	if name == "" {
+		name = CALetsEncrypt
+	}
+	if url, ok := knownDirectories[name]; ok {
+		return url, nil
+	}
+	return "", fmt.Errorf("unknown CA %q (a directory URL is required)", config.Name)
+}
+
+func (config CAConfig) externalAccountBinding() (*acme.ExternalAccountBinding, error) {
+	if config.EABKeyID == "" && config.EABHMACKey == "" {
+		return nil, nil
+	}
+	if config.EABKeyID == "" || config.EABHMACKey == "" {
+		return nil, fmt.Errorf("the external account binding requires a key id and a HMAC key")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(config.EABHMACKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EAB HMAC key: %w", err)
+	}
+	return &acme.ExternalAccountBinding{KID: config.EABKeyID, Key: key}, nil
+}
+
+func (config CAConfig) httpClient() (*http.Client, error) {
+	if config.RootCAFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(config.RootCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.RootCAFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fallbackClient uses the fallback CA, if the primary CA failed maxFailures
+// times in a row. After a certificate has been issued by the fallback CA,
+// the primary CA is tried again for the next certificate.
+type fallbackClient struct {
+	Client
+	fallback    Client
+	maxFailures int
+
+	mutex    sync.Mutex
+	failures int
+}
+
+// NewFallbackClient creates a client which switches to the fallback CA if
+// the issuance using the primary CA keeps failing
+func NewFallbackClient(primary Client, fallback Client, maxFailures int) Client {
+	if maxFailures <= 0 {
+		maxFailures = 3
+	}
+	return &fallbackClient{
+		Client:      primary,
+		fallback:    fallback,
+		maxFailures: maxFailures,
+	}
+}
+
+func (c *fallbackClient) IssueCertificate(csr crypto.CSR) (chain crypto.CertificateChain, err error) {
+	return c.IssueCertificateWithLog(csr, nil)
+}
+
+func (c *fallbackClient) IssueCertificateWithLog(csr crypto.CSR, logf func(msg string)) (chain crypto.CertificateChain, err error) {
+	c.mutex.Lock()
+	useFallback := c.failures >= c.maxFailures
+	c.mutex.Unlock()
+
+	if !useFallback {
+		chain, err = c.Client.IssueCertificateWithLog(csr, logf)
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if err == nil {
+			c.failures = 0
+			return chain, nil
+		}
+		c.failures++
+		if c.failures >= c.maxFailures {
+			fmt.Printf("ACME| %s failed %d times, using %s next time\n", c.Client.CAName(), c.failures, c.fallback.CAName())
+		}
+		return nil, err
+	}
+
+	chain, err = c.fallback.IssueCertificateWithLog(csr, logf)
+	if err == nil {
+		c.mutex.Lock()
+		c.failures = 0
+		c.mutex.Unlock()
+	}
+	return chain, err
+}
+
+// RevokeCertificate tries both CAs, as the certificate may have been
+// issued by the fallback CA
+func (c *fallbackClient) RevokeCertificate(cert crypto.Certificate, reason int) error {
+	err := c.Client.RevokeCertificate(cert, reason)
+	if err == nil {
+		return nil
+	}
+	if fallbackErr := c.fallback.RevokeCertificate(cert, reason); fallbackErr == nil {
+		return nil
+	}
+	return err
+}
+
+// SuggestedRenewalWindow asks the fallback CA, if the primary CA doesn't
+// know the certificate
+func (c *fallbackClient) SuggestedRenewalWindow(cert crypto.Certificate) (start time.Time, end time.Time, err error) {
+	start, end, err = c.Client.SuggestedRenewalWindow(cert)
+	if err == nil && !end.IsZero() {
+		return start, end, nil
+	}
+	if fallbackStart, fallbackEnd, fallbackErr := c.fallback.SuggestedRenewalWindow(cert); fallbackErr == nil && !fallbackEnd.IsZero() {
+		return fallbackStart, fallbackEnd, nil
+	}
+	return start, end, err
+}
+
+func (c *fallbackClient) WithChallengeType(challengeType string) (Client, error) {
+	primary, err := c.Client.WithChallengeType(challengeType)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := c.fallback.WithChallengeType(challengeType)
+	if err != nil {
+		return nil, err
+	}
+	return NewFallbackClient(primary, fallback, c.maxFailures), nil
+}
+
+func (c *fallbackClient) SetHTTPChallengeHandler(handler HTTPChallengeHandler) {
+	c.Client.SetHTTPChallengeHandler(handler)
+	c.fallback.SetHTTPChallengeHandler(handler)
+}
+
+func (c *fallbackClient) SetTLSALPNChallengeHandler(handler TLSALPNChallengeHandler) {
+	c.Client.SetTLSALPNChallengeHandler(handler)
+	c.fallback.SetTLSALPNChallengeHandler(handler)
+}
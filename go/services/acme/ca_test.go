@@ -0,0 +1,71 @@
+package acme
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
+)
+
+type fakeClient struct {
+	Client
+	name   string
+	fail   bool
+	issued int
+}
+
+func (c *fakeClient) CAName() string {
+	return c.name
+}
+
+func (c *fakeClient) IssueCertificate(csr crypto.CSR) (crypto.CertificateChain, error) {
+	return c.IssueCertificateWithLog(csr, nil)
+}
+
+func (c *fakeClient) IssueCertificateWithLog(csr crypto.CSR, logf func(msg string)) (crypto.CertificateChain, error) {
+	if c.fail {
+		return nil, fmt.Errorf("%s failed", c.name)
+	}
+	c.issued++
+	return crypto.CertificateChain{}, nil
+}
+
+func TestFallbackClient(t *testing.T) {
+	primary := &fakeClient{name: "primary", fail: true}
+	fallback := &fakeClient{name: "fallback"}
+	client := NewFallbackClient(primary, fallback, 2)
+
+	for i := range 2 {
+		if _, err := client.IssueCertificate(nil); err == nil {
+			t.Fatalf("attempt %d: expected the error of the primary CA", i)
+		}
+	}
+	if _, err := client.IssueCertificate(nil); err != nil || fallback.issued != 1 {
+		t.Fatalf("expected the fallback CA to be used, got %v", err)
+	}
+
+	primary.fail = false
+	if _, err := client.IssueCertificate(nil); err != nil || primary.issued != 1 {
+		t.Fatalf("expected the primary CA to be used again, got %v", err)
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	config := CAConfig{Name: CAZeroSSL, EABKeyID: "kid", EABHMACKey: "c2VjcmV0LWtleQ"}
+	eab, err := config.externalAccountBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eab.KID != "kid" || string(eab.Key) != "secret-key" {
+		t.Errorf("unexpected binding: %+v", eab)
+	}
+
+	config.EABKeyID = ""
+	if _, err = config.externalAccountBinding(); err == nil {
+		t.Error("expected an error for a HMAC key without key id")
+	}
+
+	if _, err = (CAConfig{Name: "step-ca"}).GetDirectoryURL(); err == nil {
+		t.Error("expected an error for an unknown CA without directory")
+	}
+}
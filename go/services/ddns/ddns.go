@@ -0,0 +1,341 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Provider pushes the external addresses of a hostname to a DNS provider.
+// If ipv4 or ipv6 is nil, the corresponding record is left untouched.
+type Provider interface {
+	Type() string
+	Hostname() string
+	Update(ctx context.Context, ipv4 net.IP, ipv6 net.IP) error
+}
+
+// PermanentError is returned by a provider if repeating the update is
+// pointless (like invalid credentials). The update isn't retried until the
+// configuration has changed or a refresh is forced.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// RetryLaterError is returned by a provider if the server asked to wait
+// before the next update
+type RetryLaterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryLaterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryLaterError) Unwrap() error {
+	return e.Err
+}
+
+// ProviderConfig contains the settings of all built-in providers. Which
+// fields are used depends on the type.
+type ProviderConfig struct {
+	Type     string
+	Hostname string
+	// Server is the update URL (dyndns2) or the primary nameserver (rfc2136)
+	Server   string
+	Username string
+	Password string
+	Zone     string
+	TTL      uint32
+
+	TsigName      string
+	TsigAlgorithm string
+	TsigSecret    string
+
+	DisableIPv4 bool
+	DisableIPv6 bool
+}
+
+// NewProvider creates one of the built-in providers
+func NewProvider(config ProviderConfig) (Provider, error) {
+	if config.Hostname == "" {
+		return nil, fmt.Errorf("ddns provider requires a hostname")
+	}
+	if config.DisableIPv4 && config.DisableIPv6 {
+		return nil, fmt.Errorf("ddns provider for %s has no address family enabled", config.Hostname)
+	}
+	var provider Provider
+	var err error
+	switch config.Type {
+	case "dyndns2":
+		provider, err = NewDynDNS2(config)
+	case "rfc2136":
+		provider, err = NewRFC2136(config)
+	default:
+		return nil, fmt.Errorf("unknown ddns provider type %q", config.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.DisableIPv4 || config.DisableIPv6 {
+		provider = &familyFilter{Provider: provider, ipv4: !config.DisableIPv4, ipv6: !config.DisableIPv6}
+	}
+	return provider, nil
+}
+
+// familyFilter updates only the enabled address families
+type familyFilter struct {
+	Provider
+	ipv4 bool
+	ipv6 bool
+}
+
+func (f *familyFilter) filter(ipv4 net.IP, ipv6 net.IP) (net.IP, net.IP) {
+	if !f.ipv4 {
+		ipv4 = nil
+	}
+	if !f.ipv6 {
+		ipv6 = nil
+	}
+	return ipv4, ipv6
+}
+
+func (f *familyFilter) Update(ctx context.Context, ipv4 net.IP, ipv6 net.IP) error {
+	ipv4, ipv6 = f.filter(ipv4, ipv6)
+	return f.Provider.Update(ctx, ipv4, ipv6)
+}
+
+// ProviderStatus describes the result of the last update of a provider
+type ProviderStatus struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Hostname    string    `json:"hostname"`
+	IPv4        string    `json:"ipv4,omitempty"`
+	IPv6        string    `json:"ipv6,omitempty"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Updater pushes address changes to all registered providers. Failed
+// updates are retried periodically (unless the error is permanent).
+type Updater interface {
+	AddProvider(name string, provider Provider)
+	// Update sets the current external addresses. The providers are
+	// updated in the background.
+	Update(ipv4 net.IP, ipv6 net.IP)
+	// Refresh forces an update of all providers
+	Refresh()
+	Status() []ProviderStatus
+	Close()
+}
+
+// NewUpdater creates an updater which retries failed updates after
+// retryInterval
+func NewUpdater(retryInterval time.Duration) Updater {
+	if retryInterval <= 0 {
+		retryInterval = 5 * time.Minute
+	}
+	u := &updater{
+		retryInterval: retryInterval,
+		now:           time.Now,
+		trigger:       make(chan bool, 1),
+		done:          make(chan struct{}),
+	}
+	go u.run()
+	return u
+}
+
+type updaterEntry struct {
+	name     string
+	provider Provider
+	status   ProviderStatus
+	ipv4     net.IP
+	ipv6     net.IP
+	failed   bool
+	// permanent is set if the update must not be retried, retryAt is the
+	// earliest time of the next attempt
+	permanent bool
+	retryAt   time.Time
+}
+
+// needsUpdate decides if the provider has to be updated
+func (entry *updaterEntry) needsUpdate(ipv4 net.IP, ipv6 net.IP, force bool, now time.Time) bool {
+	if force {
+		return true
+	}
+	if entry.permanent || now.Before(entry.retryAt) {
+		return false
+	}
+	return entry.failed || !entry.ipv4.Equal(ipv4) || !entry.ipv6.Equal(ipv6)
+}
+
+// updateFailed records a failed update and decides when to retry it
+func (entry *updaterEntry) updateFailed(err error, now time.Time) {
+	entry.failed = true
+	entry.status.LastError = err.Error()
+	entry.permanent = errors.As(err, new(*PermanentError))
+	entry.retryAt = time.Time{}
+	var retryLater *RetryLaterError
+	if errors.As(err, &retryLater) {
+		entry.retryAt = now.Add(retryLater.RetryAfter)
+	}
+}
+
+type updater struct {
+	mu            sync.Mutex
+	entries       []*updaterEntry
+	ipv4          net.IP
+	ipv6          net.IP
+	retryInterval time.Duration
+	now           func() time.Time
+	trigger       chan bool
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+func (u *updater) AddProvider(name string, provider Provider) {
+	u.mu.Lock()
+	u.entries = append(u.entries, &updaterEntry{
+		name:     name,
+		provider: provider,
+		status: ProviderStatus{
+			Name:     name,
+			Type:     provider.Type(),
+			Hostname: provider.Hostname(),
+		},
+	})
+	u.mu.Unlock()
+	u.notify(false)
+}
+
+func (u *updater) Update(ipv4 net.IP, ipv6 net.IP) {
+	u.mu.Lock()
+	u.ipv4 = ipv4
+	u.ipv6 = ipv6
+	u.mu.Unlock()
+	u.notify(false)
+}
+
+func (u *updater) Refresh() {
+	u.notify(true)
+}
+
+func (u *updater) notify(force bool) {
+	select {
+	case u.trigger <- force:
+	default:
+		if force {
+			// replace a pending non-forced trigger
+			select {
+			case <-u.trigger:
+			default:
+			}
+			select {
+			case u.trigger <- true:
+			default:
+			}
+		}
+	}
+}
+
+func (u *updater) Status() []ProviderStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := make([]ProviderStatus, 0, len(u.entries))
+	for _, entry := range u.entries {
+		result = append(result, entry.status)
+	}
+	return result
+}
+
+func (u *updater) Close() {
+	u.closeOnce.Do(func() {
+		close(u.done)
+	})
+}
+
+func (u *updater) run() {
+	ticker := time.NewTicker(u.retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case force := <-u.trigger:
+			u.updateProviders(force)
+		case <-ticker.C:
+			u.updateProviders(false)
+		}
+	}
+}
+
+// updateProviders updates all providers whose last update failed or which
+// don't know the current addresses yet. Permanent errors are only retried
+// if the update is forced.
+func (u *updater) updateProviders(force bool) {
+	type job struct {
+		entry *updaterEntry
+		ipv4  net.IP
+		ipv6  net.IP
+	}
+
+	u.mu.Lock()
+	jobs := make([]job, 0, len(u.entries))
+	for _, entry := range u.entries {
+		ipv4, ipv6 := u.ipv4, u.ipv6
+		if f, ok := entry.provider.(*familyFilter); ok {
+			ipv4, ipv6 = f.filter(ipv4, ipv6)
+		}
+		if ipv4 == nil && ipv6 == nil {
+			continue
+		}
+		if entry.needsUpdate(ipv4, ipv6, force, u.now()) {
+			jobs = append(jobs, job{entry: entry, ipv4: ipv4, ipv6: ipv6})
+		}
+	}
+	u.mu.Unlock()
+
+	for _, job := range jobs {
+		entry := job.entry
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := entry.provider.Update(ctx, job.ipv4, job.ipv6)
+		cancel()
+
+		u.mu.Lock()
+		entry.status.LastAttempt = u.now()
+		if err != nil {
+			fmt.Printf("DDNS: failed to update %s (%s): %v\n", entry.name, entry.status.Hostname, err)
+			entry.updateFailed(err, entry.status.LastAttempt)
+		} else {
+			fmt.Printf("DDNS: updated %s (%s)\n", entry.name, entry.status.Hostname)
+			entry.failed = false
+			entry.permanent = false
+			entry.retryAt = time.Time{}
+			entry.ipv4, entry.ipv6 = job.ipv4, job.ipv6
+			entry.status.LastSuccess = entry.status.LastAttempt
+			entry.status.LastError = ""
+			entry.status.IPv4 = ipString(job.ipv4)
+			entry.status.IPv6 = ipString(job.ipv6)
+		}
+		u.mu.Unlock()
+	}
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
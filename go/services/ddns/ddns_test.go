@@ -0,0 +1,61 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeProvider struct {
+	err     error
+	updates int
+}
+
+func (p *fakeProvider) Type() string     { return "fake" }
+func (p *fakeProvider) Hostname() string { return "home.example.org" }
+
+func (p *fakeProvider) Update(ctx context.Context, ipv4 net.IP, ipv6 net.IP) error {
+	p.updates++
+	return p.err
+}
+
+func TestUpdaterRetries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	u := &updater{retryInterval: 5 * time.Minute, now: func() time.Time { return now }, trigger: make(chan bool, 1)}
+	transient := &fakeProvider{err: errors.New("timeout")}
+	permanent := &fakeProvider{err: parseDynDNS2Response("badauth")}
+	serverError := &fakeProvider{err: parseDynDNS2Response("911")}
+	u.AddProvider("transient", transient)
+	u.AddProvider("permanent", permanent)
+	u.AddProvider("server-error", serverError)
+	u.ipv4 = net.ParseIP("203.0.113.7")
+
+	u.updateProviders(false)
+	now = now.Add(5 * time.Minute)
+	u.updateProviders(false)
+	if transient.updates != 2 || permanent.updates != 1 || serverError.updates != 1 {
+		t.Errorf("updates = %d, %d, %d after the first retry, want 2, 1, 1",
+			transient.updates, permanent.updates, serverError.updates)
+	}
+
+	// a new address doesn't help against permanent errors or the backoff
+	u.ipv4 = net.ParseIP("203.0.113.8")
+	u.updateProviders(false)
+	if permanent.updates != 1 || serverError.updates != 1 {
+		t.Errorf("updates = %d, %d after an address change, want 1, 1", permanent.updates, serverError.updates)
+	}
+
+	now = now.Add(25 * time.Minute)
+	u.updateProviders(false)
+	if permanent.updates != 1 || serverError.updates != 2 {
+		t.Errorf("updates = %d, %d after the backoff, want 1, 2", permanent.updates, serverError.updates)
+	}
+
+	// a forced refresh retries everything
+	u.updateProviders(true)
+	if permanent.updates != 2 || serverError.updates != 3 {
+		t.Errorf("updates = %d, %d after a refresh, want 2, 3", permanent.updates, serverError.updates)
+	}
+}
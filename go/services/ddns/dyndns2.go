@@ -0,0 +1,128 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NewDynDNS2 creates a provider for the dyndns2 protocol, which is
+// supported by most DDNS services (like DynDNS, No-IP, deSEC, DuckDNS
+// or the DDNS service of the router). The server is the full update URL
+// (like https://members.dyndns.org/nic/update).
+func NewDynDNS2(config ProviderConfig) (Provider, error) {
+	if config.Server == "" {
+		return nil, fmt.Errorf("dyndns2 provider requires the update URL")
+	}
+	updateURL, err := url.Parse(config.Server)
+	if err != nil {
+		return nil, err
+	}
+	if updateURL.Scheme != "https" && updateURL.Scheme != "http" {
+		return nil, fmt.Errorf("invalid dyndns2 update URL %q", config.Server)
+	}
+	return &dynDNS2{
+		hostname:  config.Hostname,
+		updateURL: updateURL,
+		username:  config.Username,
+		password:  config.Password,
+		client:    &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+type dynDNS2 struct {
+	hostname  string
+	updateURL *url.URL
+	username  string
+	password  string
+	client    *http.Client
+}
+
+func (p *dynDNS2) Type() string {
+	return "dyndns2"
+}
+
+func (p *dynDNS2) Hostname() string {
+	return p.hostname
+}
+
+func (p *dynDNS2) Update(ctx context.Context, ipv4 net.IP, ipv6 net.IP) error {
+	// most providers accept a comma separated list of addresses
+	var addresses []string
+	if ipv4 != nil {
+		addresses = append(addresses, ipv4.String())
+	}
+	if ipv6 != nil {
+		addresses = append(addresses, ipv6.String())
+	}
+
+	updateURL := *p.updateURL
+	query := updateURL.Query()
+	query.Set("hostname", p.hostname)
+	query.Set("myip", strings.Join(addresses, ","))
+	updateURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, updateURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if p.username != "" || p.password != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+	req.Header.Set("User-Agent", "home-assistant-gateway/1.0")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && len(body) == 0 {
+		return fmt.Errorf("%s returned status %d", p.updateURL.Host, resp.StatusCode)
+	}
+	return parseDynDNS2Response(string(body))
+}
+
+// dynDNS2ServerErrorBackoff is the minimum time to wait after a server
+// error. The dyndns2 protocol requires at least 30 minutes.
+const dynDNS2ServerErrorBackoff = 30 * time.Minute
+
+// parseDynDNS2Response checks the return codes of a dyndns2 update.
+// If multiple hosts or addresses are updated, there is one line per update.
+// Errors which require a change of the configuration are permanent.
+func parseDynDNS2Response(body string) error {
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	for _, line := range lines {
+		code, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch code {
+		case "good", "nochg":
+			continue
+		case "badauth":
+			return &PermanentError{fmt.Errorf("dyndns2: authentication failed")}
+		case "notfqdn", "nohost":
+			return &PermanentError{fmt.Errorf("dyndns2: unknown hostname (%s)", code)}
+		case "numhost":
+			return fmt.Errorf("dyndns2: too many hosts")
+		case "abuse":
+			return &PermanentError{fmt.Errorf("dyndns2: the hostname is blocked for abuse")}
+		case "badagent":
+			return &PermanentError{fmt.Errorf("dyndns2: the user agent was rejected")}
+		case "dnserr", "911":
+			return &RetryLaterError{fmt.Errorf("dyndns2: server error (%s)", code), dynDNS2ServerErrorBackoff}
+		case "":
+			return fmt.Errorf("dyndns2: empty response")
+		default:
+			return fmt.Errorf("dyndns2: unexpected response %q", strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package ddns
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseDynDNS2Response(t *testing.T) {
+	tests := []struct {
+		body    string
+		wantErr bool
+	}{
+		{"good 203.0.113.7", false},
+		{"nochg 203.0.113.7\n", false},
+		{"good 203.0.113.7\ngood 2001:db8::1", false},
+		{"good 203.0.113.7\nnohost", true},
+		{"badauth", true},
+		{"911", true},
+		{"", true},
+		{"<html>error</html>", true},
+	}
+	for _, test := range tests {
+		err := parseDynDNS2Response(test.body)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseDynDNS2Response(%q) error = %v, wantErr %v", test.body, err, test.wantErr)
+		}
+	}
+}
+
+func TestDynDNS2ErrorTypes(t *testing.T) {
+	for _, code := range []string{"badauth", "nohost", "notfqdn", "abuse", "badagent"} {
+		if err := parseDynDNS2Response(code); !errors.As(err, new(*PermanentError)) {
+			t.Errorf("parseDynDNS2Response(%q) = %v, want a permanent error", code, err)
+		}
+	}
+	for _, code := range []string{"911", "dnserr"} {
+		var retryLater *RetryLaterError
+		if err := parseDynDNS2Response(code); !errors.As(err, &retryLater) || retryLater.RetryAfter < 30*time.Minute {
+			t.Errorf("parseDynDNS2Response(%q) = %v, want to retry after 30 minutes", code, err)
+		}
+	}
+}
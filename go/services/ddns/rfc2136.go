@@ -0,0 +1,118 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NewRFC2136 creates a provider which sends dynamic updates (RFC 2136) to
+// the primary nameserver of the zone. The updates are signed with TSIG if
+// a key is configured.
+func NewRFC2136(config ProviderConfig) (Provider, error) {
+	if config.Server == "" {
+		return nil, fmt.Errorf("rfc2136 provider requires the nameserver")
+	}
+	hostname := dns.Fqdn(config.Hostname)
+	zone := config.Zone
+	if zone == "" {
+		// by default the hostname is expected to be directly below the zone
+		_, parent, found := strings.Cut(hostname, ".")
+		if !found || parent == "" {
+			return nil, fmt.Errorf("rfc2136 provider requires the zone")
+		}
+		zone = parent
+	}
+	zone = dns.Fqdn(zone)
+	if !dns.IsSubDomain(zone, hostname) {
+		return nil, fmt.Errorf("%s is not part of the zone %s", hostname, zone)
+	}
+
+	server := config.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	ttl := config.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+
+	p := &rfc2136{
+		hostname: hostname,
+		zone:     zone,
+		server:   server,
+		ttl:      ttl,
+	}
+
+	if config.TsigName != "" {
+		p.tsigName = dns.Fqdn(config.TsigName)
+		p.tsigSecret = config.TsigSecret
+		p.tsigAlgorithm = dns.Fqdn(config.TsigAlgorithm)
+		if config.TsigAlgorithm == "" {
+			p.tsigAlgorithm = dns.HmacSHA256
+		}
+		switch p.tsigAlgorithm {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return nil, fmt.Errorf("unsupported TSIG algorithm %q", config.TsigAlgorithm)
+		}
+	}
+
+	return p, nil
+}
+
+type rfc2136 struct {
+	hostname string
+	zone     string
+	server   string
+	ttl      uint32
+
+	tsigName      string
+	tsigAlgorithm string
+	tsigSecret    string
+}
+
+func (p *rfc2136) Type() string {
+	return "rfc2136"
+}
+
+func (p *rfc2136) Hostname() string {
+	return strings.TrimSuffix(p.hostname, ".")
+}
+
+func (p *rfc2136) Update(ctx context.Context, ipv4 net.IP, ipv6 net.IP) error {
+	m := new(dns.Msg)
+	m.SetUpdate(p.zone)
+
+	header := dns.RR_Header{Name: p.hostname, Class: dns.ClassINET, Ttl: p.ttl}
+	if ipv4 != nil {
+		header.Rrtype = dns.TypeA
+		m.RemoveRRset([]dns.RR{&dns.A{Hdr: header}})
+		m.Insert([]dns.RR{&dns.A{Hdr: header, A: ipv4.To4()}})
+	}
+	if ipv6 != nil {
+		header.Rrtype = dns.TypeAAAA
+		m.RemoveRRset([]dns.RR{&dns.AAAA{Hdr: header}})
+		m.Insert([]dns.RR{&dns.AAAA{Hdr: header, AAAA: ipv6.To16()}})
+	}
+
+	client := &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	if p.tsigName != "" {
+		m.SetTsig(p.tsigName, p.tsigAlgorithm, 300, time.Now().Unix())
+		client.TsigSecret = map[string]string{p.tsigName: p.tsigSecret}
+	}
+
+	r, _, err := client.ExchangeContext(ctx, m, p.server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of %s rejected by %s: %s", p.hostname, p.server, dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Blocklist decides which names must not be resolved
+type Blocklist interface {
+	IsBlocked(name string) bool
+	Len() int
+}
+
+type blocklist struct {
+	mu sync.RWMutex
+	// exact contains names which are blocked (hosts-style entries)
+	exact map[string]bool
+	// suffix contains names which are blocked including all subdomains
+	// (adblock-style entries like ||example.com^)
+	suffix map[string]bool
+	// allowed contains exceptions (adblock-style entries like @@||example.com^)
+	allowed map[string]bool
+}
+
+// newBlocklist creates an empty blocklist
+func newBlocklist() *blocklist {
+	return &blocklist{
+		exact:   make(map[string]bool),
+		suffix:  make(map[string]bool),
+		allowed: make(map[string]bool),
+	}
+}
+
+// LoadBlocklistFiles reads all given files into a single blocklist
+func LoadBlocklistFiles(files ...string) (Blocklist, error) {
+	b := newBlocklist()
+	for _, file := range files {
+		err := b.LoadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *blocklist) LoadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Load(f)
+}
+
+// Load parses a blocklist. Each line may either be
+//   - a hosts-style entry: "0.0.0.0 ads.example.com"
+//   - an adblock-style entry: "||ads.example.com^" or "@@||ads.example.com^"
+//   - a plain domain name: "ads.example.com"
+//
+// Comments start with '#' or '!'
+func (b *blocklist) Load(r io.Reader) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+
+		if strings.HasPrefix(line, "@@||") {
+			if name, ok := parseAdblockRule(line[4:]); ok {
+				b.allowed[name] = true
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "||") {
+			if name, ok := parseAdblockRule(line[2:]); ok {
+				b.suffix[name] = true
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			for _, name := range fields[1:] {
+				name = normalizeName(name)
+				if name != "" && name != "localhost" && name != "localhost.localdomain" {
+					b.exact[name] = true
+				}
+			}
+			continue
+		}
+		if len(fields) == 1 && strings.Contains(fields[0], ".") {
+			if name := normalizeName(fields[0]); name != "" {
+				b.exact[name] = true
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseAdblockRule parses the part of an adblock rule after the leading "||".
+// Only rules which block a complete domain are supported.
+func parseAdblockRule(rule string) (name string, ok bool) {
+	if idx := strings.Index(rule, "$"); idx >= 0 {
+		// rules with modifiers (like $third-party) are only meant for browsers
+		if rule[idx:] != "$important" {
+			return "", false
+		}
+		rule = rule[:idx]
+	}
+	rule = strings.TrimSuffix(rule, "^")
+	if strings.ContainsAny(rule, "/*^|") {
+		return "", false
+	}
+	name = normalizeName(rule)
+	return name, name != ""
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+func (b *blocklist) IsBlocked(name string) bool {
+	name = normalizeName(name)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.allowed[name] {
+		return false
+	}
+	if b.exact[name] {
+		return true
+	}
+	for {
+		if b.suffix[name] {
+			return true
+		}
+		idx := strings.Index(name, ".")
+		if idx < 0 {
+			return false
+		}
+		name = name[idx+1:]
+		if b.allowed[name] {
+			return false
+		}
+	}
+}
+
+func (b *blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.exact) + len(b.suffix)
+}
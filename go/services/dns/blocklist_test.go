@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `# hosts-style
+0.0.0.0 ads.example.com
+127.0.0.1 localhost
+127.0.0.1 tracker.example.net tracker2.example.net # inline comment
+! adblock-style
+||doubleclick.example^
+||thirdparty.example^$third-party
+||path.example/ads^
+@@||good.doubleclick.example^
+plain.example.org
+`
+
+var blocklistTests = []struct {
+	name    string
+	blocked bool
+}{
+	{"ads.example.com.", true},
+	{"ADS.Example.COM", true},
+	{"sub.ads.example.com", false},
+	{"example.com", false},
+	{"localhost", false},
+	{"tracker.example.net", true},
+	{"tracker2.example.net", true},
+	{"doubleclick.example", true},
+	{"a.b.doubleclick.example", true},
+	{"good.doubleclick.example", false},
+	{"x.good.doubleclick.example", false},
+	{"thirdparty.example", false},
+	{"path.example", false},
+	{"plain.example.org", true},
+}
+
+func TestBlocklist(t *testing.T) {
+	b := newBlocklist()
+	err := b.Load(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range blocklistTests {
+		if blocked := b.IsBlocked(tt.name); blocked != tt.blocked {
+			t.Errorf("IsBlocked(%q) = %v, want %v", tt.name, blocked, tt.blocked)
+		}
+	}
+	if b.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", b.Len())
+	}
+}
@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache stores DNS responses until the smallest TTL of the contained records
+// has expired
+type Cache interface {
+	Get(q dns.Question) *dns.Msg
+	Put(q dns.Question, m *dns.Msg)
+	Len() int
+	Flush()
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	minTTL  uint32
+	maxTTL  uint32
+	entries map[string]*cacheEntry
+}
+
+// NewCache creates a cache holding at most size responses. TTLs are clamped
+// to the range [minTTL, maxTTL] (a maxTTL of 0 means no upper limit)
+func NewCache(size int, minTTL uint32, maxTTL uint32) Cache {
+	if size <= 0 {
+		size = 10000
+	}
+	return &cache{
+		size:    size,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+func cacheKey(q dns.Question) string {
+	return strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype] + "/" + dns.ClassToString[q.Qclass]
+}
+
+func (c *cache) Get(q dns.Question) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(q)
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	m := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+func (c *cache) Put(q dns.Question, m *dns.Msg) {
+	if m == nil || m.Truncated {
+		return
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	ttl, ok := c.responseTTL(m)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		c.evict(now)
+	}
+
+	c.entries[cacheKey(q)] = &cacheEntry{
+		msg:     m.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// responseTTL returns the smallest TTL of the response. For negative
+// responses the SOA minimum is used (RFC 2308)
+func (c *cache) responseTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			rrTTL := rr.Header().Ttl
+			if soa, isSOA := rr.(*dns.SOA); isSOA && len(m.Answer) == 0 {
+				rrTTL = min(rrTTL, soa.Minttl)
+			}
+			if !ok || rrTTL < ttl {
+				ttl = rrTTL
+				ok = true
+			}
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl, true
+}
+
+// evict removes all expired entries. If the cache is still full afterwards,
+// the entries expiring first are dropped
+func (c *cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for len(c.entries) >= c.size {
+		var oldestKey string
+		var oldest *cacheEntry
+		for key, entry := range c.entries {
+			if oldest == nil || entry.expires.Before(oldest.expires) {
+				oldestKey = key
+				oldest = entry
+			}
+		}
+		delete(c.entries, oldestKey)
+	}
+}
+
+func (c *cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cacheEntry)
+}
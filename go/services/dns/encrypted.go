@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dotIdleTimeout = 30 * time.Second
+	dohContentType = "application/dns-message"
+)
+
+// encryptedAddr is the address of a client which is connected using
+// DNS-over-TLS or DNS-over-HTTPS. Network() returns "tls" or "https",
+// so that the query log and the resolver can distinguish these clients.
+type encryptedAddr struct {
+	net.Addr
+	network string
+}
+
+func (a *encryptedAddr) Network() string {
+	return a.network
+}
+
+// encryptedResponseWriter implements dns.ResponseWriter for DoT and DoH
+type encryptedResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	write  func(m *dns.Msg) error
+}
+
+func (w *encryptedResponseWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *encryptedResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *encryptedResponseWriter) WriteMsg(m *dns.Msg) error {
+	return w.write(m)
+}
+
+func (w *encryptedResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.write(m)
+}
+
+func (w *encryptedResponseWriter) Close() error {
+	return nil
+}
+
+// TsigStatus reports an error, as TSIG is not supported for DoT and DoH
+func (w *encryptedResponseWriter) TsigStatus() error {
+	return dns.ErrSig
+}
+
+func (w *encryptedResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *encryptedResponseWriter) Hijack() {}
+
+// ServeDoT answers DNS-over-TLS queries (RFC 7858) on an already
+// established TLS connection. The messages use the same framing as
+// DNS over TCP (two bytes length prefix).
+func (s *server) ServeDoT(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	w := &encryptedResponseWriter{
+		local:  conn.LocalAddr(),
+		remote: &encryptedAddr{Addr: conn.RemoteAddr(), network: "tls"},
+		write: func(m *dns.Msg) error {
+			data, err := m.Pack()
+			if err != nil {
+				return err
+			}
+			buf := make([]byte, 2+len(data))
+			binary.BigEndian.PutUint16(buf, uint16(len(data)))
+			copy(buf[2:], data)
+			conn.SetWriteDeadline(time.Now().Add(dotIdleTimeout))
+			_, err = conn.Write(buf)
+			return err
+		},
+	}
+
+	header := make([]byte, 2)
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(data); err != nil {
+			fmt.Println("DoT: failed to unpack query:", err)
+			return
+		}
+		s.dnsHandleFunc(w, r)
+	}
+}
+
+// ServeDoH answers DNS-over-HTTPS queries (RFC 8484). Both the GET
+// (base64url encoded "dns" parameter) and the POST variant are supported.
+func (s *server) ServeDoH(w http.ResponseWriter, req *http.Request) {
+	var data []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(data) == 0 {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err = r.Unpack(data); err != nil {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	var remote net.Addr
+	if addrPort, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		remote = net.TCPAddrFromAddrPort(addrPort)
+	} else {
+		remote = &net.TCPAddr{}
+	}
+
+	var response *dns.Msg
+	s.dnsHandleFunc(&encryptedResponseWriter{
+		local:  &net.TCPAddr{},
+		remote: &encryptedAddr{Addr: remote, network: "https"},
+		write: func(m *dns.Msg) error {
+			response = m
+			return nil
+		},
+	}, r)
+
+	if response == nil {
+		http.Error(w, "no DNS response", http.StatusBadGateway)
+		return
+	}
+	data, err = response.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minTTL(response); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(data)
+}
+
+// minTTL returns the smallest TTL of all answer and authority records
+func minTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if !ok || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				ok = true
+			}
+		}
+	}
+	return ttl, ok
+}
@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeDoH(t *testing.T) {
+	s := &server{}
+	s.AddDomains("home.example.com")
+
+	query := new(dns.Msg)
+	query.SetQuestion("home.example.com.", dns.TypeNS)
+	query.Id = 0
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil),
+		httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(data)),
+	}
+	requests[1].Header.Set("Content-Type", dohContentType)
+
+	for _, req := range requests {
+		rec := httptest.NewRecorder()
+		s.ServeDoH(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", req.Method, rec.Code)
+		}
+		if rec.Header().Get("Content-Type") != dohContentType {
+			t.Errorf("%s: content type = %q", req.Method, rec.Header().Get("Content-Type"))
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(rec.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.NS).Ns != "ns1.home.example.com." {
+			t.Errorf("%s: unexpected answer %v", req.Method, response.Answer)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeDoH(rec, httptest.NewRequest(http.MethodGet, "/dns-query?dns=invalid", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status for an invalid query = %d", rec.Code)
+	}
+}
@@ -1,8 +1,10 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 )
 
 type ExternalIP interface {
@@ -18,12 +20,15 @@ func NewExternalIP(network string, address string) ExternalIP {
 }
 
 type externalIP struct {
+	mu      sync.RWMutex
 	ip      net.IP
 	network string
 	address string
 }
 
 func (e *externalIP) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.ip
 }
 
@@ -33,6 +38,95 @@ func (e *externalIP) Refresh() (net.IP, error) {
 		fmt.Println("failed:", err)
 		return nil, err
 	}
+	if !isPublicIP(addr.IP) {
+		return nil, fmt.Errorf("%s resolved to %s which is not a public address", e.address, addr.IP)
+	}
+	e.mu.Lock()
 	e.ip = addr.IP
-	return e.ip, nil
+	e.mu.Unlock()
+	return addr.IP, nil
+}
+
+// ExternalIPChangeFunc is called when the external IP has changed
+type ExternalIPChangeFunc func(oldIP net.IP, newIP net.IP)
+
+// RefreshExternalIP refreshes the external IP and calls onChange if the
+// address differs from the previous one
+func RefreshExternalIP(e ExternalIP, onChange ExternalIPChangeFunc) (net.IP, error) {
+	oldIP := e.ExternalIP()
+	newIP, err := e.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	if !oldIP.Equal(newIP) && onChange != nil {
+		onChange(oldIP, newIP)
+	}
+	return newIP, nil
+}
+
+// NewExternalIPConsensus combines multiple providers. On refresh all
+// providers are asked in parallel and the address reported by most of them
+// wins (on a tie, the provider listed first wins).
+func NewExternalIPConsensus(providers ...ExternalIP) ExternalIP {
+	return &externalIPConsensus{
+		providers: providers,
+	}
+}
+
+type externalIPConsensus struct {
+	mu        sync.RWMutex
+	ip        net.IP
+	providers []ExternalIP
+}
+
+func (e *externalIPConsensus) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ip
+}
+
+func (e *externalIPConsensus) Refresh() (net.IP, error) {
+	if len(e.providers) == 0 {
+		return nil, fmt.Errorf("no external IP providers configured")
+	}
+
+	ips := make([]net.IP, len(e.providers))
+	errs := make([]error, len(e.providers))
+
+	var wg sync.WaitGroup
+	for i, provider := range e.providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips[i], errs[i] = provider.Refresh()
+		}()
+	}
+	wg.Wait()
+
+	votes := make(map[string]int)
+	for i, ip := range ips {
+		if ip == nil {
+			fmt.Println("external IP provider failed:", errs[i])
+			continue
+		}
+		votes[ip.String()]++
+	}
+	// the first provider reporting one of the most frequent addresses wins
+	var winner net.IP
+	for _, ip := range ips {
+		if ip != nil && (winner == nil || votes[ip.String()] > votes[winner.String()]) {
+			winner = ip
+		}
+	}
+	if winner == nil {
+		return nil, errors.Join(errs...)
+	}
+	if votes[winner.String()] < len(e.providers) {
+		fmt.Printf("external IP providers disagree, using %s (%d of %d votes)\n", winner, votes[winner.String()], len(e.providers))
+	}
+
+	e.mu.Lock()
+	e.ip = winner
+	e.mu.Unlock()
+	return winner, nil
 }
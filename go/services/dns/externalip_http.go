@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewExternalIPHTTP detects the external IP using a "what is my IP" service
+// which returns the address of the client as plain text
+// (like https://api.ipify.org or https://api6.ipify.org)
+func NewExternalIPHTTP(network string, uri string) ExternalIP {
+	if uri == "" {
+		uri = "https://api64.ipify.org"
+	}
+	tcpNetwork := "tcp4"
+	if network == "ip6" {
+		tcpNetwork = "tcp6"
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &externalIPHTTP{
+		network: network,
+		uri:     uri,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				// force the address family, otherwise the service
+				// would report the address of the preferred family
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, tcpNetwork, addr)
+				},
+			},
+		},
+	}
+}
+
+type externalIPHTTP struct {
+	mu      sync.RWMutex
+	ip      net.IP
+	network string
+	uri     string
+	client  *http.Client
+}
+
+func (e *externalIPHTTP) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ip
+}
+
+func (e *externalIPHTTP) Refresh() (net.IP, error) {
+	resp, err := e.client.Get(e.uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", e.uri, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s returned no valid IP address", e.uri)
+	}
+	if !matchesNetwork(ip, e.network) {
+		return nil, fmt.Errorf("%s returned %s which is not an %s address", e.uri, ip, e.network)
+	}
+	if !isPublicIP(ip) {
+		return nil, fmt.Errorf("%s returned %s which is not a public address", e.uri, ip)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	e.mu.Lock()
+	e.ip = ip
+	e.mu.Unlock()
+	return ip, nil
+}
@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// NewExternalIPInterface uses the first public address of the given local
+// interface. If no interface is specified, all interfaces are checked.
+// This is useful for IPv6 (where the host has a public address) or if the
+// gateway is directly connected to the internet.
+func NewExternalIPInterface(network string, iface string) ExternalIP {
+	return &externalIPInterface{
+		network: network,
+		iface:   iface,
+	}
+}
+
+type externalIPInterface struct {
+	mu      sync.RWMutex
+	ip      net.IP
+	network string
+	iface   string
+}
+
+func (e *externalIPInterface) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ip
+}
+
+func (e *externalIPInterface) Refresh() (net.IP, error) {
+	var interfaces []net.Interface
+	if e.iface != "" {
+		iface, err := net.InterfaceByName(e.iface)
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, *iface)
+	} else {
+		var err error
+		interfaces, err = net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP
+			if !isPublicIP(ip) || !matchesNetwork(ip, e.network) {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			e.mu.Lock()
+			e.ip = ip
+			e.mu.Unlock()
+			return ip, nil
+		}
+	}
+	if e.iface != "" {
+		return nil, fmt.Errorf("interface %s has no public %s address", e.iface, e.network)
+	}
+	return nil, fmt.Errorf("no interface has a public %s address", e.network)
+}
+
+// carrierGradeNAT is the shared address space of RFC 6598, which is used
+// by providers behind a NAT
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !carrierGradeNAT.Contains(ip)
+}
@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewExternalIPNATPMP asks the router for its external IPv4 address using
+// NAT-PMP (RFC 6886). If no gateway is specified, the default gateway is used.
+func NewExternalIPNATPMP(gateway string) ExternalIP {
+	return &externalIPNATPMP{
+		gateway: gateway,
+	}
+}
+
+type externalIPNATPMP struct {
+	mu      sync.RWMutex
+	ip      net.IP
+	gateway string
+}
+
+func (e *externalIPNATPMP) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ip
+}
+
+func (e *externalIPNATPMP) Refresh() (net.IP, error) {
+	gateway := e.gateway
+	if gateway == "" {
+		defaultGateway, err := getDefaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		gateway = defaultGateway.String()
+	}
+
+	conn, err := net.Dial("udp4", withDefaultPort(gateway, "5351"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// version 0, opcode 0 (external address request)
+	request := []byte{0, 0}
+	response := make([]byte, 16)
+
+	// RFC 6886 recommends to start with a timeout of 250ms and to double it
+	timeout := 250 * time.Millisecond
+	for range 4 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		_, err = conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+		var n int
+		n, err = conn.Read(response)
+		if err != nil {
+			continue
+		}
+		if n < 12 || response[0] != 0 || response[1] != 128 {
+			return nil, fmt.Errorf("invalid NAT-PMP response from %s", gateway)
+		}
+		if resultCode := binary.BigEndian.Uint16(response[2:4]); resultCode != 0 {
+			return nil, fmt.Errorf("NAT-PMP request failed with result code %d", resultCode)
+		}
+		ip := net.IP(append([]byte{}, response[8:12]...))
+		if !isPublicIP(ip) {
+			return nil, fmt.Errorf("NAT-PMP gateway %s returned %s which is not a public address", gateway, ip)
+		}
+		e.mu.Lock()
+		e.ip = ip
+		e.mu.Unlock()
+		return ip, nil
+	}
+	return nil, err
+}
+
+// getDefaultGateway reads the IPv4 default gateway from /proc/net/route
+func getDefaultGateway() (net.IP, error) {
+	data, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// the address is stored in host byte order (little endian)
+		return net.IPv4(raw[3], raw[2], raw[1], raw[0]).To4(), nil
+	}
+	return nil, fmt.Errorf("no default gateway found")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewExternalIPUPnP asks the router for its external IPv4 address using
+// UPnP-IGD. If no location (URL of the device description) is specified,
+// the router is discovered using SSDP.
+func NewExternalIPUPnP(location string) ExternalIP {
+	return &externalIPUPnP{
+		location: location,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type externalIPUPnP struct {
+	mu       sync.RWMutex
+	ip       net.IP
+	location string
+	client   *http.Client
+}
+
+func (e *externalIPUPnP) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ip
+}
+
+func (e *externalIPUPnP) Refresh() (net.IP, error) {
+	location := e.location
+	if location == "" {
+		var err error
+		location, err = discoverUPnPGateway()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serviceType, controlURL, err := e.findWANConnection(location)
+	if err != nil {
+		return nil, err
+	}
+
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + serviceType + `"/></s:Body></s:Envelope>`
+
+	req, err := http.NewRequest(http.MethodPost, controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+serviceType+`#GetExternalIPAddress"`)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("UPnP GetExternalIPAddress returned status %d", resp.StatusCode)
+	}
+
+	var envelope struct {
+		Body struct {
+			Response struct {
+				NewExternalIPAddress string
+			} `xml:"GetExternalIPAddressResponse"`
+		}
+	}
+	err = xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(envelope.Body.Response.NewExternalIPAddress)).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("UPnP gateway returned no valid IPv4 address")
+	}
+	if !isPublicIP(ip) {
+		return nil, fmt.Errorf("UPnP gateway returned %s which is not a public address", ip)
+	}
+	e.mu.Lock()
+	e.ip = ip
+	e.mu.Unlock()
+	return ip, nil
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+func (d *upnpDevice) findWANConnection() (serviceType string, controlURL string) {
+	for _, service := range d.Services {
+		if strings.Contains(service.ServiceType, ":WANIPConnection:") ||
+			strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+			return service.ServiceType, service.ControlURL
+		}
+	}
+	for _, device := range d.Devices {
+		serviceType, controlURL = device.findWANConnection()
+		if controlURL != "" {
+			return serviceType, controlURL
+		}
+	}
+	return "", ""
+}
+
+// findWANConnection reads the device description and returns the service
+// type and the absolute control URL of the WAN connection service
+func (e *externalIPUPnP) findWANConnection(location string) (serviceType string, controlURL string, err error) {
+	resp, err := e.client.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	err = xml.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&root)
+	if err != nil {
+		return "", "", err
+	}
+
+	serviceType, controlURL = root.Device.findWANConnection()
+	if controlURL == "" {
+		return "", "", fmt.Errorf("UPnP device %s has no WAN connection service", location)
+	}
+
+	base := location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", "", err
+	}
+	ref, err := url.Parse(controlURL)
+	if err != nil {
+		return "", "", err
+	}
+	return serviceType, baseURL.ResolveReference(ref).String(), nil
+}
+
+// discoverUPnPGateway sends a SSDP M-SEARCH and returns the location of the
+// first internet gateway device which answers
+func discoverUPnPGateway() (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	ssdp := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	request := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+
+	_, err = conn.WriteTo([]byte(request), ssdp)
+	if err != nil {
+		return "", err
+	}
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", fmt.Errorf("no UPnP internet gateway device found: %w", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
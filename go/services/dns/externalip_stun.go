@@ -0,0 +1,192 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	stunMagicCookie          = 0x2112A442
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+)
+
+// NewExternalIPSTUN detects the external IP by sending a STUN binding
+// request (RFC 5389) to the given server (like stun.l.google.com:19302)
+func NewExternalIPSTUN(network string, server string) ExternalIP {
+	if server == "" {
+		server = "stun.l.google.com:19302"
+	}
+	return &externalIPSTUN{
+		network: network,
+		server:  withDefaultPort(server, "3478"),
+	}
+}
+
+type externalIPSTUN struct {
+	mu      sync.RWMutex
+	ip      net.IP
+	network string
+	server  string
+}
+
+func (e *externalIPSTUN) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ip
+}
+
+func (e *externalIPSTUN) Refresh() (net.IP, error) {
+	udpNetwork := "udp4"
+	if e.network == "ip6" {
+		udpNetwork = "udp6"
+	}
+	conn, err := net.DialTimeout(udpNetwork, e.server, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(request[2:4], 0)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	transactionID := request[8:20]
+	_, err = rand.Read(transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 1500)
+	// UDP may lose packets, so the request is repeated a few times
+	for attempt := range 3 {
+		conn.SetDeadline(time.Now().Add(time.Duration(attempt+1) * time.Second))
+		_, err = conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+		var n int
+		n, err = conn.Read(response)
+		if err != nil {
+			continue
+		}
+		var ip net.IP
+		ip, err = parseSTUNResponse(response[:n], transactionID)
+		if err != nil {
+			return nil, err
+		}
+		if !matchesNetwork(ip, e.network) {
+			return nil, fmt.Errorf("STUN server %s returned %s which is not an %s address", e.server, ip, e.network)
+		}
+		if !isPublicIP(ip) {
+			return nil, fmt.Errorf("STUN server %s returned %s which is not a public address", e.server, ip)
+		}
+		e.mu.Lock()
+		e.ip = ip
+		e.mu.Unlock()
+		return ip, nil
+	}
+	return nil, err
+}
+
+// parseSTUNResponse extracts the (XOR-)MAPPED-ADDRESS from a binding response
+func parseSTUNResponse(data []byte, transactionID []byte) (net.IP, error) {
+	if len(data) < 20 {
+		return nil, fmt.Errorf("STUN response too short")
+	}
+	if binary.BigEndian.Uint16(data[0:2]) != stunBindingSuccess {
+		return nil, fmt.Errorf("unexpected STUN message type 0x%04x", binary.BigEndian.Uint16(data[0:2]))
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return nil, fmt.Errorf("invalid STUN magic cookie")
+	}
+	if string(data[8:20]) != string(transactionID) {
+		return nil, fmt.Errorf("STUN transaction id mismatch")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) < 20+length {
+		return nil, fmt.Errorf("STUN response truncated")
+	}
+
+	var mapped net.IP
+	attrs := data[20 : 20+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return nil, fmt.Errorf("STUN attribute truncated")
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			ip, err := parseSTUNAddress(value, data[4:20])
+			if err != nil {
+				return nil, err
+			}
+			return ip, nil
+		case stunAttrMappedAddress:
+			ip, err := parseSTUNAddress(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			mapped = ip
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		next := 4 + (attrLen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped != nil {
+		return mapped, nil
+	}
+	return nil, fmt.Errorf("STUN response contains no mapped address")
+}
+
+// parseSTUNAddress parses a (XOR-)MAPPED-ADDRESS value. For XOR-MAPPED-ADDRESS
+// the xor key (magic cookie + transaction id) must be specified.
+func parseSTUNAddress(value []byte, xorKey []byte) (net.IP, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("STUN address too short")
+	}
+	var ip net.IP
+	switch value[1] {
+	case 0x01:
+		if len(value) < 8 {
+			return nil, fmt.Errorf("STUN IPv4 address too short")
+		}
+		ip = make(net.IP, 4)
+		copy(ip, value[4:8])
+	case 0x02:
+		if len(value) < 20 {
+			return nil, fmt.Errorf("STUN IPv6 address too short")
+		}
+		ip = make(net.IP, 16)
+		copy(ip, value[4:20])
+	default:
+		return nil, fmt.Errorf("unknown STUN address family %d", value[1])
+	}
+	for i := range ip {
+		if xorKey != nil {
+			ip[i] ^= xorKey[i]
+		}
+	}
+	return ip, nil
+}
+
+// matchesNetwork reports if ip belongs to network ("ip4" or "ip6")
+func matchesNetwork(ip net.IP, network string) bool {
+	if network == "ip6" {
+		return ip.To4() == nil && len(ip) == net.IPv6len
+	}
+	return ip.To4() != nil
+}
@@ -0,0 +1,39 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseSTUNResponse(t *testing.T) {
+	transactionID := []byte("0123456789ab")
+	external := net.IPv4(203, 0, 113, 7).To4()
+
+	response := make([]byte, 20+12)
+	binary.BigEndian.PutUint16(response[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint16(response[2:4], 12)
+	binary.BigEndian.PutUint32(response[4:8], stunMagicCookie)
+	copy(response[8:20], transactionID)
+
+	attr := response[20:]
+	binary.BigEndian.PutUint16(attr[0:2], stunAttrXorMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:4], 8)
+	attr[5] = 0x01
+	for i := range 4 {
+		attr[8+i] = external[i] ^ response[4+i]
+	}
+
+	ip, err := parseSTUNResponse(response, transactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(external) {
+		t.Errorf("ip = %s, want %s", ip, external)
+	}
+
+	_, err = parseSTUNResponse(response, []byte("ba9876543210"))
+	if err == nil {
+		t.Error("expected an error for a mismatching transaction id")
+	}
+}
@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fixedExternalIP struct {
+	ip net.IP
+}
+
+func (f *fixedExternalIP) ExternalIP() net.IP {
+	return f.ip
+}
+
+func (f *fixedExternalIP) Refresh() (net.IP, error) {
+	if f.ip == nil {
+		return nil, fmt.Errorf("no address")
+	}
+	return f.ip, nil
+}
+
+func TestExternalIPConsensus(t *testing.T) {
+	x, y := net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1")
+	consensus := NewExternalIPConsensus(
+		&fixedExternalIP{x}, &fixedExternalIP{y}, &fixedExternalIP{}, &fixedExternalIP{y}, &fixedExternalIP{x})
+	// on a tie, the provider listed first wins
+	if ip, err := consensus.Refresh(); err != nil || !ip.Equal(x) {
+		t.Errorf("Refresh() = %v, %v, want %v", ip, err, x)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for address, public := range map[string]bool{
+		"203.0.113.7": true,
+		"192.168.0.1": false,
+		"100.64.0.1":  false,
+		"100.127.0.1": false,
+		"100.128.0.1": true,
+		"2001:db8::1": true,
+		"fd00::1":     false,
+		"fe80::1":     false,
+	} {
+		if isPublicIP(net.ParseIP(address)) != public {
+			t.Errorf("isPublicIP(%s) != %v", address, public)
+		}
+	}
+}
+
+func TestExternalIPHTTPRejectsNonPublicAddresses(t *testing.T) {
+	address := "100.64.1.2"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, address)
+	}))
+	defer server.Close()
+
+	provider := NewExternalIPHTTP("ip4", server.URL)
+	if ip, err := provider.Refresh(); err == nil {
+		t.Errorf("Refresh() = %v, want an error for a CGNAT address", ip)
+	}
+	if ip := provider.ExternalIP(); ip != nil {
+		t.Errorf("ExternalIP() = %v, want nil", ip)
+	}
+
+	address = "198.51.100.1"
+	if ip, err := provider.Refresh(); err != nil || !ip.Equal(net.ParseIP(address)) {
+		t.Errorf("Refresh() = %v, %v, want %v", ip, err, address)
+	}
+}
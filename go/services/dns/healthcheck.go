@@ -0,0 +1,365 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+)
+
+// publicResolvers are used to check if the hostnames can be resolved
+// from the internet
+var publicResolvers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+const (
+	HealthOK      = "ok"
+	HealthWarning = "warning"
+	HealthError   = "error"
+)
+
+// HealthCheckTarget describes what is expected for a domain
+type HealthCheckTarget struct {
+	Domain       string
+	Hostnames    []string
+	ExternalIPv4 net.IP
+	ExternalIPv6 net.IP
+	Serial       uint32
+}
+
+// HealthCheckItem is the result of a single check
+type HealthCheckItem struct {
+	Check   string `json:"check"`
+	Target  string `json:"target,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// HealthCheckResult combines all checks of a domain
+type HealthCheckResult struct {
+	Domain    string            `json:"domain"`
+	Timestamp time.Time         `json:"timestamp"`
+	Status    string            `json:"status"`
+	Checks    []HealthCheckItem `json:"checks"`
+}
+
+func (r *HealthCheckResult) add(check string, target string, status string, format string, args ...any) {
+	r.Checks = append(r.Checks, HealthCheckItem{
+		Check:   check,
+		Target:  target,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if healthSeverity(status) > healthSeverity(r.Status) {
+		r.Status = status
+	}
+}
+
+func healthSeverity(status string) int {
+	switch status {
+	case HealthWarning:
+		return 1
+	case HealthError:
+		return 2
+	}
+	return 0
+}
+
+// CheckDomainHealth verifies that the parent zone delegates the domain to
+// the gateway, that the delegated nameservers return the expected SOA
+// serial and that public resolvers return the external IP addresses for
+// all hostnames
+func (dc *DNSClient) CheckDomainHealth(target HealthCheckTarget) HealthCheckResult {
+	result := HealthCheckResult{
+		Domain:    target.Domain,
+		Timestamp: time.Now(),
+		Status:    HealthOK,
+	}
+
+	client := new(miekgdns.Client)
+	client.Timeout = dc.timeout
+
+	nameservers := dc.checkDelegation(client, target, &result)
+	if len(nameservers) > 0 {
+		dc.checkSerial(client, target, nameservers, &result)
+	}
+	dc.checkResolution(client, target, &result)
+
+	return result
+}
+
+// checkDelegation asks the nameservers of the parent zone for the NS
+// records of the domain and returns the addresses of the delegated
+// nameservers
+func (dc *DNSClient) checkDelegation(client *miekgdns.Client, target HealthCheckTarget, result *HealthCheckResult) (nameservers map[string][]net.IP) {
+	const check = "delegation"
+
+	_, parent, found := strings.Cut(target.Domain, ".")
+	if !found {
+		result.add(check, "", HealthError, "%s has no parent zone", target.Domain)
+		return nil
+	}
+
+	parentServers := dc.findAuthoritativeServers(parent, client)
+	if len(parentServers) == 0 {
+		result.add(check, "", HealthError, "no nameservers found for the parent zone %s", parent)
+		return nil
+	}
+
+	msg := new(miekgdns.Msg)
+	msg.SetQuestion(miekgdns.Fqdn(target.Domain), miekgdns.TypeNS)
+	msg.RecursionDesired = false
+
+	var response *miekgdns.Msg
+	for _, server := range parentServers {
+		r, _, err := client.Exchange(msg, server)
+		if err == nil && r != nil {
+			response = r
+			break
+		}
+	}
+	if response == nil {
+		result.add(check, "", HealthError, "the nameservers of %s did not respond", parent)
+		return nil
+	}
+
+	nameservers = make(map[string][]net.IP)
+	for _, rr := range append(response.Answer, response.Ns...) {
+		if ns, ok := rr.(*miekgdns.NS); ok && strings.EqualFold(ns.Hdr.Name, miekgdns.Fqdn(target.Domain)) {
+			nameservers[strings.ToLower(ns.Ns)] = nil
+		}
+	}
+	if len(nameservers) == 0 {
+		result.add(check, "", HealthError, "the parent zone %s does not delegate %s", parent, target.Domain)
+		return nil
+	}
+
+	// glue records
+	for _, rr := range response.Extra {
+		switch glue := rr.(type) {
+		case *miekgdns.A:
+			if ips, ok := nameservers[strings.ToLower(glue.Hdr.Name)]; ok {
+				nameservers[strings.ToLower(glue.Hdr.Name)] = append(ips, glue.A)
+			}
+		case *miekgdns.AAAA:
+			if ips, ok := nameservers[strings.ToLower(glue.Hdr.Name)]; ok {
+				nameservers[strings.ToLower(glue.Hdr.Name)] = append(ips, glue.AAAA)
+			}
+		}
+	}
+
+	pointsToUs := false
+	for ns, ips := range nameservers {
+		if len(ips) == 0 {
+			ips, _ = net.LookupIP(strings.TrimSuffix(ns, "."))
+			nameservers[ns] = ips
+		}
+		if len(ips) == 0 {
+			result.add(check, ns, HealthWarning, "the address of the nameserver %s is unknown (missing glue record?)", ns)
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(target.ExternalIPv4) || ip.Equal(target.ExternalIPv6) {
+				pointsToUs = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(nameservers))
+	for ns := range nameservers {
+		names = append(names, ns)
+	}
+	slices.Sort(names)
+
+	if !pointsToUs {
+		result.add(check, "", HealthError, "none of the nameservers (%s) points to the external IP of the gateway", strings.Join(names, ", "))
+	} else {
+		result.add(check, "", HealthOK, "%s is delegated to %s", target.Domain, strings.Join(names, ", "))
+	}
+	return nameservers
+}
+
+// checkSerial asks all delegated nameservers for the SOA record
+func (dc *DNSClient) checkSerial(client *miekgdns.Client, target HealthCheckTarget, nameservers map[string][]net.IP, result *HealthCheckResult) {
+	const check = "serial"
+
+	msg := new(miekgdns.Msg)
+	msg.SetQuestion(miekgdns.Fqdn(target.Domain), miekgdns.TypeSOA)
+	msg.RecursionDesired = false
+
+	for ns, ips := range nameservers {
+		for _, ip := range ips {
+			server := net.JoinHostPort(ip.String(), "53")
+			r, _, err := client.Exchange(msg, server)
+			if err != nil {
+				result.add(check, ns, HealthWarning, "%s (%s) did not respond: %v", ns, ip, err)
+				continue
+			}
+			var soa *miekgdns.SOA
+			for _, rr := range append(r.Answer, r.Ns...) {
+				if s, ok := rr.(*miekgdns.SOA); ok {
+					soa = s
+					break
+				}
+			}
+			switch {
+			case soa == nil:
+				result.add(check, ns, HealthWarning, "%s (%s) returned no SOA record for %s", ns, ip, target.Domain)
+			case target.Serial != 0 && soa.Serial != target.Serial:
+				result.add(check, ns, HealthWarning, "%s (%s) returned the serial %d, expected %d", ns, ip, soa.Serial, target.Serial)
+			default:
+				result.add(check, ns, HealthOK, "%s (%s) returned the serial %d", ns, ip, soa.Serial)
+			}
+		}
+	}
+}
+
+// checkResolution resolves all hostnames using public resolvers
+func (dc *DNSClient) checkResolution(client *miekgdns.Client, target HealthCheckTarget, result *HealthCheckResult) {
+	const check = "resolution"
+
+	type expectation struct {
+		qtype uint16
+		ip    net.IP
+	}
+	var expectations []expectation
+	if target.ExternalIPv4 != nil {
+		expectations = append(expectations, expectation{miekgdns.TypeA, target.ExternalIPv4})
+	}
+	if target.ExternalIPv6 != nil {
+		expectations = append(expectations, expectation{miekgdns.TypeAAAA, target.ExternalIPv6})
+	}
+
+	for _, hostname := range target.Hostnames {
+		for _, e := range expectations {
+			qtypeName := miekgdns.TypeToString[e.qtype]
+			for _, resolver := range publicResolvers {
+				msg := new(miekgdns.Msg)
+				msg.SetQuestion(miekgdns.Fqdn(hostname), e.qtype)
+				r, _, err := client.Exchange(msg, resolver)
+				if err != nil {
+					result.add(check, hostname, HealthWarning, "%s %s via %s failed: %v", hostname, qtypeName, resolver, err)
+					continue
+				}
+				var found []string
+				matches := false
+				for _, rr := range r.Answer {
+					var ip net.IP
+					switch v := rr.(type) {
+					case *miekgdns.A:
+						ip = v.A
+					case *miekgdns.AAAA:
+						ip = v.AAAA
+					default:
+						continue
+					}
+					found = append(found, ip.String())
+					matches = matches || ip.Equal(e.ip)
+				}
+				switch {
+				case matches:
+					result.add(check, hostname, HealthOK, "%s %s via %s: %s", hostname, qtypeName, resolver, e.ip)
+				case len(found) == 0:
+					result.add(check, hostname, HealthWarning, "%s %s via %s: no address (%s), expected %s", hostname, qtypeName, resolver, miekgdns.RcodeToString[r.Rcode], e.ip)
+				default:
+					result.add(check, hostname, HealthWarning, "%s %s via %s: %s, expected %s", hostname, qtypeName, resolver, strings.Join(found, ", "), e.ip)
+				}
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// HealthHistory keeps the last results of the health checks per domain
+type HealthHistory interface {
+	// Add stores the result and returns the previous result of the domain
+	Add(result HealthCheckResult) (previous *HealthCheckResult)
+	Latest(domain string) *HealthCheckResult
+	// History returns the results of a domain (newest first)
+	History(domain string) []HealthCheckResult
+}
+
+// NewHealthHistory creates a history which keeps size results per domain.
+// If filename is not empty, the history is persisted as JSON.
+func NewHealthHistory(filename string, size int) (HealthHistory, error) {
+	if size <= 0 {
+		size = 100
+	}
+	h := &healthHistory{
+		filename: filename,
+		size:     size,
+		results:  make(map[string][]HealthCheckResult),
+	}
+	if filename == "" {
+		return h, nil
+	}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &h.results)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+type healthHistory struct {
+	mu       sync.Mutex
+	filename string
+	size     int
+	results  map[string][]HealthCheckResult
+}
+
+func (h *healthHistory) Add(result HealthCheckResult) (previous *HealthCheckResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	results := h.results[result.Domain]
+	if len(results) > 0 {
+		latest := results[0]
+		previous = &latest
+	}
+	results = append([]HealthCheckResult{result}, results...)
+	if len(results) > h.size {
+		results = results[:h.size]
+	}
+	h.results[result.Domain] = results
+
+	if h.filename != "" {
+		data, err := json.Marshal(h.results)
+		if err == nil {
+			err = os.WriteFile(h.filename, data, 0600)
+		}
+		if err != nil {
+			fmt.Println("failed to save DNS health history:", err)
+		}
+	}
+	return previous
+}
+
+func (h *healthHistory) Latest(domain string) *HealthCheckResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	results := h.results[domain]
+	if len(results) == 0 {
+		return nil
+	}
+	latest := results[0]
+	return &latest
+}
+
+func (h *healthHistory) History(domain string) []HealthCheckResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.results[domain])
+}
@@ -0,0 +1,41 @@
+package dns
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHealthHistory(t *testing.T) {
+	filename := path.Join(t.TempDir(), "health.json")
+
+	history, err := NewHealthHistory(filename, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i, status := range []string{HealthOK, HealthWarning, HealthError} {
+		result := HealthCheckResult{Domain: "home.example.com", Timestamp: start.Add(time.Duration(i) * time.Minute)}
+		result.add("delegation", "", status, "check %d", i)
+		previous := history.Add(result)
+		if i > 0 && (previous == nil || previous.Timestamp != start.Add(time.Duration(i-1)*time.Minute)) {
+			t.Fatalf("unexpected previous result: %v", previous)
+		}
+	}
+
+	history, err = NewHealthHistory(filename, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := history.History("home.example.com")
+	if len(results) != 2 || results[0].Status != HealthError || results[1].Status != HealthWarning {
+		t.Fatalf("unexpected history: %v", results)
+	}
+	if latest := history.Latest("home.example.com"); latest == nil || latest.Status != HealthError {
+		t.Errorf("unexpected latest result: %v", latest)
+	}
+	if history.Latest("other.example.com") != nil {
+		t.Error("expected no result for an unknown domain")
+	}
+}
@@ -0,0 +1,250 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ProxyConfig configures how queries for a proxy domain are forwarded
+type ProxyConfig struct {
+	// Targets are tried in order ("udp://host:port" or "tcp://host:port")
+	Targets []string
+	// Timeout of a single attempt (default: 2s)
+	Timeout time.Duration
+	// Retries is the number of additional attempts per target
+	Retries int
+	// StaleTTL defines how long the last good response is used if all
+	// targets fail (default: 1h, negative values disable the stale cache)
+	StaleTTL time.Duration
+}
+
+// ProxyTargetStatus describes the health of a proxy target
+type ProxyTargetStatus struct {
+	Target      string    `json:"target"`
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// ProxyStatus describes a proxy domain
+type ProxyStatus struct {
+	Domain      string              `json:"domain"`
+	Targets     []ProxyTargetStatus `json:"targets"`
+	StaleServed uint64              `json:"stale_served"`
+	Cached      int                 `json:"cached"`
+}
+
+const (
+	proxyMaxCached      = 10000
+	proxyStaleAnswerTTL = 30
+	proxyMaxBackoff     = 5 * time.Minute
+)
+
+type proxyTarget struct {
+	address string
+	client  *dns.Client
+	status  ProxyTargetStatus
+	// unhealthy targets are skipped until retryAt
+	retryAt time.Time
+}
+
+type proxyCacheEntry struct {
+	msg      *dns.Msg
+	storedAt time.Time
+}
+
+type proxy struct {
+	config ProxyConfig
+
+	mu          sync.Mutex
+	targets     []*proxyTarget
+	cache       map[string]proxyCacheEntry
+	staleServed uint64
+}
+
+func newProxy(config ProxyConfig) (*proxy, error) {
+	if len(config.Targets) == 0 {
+		return nil, fmt.Errorf("at least one proxy target is required")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 2 * time.Second
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.StaleTTL == 0 {
+		config.StaleTTL = time.Hour
+	}
+
+	p := &proxy{
+		config: config,
+		cache:  make(map[string]proxyCacheEntry),
+	}
+	for _, target := range config.Targets {
+		client := &dns.Client{Net: "udp", Timeout: config.Timeout}
+		address := target
+		switch {
+		case strings.HasPrefix(target, "tcp://"):
+			address = target[6:]
+			client.Net = "tcp"
+		case strings.HasPrefix(target, "udp://"):
+			address = target[6:]
+		case strings.Contains(target, "://"):
+			return nil, fmt.Errorf("unsupported proxy target %q", target)
+		}
+		p.targets = append(p.targets, &proxyTarget{
+			address: address,
+			client:  client,
+			status:  ProxyTargetStatus{Target: target, Healthy: true},
+		})
+	}
+	return p, nil
+}
+
+// orderedTargets returns the healthy targets first. Unhealthy targets are
+// only used if their backoff is expired or if no other target is left.
+func (p *proxy) orderedTargets(now time.Time) []*proxyTarget {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var healthy, retry, unhealthy []*proxyTarget
+	for _, target := range p.targets {
+		switch {
+		case target.status.Healthy:
+			healthy = append(healthy, target)
+		case !now.Before(target.retryAt):
+			retry = append(retry, target)
+		default:
+			unhealthy = append(unhealthy, target)
+		}
+	}
+	result := append(healthy, retry...)
+	if len(result) == 0 {
+		result = unhealthy
+	}
+	return result
+}
+
+func (p *proxy) markSuccess(target *proxyTarget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	target.status.Healthy = true
+	target.status.Failures = 0
+	target.status.LastError = ""
+	target.status.LastSuccess = time.Now()
+}
+
+func (p *proxy) markFailure(target *proxyTarget, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	target.status.Healthy = false
+	target.status.Failures++
+	target.status.LastError = err.Error()
+	target.status.LastFailure = now
+
+	backoff := time.Duration(target.status.Failures) * 10 * time.Second
+	if backoff > proxyMaxBackoff {
+		backoff = proxyMaxBackoff
+	}
+	target.retryAt = now.Add(backoff)
+}
+
+func proxyCacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// exchange forwards the query to the targets. If all targets fail, the
+// last good response is returned (stale is true in this case).
+func (p *proxy) exchange(r *dns.Msg) (resp *dns.Msg, stale bool, err error) {
+	for _, target := range p.orderedTargets(time.Now()) {
+		for range p.config.Retries + 1 {
+			resp, _, err = target.client.Exchange(r, target.address)
+			if err == nil && resp != nil && resp.Rcode != dns.RcodeServerFailure {
+				p.markSuccess(target)
+				p.store(r, resp)
+				return resp, false, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("%s returned %s", target.address, dns.RcodeToString[resp.Rcode])
+			}
+		}
+		fmt.Println("DNS: proxy to", target.address, "failed:", err)
+		p.markFailure(target, err)
+	}
+
+	if resp := p.lookupStale(r); resp != nil {
+		return resp, true, nil
+	}
+	return nil, false, err
+}
+
+func (p *proxy) store(r *dns.Msg, resp *dns.Msg) {
+	if p.config.StaleTTL < 0 || len(r.Question) == 0 || resp.Truncated {
+		return
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := proxyCacheKey(r.Question[0])
+	if _, ok := p.cache[key]; !ok && len(p.cache) >= proxyMaxCached {
+		// remove an arbitrary entry to limit the memory usage
+		for k := range p.cache {
+			delete(p.cache, k)
+			break
+		}
+	}
+	p.cache[key] = proxyCacheEntry{msg: resp.Copy(), storedAt: time.Now()}
+}
+
+// lookupStale returns a copy of the last good response (with a short TTL,
+// see RFC 8767)
+func (p *proxy) lookupStale(r *dns.Msg) *dns.Msg {
+	if p.config.StaleTTL < 0 || len(r.Question) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := proxyCacheKey(r.Question[0])
+	entry, ok := p.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(entry.storedAt) > p.config.StaleTTL {
+		delete(p.cache, key)
+		return nil
+	}
+	p.staleServed++
+
+	resp := entry.msg.Copy()
+	resp.Id = r.Id
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > proxyStaleAnswerTTL {
+				rr.Header().Ttl = proxyStaleAnswerTTL
+			}
+		}
+	}
+	return resp
+}
+
+func (p *proxy) status(domain string) ProxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := ProxyStatus{
+		Domain:      domain,
+		StaleServed: p.staleServed,
+		Cached:      len(p.cache),
+	}
+	for _, target := range p.targets {
+		status.Targets = append(status.Targets, target.status)
+	}
+	return status
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func startTestDNSServer(t *testing.T, ip net.IP) (address string, shutdown func()) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   ip,
+			})
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func unusedUDPAddress(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestProxyFailover(t *testing.T) {
+	address, shutdown := startTestDNSServer(t, net.IPv4(10, 0, 0, 1))
+
+	p, err := newProxy(ProxyConfig{
+		Targets: []string{"udp://" + unusedUDPAddress(t), "udp://" + address},
+		Timeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.remote.example.com.", dns.TypeA)
+
+	resp, stale, err := p.exchange(query)
+	if err != nil || stale || len(resp.Answer) != 1 {
+		t.Fatalf("exchange = %v, %v, %v", resp, stale, err)
+	}
+
+	status := p.status("remote.example.com")
+	if status.Targets[0].Healthy || !status.Targets[1].Healthy {
+		t.Errorf("unexpected target status: %+v", status.Targets)
+	}
+
+	// the first target is skipped now, so the second one is asked first
+	if targets := p.orderedTargets(time.Now()); targets[0].address != address {
+		t.Errorf("expected the healthy target first, got %s", targets[0].address)
+	}
+
+	shutdown()
+
+	resp, stale, err = p.exchange(query)
+	if err != nil || !stale || len(resp.Answer) != 1 {
+		t.Fatalf("expected a stale response, got %v, %v, %v", resp, stale, err)
+	}
+	if resp.Answer[0].Header().Ttl != proxyStaleAnswerTTL {
+		t.Errorf("stale TTL = %d", resp.Answer[0].Header().Ttl)
+	}
+
+	other := new(dns.Msg)
+	other.SetQuestion("mail.remote.example.com.", dns.TypeA)
+	if _, _, err = p.exchange(other); err == nil {
+		t.Error("expected an error for a query which has never been answered")
+	}
+}
@@ -0,0 +1,339 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QueryRecord describes a single query answered by the DNS server
+type QueryRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Client    string    `json:"client"`
+	Protocol  string    `json:"protocol"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Answers   int       `json:"answers"`
+	LatencyMs float64   `json:"latency_ms"`
+	// Source is one of "authoritative", "proxy", "stale", "resolver",
+	// "unknown" or "capped"
+	Source  string `json:"source"`
+	Proxied bool   `json:"proxied"`
+	// RateLimit is "dropped" or "slipped" if the response rate limiting
+	// didn't send the response (Rcode and Answers describe what has been
+	// sent instead)
+	RateLimit string `json:"rate_limit,omitempty"`
+}
+
+// QueryCount is a name or client with the number of queries
+type QueryCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// QueryStats summarizes the records currently held by the query log
+type QueryStats struct {
+	Since        time.Time      `json:"since"`
+	Total        int            `json:"total"`
+	Rcodes       map[string]int `json:"rcodes"`
+	Sources      map[string]int `json:"sources"`
+	RejectedRate float64        `json:"rejected_rate"`
+	NXDomainRate float64        `json:"nxdomain_rate"`
+	TopNames     []QueryCount   `json:"top_names"`
+	TopClients   []QueryCount   `json:"top_clients"`
+}
+
+// QueryLog keeps the most recent queries in a bounded ring which is mirrored
+// to a file, so that it survives restarts
+type QueryLog interface {
+	Record(record QueryRecord)
+	Records(limit int) []QueryRecord
+	Stats(top int) QueryStats
+	Subscribe() (records <-chan QueryRecord, cancel func())
+	Close() error
+}
+
+// queryLogSlotSize is the number of bytes reserved for every record in the
+// ring file. Every slot contains a checksum, the sequence number and the
+// record as JSON, padded with spaces:
+//
+//	<crc32 of the rest, 8 hex digits> <sequence, 16 hex digits> <json>
+//
+// Slots which have been torn by a crash fail the checksum and are dropped.
+const queryLogSlotSize = 512
+
+// queryLogHeaderSize is the size of the checksum and the sequence number
+// (including the separating spaces)
+const queryLogHeaderSize = 8 + 1 + 16 + 1
+
+type queryLog struct {
+	mu          sync.Mutex
+	file        *os.File
+	records     []QueryRecord
+	next        int
+	seq         uint64
+	subscribers map[chan QueryRecord]bool
+}
+
+// NewQueryLog opens (or creates) a query log file holding at most size records
+func NewQueryLog(filename string, size int) (QueryLog, error) {
+	if size <= 0 {
+		size = 10000
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queryLog{
+		file:        file,
+		records:     make([]QueryRecord, 0, size),
+		subscribers: make(map[chan QueryRecord]bool),
+	}
+	err = q.load(size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads all slots of the ring file and restores the ring in memory.
+// Afterwards the file is rewritten with the oldest record in the first slot.
+func (q *queryLog) load(size int) error {
+	info, err := q.file.Stat()
+	if err != nil {
+		return err
+	}
+	slots := int(info.Size() / queryLogSlotSize)
+
+	type slotRecord struct {
+		seq    uint64
+		record QueryRecord
+	}
+	loaded := make([]slotRecord, 0, slots)
+	buf := make([]byte, queryLogSlotSize)
+	for slot := range slots {
+		_, err = q.file.ReadAt(buf, int64(slot*queryLogSlotSize))
+		if err != nil {
+			return err
+		}
+		if seq, record, ok := parseSlot(buf); ok {
+			loaded = append(loaded, slotRecord{seq: seq, record: record})
+		}
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].seq < loaded[j].seq
+	})
+	if len(loaded) > size {
+		loaded = loaded[len(loaded)-size:]
+	}
+	for _, l := range loaded {
+		q.records = append(q.records, l.record)
+	}
+	q.next = len(q.records) % size
+
+	return q.rewrite()
+}
+
+// parseSlot returns the record of a slot, ok is false if the slot is empty
+// or torn
+func parseSlot(buf []byte) (seq uint64, record QueryRecord, ok bool) {
+	line := bytes.TrimRight(buf, " \n")
+	if len(line) <= queryLogHeaderSize || line[8] != ' ' || line[queryLogHeaderSize-1] != ' ' {
+		return 0, record, false
+	}
+	checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil || uint32(checksum) != crc32.ChecksumIEEE(line[9:]) {
+		return 0, record, false
+	}
+	seq, err = strconv.ParseUint(string(line[9:queryLogHeaderSize-1]), 16, 64)
+	if err != nil {
+		return 0, record, false
+	}
+	if json.Unmarshal(line[queryLogHeaderSize:], &record) != nil || record.Timestamp.IsZero() {
+		return 0, record, false
+	}
+	return seq, record, true
+}
+
+// rewrite writes the complete memory ring to the file
+func (q *queryLog) rewrite() error {
+	err := q.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	q.seq = 0
+	for slot, record := range q.records {
+		err = q.writeSlot(slot, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSlot writes the record with the next sequence number
+func (q *queryLog) writeSlot(slot int, record QueryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if len(data) > queryLogSlotSize-queryLogHeaderSize-1 {
+		record.Name = record.Name[:min(len(record.Name), 64)] + "..."
+		data, err = json.Marshal(record)
+		if err != nil {
+			return err
+		}
+	}
+	body := append(fmt.Appendf(nil, "%016x ", q.seq), data...)
+	q.seq++
+	buf := bytes.Repeat([]byte{' '}, queryLogSlotSize)
+	copy(buf, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(body)))
+	copy(buf[9:], body)
+	buf[queryLogSlotSize-1] = '\n'
+	_, err = q.file.WriteAt(buf, int64(slot*queryLogSlotSize))
+	return err
+}
+
+func (q *queryLog) Record(record QueryRecord) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	slot := q.next
+	if len(q.records) < cap(q.records) {
+		q.records = append(q.records, record)
+	} else {
+		q.records[slot] = record
+	}
+	q.next = (slot + 1) % cap(q.records)
+
+	if q.file != nil {
+		err := q.writeSlot(slot, record)
+		if err != nil {
+			fmt.Println("DNS: failed to write query log:", err)
+		}
+	}
+
+	for subscriber := range q.subscribers {
+		select {
+		case subscriber <- record:
+		default:
+			// slow subscribers lose records instead of blocking the server
+		}
+	}
+}
+
+// ordered returns all records, oldest first
+func (q *queryLog) ordered() []QueryRecord {
+	if len(q.records) < cap(q.records) {
+		return q.records
+	}
+	return append(append([]QueryRecord{}, q.records[q.next:]...), q.records[:q.next]...)
+}
+
+// Records returns the newest records, newest first
+func (q *queryLog) Records(limit int) []QueryRecord {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ordered := q.ordered()
+	if limit <= 0 || limit > len(ordered) {
+		limit = len(ordered)
+	}
+	result := make([]QueryRecord, 0, limit)
+	for i := len(ordered) - 1; i >= len(ordered)-limit; i-- {
+		result = append(result, ordered[i])
+	}
+	return result
+}
+
+func (q *queryLog) Stats(top int) QueryStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := QueryStats{
+		Rcodes:  make(map[string]int),
+		Sources: make(map[string]int),
+	}
+	names := make(map[string]int)
+	clients := make(map[string]int)
+
+	for _, record := range q.records {
+		if stats.Since.IsZero() || record.Timestamp.Before(stats.Since) {
+			stats.Since = record.Timestamp
+		}
+		stats.Total++
+		stats.Rcodes[record.Rcode]++
+		stats.Sources[record.Source]++
+		names[record.Name]++
+		clients[record.Client]++
+	}
+
+	if stats.Total > 0 {
+		// queries for other zones are answered without records
+		rejected := stats.Rcodes["REFUSED"] + stats.Sources["unknown"]
+		stats.RejectedRate = float64(rejected) / float64(stats.Total)
+		stats.NXDomainRate = float64(stats.Rcodes["NXDOMAIN"]) / float64(stats.Total)
+	}
+	stats.TopNames = topCounts(names, top)
+	stats.TopClients = topCounts(clients, top)
+	return stats
+}
+
+func topCounts(counts map[string]int, top int) []QueryCount {
+	result := make([]QueryCount, 0, len(counts))
+	for key, count := range counts {
+		result = append(result, QueryCount{Key: key, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if top > 0 && len(result) > top {
+		result = result[:top]
+	}
+	return result
+}
+
+func (q *queryLog) Subscribe() (<-chan QueryRecord, func()) {
+	ch := make(chan QueryRecord, 256)
+
+	q.mu.Lock()
+	q.subscribers[ch] = true
+	q.mu.Unlock()
+
+	return ch, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.subscribers[ch] {
+			delete(q.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (q *queryLog) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for subscriber := range q.subscribers {
+		close(subscriber)
+	}
+	q.subscribers = make(map[chan QueryRecord]bool)
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestQueryLogRing(t *testing.T) {
+	filename := path.Join(t.TempDir(), "queries.log")
+
+	queryLog, err := NewQueryLog(filename, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := range 5 {
+		queryLog.Record(QueryRecord{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Client:    "192.168.0.1",
+			Name:      fmt.Sprintf("host%d.example.com.", i),
+			Rcode:     "NOERROR",
+		})
+	}
+
+	records := queryLog.Records(0)
+	if len(records) != 3 || records[0].Name != "host4.example.com." || records[2].Name != "host2.example.com." {
+		t.Fatalf("unexpected records: %v", records)
+	}
+	queryLog.Close()
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3*queryLogSlotSize {
+		t.Errorf("file size = %d, want %d", info.Size(), 3*queryLogSlotSize)
+	}
+
+	queryLog, err = NewQueryLog(filename, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queryLog.Close()
+	queryLog.Record(QueryRecord{
+		Timestamp: start.Add(10 * time.Second),
+		Client:    "192.168.0.2",
+		Name:      "host5.example.com.",
+		Rcode:     "NXDOMAIN",
+	})
+
+	records = queryLog.Records(0)
+	if len(records) != 3 || records[0].Name != "host5.example.com." || records[2].Name != "host3.example.com." {
+		t.Fatalf("unexpected records after reload: %v", records)
+	}
+
+	stats := queryLog.Stats(1)
+	if stats.Total != 3 || len(stats.TopClients) != 1 || stats.TopClients[0].Key != "192.168.0.1" {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.NXDomainRate < 0.33 || stats.NXDomainRate > 0.34 {
+		t.Errorf("NXDomainRate = %f", stats.NXDomainRate)
+	}
+}
+
+func TestQueryLogTornSlot(t *testing.T) {
+	filename := path.Join(t.TempDir(), "queries.log")
+
+	queryLog, err := NewQueryLog(filename, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := range 2 {
+		queryLog.Record(QueryRecord{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Name:      fmt.Sprintf("host%d.example.com.", i),
+		})
+	}
+	queryLog.Close()
+
+	// a crash has overwritten the beginning of the second record only
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("host9"), queryLogSlotSize+100)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryLog, err = NewQueryLog(filename, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queryLog.Close()
+	records := queryLog.Records(0)
+	if len(records) != 1 || records[0].Name != "host0.example.com." {
+		t.Fatalf("unexpected records after a torn write: %v", records)
+	}
+}
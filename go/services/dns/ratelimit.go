@@ -0,0 +1,290 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RateLimitConfig configures the response rate limiting (RRL) of UDP
+// responses. Zero values are replaced by the defaults.
+type RateLimitConfig struct {
+	Disabled bool
+	// ResponsesPerSecond is the rate of identical responses per client prefix
+	ResponsesPerSecond int
+	// ErrorsPerSecond is the rate of NXDOMAIN, REFUSED and other errors
+	ErrorsPerSecond int
+	// Window is the number of seconds a client may burst
+	Window int
+	// Slip defines that every n-th dropped response is sent truncated, so
+	// that real clients retry using TCP. 1 truncates all responses, a
+	// negative value drops all responses.
+	Slip int
+	// IPv4PrefixLength and IPv6PrefixLength define the client prefixes
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+	// ExemptNetworks are never limited (default: loopback and private networks)
+	ExemptNetworks []string
+	// AnyQueries defines how ANY queries via UDP are answered: "minimal"
+	// (RFC 8482, the default), "refuse" or "allow"
+	AnyQueries string
+}
+
+// RateLimitStats contains the counters of the rate limiter
+type RateLimitStats struct {
+	Enabled   bool   `json:"enabled"`
+	Responses uint64 `json:"responses"`
+	Dropped   uint64 `json:"dropped"`
+	Slipped   uint64 `json:"slipped"`
+	AnyCapped uint64 `json:"any_capped"`
+	Buckets   int    `json:"buckets"`
+}
+
+type rateLimitAction int
+
+const (
+	rateLimitAllow rateLimitAction = iota
+	rateLimitDrop
+	rateLimitSlip
+)
+
+type rateLimitBucket struct {
+	tokens   float64
+	lastSeen time.Time
+	dropped  int
+}
+
+type rateLimiter struct {
+	config         RateLimitConfig
+	exemptNetworks []*net.IPNet
+	now            func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastSweep time.Time
+
+	responses atomic.Uint64
+	dropped   atomic.Uint64
+	slipped   atomic.Uint64
+	anyCapped atomic.Uint64
+}
+
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	if config.ResponsesPerSecond <= 0 {
+		config.ResponsesPerSecond = 10
+	}
+	if config.ErrorsPerSecond <= 0 {
+		config.ErrorsPerSecond = config.ResponsesPerSecond
+	}
+	if config.Window <= 0 {
+		config.Window = 5
+	}
+	if config.Slip == 0 {
+		config.Slip = 2
+	}
+	if config.IPv4PrefixLength <= 0 || config.IPv4PrefixLength > 32 {
+		config.IPv4PrefixLength = 24
+	}
+	if config.IPv6PrefixLength <= 0 || config.IPv6PrefixLength > 128 {
+		config.IPv6PrefixLength = 56
+	}
+	switch config.AnyQueries {
+	case "":
+		config.AnyQueries = "minimal"
+	case "minimal", "refuse", "allow":
+	default:
+		return nil, fmt.Errorf("invalid value %q for ANY queries", config.AnyQueries)
+	}
+
+	exemptNetworks := config.ExemptNetworks
+	if len(exemptNetworks) == 0 {
+		exemptNetworks = defaultAllowedNetworks
+	}
+
+	rl := &rateLimiter{
+		config:  config,
+		now:     time.Now,
+		buckets: make(map[string]*rateLimitBucket),
+	}
+	for _, network := range exemptNetworks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		rl.exemptNetworks = append(rl.exemptNetworks, ipNet)
+	}
+	return rl, nil
+}
+
+func (rl *rateLimiter) isExempt(ip net.IP) bool {
+	for _, network := range rl.exemptNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientPrefix returns the network of the client which shares one bucket
+func (rl *rateLimiter) clientPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rl.config.IPv4PrefixLength, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(rl.config.IPv6PrefixLength, 128)).String()
+}
+
+// responseKey identifies identical responses. Errors and empty responses
+// are accounted per zone (the owner of the SOA), so that random
+// subdomains don't create new buckets.
+func responseKey(m *dns.Msg) (key string, isError bool) {
+	var name string
+	var qtype uint16
+	if len(m.Question) > 0 {
+		name = strings.ToLower(m.Question[0].Name)
+		qtype = m.Question[0].Qtype
+	}
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				name = strings.ToLower(soa.Hdr.Name)
+				break
+			}
+		}
+		return fmt.Sprintf("%s/%s/%d", name, dns.RcodeToString[m.Rcode], qtype), m.Rcode != dns.RcodeSuccess
+	}
+	return fmt.Sprintf("%s/%d", name, qtype), false
+}
+
+// check accounts the response and decides if it may be sent
+func (rl *rateLimiter) check(client net.IP, m *dns.Msg) rateLimitAction {
+	rl.responses.Add(1)
+	if client == nil || rl.isExempt(client) {
+		return rateLimitAllow
+	}
+
+	key, isError := responseKey(m)
+	key = rl.clientPrefix(client) + "/" + key
+	rate := float64(rl.config.ResponsesPerSecond)
+	if isError {
+		rate = float64(rl.config.ErrorsPerSecond)
+	}
+	burst := rate * float64(rl.config.Window)
+
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sweep(now)
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: burst, lastSeen: now}
+		rl.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.lastSeen).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.lastSeen = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.dropped = 0
+		return rateLimitAllow
+	}
+
+	bucket.dropped++
+	if rl.config.Slip > 0 && bucket.dropped%rl.config.Slip == 0 {
+		rl.slipped.Add(1)
+		return rateLimitSlip
+	}
+	rl.dropped.Add(1)
+	return rateLimitDrop
+}
+
+// sweep removes the buckets which are full again
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < 10*time.Second {
+		return
+	}
+	rl.lastSweep = now
+	maxIdle := time.Duration(rl.config.Window) * time.Second
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.lastSeen) > maxIdle {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// capAny returns the response for ANY queries (or nil if the query must
+// be answered normally)
+func (rl *rateLimiter) capAny(client net.IP, r *dns.Msg) *dns.Msg {
+	if r.Question[0].Qtype != dns.TypeANY || rl.config.AnyQueries == "allow" {
+		return nil
+	}
+	if client != nil && rl.isExempt(client) {
+		return nil
+	}
+	rl.anyCapped.Add(1)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if rl.config.AnyQueries == "refuse" {
+		m.SetRcode(r, dns.RcodeRefused)
+		return m
+	}
+	m.Answer = append(m.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   r.Question[0].Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Cpu: "RFC8482",
+	})
+	return m
+}
+
+func (rl *rateLimiter) stats() RateLimitStats {
+	rl.mu.Lock()
+	buckets := len(rl.buckets)
+	rl.mu.Unlock()
+	return RateLimitStats{
+		Enabled:   true,
+		Responses: rl.responses.Load(),
+		Dropped:   rl.dropped.Load(),
+		Slipped:   rl.slipped.Load(),
+		AnyCapped: rl.anyCapped.Load(),
+		Buckets:   buckets,
+	}
+}
+
+// rateLimitedWriter applies the rate limiter to all UDP responses
+type rateLimitedWriter struct {
+	dns.ResponseWriter
+	limiter *rateLimiter
+	// action is "dropped" or "slipped" if the response hasn't been sent
+	action string
+}
+
+func (w *rateLimitedWriter) WriteMsg(m *dns.Msg) error {
+	switch w.limiter.check(addrToIP(w.RemoteAddr()), m) {
+	case rateLimitDrop:
+		w.action = "dropped"
+		return nil
+	case rateLimitSlip:
+		w.action = "slipped"
+		truncated := new(dns.Msg)
+		truncated.SetReply(m)
+		truncated.Rcode = m.Rcode
+		truncated.Truncated = true
+		return w.ResponseWriter.WriteMsg(truncated)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
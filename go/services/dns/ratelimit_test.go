@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConfig{
+		ResponsesPerSecond: 2,
+		Window:             1,
+		Slip:               2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(203, 0, 113, 1),
+	})
+
+	client := net.IPv4(198, 51, 100, 1)
+	neighbour := net.IPv4(198, 51, 100, 2)
+
+	actions := []rateLimitAction{
+		rl.check(client, response),
+		rl.check(neighbour, response),
+		rl.check(client, response),
+		rl.check(client, response),
+	}
+	want := []rateLimitAction{rateLimitAllow, rateLimitAllow, rateLimitDrop, rateLimitSlip}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("actions = %v, want %v", actions, want)
+		}
+	}
+
+	if rl.check(net.IPv4(192, 168, 1, 10), response) != rateLimitAllow {
+		t.Error("private clients must not be limited")
+	}
+
+	now = now.Add(time.Second)
+	if rl.check(client, response) != rateLimitAllow {
+		t.Error("the bucket must be refilled after one second")
+	}
+
+	stats := rl.stats()
+	if stats.Dropped != 1 || stats.Slipped != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRateLimiterAny(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeANY)
+
+	m := rl.capAny(net.IPv4(198, 51, 100, 1), query)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeHINFO {
+		t.Fatalf("unexpected response for ANY: %v", m)
+	}
+	if rl.capAny(net.IPv4(10, 0, 0, 1), query) != nil {
+		t.Error("ANY queries from private clients must not be capped")
+	}
+}
@@ -0,0 +1,303 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResolverConfig configures the forwarding resolver used for LAN clients
+type ResolverConfig struct {
+	// Upstreams is a list of upstream URIs (see NewUpstream)
+	Upstreams []string
+	// Blocklists is a list of files with hosts-style or adblock-style entries
+	Blocklists []string
+	// CacheSize is the maximum number of cached responses
+	CacheSize int
+	// AllowedNetworks restricts the clients which may use the resolver.
+	// If empty, only loopback and private networks are allowed.
+	AllowedNetworks []string
+	// AllowEncrypted allows all DoT and DoH clients to use the resolver
+	AllowEncrypted bool
+}
+
+// Resolver answers queries for names the server is not authoritative for
+type Resolver interface {
+	IsAllowed(client net.Addr) bool
+	Resolve(ctx context.Context, r *dns.Msg, client net.Addr) *dns.Msg
+	ReloadBlocklists() error
+	FlushCache()
+	Stats() ResolverStats
+	ClientStats() []ClientStats
+}
+
+// ClientStats contains the query statistics of a single LAN client
+type ClientStats struct {
+	Client    string    `json:"client"`
+	Queries   uint64    `json:"queries"`
+	Cached    uint64    `json:"cached"`
+	Blocked   uint64    `json:"blocked"`
+	Forwarded uint64    `json:"forwarded"`
+	Failed    uint64    `json:"failed"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ResolverStats contains the overall state of the resolver
+type ResolverStats struct {
+	Upstreams         []string `json:"upstreams"`
+	CachedResponses   int      `json:"cached_responses"`
+	BlocklistEntries  int      `json:"blocklist_entries"`
+	Queries           uint64   `json:"queries"`
+	Cached            uint64   `json:"cached"`
+	Blocked           uint64   `json:"blocked"`
+	Forwarded         uint64   `json:"forwarded"`
+	Failed            uint64   `json:"failed"`
+	BlocklistErrorMsg string   `json:"blocklist_error,omitempty"`
+}
+
+var defaultAllowedNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type resolver struct {
+	config    ResolverConfig
+	upstreams []Upstream
+	networks  []*net.IPNet
+	cache     Cache
+
+	mu           sync.Mutex
+	blocklist    Blocklist
+	blocklistErr error
+	clients      map[string]*ClientStats
+	total        ClientStats
+}
+
+// NewResolver creates a caching forwarder
+func NewResolver(config ResolverConfig) (Resolver, error) {
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("at least one upstream is required")
+	}
+
+	r := &resolver{
+		config:  config,
+		cache:   NewCache(config.CacheSize, 0, 24*60*60),
+		clients: make(map[string]*ClientStats),
+	}
+
+	for _, uri := range config.Upstreams {
+		upstream, err := NewUpstream(uri, 0)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, upstream)
+	}
+
+	networks := config.AllowedNetworks
+	if len(networks) == 0 {
+		networks = defaultAllowedNetworks
+	}
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		r.networks = append(r.networks, ipNet)
+	}
+
+	err := r.ReloadBlocklists()
+	if err != nil {
+		fmt.Println("DNS: failed to load blocklists:", err)
+	}
+
+	return r, nil
+}
+
+func (r *resolver) ReloadBlocklists() error {
+	blocklist, err := LoadBlocklistFiles(r.config.Blocklists...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blocklistErr = err
+	if err != nil {
+		return err
+	}
+	r.blocklist = blocklist
+	r.cache.Flush()
+	return nil
+}
+
+func (r *resolver) FlushCache() {
+	r.cache.Flush()
+}
+
+func (r *resolver) IsAllowed(client net.Addr) bool {
+	if _, ok := client.(*encryptedAddr); ok && r.config.AllowEncrypted {
+		return true
+	}
+	ip := addrToIP(client)
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrToIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *encryptedAddr:
+		return addrToIP(a.Addr)
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func (r *resolver) count(client net.Addr, update func(stats *ClientStats)) {
+	key := "unknown"
+	if ip := addrToIP(client); ip != nil {
+		key = ip.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.clients[key]
+	if stats == nil {
+		stats = &ClientStats{Client: key}
+		r.clients[key] = stats
+	}
+	stats.Queries++
+	stats.LastSeen = time.Now()
+	update(stats)
+
+	r.total.Queries++
+	update(&r.total)
+}
+
+func (r *resolver) isBlocked(name string) bool {
+	r.mu.Lock()
+	blocklist := r.blocklist
+	r.mu.Unlock()
+	return blocklist != nil && blocklist.IsBlocked(name)
+}
+
+func (r *resolver) Resolve(ctx context.Context, req *dns.Msg, client net.Addr) *dns.Msg {
+	q := req.Question[0]
+
+	if r.isBlocked(q.Name) {
+		r.count(client, func(stats *ClientStats) { stats.Blocked++ })
+		return makeBlockedResponse(req)
+	}
+
+	if cached := r.cache.Get(q); cached != nil {
+		r.count(client, func(stats *ClientStats) { stats.Cached++ })
+		cached.Id = req.Id
+		return cached
+	}
+
+	query := req.Copy()
+	query.RecursionDesired = true
+
+	var lastErr error
+	for _, upstream := range r.upstreams {
+		resp, err := upstream.Exchange(ctx, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure {
+			lastErr = fmt.Errorf("%s returned SERVFAIL", upstream)
+			continue
+		}
+		r.cache.Put(q, resp)
+		r.count(client, func(stats *ClientStats) { stats.Forwarded++ })
+		resp.Id = req.Id
+		return resp
+	}
+
+	fmt.Println("DNS: all upstreams failed:", lastErr)
+	r.count(client, func(stats *ClientStats) { stats.Failed++ })
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	m.RecursionAvailable = true
+	return m
+}
+
+// makeBlockedResponse answers blocked A/AAAA queries with the unspecified
+// address (like Pi-hole does) and all other query types with an empty answer
+func makeBlockedResponse(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch q.Qtype {
+	case dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+	case dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6unspecified})
+	}
+	return m
+}
+
+func (r *resolver) Stats() ResolverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := ResolverStats{
+		CachedResponses: r.cache.Len(),
+		Queries:         r.total.Queries,
+		Cached:          r.total.Cached,
+		Blocked:         r.total.Blocked,
+		Forwarded:       r.total.Forwarded,
+		Failed:          r.total.Failed,
+	}
+	for _, upstream := range r.upstreams {
+		stats.Upstreams = append(stats.Upstreams, upstream.String())
+	}
+	if r.blocklist != nil {
+		stats.BlocklistEntries = r.blocklist.Len()
+	}
+	if r.blocklistErr != nil {
+		stats.BlocklistErrorMsg = r.blocklistErr.Error()
+	}
+	return stats
+}
+
+func (r *resolver) ClientStats() []ClientStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]ClientStats, 0, len(r.clients))
+	for _, stats := range r.clients {
+		result = append(result, *stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Queries > result[j].Queries
+	})
+	return result
+}
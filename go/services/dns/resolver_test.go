@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolverFailsOverOnServerFailure(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	failing := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+		}),
+	}
+	go failing.ActivateAndServe()
+	<-started
+	defer failing.Shutdown()
+
+	good, shutdown := startTestDNSServer(t, net.ParseIP("192.0.2.7"))
+	defer shutdown()
+
+	r, err := NewResolver(ResolverConfig{Upstreams: []string{conn.LocalAddr().String(), good}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.org.", dns.TypeA)
+	resp := r.Resolve(context.Background(), query, &net.UDPAddr{IP: net.ParseIP("192.168.0.10")})
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("Resolve() = %s with %d answers, want the answer of the second upstream",
+			dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+}
@@ -1,10 +1,14 @@
 package dns
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -14,15 +18,24 @@ type Server interface {
 	SetExternalIPv4(externalIP ExternalIP) error
 	SetExternalIPv6(externalIP ExternalIP) error
 	AddDomains(domains ...string) error
-	AddProxyDomain(domain string, target string) error
+	AddProxyDomain(domain string, config ProxyConfig) error
+	ProxyStatus() []ProxyStatus
 	DelDomains(domains ...string) error
 	SetChallenge(domain string, challenge string) error
+	SetResolver(resolver Resolver) error
+	SetQueryLog(queryLog QueryLog) error
+	SetRateLimit(config RateLimitConfig) error
+	RateLimitStats() RateLimitStats
+	BumpSerial()
+	Serial() uint32
+	ServeDoT(ctx context.Context, conn net.Conn)
+	ServeDoH(w http.ResponseWriter, r *http.Request)
 }
 
 type domain struct {
-	name         string
-	challenge    string
-	proxy_target string
+	name      string
+	challenge string
+	proxy     *proxy
 }
 
 func (d *domain) makeNS() dns.RR {
@@ -37,7 +50,7 @@ func (d *domain) makeNS() dns.RR {
 	}
 }
 
-func (d *domain) makeSOA() dns.RR {
+func (d *domain) makeSOA(serial uint32) dns.RR {
 	return &dns.SOA{
 		Hdr: dns.RR_Header{
 			Name:   fmt.Sprintf("%s.", d.name),
@@ -47,7 +60,7 @@ func (d *domain) makeSOA() dns.RR {
 		},
 		Ns:      fmt.Sprintf("ns1.%s.", d.name),
 		Mbox:    fmt.Sprintf("admin.%s.", d.name),
-		Serial:  uint32(time.Now().Unix()),
+		Serial:  serial,
 		Refresh: 28800,
 		Retry:   7200,
 		Expire:  600,
@@ -117,8 +130,19 @@ type server struct {
 
 	ipv4 ExternalIP
 	ipv6 ExternalIP
+
+	// mutex guards the resolver, the query log and the rate limiter, which
+	// are replaced at runtime. The handler loads each of them once per query.
+	mutex       sync.RWMutex
+	resolver    Resolver
+	queryLog    QueryLog
+	rateLimiter *rateLimiter
+
+	serial atomic.Uint32
 }
 
+// SetExternalIPv4 doesn't bump the serial, the caller does it if the
+// address has changed
 func (s *server) SetExternalIPv4(externalIP ExternalIP) error {
 	s.ipv4 = externalIP
 	return nil
@@ -129,6 +153,66 @@ func (s *server) SetExternalIPv6(externalIP ExternalIP) error {
 	return nil
 }
 
+// BumpSerial increments the SOA serial of all zones. It must be called
+// whenever the answers of the server change (like the external IP)
+func (s *server) BumpSerial() {
+	serial := uint32(time.Now().Unix())
+	for {
+		old := s.serial.Load()
+		if serial <= old {
+			serial = old + 1
+		}
+		if s.serial.CompareAndSwap(old, serial) {
+			return
+		}
+	}
+}
+
+func (s *server) Serial() uint32 {
+	return s.serial.Load()
+}
+
+func (s *server) SetResolver(resolver Resolver) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.resolver = resolver
+	return nil
+}
+
+func (s *server) SetQueryLog(queryLog QueryLog) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queryLog = queryLog
+	return nil
+}
+
+// SetRateLimit enables (or disables) the response rate limiting of UDP
+// responses
+func (s *server) SetRateLimit(config RateLimitConfig) error {
+	var rateLimiter *rateLimiter
+	if !config.Disabled {
+		var err error
+		rateLimiter, err = newRateLimiter(config)
+		if err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rateLimiter = rateLimiter
+	return nil
+}
+
+func (s *server) RateLimitStats() RateLimitStats {
+	s.mutex.RLock()
+	rateLimiter := s.rateLimiter
+	s.mutex.RUnlock()
+	if rateLimiter != nil {
+		return rateLimiter.stats()
+	}
+	return RateLimitStats{}
+}
+
 func (s *server) getDomain(name string) *domain {
 	for _, domain := range s.domains {
 		if domain.name == name {
@@ -147,6 +231,7 @@ func (s *server) DelDomains(domains ...string) error {
 		}
 	}
 	s.domains = newDomains
+	s.BumpSerial()
 	return nil
 }
 
@@ -160,10 +245,15 @@ func (s *server) AddDomains(domains ...string) error {
 			s.domains = append(s.domains, d)
 		}
 	}
+	s.BumpSerial()
 	return nil
 }
 
-func (s *server) AddProxyDomain(name string, target string) error {
+func (s *server) AddProxyDomain(name string, config ProxyConfig) error {
+	p, err := newProxy(config)
+	if err != nil {
+		return err
+	}
 	d := s.getDomain(name)
 	if d == nil {
 		d = &domain{
@@ -171,21 +261,34 @@ func (s *server) AddProxyDomain(name string, target string) error {
 		}
 		s.domains = append(s.domains, d)
 	}
-	d.proxy_target = target
+	d.proxy = p
+	s.BumpSerial()
 	return nil
 }
 
+func (s *server) ProxyStatus() []ProxyStatus {
+	result := []ProxyStatus{}
+	for _, d := range s.domains {
+		if d.proxy != nil {
+			result = append(result, d.proxy.status(d.name))
+		}
+	}
+	return result
+}
+
 func (s *server) SetChallenge(domain string, challenge string) error {
 	d := s.getDomain(domain)
 	if d == nil {
 		return nil
 	}
 	d.challenge = challenge
+	s.BumpSerial()
 	return nil
 }
 
 func NewServer(addr string) (s Server, err error) {
 	server := &server{}
+	server.serial.Store(uint32(time.Now().Unix()))
 
 	server.mux = dns.NewServeMux()
 	server.mux.HandleFunc(".", server.dnsHandleFunc)
@@ -247,38 +350,140 @@ func (s *server) questionToHostAndDomain(q dns.Question) (dwh *domainWithHost) {
 	return nil
 }
 
+// responseRecorder remembers the message written to the client, so that it
+// can be added to the query log
+type responseRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (rr *responseRecorder) WriteMsg(m *dns.Msg) error {
+	rr.msg = m
+	return rr.ResponseWriter.WriteMsg(m)
+}
+
 func (s *server) dnsHandleFunc(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+
+	if len(r.Question) == 0 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	s.mutex.RLock()
+	resolver, queryLog, rateLimiter := s.resolver, s.queryLog, s.rateLimiter
+	s.mutex.RUnlock()
+	if w.RemoteAddr().Network() != "udp" {
+		rateLimiter = nil
+	}
+
+	// the recorder is wrapped by the rate limiter, so that it records what
+	// has actually been sent
+	var recorder *responseRecorder
+	if queryLog != nil {
+		recorder = &responseRecorder{ResponseWriter: w}
+		w = recorder
+	}
+	var limited *rateLimitedWriter
+	if rateLimiter != nil {
+		limited = &rateLimitedWriter{ResponseWriter: w, limiter: rateLimiter}
+		w = limited
+	}
+
+	source := s.serveDNS(w, r, resolver, rateLimiter)
+	if queryLog == nil {
+		return
+	}
+
+	record := QueryRecord{
+		Timestamp: start,
+		Protocol:  w.RemoteAddr().Network(),
+		Name:      strings.ToLower(r.Question[0].Name),
+		Type:      dns.TypeToString[r.Question[0].Qtype],
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000.0,
+		Source:    source,
+		Proxied:   source == "proxy" || source == "stale",
+	}
+	if ip := addrToIP(w.RemoteAddr()); ip != nil {
+		record.Client = ip.String()
+	}
+	if recorder.msg != nil {
+		record.Rcode = dns.RcodeToString[recorder.msg.Rcode]
+		record.Answers = len(recorder.msg.Answer)
+	}
+	if limited != nil {
+		record.RateLimit = limited.action
+	}
+	queryLog.Record(record)
+}
+
+// truncateForClient limits the responses to UDP clients to their buffer size
+// (the EDNS0 UDP size or 512 bytes). Upstream responses may have been
+// received over TCP.
+func truncateForClient(w dns.ResponseWriter, r *dns.Msg, resp *dns.Msg) {
+	if w.RemoteAddr().Network() != "udp" {
+		return
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+	resp.Truncate(size)
+}
+
+// serveDNS answers the query and returns how it has been answered
+// ("authoritative", "proxy", "stale", "resolver", "unknown" or "capped").
+// The rate limiter is nil for TCP queries.
+func (s *server) serveDNS(w dns.ResponseWriter, r *dns.Msg, resolver Resolver, rateLimiter *rateLimiter) (source string) {
+	if rateLimiter != nil {
+		if m := rateLimiter.capAny(addrToIP(w.RemoteAddr()), r); m != nil {
+			err := w.WriteMsg(m)
+			if err != nil {
+				fmt.Println("failed to write DNS responses:", err)
+			}
+			return "capped"
+		}
+	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
 
-	fmt.Println("DNS: Remote-Addr:", w.RemoteAddr())
-
 	d := s.questionToHostAndDomain(r.Question[0])
 
-	if d != nil && d.proxy_target != "" {
-		dnsClient := new(dns.Client)
-		target := d.proxy_target
-		target = strings.TrimPrefix(target, "udp://")
-		if strings.HasPrefix(target, "tcp://") {
-			target = target[6:]
-			dnsClient.Net = "tcp"
+	if d == nil && resolver != nil && resolver.IsAllowed(w.RemoteAddr()) {
+		resp := resolver.Resolve(context.Background(), r, w.RemoteAddr())
+		truncateForClient(w, r, resp)
+		err := w.WriteMsg(resp)
+		if err != nil {
+			fmt.Println("failed to write DNS responses:", err)
 		}
-		resp, runtime, err := dnsClient.Exchange(r, target)
-		fmt.Println("runtime:", runtime)
-		fmt.Println("err:", err)
-		if resp != nil {
-			w.WriteMsg(resp)
-		} else {
+		return "resolver"
+	}
+
+	if d != nil && d.proxy != nil {
+		resp, stale, err := d.proxy.exchange(r)
+		if err != nil {
+			fmt.Println("DNS: all proxy targets failed for", d.name+":", err)
+			m.SetRcode(r, dns.RcodeServerFailure)
 			w.WriteMsg(m)
+			return "proxy"
 		}
-		return
+		truncateForClient(w, r, resp)
+		w.WriteMsg(resp)
+		if stale {
+			return "stale"
+		}
+		return "proxy"
 	}
 
+	// queries for other zones get an empty answer
+	source = "unknown"
 	if d != nil {
+		source = "authoritative"
 		switch r.Question[0].Qtype {
 		case dns.TypeTXT:
-			fmt.Println("host:", d.host)
 			if d.host == "_acme-challenge" {
 				m.Answer = append(m.Answer, d.makeACME())
 				m.Ns = append(m.Ns, d.makeNS())
@@ -305,12 +510,10 @@ func (s *server) dnsHandleFunc(w dns.ResponseWriter, r *dns.Msg) {
 			m.Ns = append(m.Ns, d.makeNS())
 		case dns.TypeNS:
 			m.Answer = append(m.Answer, d.makeNS())
-			m.Ns = append(m.Ns, d.makeSOA())
-		default:
-			fmt.Println("?", r.Question[0].Name)
+			m.Ns = append(m.Ns, d.makeSOA(s.serial.Load()))
 		}
 		if len(m.Answer) == 0 {
-			m.Ns = append(m.Ns, d.makeSOA())
+			m.Ns = append(m.Ns, d.makeSOA(s.serial.Load()))
 		}
 	}
 
@@ -322,10 +525,9 @@ func (s *server) dnsHandleFunc(w dns.ResponseWriter, r *dns.Msg) {
 		}
 	}
 
-	fmt.Printf("<<<<<<<<<<\n%v>>>>>>>>>>\n", m.String())
-
 	err := w.WriteMsg(m)
 	if err != nil {
 		fmt.Println("failed to write DNS responses:", err)
 	}
+	return source
 }
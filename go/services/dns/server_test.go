@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// udpResponseWriter records the messages written to a UDP client
+type udpResponseWriter struct {
+	dns.ResponseWriter
+	client   net.IP
+	mu       sync.Mutex
+	messages []*dns.Msg
+}
+
+func (w *udpResponseWriter) RemoteAddr() net.Addr {
+	if w.client == nil {
+		return &net.UDPAddr{IP: net.ParseIP("192.168.0.10"), Port: 5353}
+	}
+	return &net.UDPAddr{IP: w.client, Port: 5353}
+}
+
+func (w *udpResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, m)
+	return nil
+}
+
+// staticResolver answers all queries with the given number of A records
+type staticResolver struct {
+	Resolver
+	answers int
+}
+
+func (r *staticResolver) IsAllowed(client net.Addr) bool {
+	return true
+}
+
+func (r *staticResolver) Resolve(ctx context.Context, query *dns.Msg, client net.Addr) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(query)
+	for i := range r.answers {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(10, 0, byte(i/256), byte(i%256)),
+		})
+	}
+	return m
+}
+
+func TestSwapResolverAndRateLimit(t *testing.T) {
+	s := &server{}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.org.", dns.TypeA)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 1000 {
+			if i%2 == 0 {
+				s.SetResolver(&staticResolver{})
+				s.SetRateLimit(RateLimitConfig{ResponsesPerSecond: 1000})
+			} else {
+				s.SetResolver(nil)
+				s.SetRateLimit(RateLimitConfig{Disabled: true})
+			}
+		}
+	}()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &udpResponseWriter{}
+			for range 1000 {
+				s.dnsHandleFunc(w, query)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTruncateForUDPClients(t *testing.T) {
+	s := &server{}
+	s.SetResolver(&staticResolver{answers: 100})
+
+	for _, bufsize := range []uint16{0, 1232} {
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.org.", dns.TypeA)
+		want := dns.MinMsgSize
+		if bufsize != 0 {
+			query.SetEdns0(bufsize, false)
+			want = int(bufsize)
+		}
+		w := &udpResponseWriter{}
+		s.dnsHandleFunc(w, query)
+		if len(w.messages) != 1 {
+			t.Fatalf("%d messages written", len(w.messages))
+		}
+		if m := w.messages[0]; !m.Truncated || m.Len() > want {
+			t.Errorf("bufsize %d: truncated = %v, length = %d, want at most %d", bufsize, m.Truncated, m.Len(), want)
+		}
+	}
+}
+
+func TestQueryLogRecordsRateLimit(t *testing.T) {
+	queryLog, err := NewQueryLog(path.Join(t.TempDir(), "queries.log"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queryLog.Close()
+	s := &server{}
+	s.AddDomains("home.example.com")
+	s.SetQueryLog(queryLog)
+	if err = s.SetRateLimit(RateLimitConfig{ResponsesPerSecond: 1, Window: 1, Slip: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("home.example.com.", dns.TypeNS)
+	// private clients are not limited
+	w := &udpResponseWriter{client: net.ParseIP("198.51.100.1")}
+	for range 10 {
+		s.dnsHandleFunc(w, query)
+	}
+
+	actions := map[string]int{}
+	for _, record := range queryLog.Records(0) {
+		actions[record.RateLimit]++
+		if record.RateLimit == "dropped" && record.Rcode != "" {
+			t.Errorf("a dropped response has been logged with %s", record.Rcode)
+		}
+		if record.RateLimit == "slipped" && record.Answers != 0 {
+			t.Errorf("a slipped response has been logged with %d answers", record.Answers)
+		}
+	}
+	if actions["dropped"] == 0 || actions["slipped"] == 0 || actions[""] == 0 {
+		t.Errorf("unexpected rate limit actions: %v", actions)
+	}
+	if len(w.messages) != actions[""]+actions["slipped"] {
+		t.Errorf("%d messages sent, but %d logged as sent", len(w.messages), actions[""]+actions["slipped"])
+	}
+}
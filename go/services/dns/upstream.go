@@ -0,0 +1,147 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a DNS server queries can be forwarded to
+type Upstream interface {
+	Exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// NewUpstream creates an upstream from an URI. Supported are:
+//   - udp://1.1.1.1:53 (or just 1.1.1.1)
+//   - tcp://1.1.1.1:53
+//   - tls://1.1.1.1:853#cloudflare-dns.com (DNS-over-TLS, the fragment is the TLS server name)
+//   - https://cloudflare-dns.com/dns-query (DNS-over-HTTPS)
+func NewUpstream(uri string, timeout time.Duration) (Upstream, error) {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		u, err = url.Parse("udp://" + uri)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &plainUpstream{
+			uri:     uri,
+			address: withDefaultPort(u.Host, "53"),
+			client:  &dns.Client{Net: u.Scheme, Timeout: timeout},
+		}, nil
+	case "tls":
+		serverName := u.Fragment
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+		return &plainUpstream{
+			uri:     uri,
+			address: withDefaultPort(u.Host, "853"),
+			client: &dns.Client{
+				Net:       "tcp-tls",
+				Timeout:   timeout,
+				TLSConfig: &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12},
+			},
+		}, nil
+	case "https":
+		return &dohUpstream{
+			uri:    uri,
+			client: &http.Client{Timeout: timeout},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+type plainUpstream struct {
+	uri     string
+	address string
+	client  *dns.Client
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.ExchangeContext(ctx, r, u.address)
+	if err != nil {
+		return nil, err
+	}
+	// retry truncated UDP responses via TCP
+	if resp.Truncated && u.client.Net == "udp" {
+		tcpClient := &dns.Client{Net: "tcp", Timeout: u.client.Timeout}
+		resp, _, err = tcpClient.ExchangeContext(ctx, r, u.address)
+	}
+	return resp, err
+}
+
+func (u *plainUpstream) String() string {
+	return u.uri
+}
+
+type dohUpstream struct {
+	uri    string
+	client *http.Client
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends an ID of 0 to improve HTTP caching
+	query := r.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.uri, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream %s returned status %d", u.uri, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	err = m.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	m.Id = r.Id
+	return m, nil
+}
+
+func (u *dohUpstream) String() string {
+	return u.uri
+}
@@ -102,6 +102,29 @@ func (sc *SupervisorClient) GetAddonInfo(slug string) (*AddonInfo, error) {
 	return &addonResp.Data, nil
 }
 
+// RestartAddon restarts an add-on (like after its certificate has been
+// renewed)
+func (sc *SupervisorClient) RestartAddon(slug string) error {
+	req, err := http.NewRequest("POST", sc.baseURL+"/addons/"+slug+"/restart", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+sc.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("restart of add-on %s failed with status %d", slug, resp.StatusCode)
+	}
+	return nil
+}
+
 // GetRunningAddons returns only running add-ons with their network details
 func (sc *SupervisorClient) GetRunningAddons() ([]AddonTarget, error) {
 	addons, err := sc.GetAllAddons()
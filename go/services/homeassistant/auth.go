@@ -0,0 +1,118 @@
+package homeassistant
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// authTimeout limits the login requests, which wait for the Supervisor
+const authTimeout = 10 * time.Second
+
+// User is a user of Home Assistant (as returned by config/auth/list)
+type User struct {
+	ID              string   `json:"id"`
+	Username        string   `json:"username"`
+	Name            string   `json:"name"`
+	IsOwner         bool     `json:"is_owner"`
+	IsActive        bool     `json:"is_active"`
+	SystemGenerated bool     `json:"system_generated"`
+	GroupIDs        []string `json:"group_ids"`
+}
+
+// NewSupervisorClientFor creates a client for another Supervisor (or a fake
+// of it in the tests)
+func NewSupervisorClientFor(baseURL string, token string) *SupervisorClient {
+	return &SupervisorClient{
+		token:   token,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Authenticate checks the credentials of a Home Assistant user with the auth
+// API of the Supervisor (requires auth_api in the add-on configuration)
+func (sc *SupervisorClient) Authenticate(username string, password string) error {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", sc.baseURL+"/auth", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+sc.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: authTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("authentication failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Users returns the users of Home Assistant. They are only available with
+// the websocket API of Home Assistant Core, which the Supervisor proxies
+// (requires homeassistant_api in the add-on configuration).
+func (sc *SupervisorClient) Users() ([]User, error) {
+	uri := "ws" + strings.TrimPrefix(sc.baseURL, "http") + "/core/websocket"
+	dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: authTimeout}
+	conn, _, err := dialer.Dial(uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetReadDeadline(time.Now().Add(authTimeout)); err != nil {
+		return nil, err
+	}
+	if err = conn.SetWriteDeadline(time.Now().Add(authTimeout)); err != nil {
+		return nil, err
+	}
+
+	var message struct {
+		Type    string `json:"type"`
+		Success bool   `json:"success"`
+		Result  []User `json:"result"`
+		Error   *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	// auth_required
+	if err = conn.ReadJSON(&message); err != nil {
+		return nil, err
+	}
+	if err = conn.WriteJSON(map[string]string{"type": "auth", "access_token": sc.token}); err != nil {
+		return nil, err
+	}
+	if err = conn.ReadJSON(&message); err != nil {
+		return nil, err
+	}
+	if message.Type != "auth_ok" {
+		return nil, fmt.Errorf("websocket authentication failed: %s", message.Type)
+	}
+
+	if err = conn.WriteJSON(map[string]any{"id": 1, "type": "config/auth/list"}); err != nil {
+		return nil, err
+	}
+	if err = conn.ReadJSON(&message); err != nil {
+		return nil, err
+	}
+	if !message.Success {
+		if message.Error != nil {
+			return nil, fmt.Errorf("failed to list the users: %s", message.Error.Message)
+		}
+		return nil, fmt.Errorf("failed to list the users")
+	}
+	return message.Result, nil
+}
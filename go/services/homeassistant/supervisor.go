@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync"
 )
 
 type ExternalIP interface {
@@ -32,10 +33,13 @@ func NewExternalIP() ExternalIP {
 
 type externalIP struct {
 	token string
+	mu    sync.RWMutex
 	ip    net.IP
 }
 
 func (e *externalIP) ExternalIP() net.IP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.ip
 }
 
@@ -71,10 +75,18 @@ func (e *externalIP) Refresh() (net.IP, error) {
 
 	for _, iface := range networkInfo.Data.Interfaces {
 		for _, addr := range iface.IPv6.Address {
-			if ip, _, err := net.ParseCIDR(addr); err == nil && ip.To4() == nil {
-				e.ip = ip
-				return ip, nil
+			ip, _, err := net.ParseCIDR(addr)
+			if err != nil || ip.To4() != nil {
+				continue
 			}
+			// skip link-local and unique local addresses
+			if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+				continue
+			}
+			e.mu.Lock()
+			e.ip = ip
+			e.mu.Unlock()
+			return ip, nil
 		}
 	}
 
@@ -2,6 +2,8 @@ package smtp
 
 import (
 	"fmt"
+	"html"
+	"time"
 )
 
 // SendPasswordResetEmail sends a password reset email
@@ -144,3 +146,67 @@ Gateway Team`, username)
 
 	return c.SendMail(message)
 }
+
+// SendAccountLockedEmail informs the owner of an account, that it has been
+// locked after too many failed logins
+func (c *Client) SendAccountLockedEmail(userEmail, username, address string, until time.Time) error {
+	senderEmail := c.config.From
+
+	subject := "Your account has been locked"
+
+	lockedUntil := until.Format("2006-01-02 15:04 MST")
+
+	plainBody := fmt.Sprintf(`Hello %s,
+
+Your account has been locked until %s after too many failed login attempts.
+The last attempt came from %s.
+
+If these attempts were not made by you, someone may be trying to guess your
+password. Consider choosing a stronger password and enabling two-factor
+authentication.
+
+Best regards,
+Gateway Team`, username, lockedUntil, address)
+
+	htmlBody := fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>Account Locked</title>
+</head>
+<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
+    <div style="max-width: 600px; margin: 0 auto; padding: 20px;">
+        <h2 style="color: #c0392b;">Your account has been locked</h2>
+        
+        <p>Hello %s,</p>
+        
+        <p>Your account has been locked until <strong>%s</strong> after too many failed login attempts.
+        The last attempt came from <strong>%s</strong>.</p>
+        
+        <p>If these attempts were not made by you, someone may be trying to guess your password.
+        Consider choosing a stronger password and enabling two-factor authentication.</p>
+        
+        <hr style="border: none; border-top: 1px solid #eee; margin: 30px 0;">
+        
+        <p style="font-size: 12px; color: #666;">
+            Best regards,<br>
+            Gateway Team
+        </p>
+    </div>
+</body>
+</html>`, html.EscapeString(username), lockedUntil, html.EscapeString(address))
+
+	message := &Message{
+		From:     senderEmail,
+		To:       []string{userEmail},
+		Subject:  subject,
+		Body:     plainBody,
+		BodyHTML: htmlBody,
+		Headers: map[string]string{
+			"Reply-To": senderEmail,
+			"X-Mailer": "Gateway SMTP Client",
+		},
+	}
+
+	return c.SendMail(message)
+}
@@ -37,9 +37,9 @@ func (csr *csr) OBJ() *x509.CertificateRequest {
 
 func NewCSR(csrFile string, privateKey PrivateKey, dnsNames ...string) (CSR, error) {
 	csrBin, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
-		SignatureAlgorithm: x509.SHA256WithRSA,
-		Subject:            pkix.Name{CommonName: dnsNames[0]},
-		DNSNames:           dnsNames,
+		// the signature algorithm is derived from the key
+		Subject:  pkix.Name{CommonName: dnsNames[0]},
+		DNSNames: dnsNames,
 	}, privateKey)
 
 	if err != nil {
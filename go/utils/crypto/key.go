@@ -2,10 +2,14 @@ package crypto
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"os"
 )
 
@@ -73,16 +77,78 @@ func ParsePrivateKey(blob string) (PrivateKey, error) {
 	}, nil
 }
 
+// Supported key algorithms
+const (
+	KeyRSA2048   = "rsa2048"
+	KeyRSA3072   = "rsa3072"
+	KeyRSA4096   = "rsa4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+)
+
+// CheckKeyAlgorithm returns an error if the key algorithm is not supported
+// (an empty algorithm selects RSA 2048)
+func CheckKeyAlgorithm(algorithm string) error {
+	switch algorithm {
+	case "", KeyRSA2048, KeyRSA3072, KeyRSA4096, KeyECDSAP256, KeyECDSAP384, KeyEd25519:
+		return nil
+	}
+	return fmt.Errorf("unsupported key algorithm: %s", algorithm)
+}
+
 func CreatePrivateKey() (PrivateKey, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	return CreatePrivateKeyWithAlgorithm(KeyRSA2048)
+}
+
+func CreatePrivateKeyWithAlgorithm(algorithm string) (PrivateKey, error) {
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case "", KeyRSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case KeyRSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = CheckKeyAlgorithm(algorithm)
+	}
 	if err != nil {
 		return nil, err
 	}
 	p := &privateKey{Signer: key}
-	p.encode()
+	err = p.encode()
+	if err != nil {
+		return nil, err
+	}
 	return p, nil
 }
 
+// KeyAlgorithm returns the algorithm of a public key (like "ecdsa-p256")
+func KeyAlgorithm(publicKey crypto.PublicKey) string {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return KeyECDSAP256
+		case elliptic.P384():
+			return KeyECDSAP384
+		}
+	case ed25519.PublicKey:
+		return KeyEd25519
+	}
+	return ""
+}
+
 func ReadPrivateKey(keyFile string) (PrivateKey, error) {
 	data, err := os.ReadFile(keyFile)
 	if err != nil {
@@ -92,7 +158,11 @@ func ReadPrivateKey(keyFile string) (PrivateKey, error) {
 }
 
 func CreatePrivateKeyFile(keyFile string) (PrivateKey, error) {
-	p, err := CreatePrivateKey()
+	return CreatePrivateKeyFileWithAlgorithm(keyFile, KeyRSA2048)
+}
+
+func CreatePrivateKeyFileWithAlgorithm(keyFile string, algorithm string) (PrivateKey, error) {
+	p, err := CreatePrivateKeyWithAlgorithm(algorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -110,3 +180,16 @@ func GetOrCreatePrivateKeyFile(keyFile string) (PrivateKey, error) {
 	}
 	return CreatePrivateKeyFile(keyFile)
 }
+
+// KeyType returns a description of a public key (like "RSA 2048")
+func KeyType(publicKey crypto.PublicKey) string {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", publicKey)
+}
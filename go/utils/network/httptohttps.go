@@ -6,28 +6,34 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"sync"
 )
 
 type HttpToHttps interface {
 	io.Closer
+	// SetChallenge serves the response of an HTTP-01 challenge (an empty
+	// challenge removes it)
 	SetChallenge(hostname string, token string, challenge string) error
 	SetHandler(hostname string, handler http.Handler) error
 }
 
-type tokenAndChallenge struct {
-	token     string
-	challenge string
+// hostAndToken identifies a challenge, there may be several challenges for
+// a hostname (like for the RSA and ECDSA certificate)
+type hostAndToken struct {
+	hostname string
+	token    string
 }
 
 type httpToHttps struct {
 	listener   net.Listener
-	challenges map[string]tokenAndChallenge
+	mutex      sync.Mutex
+	challenges map[hostAndToken]string
 	handlers   map[string]http.Handler
 }
 
 func NewHttpToHttps(network string, address string) (HttpToHttps, error) {
 	h := &httpToHttps{
-		challenges: make(map[string]tokenAndChallenge),
+		challenges: make(map[hostAndToken]string),
 		handlers:   make(map[string]http.Handler),
 	}
 	err := h.start(network, address)
@@ -57,18 +63,20 @@ func (h *httpToHttps) start(network string, address string) (err error) {
 
 		mux.HandleFunc("/.well-known/acme-challenge/", func(w http.ResponseWriter, r *http.Request) {
 			_, token := path.Split(r.URL.Path)
-			hostname := strings.ToLower(r.Host)
-			if tAndC, ok := h.challenges[hostname]; ok {
-				if token == tAndC.token {
-					w.Write([]byte(tAndC.challenge))
-					return
-				}
+			h.mutex.Lock()
+			challenge, ok := h.challenges[hostAndToken{strings.ToLower(r.Host), token}]
+			h.mutex.Unlock()
+			if ok {
+				w.Write([]byte(challenge))
+				return
 			}
 			w.WriteHeader(http.StatusNotFound)
 		})
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			hostname := strings.ToLower(r.Host)
-			if handler, ok := h.handlers[hostname]; ok {
+			h.mutex.Lock()
+			handler, ok := h.handlers[strings.ToLower(r.Host)]
+			h.mutex.Unlock()
+			if ok {
 				handler.ServeHTTP(w, r)
 				return
 			}
@@ -85,15 +93,21 @@ func (h *httpToHttps) start(network string, address string) (err error) {
 	return nil
 }
 
-func (h httpToHttps) SetChallenge(hostname string, token string, challenge string) error {
-	h.challenges[strings.ToLower(hostname)] = tokenAndChallenge{
-		token:     strings.ToLower(token),
-		challenge: challenge,
+func (h *httpToHttps) SetChallenge(hostname string, token string, challenge string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := hostAndToken{strings.ToLower(hostname), token}
+	if challenge == "" {
+		delete(h.challenges, key)
+		return nil
 	}
+	h.challenges[key] = challenge
 	return nil
 }
 
 func (h *httpToHttps) SetHandler(hostname string, handler http.Handler) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	hostname = strings.ToLower(hostname)
 	if handler == nil {
 		delete(h.handlers, hostname)
@@ -3,19 +3,33 @@ package network
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
+// acmeTLSALPNProto is the protocol used by TLS-ALPN-01 challenges (RFC 8737)
+const acmeTLSALPNProto = "acme-tls/1"
+
 type ServeCtx interface {
 	ServeCtx(ctx context.Context, conn net.Conn)
 }
+
+// ServeCtxFunc allows to use an ordinary function as ServeCtx
+type ServeCtxFunc func(ctx context.Context, conn net.Conn)
+
+func (f ServeCtxFunc) ServeCtx(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
 type DialCtx interface {
 	DialCtx(ctx context.Context, sni string) (net.Conn, error)
 }
@@ -41,6 +55,8 @@ type TLSProxy interface {
 	InternalOnly(sni string)
 	AddTLSCertificates(sni string, tlsCertificates []tls.Certificate)
 	EnableProxyProtocol(enable bool)
+	ListenTLS(network string, address string, nextProtos []string, handler ServeCtx) error
+	SetTLSALPNChallenge(sni string, certificate *tls.Certificate)
 }
 type tlsProxy struct {
 	listener       net.Listener
@@ -53,6 +69,12 @@ type tlsProxy struct {
 	externalAddr   net.IP
 	metricCallback MetricCallback
 	proxyProtocol  bool
+
+	tlsListenersMutex sync.Mutex
+	tlsListeners      []net.Listener
+
+	challengesMutex sync.Mutex
+	challenges      map[string]*tls.Certificate
 }
 
 func NewTLSProxy(network string, address string) (TLSProxy, error) {
@@ -61,6 +83,7 @@ func NewTLSProxy(network string, address string) (TLSProxy, error) {
 		dialHandlers: make(map[string]ProxyDialCtx),
 		tlsConfigs:   make(map[string]*tls.Config),
 		internal:     make(map[string]bool),
+		challenges:   make(map[string]*tls.Certificate),
 	}
 	err := tp.start(network, address)
 	if err != nil {
@@ -83,6 +106,12 @@ func (tp *tlsProxy) Close() error {
 		tp.listener.Close()
 		tp.listener = nil
 	}
+	tp.tlsListenersMutex.Lock()
+	for _, listener := range tp.tlsListeners {
+		listener.Close()
+	}
+	tp.tlsListeners = nil
+	tp.tlsListenersMutex.Unlock()
 	if tp.httpsServer != nil {
 		close(tp.httpsListener)
 		tp.httpsListener = nil
@@ -116,6 +145,67 @@ func (tp *tlsProxy) start(network string, address string) error {
 	return nil
 }
 
+// ListenTLS accepts TLS connections on an additional address (like the
+// DNS-over-TLS port). The certificate is chosen by SNI and the PROXY
+// protocol is handled exactly like for the main listener. After the
+// handshake the decrypted connection is passed to the handler.
+func (tp *tlsProxy) ListenTLS(network string, address string, nextProtos []string, handler ServeCtx) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	tp.tlsListenersMutex.Lock()
+	tp.tlsListeners = append(tp.tlsListeners, listener)
+	tp.tlsListenersMutex.Unlock()
+
+	tlsConfig := &tls.Config{
+		GetConfigForClient: func(clientHelloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
+			tlsConfig := tp.getTLSConfig(clientHelloInfo.ServerName)
+			if tlsConfig == nil {
+				return nil, os.ErrInvalid
+			}
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = nextProtos
+			return tlsConfig, nil
+		},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				fmt.Println("could not accept client connection:", err)
+				continue
+			}
+			go func() {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				// the client address is taken from the PROXY header, like
+				// for the main listener
+				if tp.proxyProtocol {
+					proxyConn, err := HandleProxyProtocol(conn)
+					if err != nil || proxyConn == nil {
+						fmt.Println("Proxy Protocol Err:", err)
+						conn.Close()
+						return
+					}
+					conn = proxyConn
+				}
+				tlsConn := tls.Server(conn, tlsConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return
+				}
+				tlsConn.SetDeadline(time.Time{})
+				handler.ServeCtx(context.Background(), tlsConn)
+			}()
+		}
+	}()
+	return nil
+}
+
 func (tp *tlsProxy) SetExternalIp(address string) {
 	tp.externalAddr = net.ParseIP(address)
 }
@@ -186,6 +276,40 @@ func (tp *tlsProxy) AddTLSCertificates(sni string, tlsCertificates []tls.Certifi
 	tp.tlsConfigs[sni] = tlsConfig
 }
 
+// SetTLSALPNChallenge sets the certificate which is presented to ACME
+// servers validating a TLS-ALPN-01 challenge (nil removes it)
+func (tp *tlsProxy) SetTLSALPNChallenge(sni string, certificate *tls.Certificate) {
+	tp.challengesMutex.Lock()
+	defer tp.challengesMutex.Unlock()
+	sni = strings.ToLower(sni)
+	if certificate == nil {
+		delete(tp.challenges, sni)
+		return
+	}
+	tp.challenges[sni] = certificate
+}
+
+// getTLSALPNChallenge returns the challenge certificate of the sni (or nil)
+func (tp *tlsProxy) getTLSALPNChallenge(sni string) *tls.Certificate {
+	tp.challengesMutex.Lock()
+	defer tp.challengesMutex.Unlock()
+	return tp.challenges[strings.ToLower(sni)]
+}
+
+// serveTLSALPNChallenge completes the handshake using the challenge
+// certificate. No application data is exchanged, the ACME server only
+// validates the certificate.
+func (tp *tlsProxy) serveTLSALPNChallenge(conn net.Conn, sni string, certificate *tls.Certificate) {
+	fmt.Println("ServerName:", sni, "TLS-ALPN-01 challenge")
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		NextProtos:   []string{acmeTLSALPNProto},
+	})
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	tlsConn.Handshake()
+	tlsConn.Close()
+}
+
 func (tp *tlsProxy) getHandler(sni string) (httpHandler http.Handler, dial ProxyDialCtx, internal bool) {
 	if !tp.isValidHostname(sni) {
 		return nil, nil, false
@@ -257,6 +381,15 @@ func (tp *tlsProxy) ServeCtx(ctx context.Context, conn net.Conn) {
 
 	sni := clientHello.ServerName
 
+	// only connections validating a pending challenge are intercepted, the
+	// others (e.g. for passthrough backends) are routed as usual
+	if slices.Contains(clientHello.SupportedProtos, acmeTLSALPNProto) {
+		if certificate := tp.getTLSALPNChallenge(sni); certificate != nil {
+			tp.serveTLSALPNChallenge(conn, sni, certificate)
+			return
+		}
+	}
+
 	tlsConfig := tp.getTLSConfig(sni)
 	httpHandler, dial, _ := tp.getHandler(sni)
 
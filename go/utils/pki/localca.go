@@ -0,0 +1,213 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
+)
+
+const (
+	localCARootValidity         = 10 * 365 * 24 * time.Hour
+	localCAIntermediateValidity = 5 * 365 * 24 * time.Hour
+	localCALeafValidity         = 90 * 24 * time.Hour
+)
+
+// LocalCA is a private CA for hostnames which can't get a public
+// certificate (like LAN-only hostnames). It consists of a root and an
+// intermediate CA, the root is restricted to the permitted domains using
+// name constraints.
+type LocalCA interface {
+	CA
+	// RootCertificate returns the certificate which has to be installed on
+	// the devices
+	RootCertificate() crypto.Certificate
+	// Permits returns true if the name is within the permitted domains
+	Permits(name string) bool
+}
+
+type localCA struct {
+	permittedDomains []string
+	rootCert         crypto.Certificate
+	intermediateKey  crypto.PrivateKey
+	intermediateCert crypto.Certificate
+}
+
+// NewLocalCA loads the CA from dir or creates it. A new root is created if
+// the permitted domains have been changed (so the new root has to be
+// installed again).
+func NewLocalCA(dir string, name string, permittedDomains []string) (LocalCA, error) {
+	if len(permittedDomains) == 0 {
+		return nil, fmt.Errorf("the local CA requires at least one permitted domain")
+	}
+	permittedDomains = slices.Clone(permittedDomains)
+	slices.Sort(permittedDomains)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	rootKeyFile := path.Join(dir, "root.key.pem")
+	rootCertFile := path.Join(dir, "root.cert.pem")
+	intermediateKeyFile := path.Join(dir, "intermediate.key.pem")
+	intermediateCertFile := path.Join(dir, "intermediate.cert.pem")
+
+	rootKey, rootCert, err := loadLocalCACert(rootKeyFile, rootCertFile)
+	if err != nil || !slices.Equal(rootCert.OBJ().PermittedDNSDomains, permittedDomains) ||
+		time.Until(rootCert.OBJ().NotAfter) < localCAIntermediateValidity {
+		fmt.Println("LocalCA: creating a new root certificate for", strings.Join(permittedDomains, ", "))
+		rootKey, rootCert, err = createLocalCACert(rootKeyFile, rootCertFile, &x509.Certificate{
+			Subject:                     pkix.Name{CommonName: name + " Root CA", Organization: []string{name}},
+			NotAfter:                    time.Now().Add(localCARootValidity),
+			MaxPathLen:                  1,
+			PermittedDNSDomainsCritical: true,
+			PermittedDNSDomains:         permittedDomains,
+		}, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	intermediateKey, intermediateCert, err := loadLocalCACert(intermediateKeyFile, intermediateCertFile)
+	if err != nil || intermediateCert.OBJ().CheckSignatureFrom(rootCert.OBJ()) != nil ||
+		time.Until(intermediateCert.OBJ().NotAfter) < 2*localCALeafValidity {
+		fmt.Println("LocalCA: creating a new intermediate certificate")
+		intermediateKey, intermediateCert, err = createLocalCACert(intermediateKeyFile, intermediateCertFile, &x509.Certificate{
+			Subject:        pkix.Name{CommonName: name + " Intermediate CA", Organization: []string{name}},
+			NotAfter:       time.Now().Add(localCAIntermediateValidity),
+			MaxPathLen:     0,
+			MaxPathLenZero: true,
+		}, rootKey, rootCert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &localCA{
+		permittedDomains: permittedDomains,
+		rootCert:         rootCert,
+		intermediateKey:  intermediateKey,
+		intermediateCert: intermediateCert,
+	}, nil
+}
+
+func loadLocalCACert(keyFile string, certFile string) (crypto.PrivateKey, crypto.Certificate, error) {
+	key, err := crypto.ReadPrivateKey(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := crypto.GetCertificate(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// createLocalCACert creates a CA certificate. It is self signed, if
+// parentKey is nil.
+func createLocalCACert(keyFile string, certFile string, template *x509.Certificate, parentKey crypto.PrivateKey, parentCert crypto.Certificate) (crypto.PrivateKey, crypto.Certificate, error) {
+	key, err := crypto.CreatePrivateKeyFileWithAlgorithm(keyFile, crypto.KeyECDSAP384)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber, err = randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.BasicConstraintsValid = true
+	template.IsCA = true
+
+	parent, signer := template, key
+	if parentKey != nil {
+		parent, signer = parentCert.OBJ(), parentKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := crypto.NewCertificateFromASN1(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(certFile, []byte(cert.PEM()), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func (ca *localCA) RootCertificate() crypto.Certificate {
+	return ca.rootCert
+}
+
+func (ca *localCA) Permits(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	for _, domain := range ca.permittedDomains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueCertificate issues a server certificate, which is valid for 90 days
+func (ca *localCA) IssueCertificate(csr crypto.CSR) (chain crypto.CertificateChain, err error) {
+	request := csr.OBJ()
+	if err = request.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if len(request.DNSNames) == 0 {
+		return nil, fmt.Errorf("the CSR contains no DNS names")
+	}
+	for _, name := range request.DNSNames {
+		if !ca.Permits(name) {
+			return nil, fmt.Errorf("the local CA is not permitted to issue certificates for %s", name)
+		}
+	}
+
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	intermediate := ca.intermediateCert.OBJ()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: request.DNSNames[0]},
+		DNSNames:              request.DNSNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(localCALeafValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(intermediate.NotAfter) {
+		template.NotAfter = intermediate.NotAfter
+	}
+	if _, ok := request.PublicKey.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, intermediate, request.PublicKey, ca.intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := crypto.NewCertificateFromASN1(der)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.CertificateChain{cert, ca.intermediateCert}, nil
+}
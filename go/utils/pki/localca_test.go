@@ -0,0 +1,59 @@
+package pki
+
+import (
+	"crypto/x509"
+	"path"
+	"testing"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
+)
+
+func TestLocalCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewLocalCA(dir, "Test", []string{"home.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.CreatePrivateKeyWithAlgorithm(crypto.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := crypto.NewCSR(path.Join(dir, "csr.pem"), key, "nas.home.lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := ca.IssueCertificate(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.RootCertificate().OBJ())
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(chain[1].OBJ())
+	_, err = chain[0].OBJ().Verify(x509.VerifyOptions{
+		DNSName:       "nas.home.lan",
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Errorf("the certificate is not valid: %v", err)
+	}
+
+	csr, err = crypto.NewCSR(path.Join(dir, "csr.pem"), key, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ca.IssueCertificate(csr); err == nil {
+		t.Error("expected an error for a name outside of the permitted domains")
+	}
+
+	// the root is kept as long as the permitted domains don't change
+	reloaded, err := NewLocalCA(dir, "Test", []string{"home.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.RootCertificate().OBJ().Equal(ca.RootCertificate().OBJ()) {
+		t.Error("expected the existing root certificate to be reused")
+	}
+}
@@ -0,0 +1,157 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspRetryInterval is the delay after a failed OCSP request
+const ocspRetryInterval = time.Hour
+
+// ocspStaple is an OCSP response, which is attached to the served
+// certificate (so that clients don't need to ask the OCSP responder)
+type ocspStaple struct {
+	raw        []byte
+	status     int
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// refreshAt returns the time when the staple should be refreshed: after
+// half of its validity
+func (staple *ocspStaple) refreshAt() time.Time {
+	if staple.nextUpdate.IsZero() {
+		return staple.thisUpdate.Add(12 * time.Hour)
+	}
+	return staple.thisUpdate.Add(staple.nextUpdate.Sub(staple.thisUpdate) / 2)
+}
+
+func (staple *ocspStaple) valid(now time.Time) bool {
+	return staple.status == ocsp.Good && (staple.nextUpdate.IsZero() || now.Before(staple.nextUpdate))
+}
+
+func parseOCSPStaple(raw []byte, leaf *x509.Certificate, issuer *x509.Certificate) (*ocspStaple, error) {
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &ocspStaple{
+		raw:        raw,
+		status:     resp.Status,
+		thisUpdate: resp.ThisUpdate,
+		nextUpdate: resp.NextUpdate,
+	}, nil
+}
+
+// readOCSPStaple returns nil if there is no cached response for the
+// certificate
+func readOCSPStaple(filename string, leaf *x509.Certificate, issuer *x509.Certificate) *ocspStaple {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	staple, err := parseOCSPStaple(raw, leaf, issuer)
+	if err != nil {
+		return nil
+	}
+	return staple
+}
+
+// fetchOCSPStaple asks the OCSP responder of the certificate. It returns
+// nil if the certificate doesn't contain an OCSP responder.
+func fetchOCSPStaple(ctx context.Context, leaf *x509.Certificate, issuer *x509.Certificate) (*ocspStaple, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var lastErr error
+	for _, server := range leaf.OCSPServer {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(req))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		httpReq.Header.Set("Content-Type", "application/ocsp-request")
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("OCSP responder %s: %s", server, resp.Status)
+			continue
+		}
+		return parseOCSPStaple(raw, leaf, issuer)
+	}
+	return nil, lastErr
+}
+
+func (staple *ocspStaple) revoked() bool {
+	return staple.status == ocsp.Revoked
+}
+
+// updateOCSPStaple returns the cached OCSP response of the chain or fetches
+// a new one (after half of the validity of the cached response). It also
+// returns the time of the next refresh, which is zero if the certificate
+// doesn't contain an OCSP responder.
+func updateOCSPStaple(ctx context.Context, filename string, chain crypto.CertificateChain) (staple *ocspStaple, refreshAt time.Time) {
+	if len(chain) < 2 {
+		return nil, refreshAt
+	}
+	leaf, issuer := chain[0].OBJ(), chain[1].OBJ()
+	if len(leaf.OCSPServer) == 0 {
+		return nil, refreshAt
+	}
+	now := time.Now()
+	staple = readOCSPStaple(filename, leaf, issuer)
+	if staple != nil && now.Before(staple.refreshAt()) {
+		return staple, staple.refreshAt()
+	}
+	fresh, err := fetchOCSPStaple(ctx, leaf, issuer)
+	if err != nil || fresh == nil {
+		fmt.Println("OCSP:", err)
+		if staple != nil && !staple.valid(now) && !staple.revoked() {
+			staple = nil
+		}
+		return staple, now.Add(ocspRetryInterval)
+	}
+	if err = os.WriteFile(filename, fresh.raw, 0600); err != nil {
+		fmt.Println("OCSP:", err)
+	}
+	refreshAt = fresh.refreshAt()
+	if refreshAt.Before(now) {
+		refreshAt = now.Add(ocspRetryInterval)
+	}
+	return fresh, refreshAt
+}
+
+func (staple *ocspStaple) statusText() string {
+	switch staple.status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
@@ -2,10 +2,15 @@ package pki
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dueckminor/home-assistant-addons/go/utils/crypto"
@@ -15,6 +20,26 @@ type CA interface {
 	IssueCertificate(csr crypto.CSR) (chain crypto.CertificateChain, err error)
 }
 
+// LoggingCA is implemented by CAs which report the messages of an issuance
+type LoggingCA interface {
+	IssueCertificateWithLog(csr crypto.CSR, logf func(msg string)) (chain crypto.CertificateChain, err error)
+}
+
+// RevokingCA is implemented by CAs which can revoke certificates
+type RevokingCA interface {
+	RevokeCertificate(cert crypto.Certificate, reason int) error
+}
+
+// RenewalInfoCA is implemented by CAs which suggest when a certificate
+// should be renewed (ACME Renewal Information)
+type RenewalInfoCA interface {
+	SuggestedRenewalWindow(cert crypto.Certificate) (start time.Time, end time.Time, err error)
+}
+
+// DefaultRenewalThreshold is the percentage of the lifetime after which a
+// certificate is renewed
+const DefaultRenewalThreshold = 60
+
 type TLSServer interface {
 	AddTLSCertificates(sni string, tlsCertificates []tls.Certificate)
 }
@@ -24,6 +49,81 @@ type ServerCertificate interface {
 	SetTLSServer(tlsServer TLSServer)
 	GetChain() crypto.CertificateChain
 	GetCertAndKey() (crypto.PrivateKey, crypto.CertificateChain)
+	// SetDNSNames changes the names of the certificate. A new certificate
+	// is requested if the current one doesn't contain all names.
+	SetDNSNames(dnsNames ...string)
+	// GetRenewalState returns the state of the failed renewal attempts
+	GetRenewalState() RenewalState
+	GetStatus() CertificateStatus
+	// SetRenewalThreshold sets the percentage of the lifetime after which
+	// the certificate is renewed
+	SetRenewalThreshold(percent int)
+	// Renew requests a new certificate immediately (ignoring the backoff)
+	Renew()
+	// Revoke revokes the current certificate and requests a new one. The
+	// reason is a CRL reason code (RFC 5280).
+	Revoke(reason int) error
+	// SetKeyConfig selects the key algorithm and the key rotation policy.
+	// A new certificate is requested if the algorithm changes.
+	SetKeyConfig(keyConfig KeyConfig) error
+	// SetIssuedHandler registers a function, which is called with the key
+	// and chain of the (primary) certificate after startup and whenever a
+	// new certificate has been issued
+	SetIssuedHandler(handler func(key crypto.PrivateKey, chain crypto.CertificateChain))
+}
+
+// Key rotation policies
+const (
+	// KeyPolicyRotate creates a new key for each certificate (default)
+	KeyPolicyRotate = "rotate"
+	// KeyPolicyReuse keeps the key on renewal (as long as the algorithm
+	// isn't changed), so that pinned keys (TLSA, HPKP) stay valid
+	KeyPolicyReuse = "reuse"
+)
+
+// KeyConfig selects the keys of a server certificate
+type KeyConfig struct {
+	// Algorithm is one of the crypto.Key* algorithms (default: RSA 2048)
+	Algorithm string
+	// Dual requests a second certificate (RSA 2048 for non-RSA algorithms,
+	// ECDSA P-256 otherwise). The TLS server chooses the certificate
+	// supported by the client.
+	Dual   bool
+	Policy string
+}
+
+// Check validates the algorithm and the policy
+func (keyConfig KeyConfig) Check() error {
+	if err := crypto.CheckKeyAlgorithm(keyConfig.Algorithm); err != nil {
+		return err
+	}
+	switch keyConfig.Policy {
+	case "", KeyPolicyRotate, KeyPolicyReuse:
+		return nil
+	}
+	return fmt.Errorf("unsupported key policy: %s", keyConfig.Policy)
+}
+
+// CertificateStatus describes a managed certificate
+type CertificateStatus struct {
+	DNSNames         []string  `json:"dns_names"`
+	Issuer           string    `json:"issuer,omitempty"`
+	SerialNumber     string    `json:"serial_number,omitempty"`
+	KeyType          string    `json:"key_type,omitempty"`
+	KeyPolicy        string    `json:"key_policy"`
+	NotBefore        time.Time `json:"not_before,omitzero"`
+	NotAfter         time.Time `json:"not_after,omitzero"`
+	RenewalThreshold int       `json:"renewal_threshold"`
+	RenewAt          time.Time `json:"renew_at,omitzero"`
+	// SuggestedWindowStart and SuggestedWindowEnd are the renewal window
+	// suggested by the CA
+	SuggestedWindowStart time.Time `json:"suggested_window_start,omitzero"`
+	SuggestedWindowEnd   time.Time `json:"suggested_window_end,omitzero"`
+	// OCSPStatus is the status of the stapled OCSP response ("good",
+	// "revoked" or "unknown")
+	OCSPStatus     string       `json:"ocsp_status,omitempty"`
+	OCSPNextUpdate time.Time    `json:"ocsp_next_update,omitzero"`
+	Renewal        RenewalState `json:"renewal"`
 }
 
 type keyAndChain struct {
@@ -31,18 +131,74 @@ type keyAndChain struct {
 	chain crypto.CertificateChain
 }
 
+// certificateVariant is a certificate using one key algorithm. Dual
+// certificates consist of two variants.
+type certificateVariant struct {
+	algorithm   string
+	keyFile     string
+	certFile    string
+	newKeyFile  string
+	newCsrFile  string
+	newCertFile string
+	ocspFile    string
+}
+
+func newCertificateVariant(filename string, algorithm string) *certificateVariant {
+	return &certificateVariant{
+		algorithm:   algorithm,
+		keyFile:     filename + ".key.pem",
+		certFile:    filename + ".cert.pem",
+		newKeyFile:  filename + ".new-key.pem",
+		newCsrFile:  filename + ".new-csr.pem",
+		newCertFile: filename + ".new-cert.pem",
+		ocspFile:    filename + ".ocsp.der",
+	}
+}
+
+// load returns nil if the certificate hasn't been issued yet
+func (v *certificateVariant) load() (*keyAndChain, error) {
+	key, err := crypto.ReadPrivateKey(v.keyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	chain, err := crypto.GetCertificateChain(v.certFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &keyAndChain{key: key, chain: chain}, nil
+}
+
 type serverCertificate struct {
 	cancel          func()
 	tlsServer       TLSServer
-	keyAndChain     *keyAndChain
-	keyFile         string
-	certFile        string
-	newKeyFile      string
-	newCsrFile      string
-	newCertFile     string
+	filename        string
+	stateFile       string
 	tlsCertificates []tls.Certificate
 	issuer          CA
-	dnsNames        []string
+	refresh         chan struct{}
+
+	mutex       sync.Mutex
+	keyAndChain *keyAndChain
+	dnsNames    []string
+	state       RenewalState
+	threshold   int
+	forced      bool
+	// newKey prevents the reuse of the key of a revoked certificate
+	newKey    bool
+	keyConfig KeyConfig
+	keyTypes  []string
+	// windows are the renewal windows by serial number
+	windows map[string]*renewalWindow
+	ocsp    *ocspStaple
+	// issuedHandler has been called for issuedSerial
+	issuedHandler func(key crypto.PrivateKey, chain crypto.CertificateChain)
+	issuedSerial  string
 }
 
 func (sc *serverCertificate) Close() error {
@@ -52,20 +208,260 @@ func (sc *serverCertificate) Close() error {
 
 func (sc *serverCertificate) SetTLSServer(tlsServer TLSServer) {
 	sc.tlsServer = tlsServer
-	sc.tlsServer.AddTLSCertificates(sc.dnsNames[0], sc.tlsCertificates)
+	sc.tlsServer.AddTLSCertificates(sc.getDNSNames()[0], sc.tlsCertificates)
+}
+
+func (sc *serverCertificate) getDNSNames() []string {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return slices.Clone(sc.dnsNames)
+}
+
+func (sc *serverCertificate) SetDNSNames(dnsNames ...string) {
+	if len(dnsNames) == 0 {
+		return
+	}
+	sc.mutex.Lock()
+	changed := !slices.Equal(sc.dnsNames, dnsNames)
+	sc.dnsNames = slices.Clone(dnsNames)
+	sc.mutex.Unlock()
+	if changed {
+		sc.triggerRefresh()
+	}
+}
+
+func (sc *serverCertificate) GetRenewalState() RenewalState {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.state
+}
+
+func (sc *serverCertificate) GetStatus() CertificateStatus {
+	sc.mutex.Lock()
+	status := CertificateStatus{
+		DNSNames:         slices.Clone(sc.dnsNames),
+		KeyType:          strings.Join(sc.keyTypes, ", "),
+		KeyPolicy:        sc.keyConfig.Policy,
+		RenewalThreshold: sc.threshold,
+		Renewal:          sc.state,
+	}
+	sc.mutex.Unlock()
+
+	chain := sc.GetChain()
+	if len(chain) == 0 {
+		return status
+	}
+	cert := chain[0].OBJ()
+	status.DNSNames = cert.DNSNames
+	status.Issuer = cert.Issuer.String()
+	status.SerialNumber = cert.SerialNumber.Text(16)
+	status.NotBefore = cert.NotBefore
+	status.NotAfter = cert.NotAfter
+	status.RenewAt = sc.renewAt(cert)
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if window := sc.windows[cert.SerialNumber.Text(16)]; window != nil {
+		status.SuggestedWindowStart = window.start
+		status.SuggestedWindowEnd = window.end
+	}
+	if sc.ocsp != nil {
+		status.OCSPStatus = sc.ocsp.statusText()
+		status.OCSPNextUpdate = sc.ocsp.nextUpdate
+	}
+	return status
+}
+
+// renewAt returns the time when the certificate is renewed: after the
+// renewal threshold or within the window suggested by the CA (whatever
+// comes first)
+func (sc *serverCertificate) renewAt(cert *x509.Certificate) time.Time {
+	sc.mutex.Lock()
+	threshold := sc.threshold
+	window := sc.windows[cert.SerialNumber.Text(16)]
+	sc.mutex.Unlock()
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	renewAt := cert.NotBefore.Add(lifetime * time.Duration(threshold) / 100)
+	if window != nil && !window.renewAt.IsZero() && window.renewAt.Before(renewAt) {
+		return window.renewAt
+	}
+	return renewAt
+}
+
+// updateRenewalWindow queries the renewal window suggested by the CA (at
+// most every 6 hours). It returns the time of the next query.
+func (sc *serverCertificate) updateRenewalWindow(cert crypto.Certificate) time.Time {
+	renewalInfoCA, ok := sc.issuer.(RenewalInfoCA)
+	if !ok {
+		return time.Time{}
+	}
+	serial := cert.OBJ().SerialNumber.Text(16)
+	now := time.Now()
+
+	sc.mutex.Lock()
+	window := sc.windows[serial]
+	sc.mutex.Unlock()
+	if window != nil && now.Before(window.nextCheck) {
+		return window.nextCheck
+	}
+
+	start, end, err := renewalInfoCA.SuggestedRenewalWindow(cert)
+	switch {
+	case err != nil:
+		fmt.Println("ARI:", err)
+		if window == nil {
+			window = &renewalWindow{}
+		}
+	case window == nil || !window.start.Equal(start) || !window.end.Equal(end):
+		window = newRenewalWindow(start, end, now)
+		if !end.IsZero() {
+			fmt.Printf("ARI: suggested renewal window of %s: %s - %s\n", serial, start, end)
+		}
+	}
+	window.nextCheck = now.Add(ariCheckInterval)
+
+	sc.mutex.Lock()
+	if sc.windows == nil {
+		sc.windows = map[string]*renewalWindow{}
+	}
+	sc.windows[serial] = window
+	sc.mutex.Unlock()
+	return window.nextCheck
+}
+
+func (sc *serverCertificate) SetRenewalThreshold(percent int) {
+	if percent <= 0 || percent >= 100 {
+		percent = DefaultRenewalThreshold
+	}
+	sc.mutex.Lock()
+	changed := sc.threshold != percent
+	sc.threshold = percent
+	sc.mutex.Unlock()
+	if changed {
+		sc.triggerRefresh()
+	}
+}
+
+func (sc *serverCertificate) Renew() {
+	sc.mutex.Lock()
+	sc.forced = true
+	sc.mutex.Unlock()
+	sc.triggerRefresh()
+}
+
+// SetIssuedHandler calls the handler with the current certificate right
+// away. Triggering a refresh instead would skip the backoff of failed
+// renewals.
+func (sc *serverCertificate) SetIssuedHandler(handler func(key crypto.PrivateKey, chain crypto.CertificateChain)) {
+	sc.mutex.Lock()
+	sc.issuedHandler = handler
+	sc.issuedSerial = ""
+	keyAndChain := sc.keyAndChain
+	sc.mutex.Unlock()
+	if keyAndChain != nil {
+		sc.notifyIssued(keyAndChain)
+	}
+}
+
+// notifyIssued calls the issued handler, if the certificate has changed
+func (sc *serverCertificate) notifyIssued(keyAndChain *keyAndChain) {
+	serial := keyAndChain.chain[0].OBJ().SerialNumber.Text(16)
+	sc.mutex.Lock()
+	handler := sc.issuedHandler
+	changed := sc.issuedSerial != serial
+	sc.issuedSerial = serial
+	sc.mutex.Unlock()
+	if handler != nil && changed {
+		handler(keyAndChain.key, keyAndChain.chain)
+	}
+}
+
+// Revoke revokes the certificates of all variants
+func (sc *serverCertificate) Revoke(reason int) error {
+	revokingCA, ok := sc.issuer.(RevokingCA)
+	if !ok {
+		return fmt.Errorf("the CA doesn't support revocation")
+	}
+	revoked := 0
+	for _, variant := range sc.getVariants() {
+		keyAndChain, err := variant.load()
+		if err != nil || keyAndChain == nil {
+			continue
+		}
+		err = revokingCA.RevokeCertificate(keyAndChain.chain[0], reason)
+		if err != nil {
+			return err
+		}
+		revoked++
+	}
+	if revoked == 0 {
+		return fmt.Errorf("there is no certificate to revoke")
+	}
+	sc.mutex.Lock()
+	sc.newKey = true
+	sc.mutex.Unlock()
+	sc.Renew()
+	return nil
+}
+
+func (sc *serverCertificate) SetKeyConfig(keyConfig KeyConfig) error {
+	if err := keyConfig.Check(); err != nil {
+		return err
+	}
+	if keyConfig.Algorithm == "" {
+		keyConfig.Algorithm = crypto.KeyRSA2048
+	}
+	if keyConfig.Policy == "" {
+		keyConfig.Policy = KeyPolicyRotate
+	}
+	sc.mutex.Lock()
+	changed := sc.keyConfig != keyConfig
+	sc.keyConfig = keyConfig
+	sc.mutex.Unlock()
+	if changed {
+		sc.triggerRefresh()
+	}
+	return nil
+}
+
+// getVariants returns the primary certificate and (for dual certificates)
+// the certificate using the second algorithm
+func (sc *serverCertificate) getVariants() []*certificateVariant {
+	sc.mutex.Lock()
+	keyConfig := sc.keyConfig
+	sc.mutex.Unlock()
+
+	variants := []*certificateVariant{newCertificateVariant(sc.filename, keyConfig.Algorithm)}
+	if keyConfig.Dual {
+		if strings.HasPrefix(keyConfig.Algorithm, "rsa") {
+			variants = append(variants, newCertificateVariant(sc.filename+".ecdsa", crypto.KeyECDSAP256))
+		} else {
+			variants = append(variants, newCertificateVariant(sc.filename+".rsa", crypto.KeyRSA2048))
+		}
+	}
+	return variants
+}
+
+func (sc *serverCertificate) triggerRefresh() {
+	select {
+	case sc.refresh <- struct{}{}:
+	default:
+	}
 }
 
 func (sc *serverCertificate) updateTLSServer() {
 	if nil == sc.tlsServer || len(sc.tlsCertificates) == 0 {
 		return
 	}
-	for _, sni := range sc.dnsNames {
+	for _, sni := range sc.getDNSNames() {
 		sc.tlsServer.AddTLSCertificates(sni, sc.tlsCertificates)
 	}
 }
 
 func (sc *serverCertificate) GetChain() crypto.CertificateChain {
+	sc.mutex.Lock()
 	keyAndChain := sc.keyAndChain
+	sc.mutex.Unlock()
 	if keyAndChain == nil {
 		return nil
 	}
@@ -73,7 +469,9 @@ func (sc *serverCertificate) GetChain() crypto.CertificateChain {
 }
 
 func (sc *serverCertificate) GetCertAndKey() (crypto.PrivateKey, crypto.CertificateChain) {
+	sc.mutex.Lock()
 	keyAndChain := sc.keyAndChain
+	sc.mutex.Unlock()
 	if keyAndChain == nil {
 		return nil, nil
 	}
@@ -88,7 +486,7 @@ func (sc *serverCertificate) refreshLoop(ctx context.Context) {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.Tick(time.Second * 5):
+			case <-time.After(time.Second * 5):
 				continue
 			}
 		}
@@ -101,92 +499,266 @@ func (sc *serverCertificate) refreshLoopStep(ctx context.Context) (err error) {
 			err = fmt.Errorf("panic in refreshLoopStep: %v", r)
 		}
 	}()
-	key, err := crypto.ReadPrivateKey(sc.keyFile)
-	if os.IsNotExist(err) {
-		sc.createCert()
-		return nil
-	}
-	if err != nil {
-		return err
-	}
+	dnsNames := sc.getDNSNames()
+	variants := sc.getVariants()
+
+	sc.mutex.Lock()
+	forced := sc.forced
+	sc.mutex.Unlock()
+
+	var due []*certificateVariant
+	var tlsCertificates []tls.Certificate
+	var keyTypes []string
+	var serials []string
+	var primaryStaple *ocspStaple
+	wait := time.Hour * 24
+
+	for i, variant := range variants {
+		keyAndChain, err := variant.load()
+		if err != nil {
+			return err
+		}
+		if keyAndChain == nil {
+			due = append(due, variant)
+			continue
+		}
+		if i == 0 {
+			sc.mutex.Lock()
+			sc.keyAndChain = keyAndChain
+			sc.mutex.Unlock()
+			sc.notifyIssued(keyAndChain)
+		}
+		cert := keyAndChain.chain[0].OBJ()
+		serials = append(serials, cert.SerialNumber.Text(16))
+		tlsCertificate := tls.Certificate{
+			Certificate: keyAndChain.chain.ASN1(),
+			PrivateKey:  keyAndChain.key,
+			Leaf:        cert,
+		}
+		keyTypes = append(keyTypes, crypto.KeyType(cert.PublicKey))
 
-	chain, err := crypto.GetCertificateChain(sc.certFile)
-	if err != nil {
-		return err
-	}
+		staple, refreshAt := updateOCSPStaple(ctx, variant.ocspFile, keyAndChain.chain)
+		if !refreshAt.IsZero() {
+			wait = min(wait, time.Until(refreshAt))
+		}
+		if i == 0 {
+			primaryStaple = staple
+		}
+		if staple != nil && staple.valid(time.Now()) {
+			tlsCertificate.OCSPStaple = staple.raw
+		}
+		tlsCertificates = append(tlsCertificates, tlsCertificate)
+
+		if staple != nil && staple.revoked() {
+			sc.mutex.Lock()
+			sc.newKey = true
+			sc.mutex.Unlock()
+			fmt.Printf("Certificate (%s, %s) has been revoked, trying to get a new certificate\n", dnsNames[0], variant.algorithm)
+			due = append(due, variant)
+			continue
+		}
 
-	sc.tlsCertificates = []tls.Certificate{
-		{
-			Certificate: chain.ASN1(),
-			PrivateKey:  key,
-			Leaf:        chain[0].OBJ(),
-		},
-	}
+		if err := sc.checkVariant(variant, keyAndChain, dnsNames); err != nil {
+			fmt.Printf("Certificate (%s): %v, trying to get a new certificate\n", dnsNames[0], err)
+			due = append(due, variant)
+			continue
+		}
 
-	sc.keyAndChain = &keyAndChain{
-		key:   key,
-		chain: chain,
-	}
+		lifetime := cert.NotAfter.Sub(cert.NotBefore)
+		used := time.Now().UTC().Sub(cert.NotBefore)
+		percentUsed := float64(used) * 100.0 / float64(lifetime)
 
-	sc.updateTLSServer()
+		fmt.Printf("Certificate (%s, %s) has used %.2f%% of its lifetime\n", dnsNames[0], variant.algorithm, percentUsed)
+		fmt.Println("Valid-NotBefore:", cert.NotBefore)
+		fmt.Println("Valid-NotAfter:", cert.NotAfter)
 
-	lifetime := chain[0].OBJ().NotAfter.Sub(chain[0].OBJ().NotBefore)
-	used := time.Now().UTC().Sub(chain[0].OBJ().NotBefore)
-	percentUsed := float64(used) * 100.0 / float64(lifetime)
+		if nextCheck := sc.updateRenewalWindow(keyAndChain.chain[0]); !nextCheck.IsZero() {
+			wait = min(wait, time.Until(nextCheck))
+		}
+		renewIn := time.Until(sc.renewAt(cert))
+		if renewIn <= 0 || forced {
+			due = append(due, variant)
+		} else {
+			wait = min(wait, renewIn)
+		}
+	}
 
-	fmt.Printf("Certificate (%s) has used %.2f%% of its lifetime\n", sc.dnsNames[0], percentUsed)
-	fmt.Println("Valid-NotBefore:", chain[0].OBJ().NotBefore)
-	fmt.Println("Valid-NotAfter:", chain[0].OBJ().NotAfter)
+	// clients supporting ECDSA should get the ECDSA certificate (the TLS
+	// server uses the first certificate supported by the client)
+	slices.SortStableFunc(tlsCertificates, func(a, b tls.Certificate) int {
+		_, aIsRSA := a.Leaf.PublicKey.(*rsa.PublicKey)
+		_, bIsRSA := b.Leaf.PublicKey.(*rsa.PublicKey)
+		switch {
+		case !aIsRSA && bIsRSA:
+			return -1
+		case aIsRSA && !bIsRSA:
+			return 1
+		}
+		return 0
+	})
+	if len(tlsCertificates) > 0 {
+		sc.tlsCertificates = tlsCertificates
+		sc.updateTLSServer()
+	}
+	sc.mutex.Lock()
+	sc.keyTypes = keyTypes
+	sc.ocsp = primaryStaple
+	// forget the renewal windows of replaced certificates
+	for serial := range sc.windows {
+		if !slices.Contains(serials, serial) {
+			delete(sc.windows, serial)
+		}
+	}
+	sc.mutex.Unlock()
 
-	if percentUsed < 60.0 {
+	if len(due) == 0 {
 		fmt.Println("no need to update")
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(time.Hour * 24):
+		case <-sc.refresh:
+			return nil
+		case <-time.After(wait):
 			return nil
 		}
 	}
 
 	fmt.Println("trying to get a new certificate")
-	sc.createCert()
+	return sc.renew(ctx, due)
+}
+
+// checkVariant returns an error if the certificate doesn't match the
+// configuration (names or key algorithm)
+func (sc *serverCertificate) checkVariant(variant *certificateVariant, keyAndChain *keyAndChain, dnsNames []string) error {
+	cert := keyAndChain.chain[0].OBJ()
+	for _, name := range dnsNames {
+		if !slices.Contains(cert.DNSNames, name) {
+			return fmt.Errorf("the certificate doesn't contain %s", name)
+		}
+	}
+	if algorithm := crypto.KeyAlgorithm(cert.PublicKey); algorithm != variant.algorithm {
+		return fmt.Errorf("the certificate uses %s instead of %s", algorithm, variant.algorithm)
+	}
+	return nil
+}
+
+// renew requests new certificates for the variants. After failed attempts,
+// it waits until the backoff has expired (or the names have been changed).
+func (sc *serverCertificate) renew(ctx context.Context, variants []*certificateVariant) error {
+	sc.mutex.Lock()
+	state := sc.state
+	forced := sc.forced
+	sc.mutex.Unlock()
+	if wait := time.Until(state.NextRetry); wait > 0 && !forced {
+		fmt.Printf("Certificate (%s): %d failed attempts, next retry at %s\n",
+			sc.getDNSNames()[0], state.Attempts, state.NextRetry.Format(time.RFC3339))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sc.refresh:
+			sc.mutex.Lock()
+			sc.state.NextRetry = time.Time{}
+			sc.mutex.Unlock()
+			return nil
+		case <-time.After(wait):
+			return nil
+		}
+	}
+
+	var log []string
+	logf := func(msg string) {
+		log = append(log, time.Now().Format(time.TimeOnly)+" "+msg)
+	}
+	var err error
+	for _, variant := range variants {
+		logf("requesting a certificate using " + variant.algorithm)
+		err = sc.createCert(variant, logf)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log = append(log, time.Now().Format(time.TimeOnly)+" "+err.Error())
+	}
+
+	sc.mutex.Lock()
+	sc.forced = false
+	if err == nil {
+		sc.newKey = false
+	}
+	sc.state.recordAttempt(time.Now(), err, log)
+	state = sc.state
+	sc.mutex.Unlock()
+	if saveErr := state.save(sc.stateFile); saveErr != nil {
+		fmt.Println("failed to save the renewal state:", saveErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to get a new certificate (%d failed attempts, next retry at %s): %w",
+			state.Attempts, state.NextRetry.Format(time.RFC3339), err)
+	}
 	return nil
 }
 
-func (sc *serverCertificate) createCert() (err error) {
-	key, err := crypto.GetOrCreatePrivateKeyFile(sc.newKeyFile)
+func (sc *serverCertificate) createCert(variant *certificateVariant, logf func(msg string)) (err error) {
+	sc.mutex.Lock()
+	policy := sc.keyConfig.Policy
+	newKey := sc.newKey
+	sc.mutex.Unlock()
+
+	// reuse the current key (if the policy allows it and the certificate
+	// hasn't been revoked), otherwise a new key is created for every attempt
+	var key crypto.PrivateKey
+	if policy == KeyPolicyReuse && !newKey {
+		key, err = crypto.ReadPrivateKey(variant.keyFile)
+		if err != nil || crypto.KeyAlgorithm(key.Public()) != variant.algorithm {
+			key = nil
+		}
+	}
+	if key != nil {
+		err = os.WriteFile(variant.newKeyFile, []byte(key.PEM()), 0600)
+	} else {
+		key, err = crypto.CreatePrivateKeyFileWithAlgorithm(variant.newKeyFile, variant.algorithm)
+	}
 	if err != nil {
 		return err
 	}
 
-	csr, err := crypto.NewCSR(sc.newCsrFile, key, sc.dnsNames...)
+	csr, err := crypto.NewCSR(variant.newCsrFile, key, sc.getDNSNames()...)
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(sc.newCsrFile, []byte(csr.PEM()), os.ModePerm)
+	err = os.WriteFile(variant.newCsrFile, []byte(csr.PEM()), os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	chain, err := sc.issuer.IssueCertificate(csr)
+	var chain crypto.CertificateChain
+	if loggingCA, ok := sc.issuer.(LoggingCA); ok {
+		chain, err = loggingCA.IssueCertificateWithLog(csr, logf)
+	} else {
+		chain, err = sc.issuer.IssueCertificate(csr)
+	}
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(sc.newCertFile, []byte(chain.PEM()), os.ModePerm)
+	err = os.WriteFile(variant.newCertFile, []byte(chain.PEM()), os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(sc.newCertFile, sc.certFile)
+	err = os.Rename(variant.newCertFile, variant.certFile)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(sc.newKeyFile, sc.keyFile)
+	err = os.Rename(variant.newKeyFile, variant.keyFile)
 	if err != nil {
 		return err
 	}
-	err = os.Remove(sc.newCsrFile)
+	// the OCSP response belongs to the replaced certificate
+	os.Remove(variant.ocspFile)
+	err = os.Remove(variant.newCsrFile)
 	if err != nil {
 		return err
 	}
@@ -195,18 +767,31 @@ func (sc *serverCertificate) createCert() (err error) {
 }
 
 func NewServerCertificate(filename string, issuer CA, dnsNames ...string) (sc ServerCertificate) {
+	return NewServerCertificateWithKeyConfig(filename, issuer, KeyConfig{}, dnsNames...)
+}
+
+// NewServerCertificateWithKeyConfig creates a server certificate using the
+// key algorithm and key policy of keyConfig
+func NewServerCertificateWithKeyConfig(filename string, issuer CA, keyConfig KeyConfig, dnsNames ...string) ServerCertificate {
+	if keyConfig.Check() != nil || keyConfig.Algorithm == "" {
+		keyConfig.Algorithm = crypto.KeyRSA2048
+	}
+	if keyConfig.Policy == "" {
+		keyConfig.Policy = KeyPolicyRotate
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 
 	result := &serverCertificate{
-		cancel:      cancel,
-		keyFile:     filename + ".key.pem",
-		certFile:    filename + ".cert.pem",
-		newKeyFile:  filename + ".new-key.pem",
-		newCsrFile:  filename + ".new-csr.pem",
-		newCertFile: filename + ".new-cert.pem",
-		issuer:      issuer,
-		dnsNames:    dnsNames,
+		cancel:    cancel,
+		filename:  filename,
+		stateFile: filename + ".state.json",
+		issuer:    issuer,
+		refresh:   make(chan struct{}, 1),
+		dnsNames:  dnsNames,
+		threshold: DefaultRenewalThreshold,
+		keyConfig: keyConfig,
 	}
+	result.state = readRenewalState(result.stateFile)
 
 	go result.refreshLoop(ctx)
 
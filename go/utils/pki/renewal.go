@@ -0,0 +1,97 @@
+package pki
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+const (
+	renewalMinBackoff = 5 * time.Minute
+	renewalMaxBackoff = 24 * time.Hour
+	// ariCheckInterval is the interval of querying the renewal window
+	// suggested by the CA
+	ariCheckInterval = 6 * time.Hour
+)
+
+// RenewalState describes the failed attempts to get a new certificate. It
+// is persisted next to the certificate, so that a restart doesn't reset
+// the backoff (which would hit the rate limits of the CA).
+type RenewalState struct {
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextRetry   time.Time `json:"next_retry,omitzero"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	// Log contains the messages of the last attempt
+	Log []string `json:"log,omitempty"`
+}
+
+// renewalBackoff doubles the delay with each failed attempt (starting with
+// 5 minutes, at most 24 hours) and adds a jitter of +/-20%
+func renewalBackoff(attempts int) time.Duration {
+	backoff := renewalMinBackoff
+	for i := 1; i < attempts && backoff < renewalMaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, renewalMaxBackoff)
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(backoff))
+	return backoff + jitter
+}
+
+// recordAttempt updates the state after an attempt to get a new certificate
+func (state *RenewalState) recordAttempt(now time.Time, err error, log []string) {
+	state.LastAttempt = now
+	state.Log = log
+	if err == nil {
+		*state = RenewalState{LastAttempt: now, LastSuccess: now, Log: log}
+		return
+	}
+	state.Attempts++
+	state.LastError = err.Error()
+	state.NextRetry = now.Add(renewalBackoff(state.Attempts))
+}
+
+func readRenewalState(filename string) (state RenewalState) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return state
+	}
+	json.Unmarshal(data, &state)
+	return state
+}
+
+func (state RenewalState) save(filename string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0600)
+}
+
+// renewalWindow is the window suggested by the CA (ACME Renewal
+// Information). The certificate is renewed at a random time within the
+// window, so that not all clients of the CA renew at the same time.
+type renewalWindow struct {
+	start     time.Time
+	end       time.Time
+	renewAt   time.Time
+	nextCheck time.Time
+}
+
+func newRenewalWindow(start time.Time, end time.Time, now time.Time) *renewalWindow {
+	window := &renewalWindow{start: start, end: end}
+	if end.IsZero() {
+		return window
+	}
+	from := start
+	if from.Before(now) {
+		from = now
+	}
+	window.renewAt = from
+	if end.After(from) {
+		window.renewAt = from.Add(time.Duration(rand.Int64N(int64(end.Sub(from)))))
+	}
+	return window
+}
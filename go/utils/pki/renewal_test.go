@@ -0,0 +1,66 @@
+package pki
+
+import (
+	"errors"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRenewalBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  5 * time.Minute,
+		2:  10 * time.Minute,
+		4:  40 * time.Minute,
+		20: 24 * time.Hour,
+	} {
+		backoff := renewalBackoff(attempts)
+		if backoff < want*8/10 || backoff > want*12/10 {
+			t.Errorf("renewalBackoff(%d) = %s, want %s +/-20%%", attempts, backoff, want)
+		}
+	}
+}
+
+func TestRenewalState(t *testing.T) {
+	filename := path.Join(t.TempDir(), "example.com.state.json")
+	now := time.Now().Truncate(time.Second)
+
+	var state RenewalState
+	state.recordAttempt(now, errors.New("rate limited"), nil)
+	state.recordAttempt(now, errors.New("rate limited"), nil)
+	if state.Attempts != 2 || state.LastError != "rate limited" || !state.NextRetry.After(now) {
+		t.Fatalf("unexpected state after failures: %+v", state)
+	}
+
+	if err := state.save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded := readRenewalState(filename)
+	if loaded.Attempts != 2 || !loaded.NextRetry.Equal(state.NextRetry) {
+		t.Errorf("loaded state %+v differs from %+v", loaded, state)
+	}
+
+	state.recordAttempt(now, nil, []string{"issued"})
+	if state.Attempts != 0 || state.LastError != "" || !state.NextRetry.IsZero() || !state.LastSuccess.Equal(now) || len(state.Log) != 1 {
+		t.Errorf("unexpected state after success: %+v", state)
+	}
+}
+
+func TestRenewalWindow(t *testing.T) {
+	now := time.Now()
+	start, end := now.Add(time.Hour), now.Add(2*time.Hour)
+	window := newRenewalWindow(start, end, now)
+	if window.renewAt.Before(start) || !window.renewAt.Before(end) {
+		t.Errorf("renewAt %s is not within %s - %s", window.renewAt, start, end)
+	}
+
+	// a window in the past requires an immediate renewal
+	window = newRenewalWindow(now.Add(-2*time.Hour), now.Add(-time.Hour), now)
+	if !window.renewAt.Equal(now) {
+		t.Errorf("renewAt %s, want %s", window.renewAt, now)
+	}
+
+	if window = newRenewalWindow(time.Time{}, time.Time{}, now); !window.renewAt.IsZero() {
+		t.Errorf("expected no renewal time without window, got %s", window.renewAt)
+	}
+}
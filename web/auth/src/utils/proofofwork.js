@@ -0,0 +1,33 @@
+/**
+ * Solves the proof of work, which the auth server requires after some
+ * failed logins
+ *
+ * The SHA-256 hash of "<challenge>:<nonce>" has to start with the given
+ * number of zero bits.
+ */
+
+function leadingZeroBits(bytes) {
+  let bits = 0
+  for (const byte of bytes) {
+    if (byte !== 0) {
+      return bits + Math.clz32(byte) - 24
+    }
+    bits += 8
+  }
+  return bits
+}
+
+/**
+ * @param {object} challenge - the proof_of_work of the auth server
+ * @returns {object} the solution, which is sent as proof_of_work
+ */
+export async function solveProofOfWork(challenge) {
+  const encoder = new TextEncoder()
+  for (let nonce = 0; ; nonce++) {
+    const data = encoder.encode(`${challenge.challenge}:${nonce}`)
+    const hash = new Uint8Array(await crypto.subtle.digest('SHA-256', data))
+    if (leadingZeroBits(hash) >= challenge.difficulty) {
+      return { challenge: challenge.challenge, nonce: String(nonce) }
+    }
+  }
+}
@@ -0,0 +1,88 @@
+/**
+ * Helpers for the WebAuthn API (passkeys)
+ *
+ * The auth server encodes all binary values as base64url strings, but
+ * navigator.credentials expects ArrayBuffers (and returns them).
+ */
+
+function toBuffer(value) {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/')
+  const padded = base64 + '='.repeat((4 - base64.length % 4) % 4)
+  return Uint8Array.from(atob(padded), c => c.charCodeAt(0)).buffer
+}
+
+function toBase64url(buffer) {
+  const bytes = new Uint8Array(buffer)
+  let binary = ''
+  for (const byte of bytes) {
+    binary += String.fromCharCode(byte)
+  }
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+function toDescriptors(credentials) {
+  return (credentials || []).map(credential => ({ ...credential, id: toBuffer(credential.id) }))
+}
+
+/**
+ * @returns {boolean} true if the browser supports passkeys
+ */
+export function passkeysSupported() {
+  return !!window.PublicKeyCredential && !!navigator.credentials
+}
+
+/**
+ * Creates a passkey
+ *
+ * @param {object} options - response of /webauthn/register/begin
+ * @returns {object} the credential, which is sent to /webauthn/register/finish
+ */
+export async function createPasskey(options) {
+  const publicKey = {
+    ...options.publicKey,
+    challenge: toBuffer(options.publicKey.challenge),
+    user: { ...options.publicKey.user, id: toBuffer(options.publicKey.user.id) },
+    excludeCredentials: toDescriptors(options.publicKey.excludeCredentials)
+  }
+  const credential = await navigator.credentials.create({ publicKey })
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    authenticatorAttachment: credential.authenticatorAttachment,
+    clientExtensionResults: credential.getClientExtensionResults(),
+    response: {
+      attestationObject: toBase64url(credential.response.attestationObject),
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      transports: credential.response.getTransports ? credential.response.getTransports() : []
+    }
+  }
+}
+
+/**
+ * Signs the challenge with a passkey
+ *
+ * @param {object} options - response of /webauthn/login/begin
+ * @returns {object} the assertion, which is sent to /webauthn/login/finish
+ */
+export async function getPasskey(options) {
+  const publicKey = {
+    ...options.publicKey,
+    challenge: toBuffer(options.publicKey.challenge),
+    allowCredentials: toDescriptors(options.publicKey.allowCredentials)
+  }
+  const credential = await navigator.credentials.get({ publicKey })
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    authenticatorAttachment: credential.authenticatorAttachment,
+    clientExtensionResults: credential.getClientExtensionResults(),
+    response: {
+      authenticatorData: toBase64url(credential.response.authenticatorData),
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      signature: toBase64url(credential.response.signature),
+      userHandle: credential.response.userHandle ? toBase64url(credential.response.userHandle) : null
+    }
+  }
+}